@@ -19,6 +19,7 @@ import (
     "os"
     "io"
     "hash/crc32"
+    "crypto/md5"
     "crypto/sha1"
     "encoding/xml"
     "encoding/hex"
@@ -32,6 +33,8 @@ type Sha1 [sha1.Size]byte
 
 type Crc32 [crc32.Size]byte
 
+type Md5 [md5.Size]byte
+
 func NewSha1String(hexstr string) (sum Sha1, ok bool) {
     s, err := hex.DecodeString(hexstr)
     if err != nil || len(s) != sha1.Size {
@@ -54,6 +57,17 @@ func NewCrc32String(hexstr string) (sum Crc32, ok bool) {
     return
 }
 
+func NewMd5String(hexstr string) (sum Md5, ok bool) {
+    s, err := hex.DecodeString(hexstr)
+    if err != nil || len(s) != md5.Size {
+        return
+    }
+
+    ok = true
+    copy(sum[:], s)
+    return
+}
+
 ///////////////////////////////////////////////////////////////////////////////
 // XML marshaling
 ///////////////////////////////////////////////////////////////////////////////
@@ -78,6 +92,16 @@ func (crc32 *Crc32) UnmarshalXMLAttr(attr xml.Attr) error {
     return nil
 }
 
+func (md5 *Md5) UnmarshalXMLAttr(attr xml.Attr) error {
+    var value []byte
+    var err error
+    if value, err = hex.DecodeString(attr.Value); err != nil {
+        return err
+    }
+    copy((*md5)[:], value)
+    return nil
+}
+
 ///////////////////////////////////////////////////////////////////////////////
 // Sha1File - Return the SHA1 checksum for a file
 ///////////////////////////////////////////////////////////////////////////////
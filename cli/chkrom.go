@@ -16,9 +16,12 @@
 package main
 
 import (
+    "bufio"
     "encoding/json"
     "fmt"
+    "io"
     "os"
+    "path/filepath"
     "runtime"
 
     "gorom/util"
@@ -33,6 +36,8 @@ type ChkromStats struct {
     Missing int
     Corrupt int
     BadName int
+    NoDump  int
+    BadDump int
     Extra   int
     Total   int
 }
@@ -50,12 +55,51 @@ const (
 
 type Logger interface {
     header(name string)
+    setType(name string)
     machine(machine *dat.Machine, status int, info ...string)
     extra(path string)
     rom(rom *dat.Rom, status int, info ...string)
     machineChkromStats(machChkromStats *ChkromStats, machRomChkromStats *ChkromStats)
     romChkromStats(romChkromStats *ChkromStats)
-    close()
+    close() error
+}
+
+// machStatusName returns the name of a machine status used by the reports
+func machStatusName(status int) string {
+    switch {
+    case status == MachOk:
+        return "ok"
+    case status == MachMissing:
+        return "missing"
+    case status == MachCorrupt:
+        return "corrupt"
+    case (status & MachRomCorrupt != 0) || (status & MachRomBadName != 0) || (status & MachRomMissing != 0):
+        return "errors"
+    case (status & MachRomExtra != 0):
+        return "extra"
+    }
+    panic("invalid machine status")
+}
+
+// romStatusName returns the name of a ROM status used by the reports
+func romStatusName(status int) string {
+    switch status {
+    case dat.RomOk:
+        return "ok"
+    case dat.RomMissing:
+        return "missing"
+    case dat.RomUnknown:
+        return "extra"
+    case dat.RomCorrupt:
+        return "corrupt"
+    case dat.RomBadName:
+        return "badname"
+    case dat.RomNoDump:
+        return "nodump"
+    case dat.RomBadDump:
+        return "baddump"
+    }
+    panic("invalid rom status")
 }
 
 ///////////////////////////////////////////////////////////////////////////////
@@ -63,34 +107,51 @@ type Logger interface {
 ///////////////////////////////////////////////////////////////////////////////
 
 type StdLogger struct {
+    wr io.Writer
+    color bool
 }
 
-func NewStdLogger() *StdLogger {
-    return &StdLogger{}
+func NewStdLogger(wr io.Writer, color bool) *StdLogger {
+    return &StdLogger{ wr: wr, color: color }
+}
+
+func (log *StdLogger) printf(format string, a ...interface{}) {
+    fmt.Fprintf(log.wr, format, a...)
+}
+
+// colorf colors a string unless the report is written to a file
+func (log *StdLogger) colorf(colorFunc func(string, ...interface{}) string, format string, a ...interface{}) string {
+    if !log.color {
+        return fmt.Sprintf(format, a...)
+    }
+    return colorFunc(format, a...)
 }
 
 func (log *StdLogger) header(name string) {
-    term.Println(name)
+    log.printf("%s\n", name)
+}
+
+func (log *StdLogger) setType(name string) {
+    log.printf("Set type : %s\n", name)
 }
 
 func (log *StdLogger) machine(machine *dat.Machine, status int, info ...string) {
     var str string
     switch {
     case status == MachOk:
-        str = term.Green("OK")
+        str = log.colorf(term.Green, "OK")
     case status == MachMissing:
-        str = term.Yellow("MISSING")
+        str = log.colorf(term.Yellow, "MISSING")
     case status == MachCorrupt:
-        str = term.Red("CORRUPT")
+        str = log.colorf(term.Red, "CORRUPT")
         if len(info) > 0 {
-            str += term.Red(fmt.Sprintf(" (%s)", info[0]))
+            str += log.colorf(term.Red, " (%s)", info[0])
         }
     case (status & MachRomCorrupt != 0) || (status & MachRomBadName != 0) || (status & MachRomMissing != 0):
-        str = term.Red("ROM ERRORS")
+        str = log.colorf(term.Red, "ROM ERRORS")
     case (status & MachRomExtra != 0):
-        str = term.Blue("EXTRA ROMS")
+        str = log.colorf(term.Blue, "EXTRA ROMS")
     default:
-        term.Println(status)
         panic("invalid machine status")
     }
 
@@ -98,57 +159,68 @@ func (log *StdLogger) machine(machine *dat.Machine, status int, info ...string)
     if machine.Path != "" {
         name = machine.Path
     }
-    term.Printf("%s : %s\n", name, str)
+    log.printf("%s : %s\n", name, str)
 }
 
 func (log *StdLogger) extra(path string) {
-    term.Printf("%s : %s\n", path, term.Blue("EXTRA"))
+    log.printf("%s : %s\n", path, log.colorf(term.Blue, "EXTRA"))
 }
 
 func (log *StdLogger) rom(rom *dat.Rom, status int, info ...string) {
     var str string
     switch status {
     case dat.RomOk:
-        str = term.Green("OK")
+        str = log.colorf(term.Green, "OK")
     case dat.RomMissing:
-        str = term.Yellow("MISSING")
+        str = log.colorf(term.Yellow, "MISSING")
     case dat.RomUnknown:
-        str = term.Blue("EXTRA")
+        str = log.colorf(term.Blue, "EXTRA")
     case dat.RomCorrupt:
-        str = term.Red("CORRUPT")
+        str = log.colorf(term.Red, "CORRUPT")
     case dat.RomBadName:
-        str = term.Magenta(fmt.Sprintf("BAD NAME (%s)", info[0]))
+        str = log.colorf(term.Magenta, "BAD NAME (%s)", info[0])
+    case dat.RomNoDump:
+        str = log.colorf(term.Cyan, "NO DUMP")
+    case dat.RomBadDump:
+        str = log.colorf(term.Cyan, "BAD DUMP")
     default:
         panic("invalid rom status")
     }
 
-    term.Printf("  %s : %s\n", rom.Name, str)
+    log.printf("  %s : %s\n", rom.Name, str)
 }
 
 func (log *StdLogger) machineChkromStats(machChkromStats *ChkromStats, machRomChkromStats *ChkromStats) {
-    term.Println("\nMachine Stats")
-    term.Printf("  All OK          : %d (%.1f%%)\n", machChkromStats.Ok, 100.0 * float32(machChkromStats.Ok) / float32(machChkromStats.Total))
-    term.Printf("  ROMs Corrupt    : %d (%.1f%%)\n", machRomChkromStats.Corrupt, 100.0 * float32(machRomChkromStats.Corrupt) / float32(machChkromStats.Total))
-    term.Printf("  ROMs Bad Name   : %d (%.1f%%)\n", machRomChkromStats.BadName, 100.0 * float32(machRomChkromStats.BadName) / float32(machChkromStats.Total))
-    term.Printf("  ROMs Missing    : %d (%.1f%%)\n", machRomChkromStats.Missing, 100.0 * float32(machRomChkromStats.Missing) / float32(machChkromStats.Total))
-    term.Printf("  ROMs Extra      : %d (%.1f%%)\n", machRomChkromStats.Extra, 100.0 * float32(machRomChkromStats.Extra) / float32(machChkromStats.Total))
-    term.Printf("  Machine Missing : %d (%.1f%%)\n", machChkromStats.Missing, 100.0 * float32(machChkromStats.Missing) / float32(machChkromStats.Total))
-    term.Printf("  Machine Corrupt : %d (%.1f%%)\n", machChkromStats.Corrupt, 100.0 * float32(machChkromStats.Corrupt) / float32(machChkromStats.Total))
-    term.Printf("  Total Machines  : %d\n", machChkromStats.Total)
-    term.Printf("  Extra Files     : %d\n", machChkromStats.Extra)
+    log.printf("\nMachine Stats\n")
+    log.printf("  All OK          : %d (%.1f%%)\n", machChkromStats.Ok, 100.0 * float32(machChkromStats.Ok) / float32(machChkromStats.Total))
+    log.printf("  ROMs Corrupt    : %d (%.1f%%)\n", machRomChkromStats.Corrupt, 100.0 * float32(machRomChkromStats.Corrupt) / float32(machChkromStats.Total))
+    log.printf("  ROMs Bad Name   : %d (%.1f%%)\n", machRomChkromStats.BadName, 100.0 * float32(machRomChkromStats.BadName) / float32(machChkromStats.Total))
+    log.printf("  ROMs Missing    : %d (%.1f%%)\n", machRomChkromStats.Missing, 100.0 * float32(machRomChkromStats.Missing) / float32(machChkromStats.Total))
+    log.printf("  ROMs Extra      : %d (%.1f%%)\n", machRomChkromStats.Extra, 100.0 * float32(machRomChkromStats.Extra) / float32(machChkromStats.Total))
+    log.printf("  Machine Missing : %d (%.1f%%)\n", machChkromStats.Missing, 100.0 * float32(machChkromStats.Missing) / float32(machChkromStats.Total))
+    log.printf("  Machine Corrupt : %d (%.1f%%)\n", machChkromStats.Corrupt, 100.0 * float32(machChkromStats.Corrupt) / float32(machChkromStats.Total))
+    log.printf("  Total Machines  : %d\n", machChkromStats.Total)
+    log.printf("  Extra Files     : %d\n", machChkromStats.Extra)
 }
 
 func (log *StdLogger) romChkromStats(romChkromStats *ChkromStats) {
-    term.Println("\nROM Stats")
-    term.Printf("  OK        : %d (%.1f%%)\n", romChkromStats.Ok, 100.0 * float32(romChkromStats.Ok) / float32(romChkromStats.Total))
-    term.Printf("  Corrupt   : %d (%.1f%%)\n", romChkromStats.Corrupt, 100.0 * float32(romChkromStats.Corrupt) / float32(romChkromStats.Total))
-    term.Printf("  Bad Name  : %d (%.1f%%)\n", romChkromStats.BadName, 100.0 * float32(romChkromStats.BadName) / float32(romChkromStats.Total))
-    term.Printf("  Missing   : %d (%.1f%%)\n", romChkromStats.Missing, 100.0 * float32(romChkromStats.Missing) / float32(romChkromStats.Total))
-    term.Printf("  Total     : %d\n", romChkromStats.Total)
-    term.Printf("  Extra     : %d\n", romChkromStats.Extra)
+    log.printf("\nROM Stats\n")
+    log.printf("  OK        : %d (%.1f%%)\n", romChkromStats.Ok, 100.0 * float32(romChkromStats.Ok) / float32(romChkromStats.Total))
+    log.printf("  Corrupt   : %d (%.1f%%)\n", romChkromStats.Corrupt, 100.0 * float32(romChkromStats.Corrupt) / float32(romChkromStats.Total))
+    log.printf("  Bad Name  : %d (%.1f%%)\n", romChkromStats.BadName, 100.0 * float32(romChkromStats.BadName) / float32(romChkromStats.Total))
+    log.printf("  Missing   : %d (%.1f%%)\n", romChkromStats.Missing, 100.0 * float32(romChkromStats.Missing) / float32(romChkromStats.Total))
+    if romChkromStats.NoDump > 0 {
+        log.printf("  No Dump   : %d (%.1f%%)\n", romChkromStats.NoDump, 100.0 * float32(romChkromStats.NoDump) / float32(romChkromStats.Total))
+    }
+    if romChkromStats.BadDump > 0 {
+        log.printf("  Bad Dump  : %d (%.1f%%)\n", romChkromStats.BadDump, 100.0 * float32(romChkromStats.BadDump) / float32(romChkromStats.Total))
+    }
+    log.printf("  Total     : %d\n", romChkromStats.Total)
+    log.printf("  Extra     : %d\n", romChkromStats.Extra)
 }
 
-func (log *StdLogger) close() {
+func (log *StdLogger) close() error {
+    return nil
 }
 
 ///////////////////////////////////////////////////////////////////////////////
@@ -169,6 +241,7 @@ type JsonMachine struct {
 
 type JsonHeader struct {
     Name string                     `json:"name"`
+    SetType string                  `json:"settype,omitempty"`
 }
 
 type JsonSchema struct {
@@ -178,37 +251,27 @@ type JsonSchema struct {
 }
 
 type JsonLogger struct {
+    wr io.Writer
     value JsonSchema
     machLast string
 }
 
-func NewJsonLogger() *JsonLogger {
-    return &JsonLogger{value: JsonSchema{Machines: make(map[string]JsonMachine)}}
+func NewJsonLogger(wr io.Writer) *JsonLogger {
+    return &JsonLogger{wr: wr, value: JsonSchema{Machines: make(map[string]JsonMachine)}}
 }
 
 func (log *JsonLogger) header(name string) {
     log.value.Header.Name = name
 }
 
+func (log *JsonLogger) setType(name string) {
+    log.value.Header.SetType = name
+}
+
 func (log *JsonLogger) machine(machine *dat.Machine, status int, info ...string) {
-    var str string
-    switch {
-    case status == MachOk:
-        str = "ok"
-    case status == MachMissing:
-        str = "missing"
-    case status == MachCorrupt:
-        str = "corrupt"
-    case (status & MachRomCorrupt != 0) || (status & MachRomBadName != 0) || (status & MachRomMissing != 0):
-        str = "errors"
-    case (status & MachRomExtra != 0):
-        str = "extra"
-    default:
-        panic("invalid machine status")
-    }
     log.machLast = machine.Name
     jsonMach := JsonMachine{
-        Status: str, Path: machine.Path, Roms: make(map[string]JsonRom) }
+        Status: machStatusName(status), Path: machine.Path, Roms: make(map[string]JsonRom) }
     if len(info) > 0 {
         jsonMach.Info = info[0]
     }
@@ -220,22 +283,7 @@ func (log *JsonLogger) extra(path string) {
 }
 
 func (log *JsonLogger) rom(rom *dat.Rom, status int, info ...string) {
-    var str string
-    switch status {
-    case dat.RomOk:
-        str = "ok"
-    case dat.RomMissing:
-        str = "missing"
-    case dat.RomUnknown:
-        str = "extra"
-    case dat.RomCorrupt:
-        str = "corrupt"
-    case dat.RomBadName:
-        str = "badname"
-    default:
-        panic("invalid rom status")
-    }
-    jsonRom := JsonRom{Status: str}
+    jsonRom := JsonRom{Status: romStatusName(status)}
     if len(info) > 0 {
         jsonRom.Info = info[0]
     }
@@ -248,9 +296,13 @@ func (log *JsonLogger) machineChkromStats(machChkromStats *ChkromStats, machRomC
 func (log *JsonLogger) romChkromStats(romChkromStats *ChkromStats) {
 }
 
-func (log *JsonLogger) close() {
-    j, _ := json.MarshalIndent(log.value, "", "  ")
-    term.Printf("%s", j)
+func (log *JsonLogger) close() error {
+    j, err := json.MarshalIndent(log.value, "", "  ")
+    if err != nil {
+        return err
+    }
+    _, err = fmt.Fprintf(log.wr, "%s", j)
+    return err
 }
 
 ///////////////////////////////////////////////////////////////////////////////
@@ -270,6 +322,7 @@ var (
     machChkromStats ChkromStats
     machRomChkromStats ChkromStats
     logger Logger
+    fixDat *FixDat
 )
 
 func chkromValidate(machine *dat.Machine, rdb *romdb.RomDB, ch chan ValidResults) {
@@ -278,19 +331,46 @@ func chkromValidate(machine *dat.Machine, rdb *romdb.RomDB, ch chan ValidResults
 
     var err error
     var ok bool
-    if !options.ChkRom.SizeOnly {
-        ok, err = dat.ValidateChecksums(machine, rdb, badNames, &extras, nil)
-    } else {
+    if options.ChkRom.SizeOnly {
         ok, err = dat.ValidateSizes(machine, &extras, nil)
+    } else if options.ChkRom.CrcOnly {
+        ok, err = dat.ValidateCrcs(machine, rdb, badNames, &extras)
+    } else {
+        ok, err = dat.ValidateChecksums(machine, rdb, badNames, &extras, nil)
     }
 
     ch <- ValidResults{ machine: machine, badNames: badNames, extras: extras, ok: ok, err: err}
 }
 
+// chkromRoms returns the ROMs and disks of a machine with the disks named
+// by their CHD file
+func chkromRoms(machine *dat.Machine) []*dat.Rom {
+    roms := machine.Roms
+    if len(machine.Disks) > 0 {
+        roms = append([]*dat.Rom{}, machine.Roms...)
+        for _, disk := range machine.Disks {
+            rom := *disk
+            rom.Name = dat.DiskFile(disk)
+            roms = append(roms, &rom)
+        }
+    }
+    return roms
+}
+
+func noDump(roms []*dat.Rom) bool {
+    for _, rom := range roms {
+        if rom.DumpStatus != dat.DumpNoDump {
+            return false
+        }
+    }
+    return len(roms) > 0
+}
+
 func chkromResults(ch chan ValidResults) {
     results := <- ch
 
     machine := results.machine
+    roms := chkromRoms(machine)
     badNames := results.badNames
     extras := results.extras
     ok := results.ok
@@ -299,13 +379,15 @@ func chkromResults(ch chan ValidResults) {
     machChkromStats.Total++
     machStatus := MachOk
 
+    fixDat.machine(machine, fixDatRom)
+
     if err != nil {
         logger.machine(machine, MachCorrupt, err.Error())
-        romChkromStats.Total += len(machine.Roms)
-        romChkromStats.Corrupt += len(machine.Roms);
+        romChkromStats.Total += len(roms)
+        romChkromStats.Corrupt += len(roms);
         machChkromStats.Corrupt++
     } else if ok {
-        for _, rom := range machine.Roms {
+        for _, rom := range roms {
             switch rom.Status {
             case dat.RomCorrupt:
                 machStatus |= MachRomCorrupt
@@ -341,7 +423,7 @@ func chkromResults(ch chan ValidResults) {
             }
         }
 
-        for _, rom := range machine.Roms {
+        for _, rom := range roms {
             romChkromStats.Total++
 
             switch rom.Status {
@@ -365,6 +447,16 @@ func chkromResults(ch chan ValidResults) {
                     logger.rom(rom, rom.Status)
                 }
                 romChkromStats.Missing++;
+            case dat.RomNoDump:
+                if !options.App.NoOk && !options.ChkRom.NoRom {
+                    logger.rom(rom, rom.Status)
+                }
+                romChkromStats.NoDump++;
+            case dat.RomBadDump:
+                if !options.App.NoOk && !options.ChkRom.NoRom {
+                    logger.rom(rom, rom.Status)
+                }
+                romChkromStats.BadDump++;
             }
         }
 
@@ -374,10 +466,24 @@ func chkromResults(ch chan ValidResults) {
             }
             romChkromStats.Extra++
         }
+    } else if noDump(roms) {
+        // Nothing is required for a machine that has no dumped ROMs
+        if !options.App.NoOk {
+            logger.machine(machine, MachOk)
+        }
+        machChkromStats.Ok++
+        romChkromStats.Total += len(roms)
+        romChkromStats.NoDump += len(roms)
     } else {
         logger.machine(machine, MachMissing)
-        romChkromStats.Total += len(machine.Roms)
-        romChkromStats.Missing += len(machine.Roms);
+        for _, rom := range roms {
+            romChkromStats.Total++
+            if rom.DumpStatus == dat.DumpNoDump {
+                romChkromStats.NoDump++
+            } else {
+                romChkromStats.Missing++
+            }
+        }
         machChkromStats.Missing++
     }
 }
@@ -387,18 +493,44 @@ func chkrom(datFile string, machines []string) (bool, error) {
     machChkromStats = ChkromStats{}
     machRomChkromStats = ChkromStats{}
 
-    if options.ChkRom.JsonOut {
-        logger = NewJsonLogger()
-    } else {
-        logger = NewStdLogger()
+    // Write the report to the terminal unless a report file is given
+    var reportFile *os.File
+    var reportBuf *bufio.Writer
+    var err error
+    wr := term.Writer()
+    if options.ChkRom.ReportFile != "" {
+        reportFile, err = os.Create(filepath.ToSlash(options.ChkRom.ReportFile))
+        if err != nil {
+            return false, err
+        }
+        defer reportFile.Close()
+        reportBuf = bufio.NewWriter(reportFile)
+        wr = reportBuf
+    }
+
+    logger, err = newLogger(wr, reportFile == nil)
+    if err != nil {
+        return false, err
     }
 
     machSet := util.NewStringSet()
 
     var rdb *romdb.RomDB
-    var err error
+    fixDat, err = createFixDat()
+    if err != nil {
+        return false, err
+    }
+
     if !options.ChkRom.SizeOnly {
-        rdb, err = romdb.OpenRomDB(".", options.App.SkipHeader)
+        skipper, err := headerSkipper(datFile)
+        if err != nil {
+            return false, err
+        }
+        err = checkMd5Dat(datFile)
+        if err != nil {
+            return false, err
+        }
+        rdb, err = openRomDB(".", skipper)
         if err != nil {
             return false, err
         }
@@ -413,12 +545,16 @@ func chkrom(datFile string, machines []string) (bool, error) {
         goLimit = runtime.NumCPU()
     }
 
-    err = dat.ParseDatFile(datFile, machines, func(header *dat.Header) error {
+    err = dat.ParseDatFileSetType(datFile, machines, options.App.SetTypeId, func(header *dat.Header) error {
         if !options.App.NoHeader {
             logger.header(header.Name)
         }
+        fixDat.header(header)
         util.Progressf("Parsing DAT file...\n")
         return nil
+    }, func(setType int) error {
+        logger.setType(dat.SetTypeName(setType))
+        return nil
     }, func(machine *dat.Machine) error {
         machSet.Set(machine.Name)
 
@@ -465,7 +601,23 @@ func chkrom(datFile string, machines []string) (bool, error) {
         }
     }
 
-    logger.close()
+    err = logger.close()
+    if err != nil {
+        return false, err
+    }
+
+    if reportBuf != nil {
+        err = reportBuf.Flush()
+        if err != nil {
+            return false, err
+        }
+    }
+
+    err = fixDat.close()
+    if err != nil {
+        return false, err
+    }
 
-    return (romChkromStats.Ok == romChkromStats.Total), nil
+    romOk := romChkromStats.Ok + romChkromStats.NoDump + romChkromStats.BadDump
+    return (romOk == romChkromStats.Total), nil
 }
@@ -19,6 +19,7 @@ import (
     "testing"
     "os"
     "fmt"
+    "io/ioutil"
     "gorom/term"
     "gorom/test"
 )
@@ -44,6 +45,13 @@ func TestChkRomZip(t *testing.T) {
     })
 }
 
+func TestChkRomCmpro(t *testing.T) {
+    test.RunDiffTest(t, "roms/zip", "chkrom/zip.out", func() error {
+        options = Options{}
+        return runChkRom(t, "../../dats/cmpro.dat", nil, true)
+    })
+}
+
 func TestChkRomDir(t *testing.T) {
     test.RunDiffTest(t, "roms/dir", "chkrom/dir.out", func() error {
         options = Options{}
@@ -124,3 +132,180 @@ func TestChkRomBadZipJson(t *testing.T) {
         return runChkRom(t, "../../dats/zip.dat", nil, false)
     })
 }
+
+func TestChkRomCrcZip(t *testing.T) {
+    test.RunDiffTest(t, "roms/zip", "chkrom/zip.out", func() error {
+        options = Options{}
+        options.ChkRom.CrcOnly = true
+        return runChkRom(t, "../../dats/zip.dat", nil, true)
+    })
+}
+
+func TestChkRomCrcBadZip(t *testing.T) {
+    test.RunDiffTest(t, "roms/badzip", "chkrom/badzip.out", func() error {
+        options = Options{}
+        options.ChkRom.CrcOnly = true
+        return runChkRom(t, "../../dats/zip.dat", nil, false)
+    })
+}
+
+func TestChkRomCrcDir(t *testing.T) {
+    test.RunDiffTest(t, "roms/dir", "chkrom/dir.out", func() error {
+        options = Options{}
+        options.ChkRom.CrcOnly = true
+        return runChkRom(t, "../../dats/dir.dat", nil, true)
+    })
+}
+
+func TestChkRomChd(t *testing.T) {
+    test.RunDiffTest(t, "roms/chd", "chkrom/chd.out", func() error {
+        options = Options{}
+        return runChkRom(t, "../../dats/chd.dat", nil, false)
+    })
+}
+
+func TestChkRomDump(t *testing.T) {
+    test.RunDiffTest(t, "roms/zip", "chkrom/dump.out", func() error {
+        options = Options{}
+        options.App.NoExtra = true
+        return runChkRom(t, "../../dats/dump.dat", nil, false)
+    })
+}
+
+func TestChkRomDumpJson(t *testing.T) {
+    test.RunDiffTest(t, "roms/zip", "chkrom/dump.json", func() error {
+        options = Options{}
+        options.App.NoExtra = true
+        options.ChkRom.JsonOut = true
+        return runChkRom(t, "../../dats/dump.dat", []string{"machine1"}, true)
+    })
+}
+
+func TestChkRomCrc(t *testing.T) {
+    test.RunDiffTest(t, "roms/zip", "chkrom/zip.out", func() error {
+        options = Options{}
+        return runChkRom(t, "../../dats/crc.dat", nil, true)
+    })
+}
+
+func TestChkRomMd5(t *testing.T) {
+    test.RunDiffTest(t, "roms/zip", "chkrom/zip.out", func() error {
+        options = Options{}
+        options.App.Md5 = true
+        return runChkRom(t, "../../dats/md5.dat", nil, true)
+    })
+}
+
+func TestChkRomMd5Only(t *testing.T) {
+    test.RunDiffTest(t, "roms/zip", "chkrom/zip.out", func() error {
+        options = Options{}
+        return runChkRom(t, "../../dats/md5.dat", nil, true)
+    })
+}
+
+func TestChkRomHeaderDef(t *testing.T) {
+    test.RunDiffTest(t, "roms/header", "chkrom/zip.out", func() error {
+        options = Options{}
+        return runChkRom(t, "../../dats/header.dat", nil, true)
+    })
+}
+
+func TestChkRomHeaderDefOption(t *testing.T) {
+    test.RunDiffTest(t, "roms/header", "chkrom/zip.out", func() error {
+        options = Options{}
+        options.App.HeaderDef = "../../dats/headers/gorom.xml"
+        return runChkRom(t, "../../dats/zip.dat", nil, true)
+    })
+}
+
+// printFile prints and removes a file written by an operation so it is part
+// of the diff test output
+func printFile(filePath string) error {
+    data, err := ioutil.ReadFile(filePath)
+    os.Remove(filePath)
+    if err != nil {
+        return err
+    }
+    term.Printf("%s", data)
+    return nil
+}
+
+func TestChkRomFixDat(t *testing.T) {
+    test.RunDiffTest(t, "roms/badzip", "chkrom/fixdat.out", func() error {
+        options = Options{}
+        options.App.FixDat = "../../fixdat.dat"
+        err := runChkRom(t, "../../dats/zip.dat", nil, false)
+        if err != nil {
+            return err
+        }
+        return printFile(options.App.FixDat)
+    })
+}
+
+func TestChkRomReportHave(t *testing.T) {
+    test.RunDiffTest(t, "roms/zip", "chkrom/dump_have.out", func() error {
+        options = Options{}
+        options.App.NoExtra = true
+        options.ChkRom.ReportFormat = "have"
+        return runChkRom(t, "../../dats/dump.dat", nil, false)
+    })
+}
+
+func TestChkRomReportMiss(t *testing.T) {
+    test.RunDiffTest(t, "roms/badzip", "chkrom/badzip_miss.out", func() error {
+        options = Options{}
+        options.ChkRom.ReportFormat = "miss"
+        return runChkRom(t, "../../dats/zip.dat", nil, false)
+    })
+}
+
+func TestChkRomReportCsv(t *testing.T) {
+    test.RunDiffTest(t, "roms/badzip", "chkrom/badzip.csv", func() error {
+        options = Options{}
+        options.ChkRom.ReportFormat = "csv"
+        return runChkRom(t, "../../dats/zip.dat", nil, false)
+    })
+}
+
+func TestChkRomReportHtml(t *testing.T) {
+    test.RunDiffTest(t, "roms/badzip", "chkrom/badzip.html", func() error {
+        options = Options{}
+        options.ChkRom.ReportFormat = "html"
+        return runChkRom(t, "../../dats/zip.dat", nil, false)
+    })
+}
+
+func TestChkRomReportFile(t *testing.T) {
+    test.RunDiffTest(t, "roms/zip", "chkrom/zip.out", func() error {
+        options = Options{}
+        options.ChkRom.ReportFile = "../../report.txt"
+        err := runChkRom(t, "../../dats/zip.dat", nil, true)
+        if err != nil {
+            return err
+        }
+        return printFile(options.ChkRom.ReportFile)
+    })
+}
+
+func TestChkRomReportDump(t *testing.T) {
+    test.RunDiffTest(t, "roms/zip", "chkrom/dump.csv", func() error {
+        options = Options{}
+        options.App.NoExtra = true
+        options.ChkRom.ReportFormat = "csv"
+        return runChkRom(t, "../../dats/dump.dat", nil, false)
+    })
+}
+
+type failWriter struct{}
+
+func (fw failWriter) Write(p []byte) (int, error) {
+    return 0, fmt.Errorf("write failed")
+}
+
+func TestChkRomReportError(t *testing.T) {
+    for _, logger := range []Logger{ NewCsvLogger(failWriter{}), NewHtmlLogger(failWriter{}) } {
+        if logger.close() == nil {
+            test.Fail(t, fmt.Sprintf("%T did not return the write error", logger))
+        }
+    }
+}
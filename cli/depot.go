@@ -0,0 +1,142 @@
+//  GoRom - Emulator ROM Management Utilities
+//  Copyright (C) 2020 Scott Shumate <scott@shumatech.com>
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package main
+
+import (
+    "fmt"
+    "os"
+    "path"
+
+    "gorom/depot"
+    "gorom/romdb"
+    "gorom/romio"
+    "gorom/term"
+    "gorom/util"
+)
+
+type DepotStats struct {
+    Added    int
+    Existing int
+    Failed   int
+}
+
+// depotAddMachine adds the ROMs of a machine that are not in the depot yet.
+// The database checksums are used to skip the ROMs that are already there
+// without compressing them.  Disks are not added since CHDs are already
+// compressed.
+func depotAddMachine(dp *depot.Depot, rdb *romdb.RomDB, machPath string, stats *DepotStats) error {
+    rr, err := romio.OpenRomReader(machPath)
+    if rr == nil || err != nil {
+        return err
+    }
+    defer rr.Close()
+
+    sums := map[string]romio.Checksums{}
+    err = rdb.Checksums(rr, func(name string, checksums romio.Checksums) error {
+        sums[name] = checksums
+        return nil
+    })
+    if err != nil {
+        return err
+    }
+
+    added := 0
+    for _, file := range rr.Files() {
+        if romio.IsChd(file.Name) {
+            continue
+        }
+        if dp.Has(sums[file.Name].Sha1) {
+            stats.Existing++
+            continue
+        }
+        _, ok, err := dp.Add(rr, file)
+        if err != nil {
+            return err
+        }
+        if ok {
+            added++
+        } else {
+            stats.Existing++
+        }
+    }
+
+    stats.Added += added
+    if added > 0 {
+        term.Printf("%s : %s\n", machPath, term.Cyan("ADDED %d", added))
+    } else if !options.App.NoOk {
+        term.Printf("%s : %s\n", machPath, term.Green("OK"))
+    }
+    return nil
+}
+
+// depotAdd adds the ROMs of the machines in the directories or machine files
+// in paths to the depot
+func depotAdd(depotDir string, paths []string) error {
+    dp, err := depot.Open(depotDir)
+    if err != nil {
+        return err
+    }
+
+    var stats DepotStats
+    addMachine := func(rdb *romdb.RomDB, machPath string) {
+        err := depotAddMachine(dp, rdb, machPath, &stats)
+        if err != nil {
+            stats.Failed++
+            term.Printf("%s : %s\n", machPath, term.Red("ERROR %s", err))
+        }
+    }
+
+    for _, addPath := range paths {
+        info, err := os.Stat(addPath)
+        if err != nil {
+            return err
+        }
+
+        // The depot is addressed by the SHA-1 of the whole file so no
+        // headers are skipped
+        dir := addPath
+        if !info.IsDir() {
+            dir = path.Dir(addPath)
+        }
+        rdb, err := openRomDB(dir, nil)
+        if err != nil {
+            return err
+        }
+
+        if info.IsDir() {
+            err = util.ScanDir(dir, true, func(file os.FileInfo) error {
+                addMachine(rdb, path.Join(dir, file.Name()))
+                return nil
+            })
+        } else {
+            addMachine(rdb, addPath)
+        }
+        rdb.Close()
+        if err != nil {
+            return err
+        }
+    }
+
+    term.Println("\nDepot Stats")
+    term.Printf("  Added    : %d\n", stats.Added)
+    term.Printf("  Existing : %d\n", stats.Existing)
+    term.Printf("  Failed   : %d\n", stats.Failed)
+
+    if stats.Failed > 0 {
+        return fmt.Errorf("%d machines failed to be added to the depot", stats.Failed)
+    }
+    return nil
+}
@@ -0,0 +1,41 @@
+//  GoRom - Emulator ROM Management Utilities
+//  Copyright (C) 2020 Scott Shumate <scott@shumatech.com>
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package main
+
+import (
+    "testing"
+    "io/ioutil"
+    "os"
+    "gorom/test"
+)
+
+func TestDepotAdd(t *testing.T) {
+    depotDir, err := ioutil.TempDir("", "depot")
+    if err != nil {
+        test.Fail(t, err)
+    }
+    defer os.RemoveAll(depotDir)
+
+    test.RunDiffTest(t, "roms", "depot/add.out", func() error {
+        defer os.Remove("zip/.gorom.db")
+        defer os.Remove("dir/.gorom.db")
+        defer os.Remove("chd/.gorom.db")
+
+        // The directory machines have the same ROMs as the zips
+        options = Options{}
+        return depotAdd(depotDir, []string{"zip", "dir", "chd/machine1.zip"})
+    })
+}
@@ -0,0 +1,283 @@
+//  GoRom - Emulator ROM Management Utilities
+//  Copyright (C) 2020 Scott Shumate <scott@shumatech.com>
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package main
+
+import (
+    "encoding/hex"
+    "fmt"
+    "path/filepath"
+    "sort"
+    "strings"
+
+    "gorom/checksum"
+    "gorom/dat"
+    "gorom/term"
+)
+
+type DiffdatStats struct {
+    Same    int
+    Added   int
+    Removed int
+    Renamed int
+    Changed int
+}
+
+// Machine diff status constants
+const (
+    DiffSame = iota
+    DiffAdded
+    DiffRemoved
+    DiffRenamed
+    DiffChanged
+)
+
+type DiffRom struct {
+    name string
+    status int
+    oldName string
+}
+
+type DiffMachine struct {
+    machine *dat.Machine
+    status int
+    oldName string
+    roms []DiffRom
+}
+
+// romKey returns the checksum that identifies the data of a ROM.  ROMs
+// without a SHA-1 are identified by their size and CRC32.
+func romKey(rom *dat.Rom) string {
+    if rom.Sha1 != (checksum.Sha1{}) {
+        return hex.EncodeToString(rom.Sha1[:])
+    }
+    return fmt.Sprintf("%s:%d", hex.EncodeToString(rom.Crc[:]), rom.Size)
+}
+
+// machineKey returns the sorted checksums of all the ROMs and disks in a
+// machine so machines with the same data can be found
+func machineKey(machine *dat.Machine) string {
+    keys := []string{}
+    for _, roms := range [][]*dat.Rom{ machine.Roms, machine.Disks } {
+        for _, rom := range roms {
+            keys = append(keys, romKey(rom))
+        }
+    }
+    sort.Strings(keys)
+    return strings.Join(keys, ",")
+}
+
+func romEqual(oldRom *dat.Rom, newRom *dat.Rom) bool {
+    return oldRom.Size == newRom.Size && oldRom.Crc == newRom.Crc && oldRom.Sha1 == newRom.Sha1 &&
+           oldRom.Md5 == newRom.Md5 && oldRom.Merge == newRom.Merge && oldRom.DumpStatus == newRom.DumpStatus
+}
+
+// diffRoms compares the ROMs of a machine in the old and new DAT files.  New
+// ROMs with the same checksum as an old ROM that is gone were renamed.
+func diffRoms(oldRoms []*dat.Rom, newRoms []*dat.Rom, nameFunc func(rom *dat.Rom) string) []DiffRom {
+    oldMap := map[string]*dat.Rom{}
+    for _, rom := range oldRoms {
+        oldMap[rom.Name] = rom
+    }
+    newMap := map[string]*dat.Rom{}
+    for _, rom := range newRoms {
+        newMap[rom.Name] = rom
+    }
+
+    // Old ROMs that are not in the new machine can be renamed
+    goneMap := map[string]*dat.Rom{}
+    for _, rom := range oldRoms {
+        if _, ok := newMap[rom.Name]; !ok {
+            goneMap[romKey(rom)] = rom
+        }
+    }
+
+    diffs := []DiffRom{}
+    for _, rom := range newRoms {
+        if oldRom, ok := oldMap[rom.Name]; ok {
+            if !romEqual(oldRom, rom) {
+                diffs = append(diffs, DiffRom{ name: nameFunc(rom), status: DiffChanged })
+            }
+        } else if oldRom, ok := goneMap[romKey(rom)]; ok {
+            delete(goneMap, romKey(rom))
+            delete(oldMap, oldRom.Name)
+            diffs = append(diffs, DiffRom{ name: nameFunc(rom), status: DiffRenamed, oldName: nameFunc(oldRom) })
+        } else {
+            diffs = append(diffs, DiffRom{ name: nameFunc(rom), status: DiffAdded })
+        }
+    }
+    for _, rom := range oldRoms {
+        if _, ok := newMap[rom.Name]; !ok {
+            if _, ok := oldMap[rom.Name]; ok {
+                diffs = append(diffs, DiffRom{ name: nameFunc(rom), status: DiffRemoved })
+            }
+        }
+    }
+    return diffs
+}
+
+func diffMachine(oldMachine *dat.Machine, newMachine *dat.Machine) *DiffMachine {
+    diff := &DiffMachine{ machine: newMachine }
+    diff.roms = diffRoms(oldMachine.Roms, newMachine.Roms, func(rom *dat.Rom) string { return rom.Name })
+    diff.roms = append(diff.roms, diffRoms(oldMachine.Disks, newMachine.Disks, dat.DiskFile)...)
+    if len(diff.roms) > 0 || oldMachine.CloneOf != newMachine.CloneOf || oldMachine.RomOf != newMachine.RomOf {
+        diff.status = DiffChanged
+    }
+    return diff
+}
+
+func diffStatus(status int, oldName string) string {
+    switch status {
+    case DiffAdded:
+        return term.Green("ADDED")
+    case DiffRemoved:
+        return term.Red("REMOVED")
+    case DiffRenamed:
+        return term.Magenta("RENAMED from %s", oldName)
+    case DiffChanged:
+        return term.Yellow("CHANGED")
+    }
+    panic("invalid diff status")
+}
+
+func printDiffMachine(diff *DiffMachine) {
+    term.Printf("%s : %s\n", diff.machine.Name, diffStatus(diff.status, diff.oldName))
+    for _, rom := range diff.roms {
+        term.Printf("  %s : %s\n", rom.name, diffStatus(rom.status, rom.oldName))
+    }
+}
+
+// datFileFormat returns the format of a DAT file
+func datFileFormat(datFile string) (int, error) {
+    rd, closer, err := dat.OpenDatFile(datFile)
+    if err != nil {
+        return dat.DatInvalid, err
+    }
+    defer closer.Close()
+    return dat.DetectDatFormat(rd), nil
+}
+
+func diffdat(oldDat string, newDat string) error {
+    var stats DiffdatStats
+
+    // Read all of the old machines
+    oldList := []*dat.Machine{}
+    oldMap := map[string]*dat.Machine{}
+    err := dat.ParseDatFile(oldDat, nil, nil, func(machine *dat.Machine) error {
+        oldList = append(oldList, machine)
+        oldMap[machine.Name] = machine
+        return nil
+    })
+    if err != nil {
+        return err
+    }
+
+    // Compare the new machines to the old ones by name
+    var header *dat.Header
+    diffs := []*DiffMachine{}
+    newMap := map[string]bool{}
+    err = dat.ParseDatFile(newDat, nil, func(h *dat.Header) error {
+        header = h
+        return nil
+    }, func(machine *dat.Machine) error {
+        newMap[machine.Name] = true
+        if oldMachine, ok := oldMap[machine.Name]; ok {
+            diffs = append(diffs, diffMachine(oldMachine, machine))
+        } else {
+            diffs = append(diffs, &DiffMachine{ machine: machine, status: DiffAdded })
+        }
+        return nil
+    })
+    if err != nil {
+        return err
+    }
+
+    // Old machines that are gone were renamed if a new machine has the same
+    // ROMs and were removed otherwise
+    goneMap := map[string]*dat.Machine{}
+    renamed := map[string]bool{}
+    for _, machine := range oldList {
+        if !newMap[machine.Name] && len(machine.Roms) + len(machine.Disks) > 0 {
+            goneMap[machineKey(machine)] = machine
+        }
+    }
+    for _, diff := range diffs {
+        if diff.status == DiffAdded {
+            key := machineKey(diff.machine)
+            if oldMachine, ok := goneMap[key]; ok {
+                delete(goneMap, key)
+                diff.status = DiffRenamed
+                diff.oldName = oldMachine.Name
+                renamed[oldMachine.Name] = true
+            }
+        }
+    }
+
+    if header != nil && !options.App.NoHeader {
+        term.Println(header.Name)
+    }
+
+    for _, diff := range diffs {
+        switch diff.status {
+        case DiffSame:
+            stats.Same++
+            continue
+        case DiffAdded:
+            stats.Added++
+        case DiffRenamed:
+            stats.Renamed++
+        case DiffChanged:
+            stats.Changed++
+        }
+        printDiffMachine(diff)
+    }
+    for _, machine := range oldList {
+        if !newMap[machine.Name] && !renamed[machine.Name] {
+            stats.Removed++
+            printDiffMachine(&DiffMachine{ machine: machine, status: DiffRemoved })
+        }
+    }
+
+    term.Println("\nMachine Stats")
+    term.Printf("  Same    : %d\n", stats.Same)
+    term.Printf("  Added   : %d\n", stats.Added)
+    term.Printf("  Removed : %d\n", stats.Removed)
+    term.Printf("  Renamed : %d\n", stats.Renamed)
+    term.Printf("  Changed : %d\n", stats.Changed)
+
+    if options.DiffDat.UpdateDat == "" {
+        return nil
+    }
+
+    // The update DAT has the new, renamed, and changed machines in the format
+    // of the new DAT file
+    format, err := datFileFormat(newDat)
+    if err != nil {
+        return err
+    }
+    dw, err := createDatFile(filepath.ToSlash(options.DiffDat.UpdateDat), format)
+    if err != nil {
+        return err
+    }
+    if header != nil {
+        dw.WriteHeader(header)
+    }
+    for _, diff := range diffs {
+        if diff.status != DiffSame {
+            dw.WriteMachine(diff.machine)
+        }
+    }
+    return dw.Close()
+}
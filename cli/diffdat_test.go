@@ -0,0 +1,48 @@
+//  GoRom - Emulator ROM Management Utilities
+//  Copyright (C) 2020 Scott Shumate <scott@shumatech.com>
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package main
+
+import (
+    "testing"
+    "gorom/test"
+)
+
+func TestDiffDat(t *testing.T) {
+    test.RunDiffTest(t, "", "diffdat/diff.out", func() error {
+        options = Options{}
+        return diffdat("dats/diff_old.dat", "dats/diff_new.dat")
+    })
+}
+
+func TestDiffDatUpdate(t *testing.T) {
+    test.RunDiffTest(t, "", "diffdat/update.out", func() error {
+        options = Options{}
+        options.App.NoHeader = true
+        options.DiffDat.UpdateDat = "update.dat"
+        err := diffdat("dats/diff_old.dat", "dats/diff_new.dat")
+        if err != nil {
+            return err
+        }
+        return printFile(options.DiffDat.UpdateDat)
+    })
+}
+
+func TestDiffDatSame(t *testing.T) {
+    test.RunDiffTest(t, "", "diffdat/same.out", func() error {
+        options = Options{}
+        return diffdat("dats/zip.dat", "dats/cmpro.dat")
+    })
+}
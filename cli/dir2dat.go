@@ -23,32 +23,8 @@ import (
     "gorom/dat"
     "gorom/util"
     "gorom/romio"
-    "gorom/term"
 )
 
-const xmlDeclaration string = `<?xml version="1.0" encoding="UTF-8"?>
-<!DOCTYPE datafile PUBLIC "-//Logiqx//DTD ROM Management Datafile//EN" "http://www.logiqx.com/Dats/datafile.dtd">
-`
-
-const headerTag string = `	<header>
-		<name>%s</name>
-		<description>%s</description>
-		<version></version>
-		<author></author>
-	</header>
-`
-
-const datafileStart string = `<datafile>`
-const datafileEnd string = `</datafile>`
-
-const machineStart string = `	<machine name="%s">
-		<description>%s</description>
-`
-const machineEnd string = `	</machine>`
-
-const romTag string = `		<rom name="%s" size="%d" crc="%08x" sha1="%x"/>
-`
-
 func dir2dat(machFilter []string) error {
     machMap := make(map[string]bool)
     for _, arg := range machFilter {
@@ -57,11 +33,23 @@ func dir2dat(machFilter []string) error {
         machMap[machName] = true
     }
 
-    term.Println(xmlDeclaration)
-    term.Println(datafileStart)
-    term.Printf(headerTag, options.Dir2Dat.Name, options.Dir2Dat.Desc)
+    skipper, err := headerSkipper("")
+    if err != nil {
+        return err
+    }
 
-    err := util.ScanDir(".", true, func(file os.FileInfo) error {
+    dw, err := newDatWriter(dat.DatXml)
+    if err != nil {
+        return err
+    }
+    dw.RequireHeader()
+
+    err = dw.WriteHeader(&dat.Header{ Name: options.Dir2Dat.Name, Description: options.Dir2Dat.Desc })
+    if err != nil {
+        return err
+    }
+
+    err = util.ScanDir(".", true, func(file os.FileInfo) error {
         name := file.Name()
         machName := strings.TrimSuffix(name, path.Ext(path.Base(name)))
 
@@ -71,23 +59,16 @@ func dir2dat(machFilter []string) error {
             }
         }
 
-        valid := false;
-        flags := 0
-        if options.App.SkipHeader {
-            flags = romio.ChecksumSkipHeader;
-        }
-        romio.ChecksumMach(name, flags,
-                           func(name string,
-                                checksums romio.Checksums) error {
-            if !valid {
-                term.Printf(machineStart, machName, machName)
-                valid = true
-            }
-            term.Printf(romTag, dat.ToDatPath(name), checksums.Size, checksums.Crc32, checksums.Sha1)
+        machine := &dat.Machine{ Name: machName, Description: machName }
+        romio.ChecksumMachSkipper(name, 0, skipper,
+                                  func(name string,
+                                       checksums romio.Checksums) error {
+            machine.Roms = append(machine.Roms, &dat.Rom{ Name: dat.ToDatPath(name), Size: checksums.Size,
+                                                         Crc: checksums.Crc32, Sha1: checksums.Sha1 })
             return nil
         })
-        if valid {
-            term.Println(machineEnd)
+        if len(machine.Roms) > 0 {
+            return dw.WriteMachine(machine)
         }
 
         return nil
@@ -96,7 +77,5 @@ func dir2dat(machFilter []string) error {
         return err
     }
 
-    term.Println(datafileEnd)
-
-    return nil
-}
\ No newline at end of file
+    return dw.Close()
+}
@@ -0,0 +1,94 @@
+//  GoRom - Emulator ROM Management Utilities
+//  Copyright (C) 2020 Scott Shumate <scott@shumatech.com>
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package main
+
+import (
+    "path/filepath"
+
+    "gorom/dat"
+)
+
+///////////////////////////////////////////////////////////////////////////////
+// Fix DAT
+//
+// A fix DAT is a DAT file with only the machines and ROMs that are still
+// missing after a chkrom or fixrom.  The methods do nothing on a nil FixDat
+// so the operations do not need to check if the --fixdat option was given.
+///////////////////////////////////////////////////////////////////////////////
+
+const fixDatPrefix = "fix_"
+
+type FixDat struct {
+    writer *dat.Writer
+}
+
+// createFixDat creates the fix DAT file from the --fixdat option or returns
+// nil if the option was not given
+func createFixDat() (*FixDat, error) {
+    if options.App.FixDat == "" {
+        return nil, nil
+    }
+
+    writer, err := createDatFile(filepath.ToSlash(options.App.FixDat), dat.DatXml)
+    if err != nil {
+        return nil, err
+    }
+    return &FixDat{ writer: writer }, nil
+}
+
+func (fd *FixDat) header(header *dat.Header) {
+    if fd == nil {
+        return
+    }
+    fixHeader := *header
+    fixHeader.Name = fixDatPrefix + header.Name
+    if header.Description != "" {
+        fixHeader.Description = fixDatPrefix + header.Description
+    }
+    fd.writer.WriteHeader(&fixHeader)
+}
+
+// machine writes the ROMs and disks of a machine that the filter function
+// returns true for.  The machine is skipped if there are none.
+func (fd *FixDat) machine(machine *dat.Machine, filterFunc func(rom *dat.Rom) bool) {
+    if fd == nil {
+        return
+    }
+    fixMachine := dat.FilterRoms(machine, filterFunc)
+    if fixMachine != nil {
+        fd.writer.WriteMachine(fixMachine)
+    }
+}
+
+// close closes the fix DAT file and returns the first write error
+func (fd *FixDat) close() error {
+    if fd == nil {
+        return nil
+    }
+    return fd.writer.Close()
+}
+
+// fixDatRom returns true if a validated ROM is missing or corrupt.  The ROMs
+// of a missing machine are never validated so only their dump status is used.
+func fixDatRom(rom *dat.Rom) bool {
+    switch rom.Status {
+    case dat.RomUnknown:
+        return rom.DumpStatus != dat.DumpNoDump
+    case dat.RomMissing, dat.RomCorrupt:
+        return true
+    }
+    return false
+}
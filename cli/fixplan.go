@@ -0,0 +1,363 @@
+//  GoRom - Emulator ROM Management Utilities
+//  Copyright (C) 2020 Scott Shumate <scott@shumatech.com>
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package main
+
+import (
+    "encoding/hex"
+    "encoding/json"
+    "fmt"
+    "io/ioutil"
+    "os"
+    "runtime"
+
+    "gorom/romio"
+    "gorom/term"
+    "gorom/util"
+)
+
+///////////////////////////////////////////////////////////////////////////////
+// Fix Plan
+//
+// A fix plan is the list of machines to rebuild, disks to copy, and extra
+// files to trash that fixrom found.  It is applied right after the DAT is
+// parsed or saved to a JSON file so it can be reviewed and applied later.
+///////////////////////////////////////////////////////////////////////////////
+
+type FixMachine struct {
+    Path  string    `json:"path"`
+    Trash bool      `json:"trash,omitempty"`
+    Roms  []CopyRom `json:"roms"`
+}
+
+type FixPlan struct {
+    Dat      string       `json:"dat"`
+    Machines []FixMachine `json:"machines"`
+    Disks    []CopyDisk   `json:"disks"`
+    Extras   []string     `json:"extras"`
+}
+
+type FixPlanStats struct {
+    Machines int
+    Copies   int
+    Renames  int
+    Disks    int
+    Trash    int
+}
+
+func writeFixPlan(file string, plan *FixPlan) error {
+    fh, err := os.Create(file)
+    if err != nil {
+        return err
+    }
+    defer fh.Close()
+
+    enc := json.NewEncoder(fh)
+    enc.SetIndent("", "  ")
+    err = enc.Encode(plan)
+    if err != nil {
+        return err
+    }
+    return fh.Close()
+}
+
+func readFixPlan(file string) (*FixPlan, error) {
+    data, err := ioutil.ReadFile(file)
+    if err != nil {
+        return nil, err
+    }
+    plan := &FixPlan{}
+    err = json.Unmarshal(data, plan)
+    if err != nil {
+        return nil, fmt.Errorf("%s: %s", file, err)
+    }
+    return plan, nil
+}
+
+func printPlan(plan *FixPlan) {
+    for _, machine := range plan.Machines {
+        if machine.Trash {
+            term.Printf("%s : %s\n", machine.Path, term.Blue("TRASH"))
+        } else {
+            term.Println(machine.Path)
+        }
+        for _, rom := range machine.Roms {
+            switch rom.Action {
+            case ActionRename:
+                term.Printf("  %s : %s\n", rom.DstName, term.Magenta("RENAME from %s", rom.SrcName))
+            case ActionCopy:
+                if rom.Depot != "" {
+                    term.Printf("  %s : %s\n", rom.DstName, term.Cyan("COPY from depot %s", rom.SrcName))
+                } else {
+                    term.Printf("  %s : %s\n", rom.DstName, term.Cyan("COPY from %s", rom.SrcPath))
+                }
+            default:
+                if !options.App.NoOk {
+                    term.Printf("  %s : %s\n", rom.DstName, term.Green("OK"))
+                }
+            }
+        }
+    }
+    for _, disk := range plan.Disks {
+        switch disk.Action {
+        case ActionRename:
+            term.Printf("%s : %s\n", disk.DstPath, term.Magenta("RENAME from %s", disk.SrcName))
+        case ActionCopy:
+            term.Printf("%s : %s\n", disk.DstPath, term.Cyan("COPY from %s", disk.SrcPath))
+        }
+    }
+    for _, extra := range plan.Extras {
+        term.Printf("%s : %s\n", extra, term.Blue("TRASH"))
+    }
+}
+
+func printPlanStats(plan *FixPlan) {
+    var stats FixPlanStats
+    stats.Machines = len(plan.Machines)
+    for _, machine := range plan.Machines {
+        if machine.Trash {
+            stats.Trash++
+        }
+        for _, rom := range machine.Roms {
+            switch rom.Action {
+            case ActionCopy:
+                stats.Copies++
+            case ActionRename:
+                stats.Renames++
+            }
+        }
+    }
+    for _, disk := range plan.Disks {
+        if disk.Action != ActionOk {
+            stats.Disks++
+        }
+    }
+    stats.Trash += len(plan.Extras)
+
+    term.Println("\nPlan Stats")
+    term.Printf("  Machines : %d\n", stats.Machines)
+    term.Printf("  Copies   : %d\n", stats.Copies)
+    term.Printf("  Renames  : %d\n", stats.Renames)
+    term.Printf("  Disks    : %d\n", stats.Disks)
+    term.Printf("  Trash    : %d\n", stats.Trash)
+}
+
+// applyFixPlan copies the ROMs of each machine to a temp file or updates its
+// zip in place, replaces the machines with the temp files, copies the disks,
+// and trashes the extras
+func applyFixPlan(plan *FixPlan) error {
+    var renameList []Rename
+
+    // Journal every step so the run can be rolled back or undone
+    var journal *Journal
+    if len(plan.Machines) + len(plan.Disks) + len(plan.Extras) > 0 {
+        var err error
+        journal, err = createJournal()
+        if err != nil {
+            return err
+        }
+    }
+
+    goCount := 0
+    goLimit := 1
+    if !options.App.NoGo {
+        goLimit = runtime.NumCPU()
+    }
+
+    ch := make(chan CopyResults, 1)
+
+    edits := []*ZipEdit{}
+    for _, machine := range plan.Machines {
+        if options.FixRom.InPlace && zipEditable(machine) {
+            edits = append(edits, &ZipEdit{ machine: machine })
+            continue
+        }
+        if goCount == goLimit {
+            copyProcess(&renameList, ch)
+        } else {
+            goCount++
+        }
+        go copyRoms(machine.Path, machine.Roms, journal, ch)
+    }
+
+    // Process the copy results
+    if goCount > 0 {
+        term.Println("Waiting for copy jobs to complete")
+        for ; goCount > 0; goCount-- {
+            copyProcess(&renameList, ch)
+        }
+        util.Progressf("")
+    }
+
+    // Update the zips in place after the copy jobs so none of them read a zip
+    // that is being edited
+    trashDir := newTrashRun()
+    editZips(edits, &renameList, trashDir, journal)
+
+    // Rename all of the temp files and move old files to trash
+    trashed := util.NewStringSet()
+    if len(renameList) > 0 {
+        term.Println("Renaming temporary files")
+        for _, r := range renameList {
+            util.Progressf(r.machPath)
+            _, err := os.Stat(r.machPath)
+            if err == nil || os.IsExist(err) {
+                err = trashFile(r.machPath, trashDir, journal)
+                if err != nil {
+                    util.Progressf("")
+                    term.Println(term.Red("trash %s: %s", r.machPath, err))
+                    continue
+                }
+                trashed.Set(r.machPath)
+            }
+
+            err = journal.rename(r.tmpPath, r.machPath)
+            if err != nil {
+                util.Progressf("")
+                term.Println(term.Red("rename %s to %s: %s", r.tmpPath, r.machPath, err))
+            }
+        }
+        util.Progressf("")
+    }
+
+    // Copy and move the disks now that the machines are in place
+    if len(plan.Disks) > 0 {
+        term.Println("Copying disks")
+        for _, disk := range plan.Disks {
+            util.Progressf(disk.DstPath)
+            err := copyDisk(disk, trashed, trashDir, journal)
+            if err != nil {
+                util.Progressf("")
+                term.Println(term.Red("copy %s: %s", disk.DstPath, err))
+            }
+        }
+        util.Progressf("")
+    }
+
+    // Move the extra files to the trash
+    for _, extra := range plan.Extras {
+        err := trashFile(extra, trashDir, journal)
+        if err != nil {
+            term.Println(term.Red("trash %s: %s", extra, err))
+        }
+    }
+
+    return journal.commit()
+}
+
+// verifyCopyRom returns an error if the source of a ROM no longer has the
+// checksum of the ROM in the DAT
+func verifyCopyRom(rom CopyRom, skipper *romio.HeaderSkipper) error {
+    if rom.Sha1 == "" && rom.Crc == "" {
+        return nil
+    }
+
+    reader, err := openCopyReader(rom)
+    if err == nil && reader == nil {
+        err = fmt.Errorf("unable to open reader")
+    }
+    if err != nil {
+        return err
+    }
+    defer reader.Close()
+
+    file := reader.Stat(rom.SrcName)
+    if file == nil {
+        return fmt.Errorf("%s not found in %s", rom.SrcName, reader.Path())
+    }
+    rc, err := reader.Open(file)
+    if err != nil {
+        return err
+    }
+    defer rc.Close()
+    sums, err := romio.ChecksumRomSkipper(rc, 0, skipper)
+    if err != nil {
+        return err
+    }
+
+    if (rom.Sha1 != "" && rom.Sha1 != hex.EncodeToString(sums.Sha1[:])) ||
+       (rom.Crc != "" && rom.Crc != hex.EncodeToString(sums.Crc32[:])) {
+        return fmt.Errorf("%s does not match the checksum of %s", rom.SrcName, rom.DstName)
+    }
+    return nil
+}
+
+// verifyFixPlan checksums the sources of the ROMs in a saved plan and removes
+// the machines with a source that changed since the plan was saved.  It
+// returns the number of machines removed.
+func verifyFixPlan(plan *FixPlan, skipper *romio.HeaderSkipper) int {
+    machines := []FixMachine{}
+    for _, machine := range plan.Machines {
+        util.Progressf(machine.Path)
+        var err error
+        for _, rom := range machine.Roms {
+            err = verifyCopyRom(rom, skipper)
+            if err != nil {
+                break
+            }
+        }
+        if err != nil {
+            util.Progressf("")
+            term.Printf("%s : %s\n", machine.Path, term.Red("SKIPPED %s", err))
+            continue
+        }
+        machines = append(machines, machine)
+    }
+    util.Progressf("")
+
+    skipped := len(plan.Machines) - len(machines)
+    plan.Machines = machines
+    return skipped
+}
+
+// applyPlanFile applies a fix plan saved by fixrom --plan-file.  The sources
+// are verified first since they may have changed since the plan was saved.
+func applyPlanFile(file string) error {
+    plan, err := readFixPlan(file)
+    if err != nil {
+        return err
+    }
+
+    err = recoverJournal()
+    if err != nil {
+        return err
+    }
+
+    if !options.App.NoHeader && plan.Dat != "" {
+        term.Println(plan.Dat)
+    }
+
+    // The header skipper of the DAT file is only used if the DAT file is
+    // still there
+    datFile := ""
+    if _, err := os.Stat(plan.Dat); err == nil {
+        datFile = plan.Dat
+    }
+    skipper, err := headerSkipper(datFile)
+    if err != nil {
+        return err
+    }
+    skipped := verifyFixPlan(plan, skipper)
+
+    printPlan(plan)
+    printPlanStats(plan)
+    if !options.App.DryRun {
+        err = applyFixPlan(plan)
+    }
+    if err == nil && skipped > 0 {
+        err = fmt.Errorf("%d machines skipped because their sources changed", skipped)
+    }
+    return err
+}
@@ -16,22 +16,24 @@
 package main
 
 import (
+    "encoding/hex"
     "fmt"
+    "io"
+    "io/ioutil"
     "os"
-    "runtime"
     "path"
+    "path/filepath"
 
+    "gorom"
+    "gorom/checksum"
     "gorom/dat"
+    "gorom/depot"
     "gorom/romdb"
     "gorom/romio"
     "gorom/util"
     "gorom/term"
 )
 
-const (
-    TrashDir = ".trash"
-)
-
 type FixromStats struct {
     Ok      int
     Fixed   int
@@ -52,10 +54,60 @@ func printHeader(header *dat.Header) error {
     return nil
 }
 
+func printSetType(setType int) error {
+    term.Printf("Set type : %s\n", dat.SetTypeName(setType))
+    return nil
+}
+
+// Fix plan actions
+const (
+    ActionOk = "OK"
+    ActionRename = "RENAME"
+    ActionCopy = "COPY"
+)
+
+type CopyDisk struct {
+    Action  string `json:"action"`
+    DstPath string `json:"path"`
+    SrcName string `json:"src_name"`
+    SrcPath string `json:"src_path"`
+    Local   bool   `json:"local,omitempty"`
+    Move    bool   `json:"move,omitempty"`
+}
+
 type CopyRom struct {
-    dstName string
-    srcName string
-    srcPath string
+    Action  string `json:"action"`
+    DstName string `json:"name"`
+    SrcName string `json:"src_name"`
+    SrcPath string `json:"src_path,omitempty"`
+    Depot   string `json:"depot,omitempty"`
+    Sha1    string `json:"sha1,omitempty"`
+    Crc     string `json:"crc,omitempty"`
+}
+
+// newCopyRom returns a ROM copy with the SHA-1 of the ROM in the DAT, or its
+// CRC32 if it has no SHA-1, so a saved plan can verify the source later
+func newCopyRom(action string, rom *dat.Rom, srcName string, srcPath string) CopyRom {
+    copyRom := CopyRom{ Action: action, DstName: rom.Name, SrcName: srcName, SrcPath: srcPath }
+    if rom.Sha1 != (checksum.Sha1{}) {
+        copyRom.Sha1 = hex.EncodeToString(rom.Sha1[:])
+    } else if rom.Crc != (checksum.Crc32{}) {
+        copyRom.Crc = hex.EncodeToString(rom.Crc[:])
+    }
+    return copyRom
+}
+
+// openCopyReader opens the reader of the source of a ROM copy
+func openCopyReader(rom CopyRom) (romio.RomReader, error) {
+    if rom.Depot != "" {
+        dp, err := depot.Open(rom.Depot)
+        if err != nil {
+            return nil, err
+        }
+        sum, _ := checksum.NewSha1String(rom.SrcName)
+        return dp.OpenReader(sum)
+    }
+    return romio.OpenRomReader(rom.SrcPath)
 }
 
 type CopyResults struct {
@@ -65,18 +117,21 @@ type CopyResults struct {
     err error
 }
 
-func copyRoms(machPath string, roms []CopyRom, ch chan CopyResults) {
+func copyRoms(machPath string, roms []CopyRom, journal *Journal, ch chan CopyResults) {
     results := CopyResults{ machPath: machPath }
 
     format := romio.MachFormat(machPath)
     writer, err := romio.CreateRomWriterTemp(".", format)
     if err != nil {
         results.errmsg = "create temp writer"
+    } else if err = journal.temp(writer.Path()); err != nil {
+        results.tmpPath = writer.Path()
+        results.errmsg = "journal temp"
     } else {
         results.tmpPath = writer.Path()
 
         for _, rom := range roms {
-            err = writer.Create(rom.dstName)
+            err = writer.Create(rom.DstName)
             if err != nil {
                 results.errmsg = "writer create"
             }
@@ -84,20 +139,20 @@ func copyRoms(machPath string, roms []CopyRom, ch chan CopyResults) {
 
         for index := writer.First(); index >= 0; index = writer.Next() {
             rom := roms[index]
-            reader, err := romio.OpenRomReader(rom.srcPath)
+            reader, err := openCopyReader(rom)
             if err != nil {
-                results.errmsg = rom.srcPath
+                results.errmsg = rom.SrcPath
                 break
             }
             if reader == nil {
-                results.errmsg = rom.srcPath
+                results.errmsg = rom.SrcPath
                 err = fmt.Errorf("unable to open reader")
                 break
             }
-            err = romio.CopyRom(writer, rom.dstName, reader, rom.srcName)
+            err = romio.CopyRom(writer, rom.DstName, reader, rom.SrcName)
             reader.Close()
             if err != nil {
-                results.errmsg = fmt.Sprintf("copy %s to %s", rom.srcName, writer.Path())
+                results.errmsg = fmt.Sprintf("copy %s to %s", rom.SrcName, writer.Path())
                 break
             }
         }
@@ -130,9 +185,230 @@ func copyProcess(renameList *[]Rename, ch chan CopyResults) {
     }
 }
 
+func romsOk(roms []*dat.Rom) bool {
+    for _, rom := range roms {
+        if !dat.StatusOk(rom.Status) {
+            return false
+        }
+    }
+    return true
+}
+
+func findRom(rom *dat.Rom, romDBs []*romdb.RomDB) (*romdb.RomDBEntry, *romdb.RomDB, error) {
+    // Walk the sources to find the checksum and skip any copies that are gone
+    for _, rdb := range romDBs {
+        entries, err := dat.LookupRom(rdb, rom)
+        if err != nil {
+            return nil, nil, err
+        }
+        var trashEntry *romdb.RomDBEntry
+        for _, entry := range entries {
+            entryPath := rdb.Path(entry)
+            _, err = os.Stat(entryPath)
+            if err != nil {
+                continue
+            }
+            // Copies in the trash are only used if there are no others
+            if rdb.Shared() && inTrash(entryPath) {
+                if trashEntry == nil {
+                    trashEntry = entry
+                }
+                continue
+            }
+            return entry, rdb, nil
+        }
+        // A shared database already has the ROMs of every source
+        if rdb.Shared() {
+            if trashEntry != nil {
+                return trashEntry, rdb, nil
+            }
+            break
+        }
+    }
+    return nil, nil, nil
+}
+
+// findDisks finds the disks of a machine that need to be copied or moved.
+// If rebuild is set, then the machine directory is being rebuilt and the OK
+// disks need to be moved back into it.
+func findDisks(machine *dat.Machine, romDBs []*romdb.RomDB, badNames map[string]string,
+               rebuild bool, disks *[]CopyDisk) (bool, error) {
+    for _, disk := range machine.Disks {
+        diskFile := dat.DiskFile(disk)
+        dstPath := dat.DiskPath(machine, disk)
+
+        switch disk.Status {
+        case dat.RomNoDump:
+        case dat.RomOk, dat.RomBadDump:
+            if !options.App.NoOk {
+                term.Printf("  %s : %s\n", diskFile, term.Green("OK"))
+            }
+            if rebuild {
+                *disks = append(*disks, CopyDisk{ Action: ActionOk, DstPath: dstPath, SrcName: diskFile, SrcPath: machine.Name, Local: true, Move: true })
+            }
+        case dat.RomBadName:
+            term.Printf("  %s : %s\n", diskFile, term.Magenta("RENAME from %s", badNames[diskFile]))
+            *disks = append(*disks, CopyDisk{ Action: ActionRename, DstPath: dstPath, SrcName: badNames[diskFile], SrcPath: machine.Name, Local: true, Move: true })
+        default:
+            entry, rdb, err := findRom(disk, romDBs)
+            if err != nil {
+                return false, err
+            }
+            if entry == nil {
+                term.Printf("  %s : %s\n", diskFile, term.Red("NOT FOUND"))
+                return false, nil
+            }
+            // Local sources are relative so they are found in the trash if
+            // their machine is rebuilt
+            srcPath := rdb.Path(entry)
+            local := rdb == romDBs[0] && rdb.Contains(entry)
+            if local {
+                srcPath = path.Join(rdb.Dir, path.Base(entry.MachPath))
+            }
+            term.Printf("  %s : %s\n", diskFile, term.Cyan("COPY from %s", srcPath))
+            *disks = append(*disks, CopyDisk{ Action: ActionCopy, DstPath: dstPath, SrcName: entry.RomPath, SrcPath: srcPath, Local: local })
+        }
+    }
+    return true, nil
+}
+
+// notFoundRoms returns the set of ROMs and disks of a machine that need to be
+// fixed and are not in any of the sources or the depot
+func notFoundRoms(machine *dat.Machine, romDBs []*romdb.RomDB, dp *depot.Depot) (map[*dat.Rom]bool, error) {
+    notFound := map[*dat.Rom]bool{}
+    for _, roms := range [][]*dat.Rom{ machine.Roms, machine.Disks } {
+        for _, rom := range roms {
+            if !fixDatRom(rom) {
+                continue
+            }
+            entry, _, err := findRom(rom, romDBs)
+            if err != nil {
+                return nil, err
+            }
+            if entry == nil {
+                notFound[rom] = true
+            }
+        }
+    }
+
+    // Only ROMs are stored in the depot
+    if dp != nil {
+        for _, rom := range machine.Roms {
+            if notFound[rom] && dp.Has(rom.Sha1) {
+                delete(notFound, rom)
+            }
+        }
+    }
+    return notFound, nil
+}
+
+func copyDisk(disk CopyDisk, trashed util.StringSet, trashDir string, journal *Journal) error {
+    // Sources in a machine that was rebuilt are now in the trash
+    srcPath := disk.SrcPath
+    if disk.Local && trashed.IsSet(srcPath) {
+        srcPath = path.Join(trashDir, srcPath)
+    }
+
+    if disk.Move && path.Join(srcPath, disk.SrcName) == disk.DstPath {
+        return nil
+    }
+
+    err := os.MkdirAll(path.Dir(disk.DstPath), 0755)
+    if err != nil {
+        return err
+    }
+
+    _, err = os.Stat(disk.DstPath)
+    if err == nil {
+        err = trashFile(disk.DstPath, trashDir, journal)
+        if err != nil {
+            return err
+        }
+    }
+
+    if disk.Move {
+        return journal.rename(path.Join(srcPath, disk.SrcName), disk.DstPath)
+    }
+
+    reader, err := romio.OpenRomReader(srcPath)
+    if err != nil {
+        return err
+    }
+    if reader == nil {
+        return fmt.Errorf("unable to open reader")
+    }
+    defer reader.Close()
+
+    srcFile := reader.Stat(disk.SrcName)
+    if srcFile == nil {
+        return os.ErrNotExist
+    }
+    rc, err := reader.Open(srcFile)
+    if err != nil {
+        return err
+    }
+    defer rc.Close()
+
+    // Copy to a temp file first so a failed copy does not leave a partial disk
+    fh, err := ioutil.TempFile(path.Dir(disk.DstPath), "gorom*")
+    if err != nil {
+        return err
+    }
+    err = journal.temp(fh.Name())
+    if err == nil {
+        _, err = io.Copy(fh, rc)
+    }
+    fh.Close()
+    if err == nil {
+        err = os.Chtimes(fh.Name(), srcFile.ModTime, srcFile.ModTime)
+    }
+    if err == nil {
+        err = journal.rename(fh.Name(), disk.DstPath)
+    }
+    if err != nil {
+        os.Remove(fh.Name())
+    }
+    return err
+}
+
+// wantedRoms returns a function that is true for the files with the size of a
+// ROM in the DAT file.  Files in zips also need the CRC32 of one of the ROMs
+// with that size.  CHDs are always wanted since only their header is read.
+func wantedRoms(datFile string) (romdb.WantedFunc, error) {
+    // A nil CRC32 set means a ROM of that size has no CRC32
+    sizes := map[int64]map[checksum.Crc32]bool{}
+    err := dat.ParseDatFile(datFile, nil, nil, func(machine *dat.Machine) error {
+        for _, rom := range machine.Roms {
+            crcs, ok := sizes[rom.Size]
+            if rom.Crc == (checksum.Crc32{}) {
+                sizes[rom.Size] = nil
+            } else if !ok {
+                sizes[rom.Size] = map[checksum.Crc32]bool{ rom.Crc: true }
+            } else if crcs != nil {
+                crcs[rom.Crc] = true
+            }
+        }
+        return nil
+    })
+    if err != nil {
+        return nil, err
+    }
+
+    return func(file *romio.RomFile) bool {
+        if romio.IsChd(file.Name) {
+            return true
+        }
+        crcs, ok := sizes[file.Size]
+        if !ok {
+            return false
+        }
+        return crcs == nil || !file.HasCrc32 || crcs[file.Crc32]
+    }, nil
+}
+
 func fixrom(datFile string, machines []string, dirs []string) (bool, error) {
-    var renameList []Rename
     var FixromStats FixromStats
+    plan := &FixPlan{ Dat: datFile, Machines: []FixMachine{}, Disks: []CopyDisk{}, Extras: []string{} }
 
     var machSet util.StringSet
     if options.FixRom.ExtraTrash {
@@ -142,16 +418,68 @@ func fixrom(datFile string, machines []string, dirs []string) (bool, error) {
     // Current directory takes precedence
     dirs = append([]string{"."}, dirs...)
 
+    // Roll back an interrupted run before the directory is scanned
+    err := recoverJournal()
+    if err != nil {
+        return false, err
+    }
+
+    skipper, err := headerSkipper(datFile)
+    if err != nil {
+        return false, err
+    }
+    err = checkMd5Dat(datFile)
+    if err != nil {
+        return false, err
+    }
+
+    fixDat, err := createFixDat()
+    if err != nil {
+        return false, err
+    }
+
+    var dp *depot.Depot
+    if options.FixRom.Depot != "" {
+        dp, err = depot.Open(filepath.ToSlash(options.FixRom.Depot))
+        if err != nil {
+            return false, err
+        }
+    }
+
+    // Sizes and CRC32s are not useful if ROM headers are skipped since they
+    // are for the whole file
+    var wanted romdb.WantedFunc
+    if options.FixRom.QuickScan && skipper == nil {
+        wanted, err = wantedRoms(datFile)
+        if err != nil {
+            return false, err
+        }
+    }
+
+    // The trash runs are the lowest priority sources so the ROMs of machines
+    // and extra files trashed by earlier runs are still found
+    trashDirs, err := trashRunDirs()
+    if err != nil {
+        return false, err
+    }
+
     // Scan all of the provided directories
     romDBs := []*romdb.RomDB{}
-    for _, dir := range dirs {
-        term.Printf("Scanning directory %s\n", dir)
+    for i, dir := range append(dirs, trashDirs...) {
+        if i < len(dirs) {
+            term.Printf("Scanning directory %s\n", dir)
+        } else if i == len(dirs) {
+            term.Println("Scanning trash")
+        }
 
-        rdb, err := romdb.OpenRomDB(dir, options.App.SkipHeader)
+        rdb, err := openRomDB(dir, skipper)
         if err != nil {
             return false, err
         }
         defer rdb.Close()
+        if wanted != nil {
+            rdb.SetWanted(wanted)
+        }
         if !options.FixRom.SkipScan {
             goLimit := 0
             if options.App.NoGo {
@@ -172,15 +500,10 @@ func fixrom(datFile string, machines []string, dirs []string) (bool, error) {
         util.Progressf("");
     }
 
-    goCount := 0
-    goLimit := 1
-    if !options.App.NoGo {
-        goLimit = runtime.NumCPU()
-    }
-
-    ch := make(chan CopyResults, 1)
-
-    err := dat.ParseDatFile(datFile, machines, printHeader, func(machine *dat.Machine) error {
+    err = dat.ParseDatFileSetType(datFile, machines, options.App.SetTypeId, func(header *dat.Header) error {
+        fixDat.header(header)
+        return printHeader(header)
+    }, printSetType, func(machine *dat.Machine) error {
         badNames := map[string]string{}
         extras := []string{}
 
@@ -197,24 +520,41 @@ func fixrom(datFile string, machines []string, dirs []string) (bool, error) {
         }
         util.Progressf("")
 
-        // Machine is OK if there are no extras and all ROMS are OK
-        if valid && len(extras) == 0 {
-            ok := true
-            for _, rom := range machine.Roms {
-                if rom.Status != dat.RomOk {
-                    ok = false
-                    break
+        // Extra disks of an archived machine are in a separate directory
+        // that is not rebuilt so leave them alone
+        if machine.Format != gorom.FormatDir {
+            romExtras := []string{}
+            for _, name := range extras {
+                if !romio.IsChd(name) {
+                    romExtras = append(romExtras, name)
                 }
             }
-            if ok {
-                FixromStats.Ok++
-                if !options.App.NoOk {
-                    term.Printf("%s : %s\n", machine.Path, term.Green("OK"))
+            extras = romExtras
+        }
+
+        // ROMs that were never dumped are not required even if the machine
+        // is missing
+        if !valid {
+            for _, roms := range [][]*dat.Rom{ machine.Roms, machine.Disks } {
+                for _, rom := range roms {
+                    if rom.DumpStatus == dat.DumpNoDump {
+                        rom.Status = dat.RomNoDump
+                    }
                 }
-                return nil
             }
         }
 
+        // Machine is OK if there are no extras and all ROMs and disks are OK
+        romOk := len(extras) == 0 && romsOk(machine.Roms)
+        diskOk := romsOk(machine.Disks)
+        if romOk && diskOk {
+            FixromStats.Ok++
+            if !options.App.NoOk {
+                term.Printf("%s : %s\n", machine.Path, term.Green("OK"))
+            }
+            return nil
+        }
+
         // Set the machine path if the machine is not valid
         if !valid {
             machine.Path = machine.Name + romio.MachExt(options.FixRom.Format)
@@ -225,16 +565,16 @@ func fixrom(datFile string, machines []string, dirs []string) (bool, error) {
         roms := []CopyRom{}
 
         // Copy OK and bad name ROMs from the old machine if it is valid
-        if valid {
+        if valid && !romOk {
             for _, rom := range machine.Roms {
-                if rom.Status == dat.RomOk {
+                if rom.Status == dat.RomOk || rom.Status == dat.RomBadDump {
                     if !options.App.NoOk {
                         term.Printf("  %s : %s\n", rom.Name, term.Green("OK"))
                     }
-                    roms = append(roms, CopyRom{ dstName: rom.Name, srcName: rom.Name, srcPath: machine.Path })
+                    roms = append(roms, newCopyRom(ActionOk, rom, rom.Name, machine.Path))
                 } else  if rom.Status == dat.RomBadName {
                     term.Printf("  %s : %s\n", rom.Name, term.Magenta("RENAME from %s", badNames[rom.Name]))
-                    roms = append(roms, CopyRom{ dstName: rom.Name, srcName: badNames[rom.Name], srcPath: machine.Path })
+                    roms = append(roms, newCopyRom(ActionRename, rom, badNames[rom.Name], machine.Path))
                 }
             }
         }
@@ -243,18 +583,18 @@ func fixrom(datFile string, machines []string, dirs []string) (bool, error) {
         ok := true
         for _, rom := range machine.Roms {
             if rom.Status == dat.RomUnknown || rom.Status == dat.RomCorrupt || rom.Status == dat.RomMissing {
-                var entry *romdb.RomDBEntry
-                var rdb *romdb.RomDB
-
-                // Walk the sources to find the checksum
-                for _, rdb = range romDBs {
-                    entry, err = rdb.Lookup(rom.Sha1)
-                    if err != nil {
-                        return err
-                    }
-                    if entry != nil {
-                        break
-                    }
+                entry, rdb, err := findRom(rom, romDBs)
+                if err != nil {
+                    return err
+                }
+
+                // Copy the ROM from the depot if it is not in the sources
+                if entry == nil && dp != nil && dp.Has(rom.Sha1) {
+                    term.Printf("  %s : %s\n", rom.Name, term.Cyan("COPY from depot %x", rom.Sha1))
+                    copyRom := newCopyRom(ActionCopy, rom, hex.EncodeToString(rom.Sha1[:]), "")
+                    copyRom.Depot = dp.Dir
+                    roms = append(roms, copyRom)
+                    continue
                 }
 
                 // Stop the fix if not found
@@ -265,26 +605,45 @@ func fixrom(datFile string, machines []string, dirs []string) (bool, error) {
                 }
 
                 // Copy the found ROM to the new machine
-                path := path.Join(rdb.Dir, entry.MachPath)
+                path := rdb.Path(entry)
                 term.Printf("  %s : %s\n", rom.Name, term.Cyan("COPY from %s", path))
-                roms = append(roms, CopyRom{ dstName: rom.Name, srcName: entry.RomPath, srcPath: path })
+                roms = append(roms, newCopyRom(ActionCopy, rom, entry.RomPath, path))
             }
         }
 
-        // Start the copy job if everything was OK
+        // Find the disks to copy or move into the machine directory
+        rebuild := !romOk && len(machine.Roms) > 0
+        disks := []CopyDisk{}
         if ok {
-            if goCount == goLimit {
-                copyProcess(&renameList, ch)
-            } else {
-                goCount++
+            ok, err = findDisks(machine, romDBs, badNames, rebuild && machine.Format == gorom.FormatDir, &disks)
+            if err != nil {
+                return err
             }
+        }
+
+        // Add the machine to the plan if everything was OK
+        if ok {
+            if rebuild {
+                _, err = os.Stat(machine.Path)
+                trash := err == nil
+                plan.Machines = append(plan.Machines, FixMachine{ Path: machine.Path, Trash: trash, Roms: roms })
+            }
+            plan.Disks = append(plan.Disks, disks...)
 
             FixromStats.Fixed++
             term.Printf("  %s\n", term.Green("OK"))
-            go copyRoms(machine.Path, roms, ch)
         } else {
             FixromStats.Failed++
             term.Printf("  %s\n", term.Red("FAILED"))
+
+            // The fix stops at the first ROM not found so look for the rest
+            if fixDat != nil {
+                notFound, err := notFoundRoms(machine, romDBs, dp)
+                if err != nil {
+                    return err
+                }
+                fixDat.machine(machine, func(rom *dat.Rom) bool { return notFound[rom] })
+            }
         }
 
         return nil
@@ -293,45 +652,7 @@ func fixrom(datFile string, machines []string, dirs []string) (bool, error) {
         return false, err
     }
 
-    // Process the copy results
-    if goCount > 0 {
-        term.Println("Waiting for copy jobs to complete")
-        for ; goCount > 0; goCount-- {
-            copyProcess(&renameList, ch)
-        }
-        util.Progressf("")
-    }
-
-    // Rename all of the temp files and move old files to trash
-    if len(renameList) > 0 {
-        term.Println("Renaming temporary files")
-        err = os.Mkdir(".trash", 0755)
-        if err != nil && os.IsNotExist(err) {
-            return false, err
-        }
-
-        for _, r := range renameList {
-            util.Progressf(r.machPath)
-            _, err = os.Stat(r.machPath)
-            if err == nil || os.IsExist(err) {
-                err = os.Rename(r.machPath, path.Join(".trash", r.machPath))
-                if err != nil {
-                    util.Progressf("")
-                    term.Println(term.Red("trash %s: %s", r.machPath, err))
-                    continue
-                }
-            }
-
-            err = os.Rename(r.tmpPath, r.machPath)
-            if err != nil {
-                util.Progressf("")
-                term.Println(term.Red("rename %s to %s: %s", r.tmpPath, r.machPath, err))
-            }
-        }
-        util.Progressf("")
-    }
-
-    // Delete extra files if option given
+    // Find the extra files to move to the trash
     if options.FixRom.ExtraTrash && len(machines) == 0 {
         err = util.ScanDir(".", true, func(file os.FileInfo) error {
             machPath := file.Name()
@@ -339,10 +660,7 @@ func fixrom(datFile string, machines []string, dirs []string) (bool, error) {
             if !machSet.IsSet(machName) {
                 FixromStats.Extra++
                 term.Printf("%s : %s\n", machPath, term.Blue("EXTRA"))
-                err = os.Rename(machPath, path.Join(TrashDir, machPath))
-                if err != nil {
-                    term.Println(term.Red("trash %s: %s", machPath, err))
-                }
+                plan.Extras = append(plan.Extras, machPath)
             }
             return nil
         })
@@ -351,6 +669,27 @@ func fixrom(datFile string, machines []string, dirs []string) (bool, error) {
         }
     }
 
+    if options.FixRom.PlanFile != "" {
+        err = writeFixPlan(filepath.ToSlash(options.FixRom.PlanFile), plan)
+        if err != nil {
+            return false, err
+        }
+    }
+
+    if options.App.DryRun {
+        printPlanStats(plan)
+    } else {
+        err = applyFixPlan(plan)
+        if err != nil {
+            return false, err
+        }
+    }
+
+    err = fixDat.close()
+    if err != nil {
+        return false, err
+    }
+
     term.Println("\nMachine Stats")
     term.Printf("  OK     : %d (%.1f%%)\n", FixromStats.Ok, 100.0 * float32(FixromStats.Ok) / float32(FixromStats.Total))
     term.Printf("  Fixed  : %d (%.1f%%)\n", FixromStats.Fixed, 100.0 * float32(FixromStats.Fixed) / float32(FixromStats.Total))
@@ -17,10 +17,15 @@ package main
 
 import (
     "testing"
+    "crypto/sha1"
+    "strings"
+    "io/ioutil"
     "os"
     "path"
     "gorom"
+    "gorom/dat"
     "gorom/test"
+    "gorom/term"
     "fmt"
 )
 
@@ -87,3 +92,389 @@ func TestFixRomDirWithDir(t *testing.T) {
         return runFixRom(t, "../../dats/dir.dat", nil, []string{"../dir"})
     })
 }
+
+func TestFixRomNonMerged(t *testing.T) {
+    test.RunDiffTest(t, "roms/badzip", "fixrom/nonmerged.out", func() error {
+        options = Options{}
+        options.FixRom.Format = gorom.FormatDir
+        options.App.SetTypeId = dat.SetNonMerged
+        return runFixRom(t, "../../dats/clone.dat", []string{"bios", "parent", "clone"}, []string{"../dir"})
+    })
+}
+
+func TestFixRomChd(t *testing.T) {
+    test.RunDiffTest(t, "roms/zip", "fixrom/chd.out", func() error {
+        options = Options{}
+        options.FixRom.Format = gorom.FormatZip
+        return runFixRom(t, "../../dats/chd.dat", []string{"machine1", "machine2"}, []string{"../chd"})
+    })
+}
+
+func TestFixRomCrc(t *testing.T) {
+    test.RunDiffTest(t, "roms/badzip", "fixrom/badzip_zip.out", func() error {
+        options = Options{}
+        options.FixRom.Format = gorom.FormatZip
+        return runFixRom(t, "../../dats/crc.dat", nil, []string{"../zip"})
+    })
+}
+
+func TestFixRomQuickScan(t *testing.T) {
+    test.RunDiffTest(t, "roms/badzip", "fixrom/badzip_zip.out", func() error {
+        options = Options{}
+        options.FixRom.Format = gorom.FormatZip
+        options.FixRom.QuickScan = true
+        return runFixRom(t, "../../dats/zip.dat", nil, []string{"../zip"})
+    })
+}
+
+func TestFixRomFixDat(t *testing.T) {
+    test.RunDiffTest(t, "roms/badzip", "fixrom/fixdat.out", func() error {
+        options = Options{}
+        options.FixRom.Format = gorom.FormatZip
+        options.DatOut.Format = "cmpro"
+
+        wd, err := os.Getwd()
+        if err != nil {
+            return err
+        }
+        defer os.Remove(path.Join(wd, ".gorom.db"))
+
+        tmpdir := test.CopyDirToTemp(t, "..", wd)
+        defer os.RemoveAll(tmpdir)
+
+        err = os.Chdir(tmpdir)
+        if err != nil {
+            return err
+        }
+
+        options.App.FixDat = "../fixdat.dat"
+        ok, err := fixrom("../../dats/zip.dat", nil, nil)
+        if err != nil {
+            return err
+        }
+        if ok {
+            return fmt.Errorf("unexpected return value")
+        }
+        return printFile(options.App.FixDat)
+    })
+}
+
+func TestFixRomDepot(t *testing.T) {
+    depotDir, err := ioutil.TempDir("", "depot")
+    if err != nil {
+        test.Fail(t, err)
+    }
+    defer os.RemoveAll(depotDir)
+
+    test.RunDiffTest(t, "roms/badzip", "fixrom/depot.out", func() error {
+        options = Options{}
+        options.App.NoOk = true
+        defer os.Remove("../zip/.gorom.db")
+        err := depotAdd(depotDir, []string{"../zip"})
+        if err != nil {
+            return err
+        }
+
+        options = Options{}
+        options.FixRom.Format = gorom.FormatZip
+        options.FixRom.Depot = depotDir
+        return runFixRom(t, "../../dats/zip.dat", nil, nil)
+    })
+}
+
+func TestFixRomPlan(t *testing.T) {
+    test.RunDiffTest(t, "roms/badzip", "fixrom/plan.out", func() error {
+        options = Options{}
+        options.FixRom.Format = gorom.FormatZip
+
+        wd, err := os.Getwd()
+        if err != nil {
+            return err
+        }
+        defer os.Remove(path.Join(wd, ".gorom.db"))
+        defer os.Remove("../zip/.gorom.db")
+
+        tmpdir := test.CopyDirToTemp(t, "..", wd)
+        defer os.RemoveAll(tmpdir)
+
+        err = os.Chdir(tmpdir)
+        if err != nil {
+            return err
+        }
+
+        // The dry run must not change any files
+        options.App.DryRun = true
+        options.FixRom.PlanFile = "../plan.json"
+        ok, err := fixrom("../../dats/zip.dat", nil, []string{"../zip"})
+        if err != nil {
+            return err
+        }
+        if !ok {
+            return fmt.Errorf("unexpected return value")
+        }
+
+        options.App.DryRun = false
+        err = applyPlanFile(options.FixRom.PlanFile)
+        if err != nil {
+            return err
+        }
+        err = printFile(options.FixRom.PlanFile)
+        if err != nil {
+            return err
+        }
+
+        options.FixRom.PlanFile = ""
+        ok, err = fixrom("../../dats/zip.dat", nil, nil)
+        if err != nil {
+            return err
+        }
+        if !ok {
+            return fmt.Errorf("unexpected return value")
+        }
+        return nil
+    })
+}
+
+func TestFixPlanVerify(t *testing.T) {
+    defer test.Chdir(t, "roms/zip")()
+
+    plan := &FixPlan{ Machines: []FixMachine{
+        { Path: "machine1.zip", Roms: []CopyRom{
+            { Action: ActionCopy, DstName: "rom_1.bin", SrcName: "rom_1.bin", SrcPath: "machine1.zip",
+              Sha1: "325701a893c1102805329f8af2d8410e40c14c79" },
+        } },
+        { Path: "machine2.zip", Roms: []CopyRom{
+            { Action: ActionCopy, DstName: "rom_1.bin", SrcName: "rom_2.bin", SrcPath: "machine1.zip",
+              Sha1: "325701a893c1102805329f8af2d8410e40c14c79" },
+        } },
+        { Path: "machine3.zip", Roms: []CopyRom{
+            { Action: ActionCopy, DstName: "rom_1.bin", SrcName: "rom_2.bin", SrcPath: "machine1.zip",
+              Crc: "00000000" },
+        } },
+    } }
+    options = Options{}
+    term.Init()
+    skipped := verifyFixPlan(plan, nil)
+    if skipped != 2 || len(plan.Machines) != 1 || plan.Machines[0].Path != "machine1.zip" {
+        test.Fail(t, "changed sources not skipped")
+    }
+}
+
+// dirSums returns the SHA-1 of every file in the current directory
+func dirSums() (map[string][sha1.Size]byte, error) {
+    files, err := ioutil.ReadDir(".")
+    if err != nil {
+        return nil, err
+    }
+    sums := map[string][sha1.Size]byte{}
+    for _, file := range files {
+        if strings.HasPrefix(file.Name(), ".") || file.IsDir() {
+            continue
+        }
+        data, err := ioutil.ReadFile(file.Name())
+        if err != nil {
+            return nil, err
+        }
+        sums[file.Name()] = sha1.Sum(data)
+    }
+    return sums, nil
+}
+
+func checkDirSums(sums map[string][sha1.Size]byte) error {
+    newSums, err := dirSums()
+    if err != nil {
+        return err
+    }
+    if fmt.Sprint(newSums) != fmt.Sprint(sums) {
+        return fmt.Errorf("directory not restored")
+    }
+    return nil
+}
+
+func TestFixRomUndo(t *testing.T) {
+    test.RunDiffTest(t, "roms/badzip", "fixrom/undo.out", func() error {
+        options = Options{}
+        options.FixRom.Format = gorom.FormatZip
+        options.App.NoGo = true
+
+        wd, err := os.Getwd()
+        if err != nil {
+            return err
+        }
+        defer os.Remove(path.Join(wd, ".gorom.db"))
+        defer os.Remove("../zip/.gorom.db")
+
+        tmpdir := test.CopyDirToTemp(t, "..", wd)
+        defer os.RemoveAll(tmpdir)
+
+        err = os.Chdir(tmpdir)
+        if err != nil {
+            return err
+        }
+
+        sums, err := dirSums()
+        if err != nil {
+            return err
+        }
+
+        // Undo a finished run
+        _, err = fixrom("../../dats/zip.dat", nil, []string{"../zip"})
+        if err != nil {
+            return err
+        }
+        ok, err := undo()
+        if err != nil {
+            return err
+        }
+        if !ok {
+            return fmt.Errorf("unexpected return value")
+        }
+        err = checkDirSums(sums)
+        if err != nil {
+            return err
+        }
+        runs, err := trashRuns()
+        if err != nil {
+            return err
+        }
+        if len(runs) != 0 {
+            return fmt.Errorf("unexpected trash runs")
+        }
+
+        // Roll back a run that stopped before it was committed
+        _, err = fixrom("../../dats/zip.dat", nil, []string{"../zip"})
+        if err != nil {
+            return err
+        }
+        data, err := ioutil.ReadFile(JournalFile)
+        if err != nil {
+            return err
+        }
+        lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+        err = ioutil.WriteFile(JournalFile, []byte(strings.Join(lines[:len(lines)-1], "\n")), 0644)
+        if err != nil {
+            return err
+        }
+        err = recoverJournal()
+        if err != nil {
+            return err
+        }
+        return checkDirSums(sums)
+    })
+}
+
+func TestFixRomTrash(t *testing.T) {
+    test.RunDiffTest(t, "roms/badzip", "fixrom/trash.out", func() error {
+        options = Options{}
+        options.FixRom.Format = gorom.FormatZip
+
+        wd, err := os.Getwd()
+        if err != nil {
+            return err
+        }
+        defer os.Remove(path.Join(wd, ".gorom.db"))
+
+        tmpdir := test.CopyDirToTemp(t, "..", wd)
+        defer os.RemoveAll(tmpdir)
+
+        err = os.Chdir(tmpdir)
+        if err != nil {
+            return err
+        }
+
+        // The ROMs missing from the set are only in machines trashed by an
+        // earlier run
+        runDir := path.Join(TrashDir, "20200101-120000")
+        err = os.MkdirAll(runDir, 0755)
+        if err != nil {
+            return err
+        }
+        for _, name := range []string{ "machine2.zip", "machine3.zip" } {
+            data, err := ioutil.ReadFile(path.Join("../zip", name))
+            if err != nil {
+                return err
+            }
+            err = ioutil.WriteFile(path.Join(runDir, "old_" + name), data, 0644)
+            if err != nil {
+                return err
+            }
+        }
+
+        return runFixRom(t, "../../dats/zip.dat", nil, nil)
+    })
+}
+
+func TestFixRomInPlace(t *testing.T) {
+    test.RunDiffTest(t, "roms/badzip", "fixrom/inplace.out", func() error {
+        options = Options{}
+        options.FixRom.Format = gorom.FormatZip
+        options.FixRom.InPlace = true
+        options.App.NoGo = true
+
+        wd, err := os.Getwd()
+        if err != nil {
+            return err
+        }
+        defer os.Remove(path.Join(wd, ".gorom.db"))
+        defer os.Remove("../zip/.gorom.db")
+
+        // The zips are copied instead of linked so they can be edited
+        tmpdir, err := ioutil.TempDir("..", "gorom*")
+        if err != nil {
+            return err
+        }
+        defer os.RemoveAll(tmpdir)
+        files, err := ioutil.ReadDir(".")
+        if err != nil {
+            return err
+        }
+        for _, file := range files {
+            if file.IsDir() || strings.HasPrefix(file.Name(), ".") {
+                continue
+            }
+            tmpPath := test.CopyFileToTemp(t, tmpdir, file.Name())
+            err = os.Rename(tmpPath, path.Join(tmpdir, file.Name()))
+            if err != nil {
+                return err
+            }
+        }
+
+        err = os.Chdir(tmpdir)
+        if err != nil {
+            return err
+        }
+
+        sums, err := dirSums()
+        if err != nil {
+            return err
+        }
+        before, err := os.Stat("machine2.zip")
+        if err != nil {
+            return err
+        }
+
+        for i := 0; i < 2; i++ {
+            ok, err := fixrom("../../dats/zip.dat", nil, []string{"../zip"})
+            if err != nil {
+                return err
+            }
+            if !ok {
+                return fmt.Errorf("unexpected return value")
+            }
+        }
+
+        after, err := os.Stat("machine2.zip")
+        if err != nil {
+            return err
+        }
+        if !os.SameFile(before, after) {
+            return fmt.Errorf("zip not updated in place")
+        }
+
+        _, err = undo()
+        if err != nil {
+            return err
+        }
+        return checkDirSums(sums)
+    })
+}
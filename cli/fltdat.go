@@ -16,13 +16,14 @@
 package main
 
 import (
+    "bufio"
     "bytes"
     "compress/gzip"
     "encoding/xml"
     "io"
+    "io/ioutil"
     "log"
     "os"
-    "path"
     "regexp"
 
     "gorom/dat"
@@ -54,38 +55,42 @@ func findRegExp(str string, regExpList []*regexp.Regexp) bool {
     return false
 }
 
-func fltdat(datFile string) error {
-    nameList := newRegExpList(options.FltDat.Name)
-    descList := newRegExpList(options.FltDat.Desc)
-    manuList := newRegExpList(options.FltDat.Manu)
-    yearList := newRegExpList(options.FltDat.Year)
-    catList := newRegExpList(options.FltDat.Cat)
+type machFilterFunc func(machine *dat.Machine) bool
 
-    var rd io.Reader
-    if datFile == "" {
-        rd = os.Stdin
-    } else {
-        df, err := os.Open(datFile)
-        if err != nil {
+func fltdatCmpro(wr io.Writer, bufBytes []byte, filterFunc machFilterFunc) error {
+    decoder := dat.NewCmproDecoder(bytes.NewReader(bufBytes))
+    start := int64(0)
+    for {
+        elem, err := decoder.Decode()
+        if err == io.EOF {
+            break
+        } else if err != nil {
             return err
         }
-        defer df.Close()
-        rd = df
-    }
 
-    var buffer bytes.Buffer
-    if path.Ext(datFile) == ".gz" {
-        gz, err := gzip.NewReader(rd)
-        if err != nil {
-            return err
+        filter := false
+        if elem.IsMachine() {
+            machine, err := elem.Machine()
+            if err != nil {
+                return err
+            }
+            filter = filterFunc(machine)
         }
-        defer gz.Close()
 
-        buffer.ReadFrom(gz)
-    } else {
-        buffer.ReadFrom(rd)
+        end := decoder.InputOffset()
+        if !filter {
+            _, err = wr.Write(bufBytes[start:end])
+            if err != nil {
+                return err
+            }
+        }
+        start = end
     }
-    bufBytes := buffer.Bytes()
+    _, err := wr.Write(bufBytes[start:])
+    return err
+}
+
+func fltdatXml(wr io.Writer, bufBytes []byte, filterFunc machFilterFunc) error {
     decoder := xml.NewDecoder(bytes.NewReader(bufBytes))
     start := int64(0)
     for {
@@ -100,30 +105,115 @@ func fltdat(datFile string) error {
             if v.Name.Local == "machine" || v.Name.Local == "game" {
                 var machine dat.Machine
                 decoder.DecodeElement(&machine, &v)
-
-                filter = !findRegExp(machine.Name, nameList) ||
-                         !findRegExp(machine.Description, descList) ||
-                         !findRegExp(machine.Manufacturer, manuList) ||
-                         !findRegExp(machine.Year, yearList) ||
-                         !findRegExp(machine.Category, catList);
-                if options.FltDat.Invert {
-                    filter = !filter
-                }
+                filter = filterFunc(&machine)
             }
 
             end := decoder.InputOffset()
             if !filter {
-                term.Print(string(bufBytes[start:end]))
+                _, err := wr.Write(bufBytes[start:end])
+                if err != nil {
+                    return err
+                }
             }
             start = end
 
         case xml.EndElement:
             end := decoder.InputOffset()
-            term.Print(string(bufBytes[start:end]))
+            _, err := wr.Write(bufBytes[start:end])
+            if err != nil {
+                return err
+            }
             start = end
         }
     }
-    term.Print(string(bufBytes[start:]))
+    _, err := wr.Write(bufBytes[start:])
+    return err
+}
+
+// fltdatCopy copies the DAT file without the filtered machines so everything
+// else in the file is kept exactly as it was
+func fltdatCopy(buffer *bufio.Reader, format int, filterFunc machFilterFunc) error {
+    bufBytes, err := ioutil.ReadAll(buffer)
+    if err != nil {
+        return err
+    }
+
+    var wr io.Writer = term.Writer()
+    var gz *gzip.Writer
+    if options.DatOut.Gzip {
+        gz = gzip.NewWriter(wr)
+        wr = gz
+    }
+
+    if format == dat.DatCmpro {
+        err = fltdatCmpro(wr, bufBytes, filterFunc)
+    } else {
+        err = fltdatXml(wr, bufBytes, filterFunc)
+    }
+    if gz != nil {
+        if closeErr := gz.Close(); err == nil {
+            err = closeErr
+        }
+    }
+    return err
+}
+
+func fltdat(datFile string) error {
+    nameList := newRegExpList(options.FltDat.Name)
+    descList := newRegExpList(options.FltDat.Desc)
+    manuList := newRegExpList(options.FltDat.Manu)
+    yearList := newRegExpList(options.FltDat.Year)
+    catList := newRegExpList(options.FltDat.Cat)
+
+    var buffer *bufio.Reader
+    if datFile == "" {
+        buffer = bufio.NewReader(os.Stdin)
+    } else {
+        rd, closer, err := dat.OpenDatFile(datFile)
+        if err != nil {
+            return err
+        }
+        defer closer.Close()
+        buffer = rd
+    }
+
+    format := dat.DetectDatFormat(buffer)
+    outFormat, err := dat.ParseDatFormat(options.DatOut.Format)
+    if err != nil {
+        return err
+    }
+
+    filterFunc := func(machine *dat.Machine) bool {
+        filter := !findRegExp(machine.Name, nameList) ||
+                  !findRegExp(machine.Description, descList) ||
+                  !findRegExp(machine.Manufacturer, manuList) ||
+                  !findRegExp(machine.Year, yearList) ||
+                  !findRegExp(machine.Category, catList);
+        if options.FltDat.Invert {
+            filter = !filter
+        }
+        return filter
+    }
+
+    // The DAT file is only written with the DAT writer when it is converted to
+    // another format
+    if outFormat == dat.DatInvalid || outFormat == format {
+        return fltdatCopy(buffer, format, filterFunc)
+    }
+
+    dw, err := newDatWriter(format)
+    if err != nil {
+        return err
+    }
+    err = dat.ParseDat(buffer, nil, dw.WriteHeader, func(machine *dat.Machine) error {
+        if filterFunc(machine) {
+            return nil
+        }
+        return dw.WriteMachine(machine)
+    })
+    if err != nil {
+        return err
+    }
 
-    return nil
+    return dw.Close()
 }
@@ -51,4 +51,12 @@ func TestFltDatSnk(t *testing.T) {
         options.FltDat.Manu = []string{"(?i)snk"}
         return fltdat("dats/mame.xml.gz")
     })
-}
\ No newline at end of file
+}
+
+func TestFltDatCmpro(t *testing.T) {
+    test.RunDiffTest(t, "", "fltdat/cmpro.out", func() error {
+        options = Options{}
+        options.FltDat.Name = []string{"machine[13]"}
+        return fltdat("dats/cmpro.dat")
+    })
+}
@@ -187,7 +187,7 @@ func fuzzymv(matchDir, renameDir string) error {
                             }
                         }
 
-                        if !options.FuzzyMv.DryRun {
+                        if !options.App.DryRun {
                             err = os.Rename(path.Join(renameDir, rfile), path.Join(renameDir, newfile))
                             if err != nil {
                                 term.Println(err)
@@ -16,31 +16,73 @@
 package main
 
 import (
+    "encoding/csv"
+    "encoding/hex"
+    "encoding/json"
+    "errors"
     "fmt"
+    "io/ioutil"
+    "os"
+    "path"
+    "path/filepath"
+    "strconv"
+    "strings"
+    "time"
 
     "gorom/term"
     "gorom/romdb"
+    "gorom/romio"
     "gorom/checksum"
+    "gorom/util"
 )
 
-func dbLookup(rdb *romdb.RomDB, hexstr string) error {
-    sum, ok := checksum.NewSha1String(hexstr)
-    if !ok {
-        return fmt.Errorf("Invalid checksum")
+// dbLookup looks up a SHA-1, a CRC32, or a glob pattern on the ROM names
+func dbLookup(rdb *romdb.RomDB, arg string) error {
+    var entries []*romdb.RomDBEntry
+    var err error
+    notFound := "Checksum not found"
+
+    if sum, ok := checksum.NewSha1String(arg); ok {
+        entries, err = rdb.Lookup(sum)
+    } else if crc, ok := checksum.NewCrc32String(arg); ok {
+        entries, err = rdb.LookupCrc32Any(crc)
+    } else {
+        entries, err = rdb.LookupName(arg)
+        if err != nil {
+            return fmt.Errorf("Invalid name pattern")
+        }
+        notFound = "Name not found"
     }
-    entry, err := rdb.Lookup(sum)
     if err != nil {
         return err
     }
-    if entry == nil {
-        return fmt.Errorf("Checksum not found")
+    if len(entries) == 0 {
+        return errors.New(notFound)
     }
 
-    term.Printf("%s %s %x %s\n", entry.MachPath, entry.RomPath, entry.Sum, entry.ModTime)
+    printEntries(entries)
+    return nil
+}
 
+func dbLookupMachine(rdb *romdb.RomDB, pattern string) error {
+    entries, err := rdb.LookupMachine(pattern)
+    if err != nil {
+        return fmt.Errorf("Invalid machine pattern")
+    }
+    if len(entries) == 0 {
+        return fmt.Errorf("Machine not found")
+    }
+
+    printEntries(entries)
     return nil
 }
 
+func printEntries(entries []*romdb.RomDBEntry) {
+    for _, entry := range entries {
+        term.Printf("%s %s %x %s\n", entry.MachPath, entry.RomPath, entry.Sum, entry.ModTime)
+    }
+}
+
 func dbScan(rdb *romdb.RomDB) error {
     goLimit := 0
     if options.App.NoGo {
@@ -60,8 +102,280 @@ func dbDump(rdb *romdb.RomDB) error {
     return nil
 }
 
-func goromdb() error {
-    rdb, err := romdb.OpenRomDB(".", options.App.SkipHeader)
+func dbVerify(rdb *romdb.RomDB) error {
+    var ok, mismatch, missing, failed int
+    err := rdb.Verify(options.GoRomDB.Sample, func(entry *romdb.RomDBEntry, err error) {
+        switch err {
+        case nil:
+            ok++
+            if !options.App.NoOk {
+                term.Printf("%s %s : %s\n", entry.MachPath, entry.RomPath, term.Green("OK"))
+            }
+        case romdb.MismatchError:
+            mismatch++
+            term.Printf("%s %s : %s\n", entry.MachPath, entry.RomPath, term.Red("MISMATCH"))
+        case romdb.NotFoundError:
+            missing++
+            term.Printf("%s %s : %s\n", entry.MachPath, entry.RomPath, term.Red("NOT FOUND"))
+        default:
+            failed++
+            term.Printf("%s %s : %s\n", entry.MachPath, entry.RomPath, term.Red("ERROR %s", err))
+        }
+    })
+    if err != nil {
+        return err
+    }
+
+    term.Println("\nVerify Stats")
+    term.Printf("  OK        : %d\n", ok)
+    term.Printf("  Mismatch  : %d\n", mismatch)
+    term.Printf("  Not Found : %d\n", missing)
+    term.Printf("  Error     : %d\n", failed)
+    term.Printf("  Total     : %d\n", ok + mismatch + missing + failed)
+
+    if bad := mismatch + missing + failed; bad > 0 {
+        return fmt.Errorf("%d database entries failed verification", bad)
+    }
+    return nil
+}
+
+func dbPrune(rdb *romdb.RomDB) error {
+    count, err := rdb.Prune()
+    if err != nil {
+        return err
+    }
+    term.Printf("Pruned %d entries\n", count)
+    return nil
+}
+
+func dbStats(rdb *romdb.RomDB) error {
+    stats, err := rdb.Stats()
+    if err != nil {
+        return err
+    }
+
+    term.Println("Database Stats")
+    term.Printf("  Entries    : %d\n", stats.Entries)
+    term.Printf("  Machines   : %d\n", stats.Machines)
+    term.Printf("  Bytes      : %d\n", stats.Bytes)
+    term.Printf("  Checksums  : %d\n", stats.Checksums)
+    term.Printf("  Duplicates : %d (%d bytes)\n", stats.Duplicates, stats.DuplicateBytes)
+    if rdb.Shared() {
+        roots, err := rdb.Roots()
+        if err != nil {
+            return err
+        }
+        term.Printf("  Roots      : %d\n", len(roots))
+    }
+    return nil
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// Export and Import
+//
+// The database entries are exported as a JSON array of records or as CSV with
+// the same fields as columns.  Checksums are in hex and empty if they were
+// never calculated.
+///////////////////////////////////////////////////////////////////////////////
+
+type DbRecord struct {
+    Machine string `json:"machine"`
+    Rom     string `json:"rom"`
+    Size    int64  `json:"size"`
+    Sha1    string `json:"sha1"`
+    Crc32   string `json:"crc32"`
+    Md5     string `json:"md5"`
+    ModTime string `json:"modtime"`
+}
+
+var dbColumns = []string{ "machine", "rom", "size", "sha1", "crc32", "md5", "modtime" }
+
+func isCsvFile(file string) bool {
+    return strings.HasSuffix(strings.ToLower(file), ".csv")
+}
+
+func newDbRecord(entry *romdb.RomDBEntry) DbRecord {
+    return DbRecord{
+        Machine: entry.MachPath,
+        Rom:     entry.RomPath,
+        Size:    entry.Size,
+        Sha1:    hex.EncodeToString(entry.Sum[:]),
+        Crc32:   csvChecksum(entry.Crc32[:]),
+        Md5:     csvChecksum(entry.Md5[:]),
+        ModTime: entry.ModTime.Format(time.RFC3339Nano),
+    }
+}
+
+// parseChecksum decodes a hex checksum into sum.  Empty checksums are left as
+// zero unless they are required.
+func parseChecksum(sum []byte, hexstr string, required bool) error {
+    if hexstr == "" && !required {
+        return nil
+    }
+    b, err := hex.DecodeString(hexstr)
+    if err != nil || len(b) != len(sum) {
+        return fmt.Errorf("invalid checksum '%s'", hexstr)
+    }
+    copy(sum, b)
+    return nil
+}
+
+func (record *DbRecord) entry() (*romdb.RomDBEntry, error) {
+    entry := &romdb.RomDBEntry{ MachPath: record.Machine, RomPath: record.Rom, Size: record.Size }
+    if entry.MachPath == "" || entry.RomPath == "" {
+        return nil, fmt.Errorf("missing machine or ROM name")
+    }
+    err := parseChecksum(entry.Sum[:], record.Sha1, true)
+    if err != nil {
+        return nil, err
+    }
+    err = parseChecksum(entry.Crc32[:], record.Crc32, false)
+    if err != nil {
+        return nil, err
+    }
+    err = parseChecksum(entry.Md5[:], record.Md5, false)
+    if err != nil {
+        return nil, err
+    }
+    entry.ModTime, err = time.Parse(time.RFC3339Nano, record.ModTime)
+    if err != nil {
+        return nil, err
+    }
+    return entry, nil
+}
+
+func dbExport(rdb *romdb.RomDB, file string) error {
+    records := []DbRecord{}
+    err := rdb.ForEach(func(entry *romdb.RomDBEntry) error {
+        records = append(records, newDbRecord(entry))
+        return nil
+    })
+    if err != nil {
+        return err
+    }
+
+    fh, err := os.Create(file)
+    if err != nil {
+        return err
+    }
+    defer fh.Close()
+
+    if isCsvFile(file) {
+        wr := csv.NewWriter(fh)
+        wr.Write(dbColumns)
+        for _, r := range records {
+            wr.Write([]string{ r.Machine, r.Rom, strconv.FormatInt(r.Size, 10), r.Sha1, r.Crc32, r.Md5, r.ModTime })
+        }
+        wr.Flush()
+        err = wr.Error()
+    } else {
+        enc := json.NewEncoder(fh)
+        enc.SetIndent("", "  ")
+        err = enc.Encode(records)
+    }
+    if err != nil {
+        return err
+    }
+
+    term.Printf("Exported %d entries\n", len(records))
+    return fh.Close()
+}
+
+func readDbRecords(file string) ([]DbRecord, error) {
+    records := []DbRecord{}
+    if !isCsvFile(file) {
+        data, err := ioutil.ReadFile(file)
+        if err != nil {
+            return nil, err
+        }
+        err = json.Unmarshal(data, &records)
+        if err != nil {
+            return nil, fmt.Errorf("%s: %s", file, err)
+        }
+        return records, nil
+    }
+
+    fh, err := os.Open(file)
+    if err != nil {
+        return nil, err
+    }
+    defer fh.Close()
+
+    rows, err := csv.NewReader(fh).ReadAll()
+    if err != nil {
+        return nil, fmt.Errorf("%s: %s", file, err)
+    }
+    if len(rows) == 0 || strings.Join(rows[0], ",") != strings.Join(dbColumns, ",") {
+        return nil, fmt.Errorf("%s: invalid CSV header", file)
+    }
+    for _, row := range rows[1:] {
+        size, err := strconv.ParseInt(row[2], 10, 64)
+        if err != nil {
+            return nil, fmt.Errorf("%s: invalid size '%s'", file, row[2])
+        }
+        records = append(records, DbRecord{ row[0], row[1], size, row[3], row[4], row[5], row[6] })
+    }
+    return records, nil
+}
+
+func dbImport(rdb *romdb.RomDB, file string) error {
+    records, err := readDbRecords(file)
+    if err != nil {
+        return err
+    }
+
+    entries := make([]*romdb.RomDBEntry, len(records))
+    for i := range records {
+        entries[i], err = records[i].entry()
+        if err != nil {
+            return fmt.Errorf("%s: record %d: %s", file, i + 1, err)
+        }
+    }
+
+    err = rdb.Import(entries)
+    if err != nil {
+        return err
+    }
+
+    term.Printf("Imported %d entries\n", len(entries))
+    return nil
+}
+
+// dbWatch watches the current directory and the source directories until
+// one of them fails
+func dbWatch(rdb *romdb.RomDB, skipper *romio.HeaderSkipper, dirs []string) error {
+    rdbs := []*romdb.RomDB{ rdb }
+    for _, dir := range dirs {
+        srcDB, err := openRomDB(dir, skipper)
+        if err != nil {
+            return err
+        }
+        defer srcDB.Close()
+        rdbs = append(rdbs, srcDB)
+    }
+
+    ch := make(chan error, len(rdbs))
+    for _, watchDB := range rdbs {
+        go func(watchDB *romdb.RomDB) {
+            ch <- watchDB.Watch(nil, func(name string, err error) {
+                machPath := path.Join(watchDB.Dir, name)
+                if err == nil {
+                    term.Println(machPath)
+                } else {
+                    term.Println(machPath, err)
+                }
+            })
+        }(watchDB)
+    }
+    return <-ch
+}
+
+func goromdb(args []string) error {
+    skipper, err := headerSkipper("")
+    if err != nil {
+        return err
+    }
+    rdb, err := openRomDB(".", skipper)
     if err != nil {
         return err;
     }
@@ -69,10 +383,24 @@ func goromdb() error {
 
     if options.GoRomDB.Lookup != "" {
         return dbLookup(rdb, options.GoRomDB.Lookup)
+    } else if options.GoRomDB.LookupMachine != "" {
+        return dbLookupMachine(rdb, options.GoRomDB.LookupMachine)
     } else if options.GoRomDB.Scan {
         return dbScan(rdb)
     } else if options.GoRomDB.Dump {
         return dbDump(rdb)
+    } else if options.GoRomDB.Verify {
+        return dbVerify(rdb)
+    } else if options.GoRomDB.Prune {
+        return dbPrune(rdb)
+    } else if options.GoRomDB.Stats {
+        return dbStats(rdb)
+    } else if options.GoRomDB.Export != "" {
+        return dbExport(rdb, filepath.ToSlash(options.GoRomDB.Export))
+    } else if options.GoRomDB.Import != "" {
+        return dbImport(rdb, filepath.ToSlash(options.GoRomDB.Import))
+    } else if options.GoRomDB.Watch {
+        return dbWatch(rdb, skipper, util.ToSlash(args))
     } else {
         return fmt.Errorf("No database operation specified")
     }
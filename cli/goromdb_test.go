@@ -17,8 +17,10 @@ package main
 
 import (
     "testing"
+    "io/ioutil"
     "os"
     "fmt"
+    "path"
     "strings"
     "regexp"
     "gorom/test"
@@ -46,28 +48,28 @@ func TestGoRomDB(t *testing.T) {
         options = Options{}
         options.GoRomDB.Scan = true
         options.App.NoGo = true
-        err := goromdb()
+        err := goromdb(nil)
         if err != nil {
             return err
         }
 
         options = Options{}
         options.GoRomDB.Dump = true
-        err = goromdb()
+        err = goromdb(nil)
         if err != nil {
             return err
         }
 
         options = Options{}
         options.GoRomDB.Lookup = test.ZipDats[0].Machines["machine2"].Roms["rom_4.bin"].Sha1
-        err = goromdb()
+        err = goromdb(nil)
         if err != nil {
             return err
         }
 
         options = Options{}
         options.GoRomDB.Lookup = "1111111111111111111111111111111111111111"
-        err = goromdb()
+        err = goromdb(nil)
         if err.Error() != "Checksum not found" {
             if err == nil {
                 err = fmt.Errorf("Checksum was found")
@@ -77,10 +79,10 @@ func TestGoRomDB(t *testing.T) {
 
         options = Options{}
         options.GoRomDB.Lookup = "not a checksum"
-        err = goromdb()
-        if err.Error() != "Invalid checksum" {
+        err = goromdb(nil)
+        if err.Error() != "Name not found" {
             if err == nil {
-                err = fmt.Errorf("Checksum NOT invalid")
+                err = fmt.Errorf("Name was found")
             }
             return err
         }
@@ -89,3 +91,166 @@ func TestGoRomDB(t *testing.T) {
     }, dateFilter)
 }
 
+
+func TestGoRomDBLookup(t *testing.T) {
+    tmpdir := test.CopyDirToTemp(t, test.TestDir, path.Join(test.TestDir, "roms/dir"))
+    defer os.RemoveAll(tmpdir)
+    test.CopyDir(t, tmpdir, path.Join(test.TestDir, "roms/zip"))
+
+    test.RunDiffFilterTest(t, path.Base(tmpdir), "goromdb/lookup.out", func() error {
+        options = Options{}
+        options.GoRomDB.Scan = true
+        options.App.NoGo = true
+        err := goromdb(nil)
+        if err != nil {
+            return err
+        }
+
+        for _, lookup := range []string{ "c506e1b8", "rom_1.bin", "rom_[68]*" } {
+            options = Options{}
+            options.GoRomDB.Lookup = lookup
+            err = goromdb(nil)
+            if err != nil {
+                return err
+            }
+        }
+
+        options = Options{}
+        options.GoRomDB.LookupMachine = "machine1"
+        err = goromdb(nil)
+        if err != nil {
+            return err
+        }
+
+        options = Options{}
+        options.GoRomDB.Lookup = "ffffffff"
+        err = goromdb(nil)
+        if err == nil || err.Error() != "Checksum not found" {
+            return fmt.Errorf("CRC32 was found: %v", err)
+        }
+
+        options = Options{}
+        options.GoRomDB.Lookup = "rom_["
+        err = goromdb(nil)
+        if err == nil || err.Error() != "Invalid name pattern" {
+            return fmt.Errorf("name pattern NOT invalid: %v", err)
+        }
+
+        options = Options{}
+        options.GoRomDB.LookupMachine = "machine9*"
+        err = goromdb(nil)
+        if err == nil || err.Error() != "Machine not found" {
+            return fmt.Errorf("machine was found: %v", err)
+        }
+
+        return nil
+    }, dateFilter)
+}
+
+func TestGoRomDBMaint(t *testing.T) {
+    tmpdir := test.CopyDirToTemp(t, test.TestDir, path.Join(test.TestDir, "roms/dir"))
+    defer os.RemoveAll(tmpdir)
+    test.CopyDir(t, tmpdir, path.Join(test.TestDir, "roms/zip"))
+
+    test.RunDiffFilterTest(t, path.Base(tmpdir), "goromdb/maint.out", func() error {
+        options = Options{}
+        options.GoRomDB.Scan = true
+        options.App.NoGo = true
+        err := goromdb(nil)
+        if err != nil {
+            return err
+        }
+
+        options = Options{}
+        options.GoRomDB.Stats = true
+        err = goromdb(nil)
+        if err != nil {
+            return err
+        }
+
+        options = Options{}
+        options.GoRomDB.Verify = true
+        options.App.NoOk = true
+        err = goromdb(nil)
+        if err != nil {
+            return err
+        }
+
+        // Replace a ROM without touching the hard linked original and
+        // delete a machine
+        err = os.Remove("machine1/rom_1.bin")
+        if err != nil {
+            return err
+        }
+        err = ioutil.WriteFile("machine1/rom_1.bin", []byte("corrupt"), 0644)
+        if err != nil {
+            return err
+        }
+        err = os.RemoveAll("machine2")
+        if err != nil {
+            return err
+        }
+
+        options = Options{}
+        options.GoRomDB.Verify = true
+        options.App.NoOk = true
+        err = goromdb(nil)
+        if err == nil || err.Error() != "4 database entries failed verification" {
+            return fmt.Errorf("verify did not fail: %v", err)
+        }
+
+        options = Options{}
+        options.GoRomDB.Prune = true
+        err = goromdb(nil)
+        if err != nil {
+            return err
+        }
+
+        options = Options{}
+        options.GoRomDB.Stats = true
+        err = goromdb(nil)
+        if err != nil {
+            return err
+        }
+
+        options = Options{}
+        options.GoRomDB.Export = "db.json"
+        err = goromdb(nil)
+        if err != nil {
+            return err
+        }
+        err = printFile("db.json")
+        if err != nil {
+            return err
+        }
+
+        options = Options{}
+        options.GoRomDB.Export = "db.csv"
+        err = goromdb(nil)
+        if err != nil {
+            return err
+        }
+
+        // Import the CSV into a new database
+        err = os.Rename("db.csv", "../db.csv")
+        if err != nil {
+            return err
+        }
+        defer os.Remove("../db.csv")
+        err = os.Remove(".gorom.db")
+        if err != nil {
+            return err
+        }
+
+        options = Options{}
+        options.GoRomDB.Import = "../db.csv"
+        err = goromdb(nil)
+        if err != nil {
+            return err
+        }
+
+        options = Options{}
+        options.GoRomDB.Dump = true
+        return goromdb(nil)
+    }, dateFilter)
+}
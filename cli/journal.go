@@ -0,0 +1,280 @@
+//  GoRom - Emulator ROM Management Utilities
+//  Copyright (C) 2020 Scott Shumate <scott@shumatech.com>
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "io"
+    "os"
+    "path"
+    "sync"
+
+    "gorom/romio"
+    "gorom/term"
+    "gorom/util"
+)
+
+///////////////////////////////////////////////////////////////////////////////
+// Fixrom Journal
+//
+// The journal records every temp file that fixrom creates and every file that
+// it moves so an interrupted run can be rolled back and a finished run can be
+// undone.  Each step is written and synced before the move is made, and the
+// journal ends with a commit record when the run finishes.  The methods do
+// nothing on a nil Journal so fixrom does not need to check for one.
+///////////////////////////////////////////////////////////////////////////////
+
+const JournalFile = ".gorom.journal"
+
+// Journal record operations
+const (
+    JournalTemp   = "TEMP"
+    JournalMove   = "MOVE"
+    JournalTrash  = "TRASH"
+    JournalZip    = "ZIP"
+    JournalCommit = "COMMIT"
+)
+
+type JournalRecord struct {
+    Op     string `json:"op"`
+    Src    string `json:"src,omitempty"`
+    Dst    string `json:"dst,omitempty"`
+    Offset int64  `json:"offset,omitempty"`
+    Data   []byte `json:"data,omitempty"`
+}
+
+type Journal struct {
+    fh    *os.File
+    enc   *json.Encoder
+    mutex sync.Mutex
+}
+
+type UndoStats struct {
+    Restored int
+    Removed  int
+    Failed   int
+}
+
+func createJournal() (*Journal, error) {
+    fh, err := os.Create(JournalFile)
+    if err != nil {
+        return nil, err
+    }
+    return &Journal{ fh: fh, enc: json.NewEncoder(fh) }, nil
+}
+
+func (j *Journal) write(record JournalRecord) error {
+    if j == nil {
+        return nil
+    }
+    j.mutex.Lock()
+    defer j.mutex.Unlock()
+    err := j.enc.Encode(record)
+    if err != nil {
+        return err
+    }
+    return j.fh.Sync()
+}
+
+// temp records a temp file or directory that is removed on a rollback
+func (j *Journal) temp(tmpPath string) error {
+    return j.write(JournalRecord{ Op: JournalTemp, Src: tmpPath })
+}
+
+// rename records the move of a file and then moves it
+func (j *Journal) rename(srcPath string, dstPath string) error {
+    err := j.write(JournalRecord{ Op: JournalMove, Src: srcPath, Dst: dstPath })
+    if err != nil {
+        return err
+    }
+    return util.MoveFile(srcPath, dstPath)
+}
+
+// trash records the move of a file to the trash and then moves it
+func (j *Journal) trash(srcPath string, trashPath string) error {
+    err := j.write(JournalRecord{ Op: JournalTrash, Src: srcPath, Dst: trashPath })
+    if err != nil {
+        return err
+    }
+    return util.MoveFile(srcPath, trashPath)
+}
+
+// zip records the original central directory of a zip that is edited in
+// place so it can be restored
+func (j *Journal) zip(machPath string, ofs int64, tail []byte) error {
+    return j.write(JournalRecord{ Op: JournalZip, Src: machPath, Offset: ofs, Data: tail })
+}
+
+// commit marks the run as finished and closes the journal.  The journal is
+// kept so the run can be undone.
+func (j *Journal) commit() error {
+    if j == nil {
+        return nil
+    }
+    err := j.write(JournalRecord{ Op: JournalCommit })
+    if err != nil {
+        j.fh.Close()
+        return err
+    }
+    return j.fh.Close()
+}
+
+// readJournal returns the records of the journal and whether the run was
+// committed.  A partly written last record from an interrupted run is ignored.
+func readJournal() ([]JournalRecord, bool, error) {
+    fh, err := os.Open(JournalFile)
+    if err != nil {
+        return nil, false, err
+    }
+    defer fh.Close()
+
+    records := []JournalRecord{}
+    committed := false
+    dec := json.NewDecoder(fh)
+    for {
+        var record JournalRecord
+        err = dec.Decode(&record)
+        if err == io.EOF || err == io.ErrUnexpectedEOF {
+            break
+        }
+        if err != nil {
+            return nil, false, fmt.Errorf("%s: %s", JournalFile, err)
+        }
+        if record.Op == JournalCommit {
+            committed = true
+        } else {
+            records = append(records, record)
+        }
+    }
+    return records, committed, nil
+}
+
+func fileExists(filePath string) bool {
+    _, err := os.Lstat(filePath)
+    return err == nil
+}
+
+// rollbackJournal undoes the records of a journal in reverse order.  Moves are
+// reversed, temp files are removed, and zips edited in place are restored.
+// Steps that were never made because the run stopped first are skipped.
+func rollbackJournal(records []JournalRecord) UndoStats {
+    var stats UndoStats
+    for i := len(records) - 1; i >= 0; i-- {
+        record := records[i]
+        switch record.Op {
+        case JournalTemp:
+            if !fileExists(record.Src) {
+                continue
+            }
+            err := os.RemoveAll(record.Src)
+            if err != nil {
+                stats.Failed++
+                term.Println(term.Red("remove %s: %s", record.Src, err))
+                continue
+            }
+            stats.Removed++
+
+            // Remove the trash run of files trashed from a zip once it is
+            // empty
+            removeTrashDirs(record.Src)
+        case JournalMove, JournalTrash:
+            if !fileExists(record.Dst) || fileExists(record.Src) {
+                continue
+            }
+            err := os.MkdirAll(path.Dir(record.Src), 0755)
+            if err == nil {
+                err = util.MoveFile(record.Dst, record.Src)
+            }
+            if err != nil {
+                stats.Failed++
+                term.Println(term.Red("restore %s: %s", record.Src, err))
+                continue
+            }
+            if record.Op == JournalTrash {
+                term.Printf("%s : %s\n", record.Src, term.Green("RESTORED"))
+                stats.Restored++
+
+                // Remove the trash run once it is empty
+                removeTrashDirs(record.Dst)
+            }
+        case JournalZip:
+            if !fileExists(record.Src) {
+                continue
+            }
+            err := romio.RestoreZip(record.Src, record.Offset, record.Data)
+            if err != nil {
+                stats.Failed++
+                term.Println(term.Red("restore %s: %s", record.Src, err))
+                continue
+            }
+            term.Printf("%s : %s\n", record.Src, term.Green("RESTORED"))
+            stats.Restored++
+        }
+    }
+    return stats
+}
+
+// recoverJournal rolls back a fixrom run that was interrupted before it
+// finished so the directory is back in its original state
+func recoverJournal() error {
+    records, committed, err := readJournal()
+    if os.IsNotExist(err) || committed {
+        return nil
+    }
+    if err != nil {
+        return err
+    }
+
+    if options.App.DryRun {
+        term.Println(term.Yellow("Interrupted fixrom found, run without --dry-run to roll it back"))
+        return nil
+    }
+
+    term.Println("Rolling back interrupted fixrom")
+    stats := rollbackJournal(records)
+    if stats.Failed > 0 {
+        return fmt.Errorf("unable to roll back %d steps in %s", stats.Failed, JournalFile)
+    }
+    return os.Remove(JournalFile)
+}
+
+// undo restores the current directory to its state before the last fixrom
+// run using the journal
+func undo() (bool, error) {
+    records, _, err := readJournal()
+    if os.IsNotExist(err) {
+        return false, fmt.Errorf("no fixrom journal found in the current directory")
+    }
+    if err != nil {
+        return false, err
+    }
+
+    stats := rollbackJournal(records)
+    if stats.Failed == 0 {
+        err = os.Remove(JournalFile)
+        if err != nil {
+            return false, err
+        }
+    }
+
+    term.Println("\nUndo Stats")
+    term.Printf("  Restored : %d\n", stats.Restored)
+    term.Printf("  Removed  : %d\n", stats.Removed)
+    term.Printf("  Failed   : %d\n", stats.Failed)
+
+    return stats.Failed == 0, nil
+}
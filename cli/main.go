@@ -22,6 +22,9 @@ import (
 	"os"
 	"path/filepath"
 
+	"gorom/dat"
+	"gorom/romdb"
+	"gorom/romio"
 	"gorom/term"
 	"gorom/util"
 
@@ -46,8 +49,14 @@ type Options struct {
         TorZip      bool      `short:"z" long:"torzip"  description:"Convert specified Zips into TorrentZip format"`
         Dir2Dat     bool      `short:"d" long:"dir2dat" description:"Create a DAT file for the current directory"`
         FltDat      string    `short:"F" long:"fltdat"  description:"Filter DATFILE fields with regular expressions" value-name:"DATFILE"`
+        DiffDat     string    `short:"i" long:"diffdat" description:"Compare OLDDAT to the new DAT file in ARGS" value-name:"OLDDAT"`
         FuzzyMv     bool      `short:"m" long:"fuzzymv" description:"Rename files in one directory to the closest fuzzy\nmatch in another directory"`
         GoRomDB     bool      `short:"G" long:"goromdb" description:"Perform operations on the .gorom.db database"`
+        DepotAdd    string    `long:"depot-add" description:"Add the ROMs in the directories or machines in ARGS to the DEPOT ROM store" value-name:"DEPOT"`
+        Apply       string    `long:"apply" description:"Apply the fixrom plan in PLANFILE to the current directory" value-name:"PLANFILE"`
+        Undo        bool      `long:"undo" description:"Undo the last fixrom in the current directory"`
+        Trash       bool      `long:"trash" description:"List, restore, or purge the trash runs of the current directory"`
+        MergeSets   string    `long:"merge-sets" description:"Merge the ROM sets of the DATFILE and directory pairs in ARGS into OUTDIR" value-name:"OUTDIR"`
         Version     bool      `short:"V" long:"version" description:"Display the version and build date"`
     } `group:"Operations"`
 
@@ -59,14 +68,25 @@ type Options struct {
         NoHeader    bool      `short:"H" long:"no-header" description:"Do not display header description"`
         NoExtra     bool      `short:"e" long:"no-extra" description:"Do not show extra files"`
         SkipHeader  bool      `short:"k" long:"skip-header" description:"skip ROM headers in checksum calculations"`
+        HeaderDef   string    `short:"x" long:"header-def" description:"Skip ROM headers with a clrmamepro header definition" value-name:"XMLFILE"`
+        SetType     string    `short:"y" long:"set-type" description:"ROM set type: merged, split, non-merged, or auto"`
+        SetTypeId   int
+        Md5         bool      `short:"5" long:"md5" description:"Calculate MD5 checksums for DATs without SHA-1"`
+        FixDat      string    `long:"fixdat" description:"Write a DAT file of the missing ROMs to DATFILE" value-name:"DATFILE"`
+        Db          string    `long:"db" description:"Use a shared ROM database in DBFILE instead of one in each directory" value-name:"DBFILE" optional:"yes" optional-value:"default"`
+        DryRun      bool      `long:"dry-run" description:"Show the changes without changing any files"`
+        TrashDir    string    `long:"trash-dir" description:"Move trash to DIR instead of the .trash directory" value-name:"DIR"`
         Verbose     bool      `short:"v" long:"verbose" description:"Show verbose output"`
     } `group:"Application Options"`
 
     ChkRom struct {
         NoRom       bool      `short:"r" long:"no-rom" description:"Do not display individual roms"`
         NoStats     bool      `short:"T" long:"no-stats" description:"Do not display statistics"`
-        JsonOut     bool      `short:"j" long:"json" description:"Use JSON output format"`
+        JsonOut     bool      `short:"j" long:"json" description:"Use JSON output format (same as --report-format json)"`
+        ReportFormat string   `long:"report-format" description:"Report format: text, json, have, miss, csv, or html" value-name:"FORMAT"`
+        ReportFile  string    `long:"report-file" description:"Write the report to FILE instead of the terminal" value-name:"FILE"`
         SizeOnly    bool      `short:"Z" long:"size-only" description:"Scan using sizes instead of checksums"`
+        CrcOnly     bool      `long:"crc-only" description:"Scan zips using their stored CRC32s instead of checksums"`
     } `group:"Check ROM (-c, --chkrom) Options"`
 
     FixRom struct {
@@ -74,7 +94,11 @@ type Options struct {
         DefaultFmt  string    `short:"D" long:"default-fmt" description:"Default machine format: dir,zip,7z,or tgz"`
         Format      int
         SkipScan    bool      `short:"S" long:"skip-scan" description:"Skip ROM source directory scan"`
+        QuickScan   bool      `long:"quick-scan" description:"Only hash source files with the size and CRC32 of a ROM in the DAT"`
         ExtraTrash  bool      `short:"E" long:"extra-trash" description:"Move extra files to the trash"`
+        Depot       string    `long:"depot" description:"Copy the ROMs not found in the sources from the DEPOT ROM store" value-name:"DEPOT"`
+        PlanFile    string    `long:"plan-file" description:"Write the fix plan to FILE in JSON format" value-name:"FILE"`
+        InPlace     bool      `long:"in-place" description:"Update zip machines in place instead of rewriting them (not TorrentZip)"`
     } `group:"Fix ROM (-f, --fixrom) Options"`
 
     ChkTor struct {
@@ -98,23 +122,49 @@ type Options struct {
         Invert      bool      `long:"invert" description:"Invert the filter"  value-name:"REGEX"`
     }  `group:"Filter DAT (-f.--fltdat) Options"`
 
+    DiffDat struct {
+        UpdateDat   string    `long:"update-dat" description:"Write the new and changed machines to DATFILE" value-name:"DATFILE"`
+    } `group:"Diff DAT (-i, --diffdat) Options"`
+
+    DatOut struct {
+        Format      string    `long:"dat-format" description:"DAT output format: xml or cmpro"`
+        Gzip        bool      `long:"dat-gzip" description:"Compress the DAT output with gzip"`
+    } `group:"DAT Output Options"`
+
     Dir2Dat struct {
         Name        string    `long:"name" description:"Name of DAT file" value-name:"STRING"`
         Desc        string    `long:"desc" description:"Description of DAT file" value-name:"STRING"`
     } `group:"Dir2Dat (-d, --dir2dat) Options" namespace:"dat"`
 
     FuzzyMv struct {
-        DryRun      bool      `long:"dry-run" description:"Dry run without moving files"`
         Ratio       int       `long:"ratio" description:"Minimum match ratio (0-100)"`
         Confirm     bool      `long:"confirm" description:"Confirm each rename operation"`
         Match       string    `long:"match" description:"Directory containing file names to fuzzy match" value-name:"PATH"`
         Rename      string    `long:"rename" description:"Directory containing files to rename" value-name:"PATH"`
     } `group:"Fuzzy Rename (-m, --fuzzymv) Options"`
 
+    Trash struct {
+        Restore     string    `long:"restore" description:"Restore the machines in ARGS or every file of the trash RUN" value-name:"RUN"`
+        PurgeDays   int       `long:"purge-days" description:"Permanently delete the trash runs older than DAYS" value-name:"DAYS"`
+        PurgeSize   string    `long:"purge-size" description:"Permanently delete the oldest trash runs until the trash is under SIZE" value-name:"SIZE"`
+    } `group:"Trash (--trash) Options"`
+
+    MergeSets struct {
+        Symlink     bool      `long:"symlink" description:"Link the view files to the store with symbolic links instead of hard links"`
+    } `group:"Merge Sets (--merge-sets) Options"`
+
     GoRomDB struct {
         Dump        bool      `long:"dump" description:"Dump the contents of the database"`
         Scan        bool      `long:"scan" description:"Scan the current directory"`
-        Lookup      string    `long:"lookup" description:"Look up a checksum"`
+        Lookup      string    `long:"lookup" description:"Look up a SHA-1, a CRC32, or a glob on the ROM names"`
+        LookupMachine string  `long:"lookup-machine" description:"Look up the ROMs of the machines matching GLOB" value-name:"GLOB"`
+        Verify      bool      `long:"verify" description:"Hash the files again and report the entries that no longer match"`
+        Sample      int       `long:"sample" description:"Only verify a random sample of N entries" value-name:"N"`
+        Prune       bool      `long:"prune" description:"Remove the entries of files that no longer exist"`
+        Stats       bool      `long:"stats" description:"Display the database statistics"`
+        Export      string    `long:"export" description:"Export the database to FILE in JSON or CSV format" value-name:"FILE"`
+        Import      string    `long:"import" description:"Import the database entries in FILE" value-name:"FILE"`
+        Watch       bool      `long:"watch" description:"Keep the database up to date with the changes in the current directory and the directories in ARGS"`
     } `group:"Database (-G, --goromdb) Options"`
 }
 
@@ -125,18 +175,28 @@ const help string = `[OPTIONS] [ARGS ...]
 GoROM is a utility to manage emulator files. It includes operations to:
   * Check ROM sets versus a DAT file (-c, --chkrom)
   * Fix ROM sets to match a DAT file (-f, --fixrom)
+  * Apply a saved fixrom plan (--apply)
+  * Undo the last fixrom (--undo)
+  * List, restore, or purge the trash (--trash)
   * Check if files match a BitTorrent file (-t, --chktor)
   * List the contents of a BitTorrent file (-l, --lstor)
   * Convert zip files into TorrentZip format (-z, --torzip)
   * Generate a DAT file for a directory (-d, --dir2dat)
   * Filter a DAT file on its data fields (-F, --fltdat)
+  * Compare two versions of a DAT file (-i, --diffdat)
   * Fuzzy rename files to match those in another directory (-m, --fuzzymv)
   * Manage the GoROM database (-G, --goromdb)
+  * Store every unique ROM once in a depot (--depot-add)
+  * Merge ROM sets into one deduplicated collection (--merge-sets)
 
 One and only one operation must be specified on the command line. See below
 for the OPTIONS and ARGS specific to each operation. The Application Options
 section lists OPTIONS used by more than one command.
 
+DAT files can be in either the XML (Logiqx/listxml) or the ClrMamePro text
+format. The format is detected automatically and gzipped DAT files (*.gz) are
+decompressed on the fly.
+
 GoROM uses ANSI color text display by default. If this causes issues on your
 terminal, then you can disable it with the -C,--no-color option.
 
@@ -144,6 +204,15 @@ For operations involving ROM files, GoROM uses a database stored in each
 directory to save the SHA-1 checksums and file modification times to speed up
 subsequent operations. The database file is named .gorom.db.
 
+The --db option uses a single shared database for every directory instead. The
+shared database is in the file given with --db=DBFILE or in gorom/index.db in
+the user cache directory (e.g. ~/.cache/gorom/index.db) by default. It keeps the absolute
+paths of the machines in every directory that was ever scanned into it so
+fixrom finds ROMs in the whole collection without listing the directories with
+--src. Scanning a directory only updates the machines in that directory. The
+entries of directories that no longer exist, like unmounted drives, are kept
+until they are removed with goromdb --prune.
+
 Check ROM (-c, --chkrom
 ------------------------
 Verifies if the ROMs in the current directory match a DAT file. By default,
@@ -152,10 +221,51 @@ optionally be used instead to speed up the process. The drawback is that
 corrupt files of the same name and size are not detected and files with bad
 names cannot be matched.
 
+The --crc-only option is a quick check that uses the CRC32s stored in zip
+files instead of reading the ROMs. It checks the names, sizes, and CRC32s and
+finds ROMs with bad names by CRC32, so it only misses corrupt files whose CRC32
+still matches. ROMs in directories and in 7z, RAR, and tar.gz archives are
+still checked with SHA-1 checksums since libarchive does not return their
+stored CRC32s.
+
 You can specify specific machines to check by specifying them as ARGS after the
 OPTIONS. If no machines are specified, then all machines in the current
 directory are checked.
 
+By default, the ROM set is checked against the machines exactly as they are in
+the DAT file. The --set-type option checks the ROM set as a merged, split, or
+non-merged set instead. The auto set type detects the set type from the files
+in the current directory.
+
+ROM headers are skipped in the checksums using the clrmamepro header
+definition referenced by the DAT file. Header definitions are searched for in
+the directory of the DAT file and its headers subdirectory. The --header-def
+option specifies the header definition instead. The --skip-header option skips
+the NES, Atari 7800, and Atari Lynx headers without a header definition.
+
+ROMs are matched by SHA-1 when the DAT file has it. For DAT files without
+SHA-1, ROMs are matched by size and CRC32 instead. MD5 checksums are only
+calculated with the --md5 option or when the DAT file has MD5s but no SHA-1s.
+
+ROMs with a nodump status in the DAT file were never dumped and are not
+required. ROMs with a baddump status are reported as bad dumps when they match.
+
+Disks in the DAT file are checked against CHD files in a directory with the
+same name as the machine (e.g. machine/disk.chd). The SHA-1 of a CHD is read
+from its header so the disk image is not hashed.
+
+The --report-format option selects the format of the chkrom report. The text
+format is the default and the json format is the same as the --json option.
+The have and miss formats list the names and descriptions of the machines that
+are complete or incomplete. The csv format has a row for each ROM with its DAT
+file data, status, and the name of the file that matched. The html format is a
+summary of the statistics and the machines with errors. The --report-file
+option writes the report to a file instead of the terminal.
+
+The --fixdat option writes a DAT file with only the machines, ROMs, and disks
+that are missing or corrupt. The fix DAT is in the XML format unless the
+--dat-format option is used and it is gzip compressed if its name ends in .gz.
+
 Fix ROM (-f, --fixrom)
 ----------------------
 Fixes the ROMs in the current directory to match a DAT file by renaming files
@@ -164,20 +274,64 @@ directories. This is useful to apply update patches, fix an old or incomplete
 ROM set, or to convert between different types of ROM sets like merged and
 split.
 
-Fixrom always uses SHA-1 checksums to determine the files to use. When started,
-fixrom will scan the ROMs in the current directory and the specified source
-directories and store the checksums into the database.
+Fixrom uses SHA-1 checksums to determine the files to use and falls back to the
+MD5 and CRC32 checksums for DAT files without SHA-1 the same as chkrom. When
+started, fixrom will scan the ROMs in the current directory and the specified
+source directories and store the checksums into the database.
+
+The --quick-scan option only reads the source files with the same size as a
+ROM in the DAT file, which is much faster for large source directories when the
+DAT file only needs a few ROMs. Files in zips also need the CRC32 of a ROM with
+that size in the zip directory. Other files are never hashed and only their
+size and modification time are stored in the database, so they are hashed by a
+later scan that wants them. The option has no effect when ROM headers are
+skipped.
 
 Fixrom will NEVER delete the original files and will instead move them to a
-.trash directory. If you need to restore a ROM set back to its original state,
-then you can simply move the contents of the .trash directory up one directory
-level.
+subdirectory of the .trash directory named by the time of the run. The
+--trash-dir option moves the trash to another directory, which may be on
+another file system. The trash runs are scanned as the last source directories
+so ROMs in machines and extra files trashed by earlier runs are still found.
+Every temp file and move is recorded in a .gorom.journal
+file. If fixrom is interrupted, the next fixrom in the directory rolls back the
+unfinished run first. The --undo operation restores the ROM set to its state
+before the last fixrom by moving the files back from the .trash directory and
+removing the rebuilt machines.
+
+The --in-place option updates a zip machine that keeps some of its ROMs by
+appending the new ROMs and rewriting its directory instead of writing a new
+zip, which is much faster for large machines with small updates. The ROMs that
+are removed from the zip are copied to the trash run. The updated zips are no
+longer TorrentZip. Zips that are hard linked or Zip64 are still rewritten.
+
+Fixrom can convert a ROM set between the merged, split, and non-merged set
+types using the parent/clone information in the DAT file with the --set-type
+option. The auto set type detects and keeps the type of the current ROM set.
 
 Fixrom automatically detects if a machine in a ROM set is stored as a directory
 or a zip file and makes the fixed machine the same. For missing machines,
 fixrom creates a zip file by default but this can be overriden with an option
 to create a directory instead.
 
+Missing or corrupt CHD disks are copied from the source directories into the
+machine directory and disks with bad names are renamed in place.
+
+The --fixdat option writes a DAT file with the ROMs and disks of the machines
+that could not be fixed because they were not found in any source directory.
+
+The --dry-run option shows the plan of ROMs to copy and rename and files to
+move to the trash without changing any files. The --plan-file option writes the
+plan to a JSON file, which the --apply operation runs later in the same or a
+mirrored directory without scanning or checking the DAT file again. Each ROM
+in the plan has its checksum from the DAT file and --apply skips the machines
+whose sources no longer match it. The operations that cannot show their
+changes without making them, like --torzip, --undo, --merge-sets, and
+--depot-add, reject --dry-run.
+
+The --depot option copies the ROMs that are not in any source directory from a
+depot made with --depot-add. Use it with an empty directory and the
+--default-fmt option to rebuild the machines of any DAT file from the depot.
+
 You can specify specific machines to fix by specifying them as ARGS after the
 OPTIONS. If no machines are specified, then all machines in the current
 directory are fixed.
@@ -221,6 +375,22 @@ regular expression syntaxes like PCRE and Perl. Filter options of different
 types are logically AND'ed together. Filter options of the same type are
 logically OR'ed together.
 
+The filtered DAT file has the same format as the original DAT file unless the
+--dat-format option is used. The --dat-format option also selects the format
+of the DAT file generated by dir2dat, which is XML by default. The --dat-gzip
+option compresses the generated DAT file with gzip.
+
+Diff DAT (-i, --diffdat)
+------------------------
+Compares an old DAT file to a new DAT file given in ARGS and lists the machines
+that were added, removed, renamed, or changed along with their ROMs. A machine
+or ROM was renamed if it has a new name with the same checksums as one that is
+gone. Machines are changed if their ROMs, disks, or parents are different.
+
+The --update-dat option writes an update DAT file with only the new, renamed,
+and changed machines. The update DAT has the same format as the new DAT file
+unless the --dat-format option is used.
+
 Fuzzy Rename (-m, --fuzzymv)
 ----------------------------
 Renames the files in one directory to their closest fuzzy matches in another
@@ -235,10 +405,66 @@ best matches based on their scores. You can control the minimum score necessary
 for fuzzymv to consider a match as valid which allows you to control the
 strictness of the fuzzy match.
 
+Depot (--depot-add)
+-------------------
+Adds the ROMs of the machines in the directories or machine files in ARGS to
+a depot. A depot is a content addressed store that keeps every unique ROM once
+as a gzip file named by its SHA-1 (e.g. DEPOT/ab/cd/ef/01/abcdef01....gz) so
+overlapping ROM sets only take the space of their unique ROMs. The gzip header
+has the MD5, CRC32, and size of the ROM in the same format as Romba and
+RomVault so their depots can be used with --depot and they can read ours. The ROMs that are already in
+the depot are skipped using their checksums in the database. CHD disks are not
+added. The fixrom --depot option rebuilds machines from the depot by SHA-1. DAT
+files with only CRC32s or MD5s use the depot as a --src directory instead,
+which is scanned with the checksums from the gzip headers.
+
+Merge Sets (--merge-sets)
+-------------------------
+Merges the ROM sets of several DAT files into one output directory. The ARGS
+are pairs of a DAT file and the directory of its ROM set. Every unique file is
+copied once by its SHA-1 into the .store directory of the output directory and
+each DAT file gets a view directory named after the DAT file with a directory
+for each machine. The files in the views are hard links to the store, or
+symbolic links with the --symlink option, so sets that share data only take
+the space of their unique files. ROMs missing from the directory of a DAT file
+are also found in the other directories. ROM headers are not skipped.
+
+Trash (--trash)
+---------------
+Lists the trash runs of the current directory with their files and sizes. The
+--restore option moves the files of a trash run back to the current directory
+or only the machines given in ARGS. Files that already exist are not replaced.
+The --purge-days option permanently deletes the runs older than a number of
+days and the --purge-size option deletes the oldest runs until the trash is no
+bigger than a size like 500M or 20G. Use --trash-dir if the trash was moved.
+
 GoROM Database (-G, --goromdb)
 ------------------------------
 Provides some utilities for managing and troubleshooting the ROM database of
 SHA-1 checksums and modification times used by the ROM operations.
+
+The --lookup option lists every location of a SHA-1 or a CRC32 checksum. Any
+other value is a glob pattern (e.g. "pacman.6*") on the names of the ROMs. The
+--lookup-machine option lists the ROMs of the machines whose names without the
+file extension match a glob pattern.
+
+The --verify option hashes the files of the database entries again and reports
+the entries whose checksums no longer match or whose files are gone. The
+--sample option verifies a random sample of entries instead of all of them. The
+--prune option removes the entries of files that no longer exist without
+scanning the rest, including every entry of the directories that no longer exist
+in a shared database. The --stats option displays the number of entries, machines,
+and bytes in the database along with the checksums that have more than one
+location.
+
+The --export and --import options write and read the database entries as JSON
+or as CSV if the file name ends in .csv. The cached checksums of imported
+entries are only used for files with the same modification times.
+
+The --watch option scans the current directory and any source directories
+given as arguments and then keeps running to update the database as machines
+are added, changed, renamed, or deleted. Later operations on the directories
+then start without scanning. Watching is only supported on Linux.
 `
 
 const examples string = `Examples:
@@ -253,19 +479,48 @@ const examples string = `Examples:
     gorom --chkrom "datfiles/pS_AllProject_20200531_(cm).dat"
 * Delete all extraneous files in a ROM set
     gorom --chkrom "datfiles/MAME 0.220 ROMs (merged).xml" --json | jq .extras[] | xargs rm
+* Write a list of the incomplete machines to a file
+    gorom --chkrom "datfiles/MAME 0.220 ROMs (merged).xml" --report-format miss --report-file miss.txt
 * Move ROMS with errors to a directory
     gorom --chkrom "datfiles/MAME 0.220 ROMs (merged).xml" --json > result
     jq '.machines[]|select(.status=="errors")|.path' result | xargs -i mv {} errors/
+* Create a DAT file of the missing ROMs in a ROM set
+    gorom --chkrom "datfiles/MAME 0.220 ROMs (merged).xml" --fixdat "fix_MAME 0.220.xml"
 * Update an existing ROM set with an update set
     gorom --fixrom "../MAME 0.221 ROMs (merged).xml" --src "../MAME - Update ROMs (v0.220 to v0.221)"
+* Review the changes of an update and apply them later
+    gorom --fixrom "../MAME 0.221 ROMs (merged).xml" --src ../update --dry-run --plan-file update.json
+    gorom --apply update.json
+* Update the zips of a large ROM set in place
+    gorom --fixrom "../MAME 0.221 ROMs (merged).xml" --src ../update --in-place
+* Undo the last update of a ROM set
+    gorom --undo
+* Restore a machine from the trash and purge trash older than 30 days
+    gorom --trash --restore 20200524-193012 pacman
+    gorom --trash --purge-days 30
 * Create a split ROM set from a merged set
     gorom --fixrom "../MAME 0.220 ROMs (split).xml" --src "datfiles/MAME 0.220 ROMs (merged)"
+* Create a non-merged ROM set from a merged set
+    gorom --fixrom "../MAME 0.220 ROMs.xml" --set-type non-merged --src "datfiles/MAME 0.220 ROMs (merged)"
 * Create a 1G1R ROM set
     gorom --fixrom "../Atari - 2600 1G1R.dat" --src "../Atari - 2600 Roms"
+* Fix a ROM set from any collection in the shared database
+    gorom --fixrom "../MAME 0.221 ROMs (merged).xml" --db
 * Update multimedia files
     gorom --fixrom "pS_MAME_AllProject_20200531_(cm).dat" --src "../MAME - Update EXTRAs (v0.220 to v0.221)"
 * Filter a DAT with only 1980's Pac-Man games
     gorom --fltdat "../datfiles/MAME 0.221 ROMs (merged).xml" --year '198[0-9]' --desc '(?i)pac[- ]man' > pacman.dat
+* List the changes between two MAME releases and write an update DAT
+    gorom --diffdat "MAME 0.220 ROMs (merged).xml" "MAME 0.221 ROMs (merged).xml" --update-dat update.xml
+* Add ROM sets to a depot and rebuild a set from it as 7z files
+    gorom --depot-add /depot "MAME 0.220 ROMs (merged)" "Atari - 2600 Roms"
+    gorom --fixrom "../MAME 0.220 ROMs (split).xml" --depot /depot --default-fmt 7z
+* Merge arcade and console ROM sets into one deduplicated collection
+    gorom --merge-sets /roms "MAME 0.220 ROMs (merged).xml" mame "Atari - 2600.dat" atari2600
+* Check a random sample of 1000 database entries against the files
+    gorom --goromdb --verify --sample 1000
+* Keep the shared database up to date with a ROM set and its source directory
+    gorom --goromdb --watch --db "../MAME - Update ROMs (v0.220 to v0.221)"
 * Make snapshot file names exactly match rom file names
     gorom --fuzzymv --match roms/ --rename snaps/
 * Convert Zips to TorrentZip
@@ -276,6 +531,109 @@ const examples string = `Examples:
     gorom --lstor "torrents/MAME 0.220 ROMs (split).torrent"
 `
 
+// headerSkipper returns the header skipper from the --header-def option or
+// else the header definition referenced by the DAT file.  The default header
+// skipper is used with the --skip-header option if there is no definition.
+func headerSkipper(datFile string) (*romio.HeaderSkipper, error) {
+    if options.App.HeaderDef != "" {
+        return romio.LoadHeaderSkipper(filepath.ToSlash(options.App.HeaderDef))
+    }
+
+    if datFile != "" {
+        header, err := dat.ReadHeader(datFile)
+        if err != nil {
+            return nil, err
+        }
+        if header != nil && header.ClrMamePro.HeaderDef != "" {
+            headerDef := header.ClrMamePro.HeaderDef
+            if defPath, ok := dat.FindHeaderDef(datFile, headerDef); ok {
+                return romio.LoadHeaderSkipper(defPath)
+            }
+            log.Printf("header definition %s not found: use --header-def to specify it", headerDef)
+        }
+    }
+
+    if options.App.SkipHeader {
+        return romio.DefaultSkipper, nil
+    }
+    return nil, nil
+}
+
+// openRomDB opens the ROM database in a directory with the application
+// options.  The --db option uses the shared database for every directory.
+func openRomDB(dir string, skipper *romio.HeaderSkipper) (*romdb.RomDB, error) {
+    var rdb *romdb.RomDB
+    var err error
+    if options.App.Db != "" {
+        rdb, err = romdb.OpenSharedRomDB(options.App.Db, dir, skipper)
+    } else {
+        rdb, err = romdb.OpenRomDB(dir, skipper)
+    }
+    if err != nil {
+        return nil, err
+    }
+    if options.App.Md5 || md5Dat {
+        rdb.EnableMd5()
+    }
+    return rdb, nil
+}
+
+// md5Dat is set for DAT files with MD5s but no SHA-1s so the MD5 checksums are
+// calculated without the --md5 option
+var md5Dat bool
+
+// checkMd5Dat sets md5Dat for a DAT file before its ROM databases are opened
+func checkMd5Dat(datFile string) error {
+    var err error
+    md5Dat = false
+    if !options.App.Md5 {
+        md5Dat, err = dat.HasMd5Only(datFile)
+    }
+    return err
+}
+
+// newDatWriter returns a DAT writer to the terminal with the DAT output
+// options.  The format defaults to defFormat if it is not specified.
+func newDatWriter(defFormat int) (*dat.Writer, error) {
+    format, err := dat.ParseDatFormat(options.DatOut.Format)
+    if err != nil {
+        return nil, err
+    }
+    if format == dat.DatInvalid {
+        format = defFormat
+    }
+    return dat.NewWriter(term.Writer(), format, options.DatOut.Gzip), nil
+}
+
+// createDatFile creates a DAT file with the DAT output options.  The format
+// defaults to defFormat if it is not specified.
+func createDatFile(datFile string, defFormat int) (*dat.Writer, error) {
+    format, err := dat.ParseDatFormat(options.DatOut.Format)
+    if err != nil {
+        return nil, err
+    }
+    if format == dat.DatInvalid {
+        format = defFormat
+    }
+    return dat.CreateDatFile(datFile, format)
+}
+
+// dryRunSupported returns false for the operations that change files without
+// a way to only show the changes
+func dryRunSupported() bool {
+    ops := &options.Operations
+    db := &options.GoRomDB
+    switch {
+    case ops.TorZip, ops.Undo, ops.MergeSets != "", ops.DepotAdd != "":
+        return false
+    case ops.DiffDat != "" && options.DiffDat.UpdateDat != "":
+        return false
+    case ops.GoRomDB && (db.Prune || db.Import != ""):
+        return false
+    }
+    return true
+}
+
 func usage(message string) {
     log.Println(message)
     fmt.Fprintf(os.Stderr, "Try '%s --help' for more information.\n", os.Args[0])
@@ -318,6 +676,9 @@ func main() {
     if opCount > 1 {
         usage("Only one operation allowed at a time")
     }
+    if options.App.DryRun && !dryRunSupported() {
+        usage("The --dry-run option is not supported by this operation")
+    }
 
     if options.App.NoColor {
         term.IsTerminal = false
@@ -330,8 +691,23 @@ func main() {
     term.Init()
     term.CursorHide()
 
+    options.App.SetTypeId, err = dat.ParseSetType(options.App.SetType)
+    if err != nil {
+        usage(err.Error())
+    }
+
+    if options.App.Db == "default" {
+        options.App.Db, err = romdb.DefaultDbFile()
+        if err != nil {
+            log.Fatal(err)
+        }
+    }
+
     ok := true
     if options.Operations.ChkRom != "" {
+        if options.ChkRom.SizeOnly && options.ChkRom.CrcOnly {
+            usage("Only one of --size-only and --crc-only allowed")
+        }
         datFile := filepath.ToSlash(options.Operations.ChkRom)
         ok, err = chkrom(datFile, args[:])
     }
@@ -374,6 +750,14 @@ func main() {
         datFile := filepath.ToSlash(options.Operations.FltDat)
         err = fltdat(datFile)
     }
+    if options.Operations.DiffDat != "" {
+        if len(args) != 1 {
+            usage("Diff DAT requires the new DAT file in ARGS")
+        }
+        oldDat := filepath.ToSlash(options.Operations.DiffDat)
+        newDat := filepath.ToSlash(args[0])
+        err = diffdat(oldDat, newDat)
+    }
     if options.Operations.FuzzyMv {
         if options.FuzzyMv.Match == "" || options.FuzzyMv.Rename == "" {
             usage("Fuzzy rename requires both --match and --rename options")
@@ -383,7 +767,31 @@ func main() {
         err = fuzzymv(matchDir, renameDir)
     }
     if options.Operations.GoRomDB {
-        err = goromdb()
+        err = goromdb(args[:])
+    }
+    if options.Operations.Apply != "" {
+        planFile := filepath.ToSlash(options.Operations.Apply)
+        err = applyPlanFile(planFile)
+    }
+    if options.Operations.Undo {
+        ok, err = undo()
+    }
+    if options.Operations.Trash {
+        ok, err = trash(util.ToSlash(args))
+    }
+    if options.Operations.MergeSets != "" {
+        if len(args) == 0 || len(args) % 2 != 0 {
+            usage("Merge sets requires pairs of a DAT file and a ROM directory in ARGS")
+        }
+        outDir := filepath.ToSlash(options.Operations.MergeSets)
+        ok, err = mergeSets(outDir, util.ToSlash(args))
+    }
+    if options.Operations.DepotAdd != "" {
+        if len(args) == 0 {
+            usage("Depot add requires the directories or machines in ARGS")
+        }
+        depotDir := filepath.ToSlash(options.Operations.DepotAdd)
+        err = depotAdd(depotDir, util.ToSlash(args))
     }
     if options.Operations.Version {
         term.Printf("GoROM Version %s built on %s\n", Version, Build)
@@ -0,0 +1,312 @@
+//  GoRom - Emulator ROM Management Utilities
+//  Copyright (C) 2020 Scott Shumate <scott@shumatech.com>
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package main
+
+import (
+    "encoding/hex"
+    "fmt"
+    "os"
+    "path"
+    "path/filepath"
+    "strings"
+
+    "gorom"
+    "gorom/checksum"
+    "gorom/dat"
+    "gorom/romdb"
+    "gorom/romio"
+    "gorom/term"
+    "gorom/util"
+)
+
+///////////////////////////////////////////////////////////////////////////////
+// Merge Sets
+//
+// Merges the ROM sets of several DAT files into one output directory.  Every
+// unique file is copied once into a store named by its SHA-1 and each DAT file
+// gets a view directory of machine directories whose files are hard links or
+// symbolic links to the store.
+///////////////////////////////////////////////////////////////////////////////
+
+const StoreDir = ".store"
+
+type MergeStats struct {
+    Machines   int
+    Incomplete int
+    Linked     int
+    Stored     int
+    Missing    int
+}
+
+type MergeSet struct {
+    datFile string
+    rdb *romdb.RomDB
+}
+
+type StoreRom struct {
+    storeName string
+    srcName string
+}
+
+// storeName returns the name of the file of a SHA-1 in the store
+func storeName(sum checksum.Sha1) string {
+    name := hex.EncodeToString(sum[:])
+    return path.Join(name[0:2], name)
+}
+
+// viewName returns the name of the view directory of a DAT file
+func viewName(datFile string) string {
+    name := path.Base(datFile)
+    name = strings.TrimSuffix(name, ".gz")
+    return strings.TrimSuffix(name, path.Ext(name))
+}
+
+// storeRoms copies the files of a source machine into the store.  The files
+// are written to a temp directory first and then renamed so the store never
+// has partial files.
+func storeRoms(storePath string, srcPath string, roms []StoreRom) error {
+    reader, err := romio.OpenRomReader(srcPath)
+    if err != nil {
+        return err
+    }
+    if reader == nil {
+        return fmt.Errorf("unable to open reader")
+    }
+    defer reader.Close()
+
+    writer, err := romio.CreateRomWriterTemp(storePath, gorom.FormatDir)
+    if err != nil {
+        return err
+    }
+    defer os.RemoveAll(writer.Path())
+
+    for _, rom := range roms {
+        err = writer.Create(rom.storeName)
+        if err != nil {
+            return err
+        }
+    }
+    for index := writer.First(); index >= 0; index = writer.Next() {
+        rom := roms[index]
+        err = romio.CopyRom(writer, rom.storeName, reader, rom.srcName)
+        if err != nil {
+            return fmt.Errorf("copy %s: %s", rom.srcName, err)
+        }
+    }
+    err = writer.Close()
+    if err != nil {
+        return err
+    }
+
+    for _, rom := range roms {
+        dstPath := path.Join(storePath, rom.storeName)
+        err = os.MkdirAll(path.Dir(dstPath), 0755)
+        if err != nil {
+            return err
+        }
+        err = os.Rename(path.Join(writer.Path(), rom.storeName), dstPath)
+        if err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// linkRom links a file in a view to the store.  An existing file that is not
+// already the store file is replaced.
+func linkRom(viewPath string, storeFile string) error {
+    info, err := os.Lstat(viewPath)
+    if err == nil {
+        storeInfo, err := os.Stat(storeFile)
+        if err != nil {
+            return err
+        }
+        if options.MergeSets.Symlink && info.Mode() & os.ModeSymlink != 0 {
+            info, err = os.Stat(viewPath)
+        }
+        if err == nil && os.SameFile(info, storeInfo) {
+            return nil
+        }
+        err = os.Remove(viewPath)
+        if err != nil {
+            return err
+        }
+    }
+
+    err = os.MkdirAll(path.Dir(viewPath), 0755)
+    if err != nil {
+        return err
+    }
+    if options.MergeSets.Symlink {
+        target, err := filepath.Rel(filepath.FromSlash(path.Dir(viewPath)), filepath.FromSlash(storeFile))
+        if err != nil {
+            return err
+        }
+        return os.Symlink(target, viewPath)
+    }
+    return os.Link(storeFile, viewPath)
+}
+
+// mergeSet adds the machines of a DAT file to the store and links them in its
+// view.  The directory of the DAT file is searched first for each ROM and
+// then the directories of the other DAT files.
+func mergeSet(outDir string, set MergeSet, romDBs []*romdb.RomDB, stats *MergeStats) error {
+    storePath := path.Join(outDir, StoreDir)
+    viewPath := path.Join(outDir, viewName(set.datFile))
+
+    sources := []*romdb.RomDB{ set.rdb }
+    for _, rdb := range romDBs {
+        if rdb != set.rdb {
+            sources = append(sources, rdb)
+        }
+    }
+
+    return dat.ParseDatFileSetType(set.datFile, nil, options.App.SetTypeId, printHeader, printSetType, func(machine *dat.Machine) error {
+        stats.Machines++
+
+        // Find the files that are not in the store yet grouped by the
+        // machine they are copied from
+        links := map[string]string{}
+        copies := map[string][]StoreRom{}
+        copied := util.NewStringSet()
+        missing := []string{}
+        for i, roms := range [][]*dat.Rom{ machine.Roms, machine.Disks } {
+            for _, rom := range roms {
+                if rom.DumpStatus == dat.DumpNoDump {
+                    continue
+                }
+                name := rom.Name
+                if i == 1 {
+                    name = dat.DiskFile(rom)
+                }
+
+                if rom.Sha1 != (checksum.Sha1{}) {
+                    storeFile := path.Join(storePath, storeName(rom.Sha1))
+                    if _, err := os.Stat(storeFile); err == nil {
+                        links[name] = storeFile
+                        continue
+                    }
+                }
+
+                entry, rdb, err := findRom(rom, sources)
+                if err != nil {
+                    return err
+                }
+                if entry == nil {
+                    missing = append(missing, name)
+                    continue
+                }
+
+                romStoreName := storeName(entry.Sum)
+                storeFile := path.Join(storePath, romStoreName)
+                links[name] = storeFile
+                if _, err := os.Stat(storeFile); err == nil || copied.IsSet(romStoreName) {
+                    continue
+                }
+                copied.Set(romStoreName)
+                srcPath := rdb.Path(entry)
+                copies[srcPath] = append(copies[srcPath], StoreRom{ romStoreName, entry.RomPath })
+            }
+        }
+
+        for srcPath, roms := range copies {
+            err := storeRoms(storePath, srcPath, roms)
+            if err != nil {
+                return fmt.Errorf("%s: %s", srcPath, err)
+            }
+            stats.Stored += len(roms)
+        }
+
+        for name, storeFile := range links {
+            err := linkRom(path.Join(viewPath, machine.Name, name), storeFile)
+            if err != nil {
+                return err
+            }
+            stats.Linked++
+        }
+
+        if len(missing) > 0 {
+            stats.Incomplete++
+            stats.Missing += len(missing)
+            term.Printf("%s : %s\n", machine.Name, term.Red("INCOMPLETE"))
+            for _, name := range missing {
+                term.Printf("  %s : %s\n", name, term.Red("NOT FOUND"))
+            }
+        } else if !options.App.NoOk {
+            term.Printf("%s : %s\n", machine.Name, term.Green("OK"))
+        }
+        return nil
+    })
+}
+
+// mergeSets merges the ROM sets of the DAT file and directory pairs in args
+// into the output directory
+func mergeSets(outDir string, args []string) (bool, error) {
+    // Headers are not skipped since the store has the whole files
+    sets := []MergeSet{}
+    romDBs := []*romdb.RomDB{}
+    for i := 0; i < len(args); i += 2 {
+        dir := args[i + 1]
+        term.Printf("Scanning directory %s\n", dir)
+
+        rdb, err := openRomDB(dir, nil)
+        if err != nil {
+            return false, err
+        }
+        defer rdb.Close()
+
+        goLimit := 0
+        if options.App.NoGo {
+            goLimit = 1
+        }
+        err = rdb.Scan(goLimit, nil, func(machPath string, err error) {
+            if err != nil {
+                util.Progressf(term.Red("%s: %s\n", machPath, err))
+            } else {
+                util.Progressf("%s", machPath)
+            }
+        })
+        if err != nil {
+            return false, err
+        }
+        util.Progressf("")
+
+        sets = append(sets, MergeSet{ args[i], rdb })
+        romDBs = append(romDBs, rdb)
+    }
+
+    err := os.MkdirAll(path.Join(outDir, StoreDir), 0755)
+    if err != nil {
+        return false, err
+    }
+
+    var stats MergeStats
+    for _, set := range sets {
+        err = mergeSet(outDir, set, romDBs, &stats)
+        if err != nil {
+            return false, err
+        }
+    }
+
+    term.Println("\nMerge Stats")
+    term.Printf("  Machines   : %d\n", stats.Machines)
+    term.Printf("  Incomplete : %d\n", stats.Incomplete)
+    term.Printf("  Linked     : %d\n", stats.Linked)
+    term.Printf("  Stored     : %d\n", stats.Stored)
+    term.Printf("  Missing    : %d\n", stats.Missing)
+
+    return stats.Incomplete == 0, nil
+}
@@ -0,0 +1,91 @@
+//  GoRom - Emulator ROM Management Utilities
+//  Copyright (C) 2020 Scott Shumate <scott@shumatech.com>
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package main
+
+import (
+    "testing"
+    "io/ioutil"
+    "os"
+    "path"
+    "path/filepath"
+    "gorom/term"
+    "gorom/test"
+)
+
+// printMergeTree prints the files in the views with the store files they are
+// linked to
+func printMergeTree(outDir string) error {
+    storeFiles := []os.FileInfo{}
+    storeNames := []string{}
+    err := filepath.Walk(path.Join(outDir, StoreDir), func(filePath string, info os.FileInfo, err error) error {
+        if err == nil && info.Mode().IsRegular() {
+            storeFiles = append(storeFiles, info)
+            storeNames = append(storeNames, path.Base(filePath))
+        }
+        return err
+    })
+    if err != nil {
+        return err
+    }
+    term.Printf("Store files : %d\n", len(storeFiles))
+
+    return filepath.Walk(outDir, func(filePath string, info os.FileInfo, err error) error {
+        if err != nil || !info.Mode().IsRegular() {
+            return err
+        }
+        rel, err := filepath.Rel(outDir, filePath)
+        if err != nil || path.Dir(path.Dir(rel)) == StoreDir {
+            return err
+        }
+        link := "NOT LINKED"
+        for i, storeInfo := range storeFiles {
+            if os.SameFile(info, storeInfo) {
+                link = storeNames[i]
+            }
+        }
+        term.Printf("%s -> %s\n", filepath.ToSlash(rel), link)
+        return nil
+    })
+}
+
+func TestMergeSets(t *testing.T) {
+    outDir, err := ioutil.TempDir("", "merge")
+    if err != nil {
+        test.Fail(t, err)
+    }
+    defer os.RemoveAll(outDir)
+
+    test.RunDiffTest(t, "roms", "mergesets/merge.out", func() error {
+        defer os.Remove("zip/.gorom.db")
+        defer os.Remove("dir/.gorom.db")
+        defer os.Remove("chd/.gorom.db")
+
+        options = Options{}
+        args := []string{ "../dats/zip.dat", "zip", "../dats/dir.dat", "dir", "../dats/chd.dat", "chd" }
+
+        // The second merge only links the files already in the store
+        for i := 0; i < 2; i++ {
+            ok, err := mergeSets(outDir, args)
+            if err != nil {
+                return err
+            }
+            if ok {
+                test.Fail(t, "missing disk not reported")
+            }
+        }
+        return printMergeTree(outDir)
+    })
+}
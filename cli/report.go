@@ -0,0 +1,370 @@
+//  GoRom - Emulator ROM Management Utilities
+//  Copyright (C) 2020 Scott Shumate <scott@shumatech.com>
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package main
+
+import (
+    "encoding/csv"
+    "encoding/hex"
+    "fmt"
+    "html/template"
+    "io"
+    "strconv"
+    "strings"
+
+    "gorom/dat"
+)
+
+// newLogger returns the chkrom logger for the --report-format option that
+// writes to wr.  Only the text format uses color.
+func newLogger(wr io.Writer, color bool) (Logger, error) {
+    format := strings.ToLower(options.ChkRom.ReportFormat)
+    if options.ChkRom.JsonOut {
+        format = "json"
+    }
+
+    switch format {
+    case "", "text":
+        return NewStdLogger(wr, color), nil
+    case "json":
+        return NewJsonLogger(wr), nil
+    case "have":
+        return NewListLogger(wr, true), nil
+    case "miss":
+        return NewListLogger(wr, false), nil
+    case "csv":
+        return NewCsvLogger(wr), nil
+    case "html":
+        return NewHtmlLogger(wr), nil
+    }
+    return nil, fmt.Errorf("invalid report format '%s'", options.ChkRom.ReportFormat)
+}
+
+// machineHave returns true if all the ROMs of a machine are present even if
+// some have bad names or there are extras
+func machineHave(status int) bool {
+    return status & (MachMissing | MachCorrupt | MachRomCorrupt | MachRomMissing) == 0
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// Have/Miss List Logger
+//
+// The have and miss lists are the machine names and descriptions of the
+// machines that are complete or incomplete the same as the clrmamepro lists.
+///////////////////////////////////////////////////////////////////////////////
+
+type ListLogger struct {
+    wr io.Writer
+    have bool
+}
+
+func NewListLogger(wr io.Writer, have bool) *ListLogger {
+    return &ListLogger{ wr: wr, have: have }
+}
+
+func (log *ListLogger) header(name string) {
+}
+
+func (log *ListLogger) setType(name string) {
+}
+
+func (log *ListLogger) machine(machine *dat.Machine, status int, info ...string) {
+    if machineHave(status) != log.have {
+        return
+    }
+    if machine.Description != "" {
+        fmt.Fprintf(log.wr, "%s\t%s\n", machine.Name, machine.Description)
+    } else {
+        fmt.Fprintf(log.wr, "%s\n", machine.Name)
+    }
+}
+
+func (log *ListLogger) extra(path string) {
+}
+
+func (log *ListLogger) rom(rom *dat.Rom, status int, info ...string) {
+}
+
+func (log *ListLogger) machineChkromStats(machChkromStats *ChkromStats, machRomChkromStats *ChkromStats) {
+}
+
+func (log *ListLogger) romChkromStats(romChkromStats *ChkromStats) {
+}
+
+func (log *ListLogger) close() error {
+    return nil
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// CSV Logger
+//
+// The CSV report has a row for each ROM with the DAT file data, the status,
+// and the actual name of the file that matched.  The ROMs of missing and
+// corrupt machines are all reported with the machine status.  ROMs that were
+// never dumped are always reported as nodump.
+///////////////////////////////////////////////////////////////////////////////
+
+var csvColumns = []string{ "machine", "rom", "size", "crc", "sha1", "status", "actual" }
+
+type CsvLogger struct {
+    wr *csv.Writer
+    machLast string
+}
+
+func NewCsvLogger(wr io.Writer) *CsvLogger {
+    log := &CsvLogger{ wr: csv.NewWriter(wr) }
+    log.wr.Write(csvColumns)
+    return log
+}
+
+func csvChecksum(sum []byte) string {
+    for _, b := range sum {
+        if b != 0 {
+            return hex.EncodeToString(sum)
+        }
+    }
+    return ""
+}
+
+func (log *CsvLogger) write(rom *dat.Rom, status string, actual string) {
+    size := ""
+    if rom.Size > 0 {
+        size = strconv.FormatInt(rom.Size, 10)
+    }
+    log.wr.Write([]string{ log.machLast, rom.Name, size, csvChecksum(rom.Crc[:]),
+                           csvChecksum(rom.Sha1[:]), status, actual })
+}
+
+func (log *CsvLogger) header(name string) {
+}
+
+func (log *CsvLogger) setType(name string) {
+}
+
+func (log *CsvLogger) machine(machine *dat.Machine, status int, info ...string) {
+    log.machLast = machine.Name
+    roms := chkromRoms(machine)
+    if status != MachMissing && status != MachCorrupt && !(status == MachOk && noDump(roms)) {
+        return
+    }
+    for _, rom := range roms {
+        if rom.DumpStatus == dat.DumpNoDump {
+            log.write(rom, romStatusName(dat.RomNoDump), "")
+        } else {
+            log.write(rom, machStatusName(status), "")
+        }
+    }
+}
+
+func (log *CsvLogger) extra(path string) {
+    log.wr.Write([]string{ "", "", "", "", "", romStatusName(dat.RomUnknown), path })
+}
+
+func (log *CsvLogger) rom(rom *dat.Rom, status int, info ...string) {
+    switch status {
+    case dat.RomUnknown:
+        log.wr.Write([]string{ log.machLast, "", "", "", "", romStatusName(status), rom.Name })
+    case dat.RomBadName:
+        log.write(rom, romStatusName(status), info[0])
+    case dat.RomMissing, dat.RomNoDump:
+        log.write(rom, romStatusName(status), "")
+    default:
+        log.write(rom, romStatusName(status), rom.Name)
+    }
+}
+
+func (log *CsvLogger) machineChkromStats(machChkromStats *ChkromStats, machRomChkromStats *ChkromStats) {
+}
+
+func (log *CsvLogger) romChkromStats(romChkromStats *ChkromStats) {
+}
+
+func (log *CsvLogger) close() error {
+    log.wr.Flush()
+    return log.wr.Error()
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// HTML Logger
+//
+// The HTML summary has the statistics and a table of the machines that are
+// not OK with their problem ROMs.  It is written all at once when closed.
+///////////////////////////////////////////////////////////////////////////////
+
+const htmlReport = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Name}}</title>
+</head>
+<body>
+<h1>{{.Name}}</h1>
+{{- if .SetType}}
+<p>Set type: {{.SetType}}</p>
+{{- end}}
+{{- range .Stats}}
+<h2>{{.Title}}</h2>
+<table>
+{{- range .Rows}}
+<tr><td>{{.Label}}</td><td>{{.Count}}</td><td>{{.Percent}}</td></tr>
+{{- end}}
+</table>
+{{- end}}
+{{- if .Machines}}
+<h2>Machines</h2>
+<table>
+<tr><th>Machine</th><th>Description</th><th>Status</th><th>ROMs</th></tr>
+{{- range .Machines}}
+<tr><td>{{.Name}}</td><td>{{.Description}}</td><td>{{.Status}}</td><td>
+{{- range $i, $rom := .Roms}}{{if $i}}<br>{{end}}{{$rom.Name}} : {{$rom.Status}}{{end -}}
+</td></tr>
+{{- end}}
+</table>
+{{- end}}
+{{- if .Extras}}
+<h2>Extra Files</h2>
+<ul>
+{{- range .Extras}}
+<li>{{.}}</li>
+{{- end}}
+</ul>
+{{- end}}
+</body>
+</html>
+`
+
+var htmlTemplate = template.Must(template.New("report").Parse(htmlReport))
+
+type HtmlRom struct {
+    Name string
+    Status string
+}
+
+type HtmlMachine struct {
+    Name string
+    Description string
+    Status string
+    Roms []HtmlRom
+}
+
+type HtmlStatRow struct {
+    Label string
+    Count int
+    Percent string
+}
+
+type HtmlStats struct {
+    Title string
+    Rows []HtmlStatRow
+}
+
+type HtmlSchema struct {
+    Name string
+    SetType string
+    Stats []HtmlStats
+    Machines []*HtmlMachine
+    Extras []string
+}
+
+type HtmlLogger struct {
+    wr io.Writer
+    value HtmlSchema
+    machLast *HtmlMachine
+}
+
+func NewHtmlLogger(wr io.Writer) *HtmlLogger {
+    return &HtmlLogger{ wr: wr }
+}
+
+func htmlStatRow(label string, count int, total int) HtmlStatRow {
+    row := HtmlStatRow{ Label: label, Count: count }
+    if total > 0 {
+        row.Percent = fmt.Sprintf("%.1f%%", 100.0 * float32(count) / float32(total))
+    }
+    return row
+}
+
+func (log *HtmlLogger) header(name string) {
+    log.value.Name = name
+}
+
+func (log *HtmlLogger) setType(name string) {
+    log.value.SetType = name
+}
+
+func (log *HtmlLogger) machine(machine *dat.Machine, status int, info ...string) {
+    if status == MachOk {
+        log.machLast = nil
+        return
+    }
+    log.machLast = &HtmlMachine{ Name: machine.Name, Description: machine.Description,
+                                 Status: machStatusName(status) }
+    if len(info) > 0 {
+        log.machLast.Status += " (" + info[0] + ")"
+    }
+    log.value.Machines = append(log.value.Machines, log.machLast)
+}
+
+func (log *HtmlLogger) extra(path string) {
+    log.value.Extras = append(log.value.Extras, path)
+}
+
+func (log *HtmlLogger) rom(rom *dat.Rom, status int, info ...string) {
+    if log.machLast == nil || dat.StatusOk(status) {
+        return
+    }
+    str := romStatusName(status)
+    if len(info) > 0 {
+        str += " (" + info[0] + ")"
+    }
+    log.machLast.Roms = append(log.machLast.Roms, HtmlRom{ Name: rom.Name, Status: str })
+}
+
+func (log *HtmlLogger) machineChkromStats(machChkromStats *ChkromStats, machRomChkromStats *ChkromStats) {
+    total := machChkromStats.Total
+    log.value.Stats = append(log.value.Stats, HtmlStats{ Title: "Machine Stats", Rows: []HtmlStatRow{
+        htmlStatRow("All OK", machChkromStats.Ok, total),
+        htmlStatRow("ROMs Corrupt", machRomChkromStats.Corrupt, total),
+        htmlStatRow("ROMs Bad Name", machRomChkromStats.BadName, total),
+        htmlStatRow("ROMs Missing", machRomChkromStats.Missing, total),
+        htmlStatRow("ROMs Extra", machRomChkromStats.Extra, total),
+        htmlStatRow("Machine Missing", machChkromStats.Missing, total),
+        htmlStatRow("Machine Corrupt", machChkromStats.Corrupt, total),
+        htmlStatRow("Total Machines", total, 0),
+        htmlStatRow("Extra Files", machChkromStats.Extra, 0),
+    }})
+}
+
+func (log *HtmlLogger) romChkromStats(romChkromStats *ChkromStats) {
+    total := romChkromStats.Total
+    rows := []HtmlStatRow{
+        htmlStatRow("OK", romChkromStats.Ok, total),
+        htmlStatRow("Corrupt", romChkromStats.Corrupt, total),
+        htmlStatRow("Bad Name", romChkromStats.BadName, total),
+        htmlStatRow("Missing", romChkromStats.Missing, total),
+    }
+    if romChkromStats.NoDump > 0 {
+        rows = append(rows, htmlStatRow("No Dump", romChkromStats.NoDump, total))
+    }
+    if romChkromStats.BadDump > 0 {
+        rows = append(rows, htmlStatRow("Bad Dump", romChkromStats.BadDump, total))
+    }
+    rows = append(rows, htmlStatRow("Total", total, 0), htmlStatRow("Extra", romChkromStats.Extra, 0))
+    log.value.Stats = append(log.value.Stats, HtmlStats{ Title: "ROM Stats", Rows: rows })
+}
+
+func (log *HtmlLogger) close() error {
+    return htmlTemplate.Execute(log.wr, &log.value)
+}
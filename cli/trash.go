@@ -0,0 +1,327 @@
+//  GoRom - Emulator ROM Management Utilities
+//  Copyright (C) 2020 Scott Shumate <scott@shumatech.com>
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package main
+
+import (
+    "fmt"
+    "io/ioutil"
+    "os"
+    "path"
+    "path/filepath"
+    "strings"
+    "time"
+
+    "gorom/romdb"
+    "gorom/romio"
+    "gorom/term"
+    "gorom/util"
+)
+
+///////////////////////////////////////////////////////////////////////////////
+// Trash
+//
+// Every fixrom run moves the files that it replaces into its own subdirectory
+// of the trash named by the time of the run, so runs that trash the same
+// machine do not collide.  The trash is the .trash directory of the ROM set
+// unless --trash-dir moves it to another directory, which may be on another
+// file system.  The runs are the last sources of fixrom so ROMs trashed by an
+// earlier run are never lost.
+///////////////////////////////////////////////////////////////////////////////
+
+const (
+    TrashDir = ".trash"
+    TrashRunFormat = "20060102-150405"
+)
+
+type TrashRun struct {
+    Name  string
+    Time  time.Time
+    Files []string
+    Count int
+    Size  int64
+}
+
+// trashRoot returns the directory of the trash runs
+func trashRoot() string {
+    if options.App.TrashDir != "" {
+        return filepath.ToSlash(options.App.TrashDir)
+    }
+    return TrashDir
+}
+
+// newTrashRun returns the directory for the trash of a new run.  The
+// directory is not created until something is trashed.
+func newTrashRun() string {
+    name := time.Now().Format(TrashRunFormat)
+    runDir := path.Join(trashRoot(), name)
+    for i := 2; ; i++ {
+        _, err := os.Stat(runDir)
+        if os.IsNotExist(err) {
+            return runDir
+        }
+        runDir = path.Join(trashRoot(), fmt.Sprintf("%s-%d", name, i))
+    }
+}
+
+// trashFile moves a file or machine into the trash run directory
+func trashFile(filePath string, trashDir string, journal *Journal) error {
+    trashPath := path.Join(trashDir, filePath)
+    err := os.MkdirAll(path.Dir(trashPath), 0755)
+    if err != nil {
+        return err
+    }
+    return journal.trash(filePath, trashPath)
+}
+
+// parseTrashRun returns the time of a trash run from its name
+func parseTrashRun(name string) (time.Time, bool) {
+    if len(name) < len(TrashRunFormat) {
+        return time.Time{}, false
+    }
+    runTime, err := time.ParseInLocation(TrashRunFormat, name[:len(TrashRunFormat)], time.Local)
+    return runTime, err == nil
+}
+
+// trashRunDirs returns the directories of the runs in the trash from newest
+// to oldest
+func trashRunDirs() ([]string, error) {
+    runDirs := []string{}
+    err := util.ScanDir(trashRoot(), true, func(file os.FileInfo) error {
+        if _, ok := parseTrashRun(file.Name()); file.IsDir() && ok {
+            runDirs = append([]string{ path.Join(trashRoot(), file.Name()) }, runDirs...)
+        }
+        return nil
+    })
+    if os.IsNotExist(err) {
+        return runDirs, nil
+    }
+    return runDirs, err
+}
+
+// inTrash returns true if an absolute path is in the trash
+func inTrash(filePath string) bool {
+    root, err := filepath.Abs(trashRoot())
+    if err != nil {
+        return false
+    }
+    return strings.HasPrefix(filePath, filepath.ToSlash(root) + "/")
+}
+
+// trashRuns returns the runs in the trash from oldest to newest.  Other files
+// in the trash are ignored.
+func trashRuns() ([]*TrashRun, error) {
+    runs := []*TrashRun{}
+    err := util.ScanDir(trashRoot(), true, func(file os.FileInfo) error {
+        runTime, ok := parseTrashRun(file.Name())
+        if !file.IsDir() || !ok {
+            return nil
+        }
+        run := &TrashRun{ Name: file.Name(), Time: runTime }
+        runDir := path.Join(trashRoot(), run.Name)
+        err := util.ScanDir(runDir, true, func(file os.FileInfo) error {
+            run.Files = append(run.Files, file.Name())
+            return nil
+        })
+        if err != nil {
+            return err
+        }
+        err = filepath.Walk(runDir, func(filePath string, info os.FileInfo, err error) error {
+            if err != nil {
+                return err
+            }
+            if !info.IsDir() && info.Name() != romdb.DbFile {
+                run.Count++
+                run.Size += info.Size()
+            }
+            return nil
+        })
+        if err != nil {
+            return err
+        }
+        runs = append(runs, run)
+        return nil
+    })
+    if os.IsNotExist(err) {
+        return runs, nil
+    }
+    return runs, err
+}
+
+func findTrashRun(runs []*TrashRun, name string) *TrashRun {
+    for _, run := range runs {
+        if run.Name == name {
+            return run
+        }
+    }
+    return nil
+}
+
+// purgeRun permanently deletes a trash run
+func purgeRun(run *TrashRun) error {
+    term.Printf("%s : %s\n", run.Name, term.Red("PURGE %d files (%s)", run.Count, util.HumanizePow2(run.Size)))
+    if options.App.DryRun {
+        return nil
+    }
+    return os.RemoveAll(path.Join(trashRoot(), run.Name))
+}
+
+// purgeTrash deletes the runs older than the given number of days and then
+// the oldest runs until the trash is no bigger than the quota
+func purgeTrash(runs []*TrashRun, days int, quota int64) ([]*TrashRun, error) {
+    kept := []*TrashRun{}
+    var size int64
+    for _, run := range runs {
+        if days > 0 && time.Since(run.Time) > time.Duration(days) * 24 * time.Hour {
+            err := purgeRun(run)
+            if err != nil {
+                return nil, err
+            }
+            continue
+        }
+        kept = append(kept, run)
+        size += run.Size
+    }
+
+    if quota < 0 {
+        return kept, nil
+    }
+    for len(kept) > 0 && size > quota {
+        err := purgeRun(kept[0])
+        if err != nil {
+            return nil, err
+        }
+        size -= kept[0].Size
+        kept = kept[1:]
+    }
+    return kept, nil
+}
+
+// restoreTrash moves the files of a trash run back to the current directory.
+// If machines are given, then only the files of those machines are restored.
+// Files that already exist are not replaced.
+func restoreTrash(run *TrashRun, machines []string) bool {
+    machSet := util.NewStringSet()
+    for _, machine := range machines {
+        machSet.Set(romio.MachName(machine))
+    }
+
+    ok := true
+    runDir := path.Join(trashRoot(), run.Name)
+    for _, file := range run.Files {
+        if len(machSet) > 0 && !machSet.IsSet(romio.MachName(file)) {
+            continue
+        }
+        _, err := os.Lstat(file)
+        if err == nil {
+            term.Printf("%s : %s\n", file, term.Red("EXISTS"))
+            ok = false
+            continue
+        }
+        if !options.App.DryRun {
+            err = util.MoveFile(path.Join(runDir, file), file)
+            if err != nil {
+                term.Println(term.Red("restore %s: %s", file, err))
+                ok = false
+                continue
+            }
+        }
+        term.Printf("%s : %s\n", file, term.Green("RESTORED"))
+    }
+
+    if !options.App.DryRun {
+        removeTrashRun(runDir)
+    }
+    return ok
+}
+
+// removeTrashRun removes a trash run and its database once everything else in
+// it is restored
+func removeTrashRun(runDir string) {
+    files, err := ioutil.ReadDir(runDir)
+    if err == nil && len(files) == 1 && files[0].Name() == romdb.DbFile {
+        os.Remove(path.Join(runDir, romdb.DbFile))
+    }
+    os.Remove(runDir)
+}
+
+// removeTrashDirs removes the empty directories of a path in a trash run up to
+// and including the run itself
+func removeTrashDirs(trashPath string) {
+    root := path.Clean(trashRoot())
+    if !strings.HasPrefix(trashPath, root + "/") {
+        return
+    }
+    for dir := path.Dir(trashPath); dir != root; dir = path.Dir(dir) {
+        if path.Dir(dir) == root {
+            removeTrashRun(dir)
+            return
+        }
+        if os.Remove(dir) != nil {
+            return
+        }
+    }
+}
+
+func printTrashRuns(runs []*TrashRun) {
+    var count int
+    var size int64
+    for _, run := range runs {
+        term.Printf("%s : %d files (%s)\n", run.Name, run.Count, util.HumanizePow2(run.Size))
+        for _, file := range run.Files {
+            term.Printf("  %s\n", file)
+        }
+        count += run.Count
+        size += run.Size
+    }
+
+    term.Println("\nTrash Stats")
+    term.Printf("  Runs  : %d\n", len(runs))
+    term.Printf("  Files : %d\n", count)
+    term.Printf("  Size  : %s\n", util.HumanizePow2(size))
+}
+
+// trash lists, restores, or purges the trash runs of the current directory
+func trash(machines []string) (bool, error) {
+    runs, err := trashRuns()
+    if err != nil {
+        return false, err
+    }
+
+    if options.Trash.Restore != "" {
+        run := findTrashRun(runs, options.Trash.Restore)
+        if run == nil {
+            return false, fmt.Errorf("trash run %s not found", options.Trash.Restore)
+        }
+        return restoreTrash(run, machines), nil
+    }
+
+    quota := int64(-1)
+    if options.Trash.PurgeSize != "" {
+        quota, err = util.ParsePow2(options.Trash.PurgeSize)
+        if err != nil {
+            return false, err
+        }
+    }
+    if options.Trash.PurgeDays > 0 || quota >= 0 {
+        runs, err = purgeTrash(runs, options.Trash.PurgeDays, quota)
+        if err != nil {
+            return false, err
+        }
+    }
+
+    printTrashRuns(runs)
+    return true, nil
+}
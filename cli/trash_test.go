@@ -0,0 +1,176 @@
+//  GoRom - Emulator ROM Management Utilities
+//  Copyright (C) 2020 Scott Shumate <scott@shumatech.com>
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package main
+
+import (
+    "testing"
+    "fmt"
+    "io/ioutil"
+    "os"
+    "path"
+    "gorom"
+    "gorom/romdb"
+    "gorom/test"
+)
+
+func TestTrash(t *testing.T) {
+    test.RunDiffTest(t, "roms/badzip", "trash/trash.out", func() error {
+        options = Options{}
+
+        wd, err := os.Getwd()
+        if err != nil {
+            return err
+        }
+
+        tmpdir := test.CopyDirToTemp(t, "..", wd)
+        defer os.RemoveAll(tmpdir)
+
+        err = os.Chdir(tmpdir)
+        if err != nil {
+            return err
+        }
+
+        // Make an old run with a copy of a machine and a new run with a
+        // machine that is gone
+        oldRun := path.Join(TrashDir, "20200101-120000")
+        newRun := path.Join(TrashDir, "20200102-120000")
+        for _, dir := range []string{ oldRun, newRun } {
+            err = os.MkdirAll(dir, 0755)
+            if err != nil {
+                return err
+            }
+        }
+        data, err := ioutil.ReadFile("machine2.zip")
+        if err != nil {
+            return err
+        }
+        err = ioutil.WriteFile(path.Join(oldRun, "machine2.zip"), data, 0644)
+        if err != nil {
+            return err
+        }
+        err = os.Rename("machine3.zip", path.Join(newRun, "machine3.zip"))
+        if err != nil {
+            return err
+        }
+
+        _, err = trash(nil)
+        if err != nil {
+            return err
+        }
+
+        // Restore one machine and then a run with a machine that exists
+        options.Trash.Restore = "20200102-120000"
+        ok, err := trash([]string{ "machine3" })
+        if err != nil {
+            return err
+        }
+        if !ok {
+            return fmt.Errorf("unexpected return value")
+        }
+        options.Trash.Restore = "20200101-120000"
+        ok, err = trash(nil)
+        if err != nil {
+            return err
+        }
+        if ok {
+            return fmt.Errorf("unexpected return value")
+        }
+
+        // Purge by size with a dry run and then by age
+        options.Trash.Restore = ""
+        options.App.DryRun = true
+        options.Trash.PurgeSize = "1K"
+        _, err = trash(nil)
+        if err != nil {
+            return err
+        }
+        options.App.DryRun = false
+        options.Trash.PurgeSize = ""
+        options.Trash.PurgeDays = 1
+        _, err = trash(nil)
+        if err != nil {
+            return err
+        }
+        return nil
+    })
+}
+
+func TestTrashDir(t *testing.T) {
+    trashDir, err := ioutil.TempDir("", "trash")
+    if err != nil {
+        test.Fail(t, err)
+    }
+    defer os.RemoveAll(trashDir)
+
+    test.RunDiffTest(t, "roms/badzip", "fixrom/badzip_zip.out", func() error {
+        options = Options{}
+        options.FixRom.Format = gorom.FormatZip
+        options.App.TrashDir = trashDir
+        err := runFixRom(t, "../../dats/zip.dat", nil, []string{"../zip"})
+        if err != nil {
+            return err
+        }
+
+        runs, err := trashRuns()
+        if err != nil {
+            return err
+        }
+        if len(runs) != 1 || fmt.Sprint(runs[0].Files) != "[machine2.zip machine3.zip]" {
+            return fmt.Errorf("unexpected trash runs")
+        }
+        return nil
+    })
+}
+
+func TestTrashRemoveDirs(t *testing.T) {
+    tmpdir, err := ioutil.TempDir("", "trash")
+    if err != nil {
+        test.Fail(t, err)
+    }
+    defer os.RemoveAll(tmpdir)
+
+    wd, err := os.Getwd()
+    if err != nil {
+        test.Fail(t, err)
+    }
+    defer os.Chdir(wd)
+    err = os.Chdir(tmpdir)
+    if err != nil {
+        test.Fail(t, err)
+    }
+
+    // A restored disk leaves its machine directory and the database of the run
+    options = Options{}
+    runDir := path.Join(TrashDir, "20200101-120000")
+    err = os.MkdirAll(path.Join(runDir, "machine1"), 0755)
+    if err != nil {
+        test.Fail(t, err)
+    }
+    err = ioutil.WriteFile(path.Join(runDir, romdb.DbFile), nil, 0644)
+    if err != nil {
+        test.Fail(t, err)
+    }
+
+    removeTrashDirs(path.Join(runDir, "machine1", "disk1.chd"))
+    _, err = os.Stat(runDir)
+    if !os.IsNotExist(err) {
+        test.Fail(t, fmt.Errorf("trash run not removed"))
+    }
+    _, err = os.Stat(TrashDir)
+    if err != nil {
+        test.Fail(t, err)
+    }
+}
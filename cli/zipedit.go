@@ -0,0 +1,221 @@
+//  GoRom - Emulator ROM Management Utilities
+//  Copyright (C) 2020 Scott Shumate <scott@shumatech.com>
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package main
+
+import (
+    "fmt"
+    "os"
+    "path"
+
+    "gorom"
+    "gorom/romio"
+    "gorom/term"
+    "gorom/util"
+)
+
+///////////////////////////////////////////////////////////////////////////////
+// In-place Zip Update
+//
+// With --in-place, the zip machines that keep some of their files are edited
+// in place instead of being rewritten to a temp zip.  The new files are
+// appended and the renamed or removed files only change the central
+// directory.  All of the zips get their new files before any directory is
+// changed so the zips that copy files from each other still find them.
+///////////////////////////////////////////////////////////////////////////////
+
+type ZipEdit struct {
+    machine FixMachine
+    editor  *romio.ZipEditor
+    keep    []CopyRom
+}
+
+// zipEditable returns true if a machine is a zip with files to keep
+func zipEditable(machine FixMachine) bool {
+    if romio.MachFormat(machine.Path) != gorom.FormatZip {
+        return false
+    }
+    for _, rom := range machine.Roms {
+        if rom.Depot == "" && rom.SrcPath == machine.Path {
+            return true
+        }
+    }
+    return false
+}
+
+// appendZip appends the new files of a machine to its zip.  The zip is
+// restored if a file cannot be appended.
+func appendZip(edit *ZipEdit, journal *Journal) error {
+    machine := edit.machine
+    ze, err := romio.OpenZipEditor(machine.Path)
+    if err != nil {
+        return err
+    }
+
+    self, err := romio.OpenZipReader(machine.Path)
+    if err != nil {
+        return err
+    }
+    defer self.Close()
+
+    // Keep the original file for the first ROM that uses it and append the
+    // rest
+    kept := util.NewStringSet()
+    appends := []CopyRom{}
+    for _, rom := range machine.Roms {
+        if rom.Depot == "" && rom.SrcPath == machine.Path && ze.Has(rom.SrcName) && !kept.IsSet(rom.SrcName) {
+            kept.Set(rom.SrcName)
+            edit.keep = append(edit.keep, rom)
+        } else {
+            appends = append(appends, rom)
+        }
+    }
+
+    ofs, tail := ze.Tail()
+    err = journal.zip(machine.Path, ofs, tail)
+    if err != nil {
+        return err
+    }
+    edit.editor = ze
+
+    for _, rom := range appends {
+        var reader romio.RomReader = self
+        if rom.Depot != "" || rom.SrcPath != machine.Path {
+            reader, err = openCopyReader(rom)
+            if err == nil && reader == nil {
+                err = fmt.Errorf("unable to open reader")
+            }
+            if err != nil {
+                break
+            }
+        }
+        err = ze.Append(rom.DstName, reader, rom.SrcName)
+        if reader != self {
+            reader.Close()
+        }
+        if err != nil {
+            break
+        }
+    }
+    if err == nil {
+        err = ze.Flush()
+    }
+
+    if err != nil {
+        ze.Close()
+        edit.editor = nil
+        restoreErr := romio.RestoreZip(machine.Path, ofs, tail)
+        if restoreErr != nil {
+            return restoreErr
+        }
+    }
+    return err
+}
+
+// trashZipFiles copies the files removed from a zip to a zip in the trash
+func trashZipFiles(machPath string, names []string, trashDir string, journal *Journal) error {
+    reader, err := romio.OpenZipReader(machPath)
+    if err != nil {
+        return err
+    }
+    defer reader.Close()
+
+    trashPath := path.Join(trashDir, machPath)
+    err = os.MkdirAll(path.Dir(trashPath), 0755)
+    if err != nil {
+        return err
+    }
+    writer, err := romio.CreateZipWriter(trashPath)
+    if err != nil {
+        return err
+    }
+    err = journal.temp(trashPath)
+    if err != nil {
+        writer.Close()
+        return err
+    }
+
+    for _, name := range names {
+        err = writer.Create(name)
+        if err != nil {
+            writer.Close()
+            return err
+        }
+    }
+    for index := writer.First(); index >= 0; index = writer.Next() {
+        err = romio.CopyRom(writer, names[index], reader, names[index])
+        if err != nil {
+            writer.Close()
+            return err
+        }
+    }
+    return writer.Close()
+}
+
+// commitZip writes the final directory of a zip.  The removed files are
+// copied to the trash first so they are never lost.
+func commitZip(edit *ZipEdit, trashDir string, journal *Journal) error {
+    ze := edit.editor
+    for _, rom := range edit.keep {
+        err := ze.Keep(rom.DstName, rom.SrcName)
+        if err != nil {
+            return err
+        }
+    }
+
+    removed := ze.Removed()
+    if len(removed) > 0 {
+        err := trashZipFiles(edit.machine.Path, removed, trashDir, journal)
+        if err != nil {
+            return err
+        }
+    }
+    return ze.Commit()
+}
+
+// editZips updates the zips in place.  The zips that cannot be edited are
+// rewritten to temp files instead and added to the rename list.
+func editZips(edits []*ZipEdit, renameList *[]Rename, trashDir string, journal *Journal) {
+    if len(edits) == 0 {
+        return
+    }
+
+    term.Println("Updating zips in place")
+    ch := make(chan CopyResults, 1)
+    for _, edit := range edits {
+        util.Progressf(edit.machine.Path)
+        err := appendZip(edit, journal)
+        if err == romio.ZipEditUnsupportedError {
+            go copyRoms(edit.machine.Path, edit.machine.Roms, journal, ch)
+            copyProcess(renameList, ch)
+        } else if err != nil {
+            util.Progressf("")
+            term.Println(term.Red("update %s: %s", edit.machine.Path, err))
+        }
+    }
+
+    for _, edit := range edits {
+        if edit.editor == nil {
+            continue
+        }
+        util.Progressf(edit.machine.Path)
+        err := commitZip(edit, trashDir, journal)
+        if err != nil {
+            util.Progressf("")
+            term.Println(term.Red("update %s: %s", edit.machine.Path, err))
+        }
+    }
+    util.Progressf("")
+}
@@ -0,0 +1,381 @@
+//  GoRom - Emulator ROM Management Utilities
+//  Copyright (C) 2020 Scott Shumate <scott@shumatech.com>
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package dat
+
+import (
+    "bufio"
+    "fmt"
+    "io"
+    "strconv"
+    "strings"
+
+    "gorom/checksum"
+)
+
+///////////////////////////////////////////////////////////////////////////////
+// ClrMamePro DAT format
+//
+// The ClrMamePro text format is a series of top-level blocks that each have
+// a name followed by a parenthesized list of key/value pairs and nested
+// blocks:
+//
+//   clrmamepro (
+//       name "Zip ROMs"
+//       description "Zip ROMs"
+//   )
+//
+//   game (
+//       name "machine1"
+//       description "Machine 1"
+//       rom ( name rom_1.bin size 4096 crc c26a1549 sha1 3257...4c79 )
+//   )
+//
+// Values are either bare words or double quoted strings.
+///////////////////////////////////////////////////////////////////////////////
+
+type CmproElement struct {
+    Name     string
+    Value    string
+    Elements []*CmproElement
+    Line     int
+}
+
+// Get returns the value of the first child element with the given name
+func (ce *CmproElement) Get(name string) string {
+    for _, child := range ce.Elements {
+        if child.Name == name && child.Elements == nil {
+            return child.Value
+        }
+    }
+    return ""
+}
+
+func (ce *CmproElement) IsHeader() bool {
+    return ce.Name == "clrmamepro"
+}
+
+func (ce *CmproElement) IsMachine() bool {
+    return ce.Name == "game" || ce.Name == "machine" || ce.Name == "resource"
+}
+
+func (ce *CmproElement) Header() *Header {
+    var header Header
+    header.Name = ce.Get("name")
+    header.Description = ce.Get("description")
+    header.Category = ce.Get("category")
+    header.Version = ce.Get("version")
+    header.Date = ce.Get("date")
+    header.Author = ce.Get("author")
+    header.Email = ce.Get("email")
+    header.Homepage = ce.Get("homepage")
+    header.Url = ce.Get("url")
+    header.Comment = ce.Get("comment")
+    header.ClrMamePro.HeaderDef = ce.Get("header")
+    header.ClrMamePro.ForceMerging = ce.Get("forcemerging")
+    header.ClrMamePro.ForceNoDump = ce.Get("forcenodump")
+    header.ClrMamePro.ForcePacking = ce.Get("forcepacking")
+    for _, child := range ce.Elements {
+        if child.Elements == nil && child.Value == "" && header.field(child.Name) != nil {
+            header.Empty = append(header.Empty, child.Name)
+        }
+    }
+    return &header
+}
+
+func (ce *CmproElement) Machine() (*Machine, error) {
+    var machine Machine
+    machine.XMLName.Local = ce.Name
+    for _, child := range ce.Elements {
+        switch child.Name {
+        case "name":
+            machine.Name = child.Value
+        case "cloneof":
+            machine.CloneOf = child.Value
+        case "romof":
+            machine.RomOf = child.Value
+        case "sampleof":
+            machine.SampleOf = child.Value
+        case "sourcefile":
+            machine.SourceFile = child.Value
+        case "isbios":
+            machine.IsBios = child.Value
+        case "board":
+            machine.Board = child.Value
+        case "rebuildto":
+            machine.RebuildTo = child.Value
+        case "sample":
+            machine.Samples = append(machine.Samples, &Sample{ Name: child.Value })
+        case "description":
+            machine.Description = child.Value
+        case "year":
+            machine.Year = child.Value
+        case "manufacturer":
+            machine.Manufacturer = child.Value
+        case "category":
+            machine.Category = child.Value
+        case "rom":
+            rom, err := child.rom()
+            if err != nil {
+                return nil, err
+            }
+            machine.Roms = append(machine.Roms, rom)
+        case "disk":
+            disk, err := child.rom()
+            if err != nil {
+                return nil, err
+            }
+            machine.Disks = append(machine.Disks, disk)
+        }
+    }
+    return &machine, nil
+}
+
+func (ce *CmproElement) rom() (*Rom, error) {
+    var rom Rom
+    var ok bool
+    for _, child := range ce.Elements {
+        switch child.Name {
+        case "name":
+            rom.Name = child.Value
+        case "size":
+            size, err := strconv.ParseInt(child.Value, 10, 64)
+            if err != nil {
+                return nil, fmt.Errorf("line %d: invalid %s size '%s'", child.Line, ce.Name, child.Value)
+            }
+            rom.Size = size
+        case "crc":
+            // Some DATs drop leading zeros from the CRC
+            crc := child.Value
+            if len(crc) < 8 {
+                crc = strings.Repeat("0", 8 - len(crc)) + crc
+            }
+            rom.Crc, ok = checksum.NewCrc32String(crc)
+            if !ok {
+                return nil, fmt.Errorf("line %d: invalid %s crc '%s'", child.Line, ce.Name, child.Value)
+            }
+        case "sha1":
+            rom.Sha1, ok = checksum.NewSha1String(child.Value)
+            if !ok {
+                return nil, fmt.Errorf("line %d: invalid %s sha1 '%s'", child.Line, ce.Name, child.Value)
+            }
+        case "md5":
+            rom.Md5, ok = checksum.NewMd5String(child.Value)
+            if !ok {
+                return nil, fmt.Errorf("line %d: invalid %s md5 '%s'", child.Line, ce.Name, child.Value)
+            }
+        case "merge":
+            rom.Merge = child.Value
+        case "status", "flags":
+            rom.DumpStatus = child.Value
+        case "date":
+            rom.Date = child.Value
+        }
+    }
+    return &rom, nil
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// ClrMamePro Decoder
+///////////////////////////////////////////////////////////////////////////////
+
+type CmproDecoder struct {
+    rd     *bufio.Reader
+    offset int64
+    line   int
+}
+
+const utf8Bom = "\xEF\xBB\xBF"
+
+type cmproToken struct {
+    text   string
+    quoted bool
+    line   int
+}
+
+func NewCmproDecoder(rd io.Reader) *CmproDecoder {
+    br, ok := rd.(*bufio.Reader)
+    if !ok {
+        br = bufio.NewReader(rd)
+    }
+    cd := &CmproDecoder{ rd: br, line: 1 }
+
+    // Skip the UTF-8 byte order mark
+    if bom, err := br.Peek(len(utf8Bom)); err == nil && string(bom) == utf8Bom {
+        br.Discard(len(utf8Bom))
+        cd.offset = int64(len(utf8Bom))
+    }
+
+    return cd
+}
+
+// InputOffset returns the input stream byte offset just past the last
+// element returned by Decode
+func (cd *CmproDecoder) InputOffset() int64 {
+    return cd.offset
+}
+
+func (cd *CmproDecoder) readByte() (byte, error) {
+    b, err := cd.rd.ReadByte()
+    if err != nil {
+        return b, err
+    }
+    cd.offset++
+    if b == '\n' {
+        cd.line++
+    }
+    return b, nil
+}
+
+func (cd *CmproDecoder) unreadByte(b byte) {
+    cd.rd.UnreadByte()
+    cd.offset--
+    if b == '\n' {
+        cd.line--
+    }
+}
+
+func isCmproSpace(b byte) bool {
+    return b == ' ' || b == '\t' || b == '\r' || b == '\n'
+}
+
+func (cd *CmproDecoder) token() (*cmproToken, error) {
+    var b byte
+    var err error
+
+    // Skip leading white space
+    for {
+        b, err = cd.readByte()
+        if err != nil {
+            return nil, err
+        }
+        if !isCmproSpace(b) {
+            break
+        }
+    }
+
+    tok := &cmproToken{ line: cd.line }
+    var sb strings.Builder
+
+    switch b {
+    case '(', ')':
+        tok.text = string(b)
+        return tok, nil
+    case '"':
+        tok.quoted = true
+        for {
+            b, err = cd.readByte()
+            if err == io.EOF {
+                return nil, fmt.Errorf("line %d: unterminated string", tok.line)
+            } else if err != nil {
+                return nil, err
+            }
+            if b == '"' {
+                break
+            }
+            sb.WriteByte(b)
+        }
+    default:
+        sb.WriteByte(b)
+        for {
+            b, err = cd.readByte()
+            if err == io.EOF {
+                break
+            } else if err != nil {
+                return nil, err
+            }
+            if isCmproSpace(b) || b == '(' || b == ')' {
+                cd.unreadByte(b)
+                break
+            }
+            sb.WriteByte(b)
+        }
+    }
+
+    tok.text = sb.String()
+    return tok, nil
+}
+
+func (cd *CmproDecoder) block(elem *CmproElement) error {
+    elem.Elements = []*CmproElement{}
+    for {
+        tok, err := cd.token()
+        if err == io.EOF {
+            return fmt.Errorf("line %d: missing ')' for '%s'", elem.Line, elem.Name)
+        } else if err != nil {
+            return err
+        }
+
+        if !tok.quoted && tok.text == ")" {
+            return nil
+        }
+        if !tok.quoted && tok.text == "(" {
+            return fmt.Errorf("line %d: unexpected '('", tok.line)
+        }
+
+        child := &CmproElement{ Name: tok.text, Line: tok.line }
+
+        tok, err = cd.token()
+        if err == io.EOF {
+            return fmt.Errorf("line %d: missing value for '%s'", child.Line, child.Name)
+        } else if err != nil {
+            return err
+        }
+
+        if !tok.quoted && tok.text == "(" {
+            err = cd.block(child)
+            if err != nil {
+                return err
+            }
+        } else if !tok.quoted && tok.text == ")" {
+            return fmt.Errorf("line %d: missing value for '%s'", child.Line, child.Name)
+        } else {
+            child.Value = tok.text
+        }
+
+        elem.Elements = append(elem.Elements, child)
+    }
+}
+
+// Decode returns the next top-level block in the stream or io.EOF when there
+// are no more blocks
+func (cd *CmproDecoder) Decode() (*CmproElement, error) {
+    tok, err := cd.token()
+    if err != nil {
+        return nil, err
+    }
+    if tok.quoted || tok.text == "(" || tok.text == ")" {
+        return nil, fmt.Errorf("line %d: expected block name", tok.line)
+    }
+
+    elem := &CmproElement{ Name: tok.text, Line: tok.line }
+
+    tok, err = cd.token()
+    if err == io.EOF {
+        return nil, fmt.Errorf("line %d: missing '(' for '%s'", elem.Line, elem.Name)
+    } else if err != nil {
+        return nil, err
+    }
+    if tok.quoted || tok.text != "(" {
+        return nil, fmt.Errorf("line %d: expected '(' after '%s'", tok.line, elem.Name)
+    }
+
+    err = cd.block(elem)
+    if err != nil {
+        return nil, err
+    }
+
+    return elem, nil
+}
@@ -18,6 +18,7 @@ package dat
 import (
     "bufio"
     "encoding/xml"
+    "errors"
     "fmt"
     "io"
     "os"
@@ -26,6 +27,7 @@ import (
 
     "compress/gzip"
 
+    "gorom"
     "gorom/romdb"
     "gorom/romio"
     "gorom/checksum"
@@ -37,17 +39,45 @@ import (
 type Header struct {
     Name            string         `xml:"name"`
     Description     string         `xml:"description"`
+    Category        string         `xml:"category"`
     Version         string         `xml:"version"`
+    Date            string         `xml:"date"`
     Author          string         `xml:"author"`
+    Email           string         `xml:"email"`
+    Homepage        string         `xml:"homepage"`
+    Url             string         `xml:"url"`
+    Comment         string         `xml:"comment"`
+    ClrMamePro      ClrMamePro     `xml:"clrmamepro"`
+    Other           []XmlElement   `xml:"-"`
+    Empty           []string       `xml:"-"`
+}
+
+type ClrMamePro struct {
+    HeaderDef       string         `xml:"header,attr"`
+    ForceMerging    string         `xml:"forcemerging,attr"`
+    ForceNoDump     string         `xml:"forcenodump,attr"`
+    ForcePacking    string         `xml:"forcepacking,attr"`
 }
 
 type Machine struct {
+    XMLName         xml.Name
     Name            string         `xml:"name,attr"`
+    SourceFile      string         `xml:"sourcefile,attr"`
+    IsBios          string         `xml:"isbios,attr"`
+    CloneOf         string         `xml:"cloneof,attr"`
+    RomOf           string         `xml:"romof,attr"`
+    SampleOf        string         `xml:"sampleof,attr"`
+    Board           string         `xml:"board,attr"`
+    RebuildTo       string         `xml:"rebuildto,attr"`
     Description     string         `xml:"description"`
     Year            string         `xml:"year"`
     Manufacturer    string         `xml:"manufacturer"`
     Category        string         `xml:"category"`
     Roms            []*Rom         `xml:"rom"`
+    Disks           []*Rom         `xml:"disk"`
+    Samples         []*Sample      `xml:"sample"`
+    OtherAttrs      []xml.Attr     `xml:",any,attr"`
+    Other           []XmlElement   `xml:",any"`
     Path            string
     Format          int
 }
@@ -57,9 +87,95 @@ type Rom struct {
     Size            int64          `xml:"size,attr"`
     Crc             checksum.Crc32 `xml:"crc,attr"`
     Sha1            checksum.Sha1  `xml:"sha1,attr"`
+    Md5             checksum.Md5   `xml:"md5,attr"`
+    Merge           string         `xml:"merge,attr"`
+    DumpStatus      string         `xml:"status,attr"`
+    Date            string         `xml:"date,attr"`
+    OtherAttrs      []xml.Attr     `xml:",any,attr"`
     Status          int
 }
 
+type Sample struct {
+    Name            string         `xml:"name,attr"`
+}
+
+// XmlElement is an element that gorom does not use.  It is kept as is so it
+// can be written back out.
+type XmlElement struct {
+    XMLName         xml.Name
+    Attrs           []xml.Attr     `xml:",any,attr"`
+    InnerXml        string         `xml:",innerxml"`
+}
+
+// field returns the field of a header element with a string value or nil if
+// the element is not one of them
+func (header *Header) field(name string) *string {
+    switch name {
+    case "name":
+        return &header.Name
+    case "description":
+        return &header.Description
+    case "category":
+        return &header.Category
+    case "version":
+        return &header.Version
+    case "date":
+        return &header.Date
+    case "author":
+        return &header.Author
+    case "email":
+        return &header.Email
+    case "homepage":
+        return &header.Homepage
+    case "url":
+        return &header.Url
+    case "comment":
+        return &header.Comment
+    }
+    return nil
+}
+
+// IsEmpty returns true if a header element is in the DAT file but empty
+func (header *Header) IsEmpty(name string) bool {
+    for _, empty := range header.Empty {
+        if empty == name {
+            return true
+        }
+    }
+    return false
+}
+
+// UnmarshalXML decodes a header and records the elements that are empty and
+// the elements that gorom does not use so they can be written back out
+func (header *Header) UnmarshalXML(decoder *xml.Decoder, start xml.StartElement) error {
+    for {
+        tok, err := decoder.Token()
+        if err != nil {
+            return err
+        }
+        switch v := tok.(type) {
+        case xml.StartElement:
+            if field := header.field(v.Name.Local); field != nil {
+                err = decoder.DecodeElement(field, &v)
+                if err == nil && *field == "" {
+                    header.Empty = append(header.Empty, v.Name.Local)
+                }
+            } else if v.Name.Local == "clrmamepro" {
+                err = decoder.DecodeElement(&header.ClrMamePro, &v)
+            } else {
+                var elem XmlElement
+                err = decoder.DecodeElement(&elem, &v)
+                header.Other = append(header.Other, elem)
+            }
+            if err != nil {
+                return err
+            }
+        case xml.EndElement:
+            return nil
+        }
+    }
+}
+
 // Status constants
 const (
     RomUnknown = iota
@@ -67,8 +183,101 @@ const (
     RomCorrupt
     RomMissing
     RomBadName
+    RomNoDump
+    RomBadDump
 )
 
+// Dump status values from the DAT file
+const (
+    DumpNoDump = "nodump"
+    DumpBadDump = "baddump"
+)
+
+// StatusOk returns true if a ROM status does not need fixing.  ROMs that were
+// never dumped are not required and bad dumps are the best available.
+func StatusOk(status int) bool {
+    return status == RomOk || status == RomNoDump || status == RomBadDump
+}
+
+func (rom *Rom) okStatus() int {
+    if rom.DumpStatus == DumpBadDump {
+        return RomBadDump
+    }
+    return RomOk
+}
+
+// Match returns true if a ROM matches a set of file checksums using the
+// strongest checksum they have in common.  DATs without a SHA-1 fall back to
+// the MD5 and then to the size and CRC32.  Files only have the size and CRC32
+// when they are checked with the CRC32s stored in their archive.
+func (rom *Rom) Match(sums romio.Checksums) bool {
+    if rom.Sha1 != (checksum.Sha1{}) && sums.Sha1 != (checksum.Sha1{}) {
+        return rom.Sha1 == sums.Sha1
+    }
+    if rom.Md5 != (checksum.Md5{}) && sums.Md5 != (checksum.Md5{}) {
+        return rom.Md5 == sums.Md5
+    }
+    return rom.Crc == sums.Crc32 && rom.Size == sums.Size
+}
+
+// HasChecksum returns true if a ROM has any checksum to match
+func (rom *Rom) HasChecksum() bool {
+    return rom.Sha1 != (checksum.Sha1{}) || rom.Md5 != (checksum.Md5{}) || rom.Crc != (checksum.Crc32{})
+}
+
+// LookupRom looks up all the locations of a ROM in the database by its
+// strongest checksum
+func LookupRom(rdb *romdb.RomDB, rom *Rom) ([]*romdb.RomDBEntry, error) {
+    if rom.Sha1 != (checksum.Sha1{}) {
+        return rdb.Lookup(rom.Sha1)
+    }
+    if rom.Md5 != (checksum.Md5{}) {
+        entries, err := rdb.LookupMd5(rom.Md5)
+        if len(entries) > 0 || err != nil {
+            return entries, err
+        }
+    }
+    if rom.Crc != (checksum.Crc32{}) {
+        return rdb.LookupCrc32(rom.Crc, rom.Size)
+    }
+    return nil, nil
+}
+
+// Disks use the Rom type with only the name, SHA-1, and merge fields set.
+// They are stored as CHD files in a directory with the same name as the
+// machine.
+func DiskFile(disk *Rom) string {
+    return disk.Name + romio.ChdExt
+}
+
+func DiskPath(machine *Machine, disk *Rom) string {
+    return path.Join(machine.Name, DiskFile(disk))
+}
+
+// FilterRoms returns a copy of a machine with only the ROMs and disks that
+// the filter function returns true for or nil if there are none.  Samples are
+// not copied.
+func FilterRoms(machine *Machine, filterFunc func(rom *Rom) bool) *Machine {
+    filtered := *machine
+    filtered.Roms = nil
+    filtered.Disks = nil
+    filtered.Samples = nil
+    for _, rom := range machine.Roms {
+        if filterFunc(rom) {
+            filtered.Roms = append(filtered.Roms, rom)
+        }
+    }
+    for _, disk := range machine.Disks {
+        if filterFunc(disk) {
+            filtered.Disks = append(filtered.Disks, disk)
+        }
+    }
+    if len(filtered.Roms) == 0 && len(filtered.Disks) == 0 {
+        return nil
+    }
+    return &filtered
+}
+
 ///////////////////////////////////////////////////////////////////////////////
 // DAT path conversion
 ///////////////////////////////////////////////////////////////////////////////
@@ -84,40 +293,87 @@ func FromDatPath(path string) string {
 // Checksum map
 ///////////////////////////////////////////////////////////////////////////////
 
+type crc32Key struct {
+    crc  checksum.Crc32
+    size int64
+}
+
 type ChecksumMap struct {
-    toChecksum map[string]checksum.Sha1
-    toName map[checksum.Sha1]string
+    toChecksums map[string]romio.Checksums
+    sha1ToName map[checksum.Sha1]string
+    md5ToName map[checksum.Md5]string
+    crc32ToName map[crc32Key]string
 }
 
 func NewChecksumMap() *ChecksumMap {
     return &ChecksumMap {
-        toChecksum: map[string]checksum.Sha1{},
-        toName: map[checksum.Sha1]string{} }
+        toChecksums: map[string]romio.Checksums{},
+        sha1ToName: map[checksum.Sha1]string{},
+        md5ToName: map[checksum.Md5]string{},
+        crc32ToName: map[crc32Key]string{} }
 }
 
-func (cm *ChecksumMap) Add(name string, sum checksum.Sha1) {
-    cm.toChecksum[name] = sum
-    cm.toName[sum] = name
+func (cm *ChecksumMap) Add(name string, sums romio.Checksums) {
+    cm.toChecksums[name] = sums
+    if sums.Sha1 != (checksum.Sha1{}) {
+        cm.sha1ToName[sums.Sha1] = name
+    }
+    if sums.Md5 != (checksum.Md5{}) {
+        cm.md5ToName[sums.Md5] = name
+    }
+    cm.crc32ToName[crc32Key{ sums.Crc32, sums.Size }] = name
 }
 
-func (cm *ChecksumMap) Delete(name string, sum checksum.Sha1) {
-    delete(cm.toChecksum, name)
-    delete(cm.toName, sum)
+func (cm *ChecksumMap) Delete(name string) {
+    sums, ok := cm.toChecksums[name]
+    if !ok {
+        return
+    }
+    delete(cm.toChecksums, name)
+    if cm.sha1ToName[sums.Sha1] == name {
+        delete(cm.sha1ToName, sums.Sha1)
+    }
+    if cm.md5ToName[sums.Md5] == name {
+        delete(cm.md5ToName, sums.Md5)
+    }
+    key := crc32Key{ sums.Crc32, sums.Size }
+    if cm.crc32ToName[key] == name {
+        delete(cm.crc32ToName, key)
+    }
 }
 
-func (cm *ChecksumMap) ToChecksum(name string) (sum checksum.Sha1, ok bool) {
-    sum, ok = cm.toChecksum[name]
+func (cm *ChecksumMap) ToChecksums(name string) (sums romio.Checksums, ok bool) {
+    sums, ok = cm.toChecksums[name]
     return
 }
 
-func (cm *ChecksumMap) ToName(sum checksum.Sha1) (name string, ok bool) {
-    name, ok = cm.toName[sum]
+// Find returns the name of a file that matches a ROM using the same checksum
+// precedence as Rom.Match
+func (cm *ChecksumMap) Find(rom *Rom) (name string, ok bool) {
+    if rom.Sha1 != (checksum.Sha1{}) {
+        name, ok = cm.sha1ToName[rom.Sha1]
+        if ok {
+            return
+        }
+    }
+    if rom.Md5 != (checksum.Md5{}) {
+        name, ok = cm.md5ToName[rom.Md5]
+        if ok {
+            return
+        }
+    }
+    if rom.Crc != (checksum.Crc32{}) {
+        name, ok = cm.crc32ToName[crc32Key{ rom.Crc, rom.Size }]
+        if ok {
+            ok = rom.Match(cm.toChecksums[name])
+        }
+    }
     return
 }
 
-func (cm *ChecksumMap) ForEach(callback func(name string, sum checksum.Sha1)) {
-    for name, sum := range cm.toChecksum {
-        callback(name, sum)
+func (cm *ChecksumMap) ForEach(callback func(name string, sums romio.Checksums)) {
+    for name, sums := range cm.toChecksums {
+        callback(name, sums)
     }
 }
 
@@ -131,6 +387,16 @@ func (cm *ChecksumMap) ForEach(callback func(name string, sum checksum.Sha1)) {
 // badNames map (if non-nil). Extraneous ROMs not present in the machine are
 // added to the extras slice (if non-nil).
 //
+// Disks are validated the same way using the SHA-1 from the CHD header.  Bad
+// disk names are added to the badNames map by CHD file name.
+//
+// ROMs are matched by SHA-1 if the DAT file has one.  Otherwise, they are
+// matched by MD5 if the DAT file has one and MD5s are enabled in the database
+// and by size and CRC32 as a last resort.
+//
+// ROMs with a nodump status are never required and are set to RomNoDump.
+// ROMs with a baddump status are set to RomBadDump when they match.
+//
 // For each ROM found, the checksumFunc is called with the generated checksum.
 // The function returns true if the machine dir/zip was found and scanned
 // successfully and false if not.
@@ -138,7 +404,50 @@ func (cm *ChecksumMap) ForEach(callback func(name string, sum checksum.Sha1)) {
 
 func ValidateChecksums(machine *Machine, rdb *romdb.RomDB, badNames map[string]string,
                        extras *[]string, checksumFunc romdb.ChecksumFunc) (bool, error) {
+    return validate(machine, rdb, badNames, extras, checksumFunc, false)
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// ValidateCrcs - Validate the presence, size, CRC32, and name for each ROM in
+// a machine the same as ValidateChecksums except that the CRC32s stored in the
+// directory of a zip file are used instead of reading the files.  ROMs with
+// bad names are found by size and CRC32.  Corrupt ROMs with a matching CRC32
+// are not detected.
+//
+// Machines in directories or in archives that do not store CRC32s, machines
+// with ROMs that have no CRC32 in the DAT file, and disks are validated with
+// the checksums from the database instead.  The stored CRC32s are not used if
+// the database skips ROM headers since they include the header.
+///////////////////////////////////////////////////////////////////////////////
+
+func ValidateCrcs(machine *Machine, rdb *romdb.RomDB, badNames map[string]string,
+                  extras *[]string) (bool, error) {
+    return validate(machine, rdb, badNames, extras, nil, true)
+}
+
+// storedCrcs returns true if the CRC32s stored in an archive can validate the
+// ROMs of a machine
+func storedCrcs(machine *Machine, rr romio.RomReader, rdb *romdb.RomDB) bool {
+    if rdb.Skipper() != nil {
+        return false
+    }
+    for _, file := range rr.Files() {
+        if !file.HasCrc32 {
+            return false
+        }
+    }
+    for _, rom := range machine.Roms {
+        if rom.Crc == (checksum.Crc32{}) && rom.HasChecksum() {
+            return false
+        }
+    }
+    return true
+}
+
+func validate(machine *Machine, rdb *romdb.RomDB, badNames map[string]string,
+              extras *[]string, checksumFunc romdb.ChecksumFunc, crcOnly bool) (bool, error) {
     romMap := NewChecksumMap();
+    diskMap := NewChecksumMap();
     machName := machine.Name
 
     rr, err := romio.OpenRomReaderByName(machName)
@@ -150,42 +459,45 @@ func ValidateChecksums(machine *Machine, rdb *romdb.RomDB, badNames map[string]s
     machine.Format = rr.Format()
     machine.Path = rr.Path()
 
-    err = rdb.Checksum(rr, func(name string, checksum checksum.Sha1) error {
-        romMap.Add(name, checksum)
-        if checksumFunc != nil {
-            return checksumFunc(name, checksum)
+    if crcOnly && storedCrcs(machine, rr, rdb) {
+        for _, file := range rr.Files() {
+            romMap.Add(file.Name, romio.Checksums{ Crc32: file.Crc32, Size: file.Size })
         }
-        return nil;
-    })
-    if err != nil {
-        return false, err
-    }
-
-    // Set the status field for each ROM based on our results
-    for index, rom := range machine.Roms {
-        if checksum, ok := romMap.ToChecksum(rom.Name); ok {
-            if checksum == rom.Sha1 {
-                machine.Roms[index].Status = RomOk
+    } else {
+        err = rdb.Checksums(rr, func(name string, checksums romio.Checksums) error {
+            if rr.Format() == gorom.FormatDir && romio.IsChd(name) {
+                diskMap.Add(name, checksums)
             } else {
-                machine.Roms[index].Status = RomCorrupt
+                romMap.Add(name, checksums)
             }
-            romMap.Delete(rom.Name, checksum)
-        } else {
-            if name, ok := romMap.ToName(rom.Sha1); ok {
-                machine.Roms[index].Status = RomBadName
-                if badNames != nil {
-                    badNames[rom.Name] = name
-                }
-                romMap.Delete(name, rom.Sha1)
-            } else {
-                machine.Roms[index].Status = RomMissing
+            if checksumFunc != nil {
+                return checksumFunc(name, checksums.Sha1)
             }
+            return nil;
+        })
+        if err != nil {
+            return false, err
         }
     }
 
+    // Disks of an archived machine are in a directory of the same name
+    if len(machine.Disks) > 0 && rr.Format() != gorom.FormatDir {
+        err = checksumDisks(machName, rdb, diskMap, checksumFunc)
+        if err != nil {
+            return false, err
+        }
+    }
+
+    // Set the status field for each ROM based on our results
+    validateMap(machine.Roms, func(rom *Rom) string { return rom.Name }, romMap, badNames)
+    validateMap(machine.Disks, DiskFile, diskMap, badNames)
+
     // Any ROMs left in the map are extraneous
     if extras != nil {
-        romMap.ForEach(func(name string, checksum checksum.Sha1) {
+        romMap.ForEach(func(name string, checksums romio.Checksums) {
+            *extras = append(*extras, name)
+        })
+        diskMap.ForEach(func(name string, checksums romio.Checksums) {
             *extras = append(*extras, name)
         })
     }
@@ -193,6 +505,63 @@ func ValidateChecksums(machine *Machine, rdb *romdb.RomDB, badNames map[string]s
     return true, nil
 }
 
+func checksumDisks(machName string, rdb *romdb.RomDB, diskMap *ChecksumMap, checksumFunc romdb.ChecksumFunc) error {
+    info, err := os.Stat(machName)
+    if err != nil || !info.IsDir() {
+        return nil
+    }
+
+    dr, err := romio.OpenDirReader(machName)
+    if err != nil {
+        return err
+    }
+    defer dr.Close()
+
+    return rdb.Checksums(dr, func(name string, checksums romio.Checksums) error {
+        if romio.IsChd(name) {
+            diskMap.Add(name, checksums)
+        }
+        if checksumFunc != nil {
+            return checksumFunc(name, checksums.Sha1)
+        }
+        return nil;
+    })
+}
+
+func validateMap(roms []*Rom, nameFunc func(rom *Rom) string, romMap *ChecksumMap,
+                 badNames map[string]string) {
+    for _, rom := range roms {
+        romName := nameFunc(rom)
+
+        // ROMs that were never dumped cannot be checked and are not required
+        if rom.DumpStatus == DumpNoDump {
+            rom.Status = RomNoDump
+            romMap.Delete(romName)
+            continue
+        }
+
+        if checksums, ok := romMap.ToChecksums(romName); ok {
+            // ROMs without any checksum can only be matched by name
+            if !rom.HasChecksum() || rom.Match(checksums) {
+                rom.Status = rom.okStatus()
+            } else {
+                rom.Status = RomCorrupt
+            }
+            romMap.Delete(romName)
+        } else {
+            if name, ok := romMap.Find(rom); ok {
+                rom.Status = RomBadName
+                if badNames != nil {
+                    badNames[romName] = name
+                }
+                romMap.Delete(name)
+            } else {
+                rom.Status = RomMissing
+            }
+        }
+    }
+}
+
 ///////////////////////////////////////////////////////////////////////////////
 // ValidateSizes - Validate the presence, size, and name for each ROM in a
 // machine. The checksum is NOT validated which makes this function much faster
@@ -229,10 +598,15 @@ func ValidateSizes(machine *Machine, extras *[]string, sizeFunc SizeFunc) (bool,
     machine.Path = rr.Path()
 
     for _, file := range rr.Files() {
+        if rr.Format() == gorom.FormatDir && romio.IsChd(file.Name) {
+            continue
+        }
         index, ok := romMap[file.Name]
         if ok {
-            if file.Size == machine.Roms[index].Size {
-                machine.Roms[index].Status = RomOk
+            if machine.Roms[index].DumpStatus == DumpNoDump {
+                machine.Roms[index].Status = RomNoDump
+            } else if file.Size == machine.Roms[index].Size {
+                machine.Roms[index].Status = machine.Roms[index].okStatus()
             } else {
                 machine.Roms[index].Status = RomCorrupt
             }
@@ -245,11 +619,25 @@ func ValidateSizes(machine *Machine, extras *[]string, sizeFunc SizeFunc) (bool,
     }
 
     for index, rom := range machine.Roms {
-        if (rom.Status == RomUnknown) {
+        if rom.DumpStatus == DumpNoDump {
+            machine.Roms[index].Status = RomNoDump
+        } else if (rom.Status == RomUnknown) {
             machine.Roms[index].Status = RomMissing
         }
     }
 
+    // Disks do not have a size in the DAT file so only check they exist
+    for _, disk := range machine.Disks {
+        info, err := os.Stat(DiskPath(machine, disk))
+        if disk.DumpStatus == DumpNoDump {
+            disk.Status = RomNoDump
+        } else if err == nil && info.Mode().IsRegular() {
+            disk.Status = disk.okStatus()
+        } else {
+            disk.Status = RomMissing
+        }
+    }
+
     return true, nil
 }
 
@@ -257,7 +645,8 @@ func ValidateSizes(machine *Machine, extras *[]string, sizeFunc SizeFunc) (bool,
 // ParseDatFile - Parses a ROM dat file or a dir2dat file and executes a
 // callback for the header and also a callback for each machine found.  If any
 // callback returns an error, then parsing stops and the error is propogated
-// up.
+// up.  Both XML and ClrMamePro text DAT files are supported and the format is
+// detected automatically.
 ///////////////////////////////////////////////////////////////////////////////
 
 type HeaderFunc func(header *Header) error
@@ -276,34 +665,153 @@ func normalizeRomNames(machine *Machine) {
     }
 }
 
-func ParseDatFile(datFile string, machFilter []string, headerFunc HeaderFunc, machFunc MachFunc) error {
+// DAT file formats
+const (
+    DatInvalid = iota
+    DatXml
+    DatCmpro
+)
+
+// DetectDatFormat peeks at the start of a DAT file to determine if it is an
+// XML or a ClrMamePro DAT file.  The reader is not advanced.
+func DetectDatFormat(rd *bufio.Reader) int {
+    i := 0
+    if bom, err := rd.Peek(len(utf8Bom)); err == nil && string(bom) == utf8Bom {
+        i = len(utf8Bom)
+    }
+    for ; ; i++ {
+        buf, err := rd.Peek(i + 1)
+        if err != nil {
+            return DatInvalid
+        }
+        if !isCmproSpace(buf[i]) {
+            if buf[i] == '<' {
+                return DatXml
+            }
+            return DatCmpro
+        }
+    }
+}
+
+func OpenDatFile(datFile string) (*bufio.Reader, io.Closer, error) {
     df, err := os.Open(datFile)
     if err != nil {
-        return err
+        return nil, nil, err
     }
-    defer df.Close()
 
-    var buffer io.Reader
     if path.Ext(datFile) == ".gz" {
         gz, err := gzip.NewReader(df)
         if err != nil {
-            return err
+            df.Close()
+            return nil, nil, err
         }
-        defer gz.Close()
-        buffer = bufio.NewReader(gz)
-    } else {
-        buffer = bufio.NewReader(df)
+        return bufio.NewReader(gz), df, nil
     }
 
-    decoder := xml.NewDecoder(buffer)
+    return bufio.NewReader(df), df, nil
+}
 
+func ParseDatFile(datFile string, machFilter []string, headerFunc HeaderFunc, machFunc MachFunc) error {
+    buffer, closer, err := OpenDatFile(datFile)
+    if err != nil {
+        return err
+    }
+    defer closer.Close()
+
+    return ParseDat(buffer, machFilter, headerFunc, func(machine *Machine) error {
+        normalizeRomNames(machine)
+        return machFunc(machine)
+    })
+}
+
+// ParseDat parses a DAT file from a reader like ParseDatFile but without
+// normalizing the ROM names so the machines can be written back out as is
+func ParseDat(buffer *bufio.Reader, machFilter []string, headerFunc HeaderFunc, machFunc MachFunc) error {
     machMap := make(map[string]bool)
     for _, arg := range machFilter {
         machName := romio.MachName(arg)
         machMap[machName] = true
     }
 
-    machCount := len(machFilter)
+    switch DetectDatFormat(buffer) {
+    case DatXml:
+        return parseXml(buffer, machMap, headerFunc, machFunc)
+    case DatCmpro:
+        return parseCmpro(buffer, machMap, headerFunc, machFunc)
+    }
+
+    return fmt.Errorf("invalid dat file format")
+}
+
+var errHeaderFound = errors.New("header found")
+
+// ReadHeader returns the header of a DAT file without parsing the machines.
+// A nil header is returned if the DAT file does not have one.
+func ReadHeader(datFile string) (*Header, error) {
+    var header *Header
+    err := ParseDatFile(datFile, nil, func(h *Header) error {
+        header = h
+        return errHeaderFound
+    }, func(machine *Machine) error {
+        return errHeaderFound
+    })
+    if err != nil && err != errHeaderFound {
+        return nil, err
+    }
+    return header, nil
+}
+
+var errSha1Found = errors.New("SHA-1 found")
+
+// HasMd5Only returns true if the ROMs of a DAT file have MD5 checksums but no
+// SHA-1 checksums
+func HasMd5Only(datFile string) (bool, error) {
+    md5 := false
+    err := ParseDatFile(datFile, nil, nil, func(machine *Machine) error {
+        for _, rom := range machine.Roms {
+            if rom.Sha1 != (checksum.Sha1{}) {
+                return errSha1Found
+            }
+            if rom.Md5 != (checksum.Md5{}) {
+                md5 = true
+            }
+        }
+        return nil
+    })
+    if err == errSha1Found {
+        return false, nil
+    }
+    return md5, err
+}
+
+// FindHeaderDef returns the path of the header definition file for a DAT
+// file.  Like clrmamepro, header definitions are searched for in the DAT
+// file's directory and in its headers subdirectory.
+func FindHeaderDef(datFile string, headerDef string) (string, bool) {
+    if headerDef == "" {
+        return "", false
+    }
+    headerDef = FromDatPath(headerDef)
+    paths := []string{ headerDef }
+    if !path.IsAbs(headerDef) {
+        datDir := path.Dir(datFile)
+        paths = []string{ path.Join(datDir, headerDef), path.Join(datDir, "headers", headerDef) }
+    }
+    for _, p := range paths {
+        info, err := os.Stat(p)
+        if err == nil && info.Mode().IsRegular() {
+            return p, true
+        }
+    }
+    return "", false
+}
+
+func parseXml(buffer io.Reader, machMap map[string]bool, headerFunc HeaderFunc, machFunc MachFunc) error {
+    var err error
+
+    decoder := xml.NewDecoder(buffer)
+
+    machCount := len(machMap)
     datafile := false
     for {
         tok, _ := decoder.Token()
@@ -322,7 +830,7 @@ func ParseDatFile(datFile string, machFilter []string, headerFunc HeaderFunc, ma
                     if headerFunc != nil {
                         err = headerFunc(&header)
                         if err != nil {
-                            return nil
+                            return err
                         }
                     }
                 } else if se.Name.Local == "machine" || se.Name.Local == "game" {
@@ -333,7 +841,6 @@ func ParseDatFile(datFile string, machFilter []string, headerFunc HeaderFunc, ma
                                 if _, ok := machMap[attr.Value]; ok {
                                     machCount--
                                     decoder.DecodeElement(&machine, &se)
-                                    normalizeRomNames(&machine)
                                     err = machFunc(&machine)
                                     if err != nil {
                                         return err
@@ -347,7 +854,6 @@ func ParseDatFile(datFile string, machFilter []string, headerFunc HeaderFunc, ma
                         }
                     } else {
                         decoder.DecodeElement(&machine, &se)
-                        normalizeRomNames(&machine)
                         err = machFunc(&machine)
                         if err != nil {
                             return err
@@ -364,3 +870,55 @@ func ParseDatFile(datFile string, machFilter []string, headerFunc HeaderFunc, ma
 
     return nil
 }
+
+func parseCmpro(buffer io.Reader, machMap map[string]bool, headerFunc HeaderFunc, machFunc MachFunc) error {
+    decoder := NewCmproDecoder(buffer)
+
+    machCount := len(machMap)
+    found := false
+    for {
+        elem, err := decoder.Decode()
+        if err == io.EOF {
+            break
+        } else if err != nil {
+            return err
+        }
+
+        if elem.IsHeader() {
+            found = true
+            if headerFunc != nil {
+                err = headerFunc(elem.Header())
+                if err != nil {
+                    return err
+                }
+            }
+        } else if elem.IsMachine() {
+            found = true
+            if machCount > 0 {
+                if _, ok := machMap[elem.Get("name")]; !ok {
+                    continue
+                }
+                machCount--
+            }
+
+            machine, err := elem.Machine()
+            if err != nil {
+                return err
+            }
+            err = machFunc(machine)
+            if err != nil {
+                return err
+            }
+
+            if len(machMap) > 0 && machCount == 0 {
+                break
+            }
+        }
+    }
+
+    if !found {
+        return fmt.Errorf("invalid dat file format")
+    }
+
+    return nil
+}
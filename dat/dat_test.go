@@ -16,9 +16,14 @@
 package dat
 
 import (
+    "bufio"
+    "bytes"
+    "compress/gzip"
+    "reflect"
     "testing"
     "fmt"
     "os"
+    "strings"
 
     "gorom"
     "gorom/test"
@@ -101,9 +106,108 @@ func TestDatFileDir(t *testing.T) {
     test.ForEachDat(t, test.DirDats, runDatFileTest)
 }
 
+func TestDatFileCmpro(t *testing.T) {
+    test.ForEachDat(t, test.CmproDats, runDatFileTest)
+}
+
+func TestDatFileCmproFilter(t *testing.T) {
+    defer test.Chdir(t, "")()
+    df := &test.CmproDats[0]
+    names := []string{}
+    err := ParseDatFile(df.Path, []string{"machine2.zip"}, nil, func(machine *Machine) error {
+        if !machineEqual(machine, df.Machines) {
+            return fmt.Errorf("machine fields do not match")
+        }
+        names = append(names, machine.Name)
+        return nil
+    })
+    if err != nil {
+        test.Fail(t, err)
+    }
+    if len(names) != 1 || names[0] != "machine2" {
+        test.Fail(t, fmt.Sprintf("unexpected machines: %v", names))
+    }
+}
+
+func TestReadHeaderDef(t *testing.T) {
+    defer test.Chdir(t, "")()
+
+    header, err := ReadHeader("dats/header.dat")
+    if err != nil {
+        test.Fail(t, err)
+    }
+    if header == nil || header.ClrMamePro.HeaderDef != "gorom.xml" {
+        test.Fail(t, "header definition not found")
+    }
+    defPath, ok := FindHeaderDef("dats/header.dat", header.ClrMamePro.HeaderDef)
+    if !ok || defPath != "dats/headers/gorom.xml" {
+        test.Fail(t, fmt.Sprintf("wrong header definition path: %s", defPath))
+    }
+
+    decoder := NewCmproDecoder(strings.NewReader(`clrmamepro ( name ziproms header "No-Intro_NES.xml" )`))
+    elem, err := decoder.Decode()
+    if err != nil {
+        test.Fail(t, err)
+    }
+    if elem.Header().ClrMamePro.HeaderDef != "No-Intro_NES.xml" {
+        test.Fail(t, "cmpro header definition mismatch")
+    }
+}
+
+func TestDatFileCmproDisk(t *testing.T) {
+    decoder := NewCmproDecoder(strings.NewReader(`game ( name machine1 disk ( name disk1 sha1 5ece4391740056c907bf16d57c530fa4da1554bd merge disk0 ) )`))
+    elem, err := decoder.Decode()
+    if err != nil {
+        test.Fail(t, err)
+    }
+    machine, err := elem.Machine()
+    if err != nil {
+        test.Fail(t, err)
+    }
+    if len(machine.Disks) != 1 || machine.Disks[0].Name != "disk1" || machine.Disks[0].Merge != "disk0" {
+        test.Fail(t, "disk mismatch")
+    }
+}
+
+func TestDatFileCmproDump(t *testing.T) {
+    decoder := NewCmproDecoder(strings.NewReader(`game ( name machine1 rom ( name rom_1.bin size 4096 flags nodump ) rom ( name rom_2.bin size 4096 crc b7426747 status baddump ) )`))
+    elem, err := decoder.Decode()
+    if err != nil {
+        test.Fail(t, err)
+    }
+    machine, err := elem.Machine()
+    if err != nil {
+        test.Fail(t, err)
+    }
+    if machine.Roms[0].DumpStatus != DumpNoDump || machine.Roms[1].DumpStatus != DumpBadDump {
+        test.Fail(t, "dump status mismatch")
+    }
+}
+
+func TestCmproDecoderErrors(t *testing.T) {
+    dats := []string{
+        "game ( name \"machine1 )",
+        "game ( name machine1",
+        "game name machine1 )",
+        "game ( rom ( name rom_1.bin size 4096 crc xyz ) )",
+        "( name machine1 )",
+    }
+    for _, str := range dats {
+        decoder := NewCmproDecoder(strings.NewReader(str))
+        elem, err := decoder.Decode()
+        if err == nil && elem.IsMachine() {
+            _, err = elem.Machine()
+        }
+        if err == nil {
+            test.Fail(t, "expected error for: " + str)
+        }
+    }
+}
+
 func createMachine(machName string, testMach *test.Machine) *Machine {
-    machine := &Machine{ machName, testMach.Description, testMach.Year,
-        testMach.Manufacturer, testMach.Category, nil, "", gorom.FormatZip }
+    machine := &Machine{ Name: machName, Description: testMach.Description,
+        Year: testMach.Year, Manufacturer: testMach.Manufacturer,
+        Category: testMach.Category, Format: gorom.FormatZip }
 
     for romName, testRom := range testMach.Roms {
         crc32, ok := checksum.NewCrc32String(testRom.Crc32)
@@ -114,13 +218,13 @@ func createMachine(machName string, testMach *test.Machine) *Machine {
         if !ok {
             return nil
         }
-        machine.Roms = append(machine.Roms, &Rom{ romName, testRom.Size, crc32, sha1, 0 })
+        machine.Roms = append(machine.Roms, &Rom{ Name: romName, Size: testRom.Size, Crc: crc32, Sha1: sha1 })
     }
     return machine
 }
 
 func validateChecksumTest(t *testing.T, df *test.DatFile) {
-    rdb, err := romdb.OpenRomDB(".", false)
+    rdb, err := romdb.OpenRomDB(".", nil)
     if err != nil {
         test.Fail(t, err)
     }
@@ -243,3 +347,180 @@ func TestValidateSizeZip(t *testing.T) {
 func TestValidateSizeDir(t *testing.T) {
     test.ForEachDat(t, test.DirDats, runValidateSizeTest)
 }
+
+func TestValidateChecksumDisk(t *testing.T) {
+    machines := []*Machine{}
+    func() {
+        defer test.Chdir(t, "")()
+        err := ParseDatFile("dats/chd.dat", nil, nil, func(machine *Machine) error {
+            machines = append(machines, machine)
+            return nil
+        })
+        if err != nil {
+            test.Fail(t, err)
+        }
+    }()
+
+    defer test.Chdir(t, "roms/chd")()
+    defer os.Remove(".gorom.db")
+
+    rdb, err := romdb.OpenRomDB(".", nil)
+    if err != nil {
+        test.Fail(t, err)
+    }
+    defer rdb.Close()
+
+    expStatus := []int{ RomOk, RomBadName, RomUnknown }
+    for i, machine := range machines {
+        if len(machine.Disks) != 1 {
+            test.Fail(t, "disk count mismatch")
+        }
+        badNames := map[string]string{}
+        extras := []string{}
+        ok, err := ValidateChecksums(machine, rdb, badNames, &extras, nil)
+        if err != nil {
+            test.Fail(t, err)
+        }
+        if ok != (expStatus[i] != RomUnknown) {
+            test.Fail(t, "machine " + machine.Name + " validation mismatch")
+        }
+        if machine.Disks[0].Status != expStatus[i] {
+            test.Fail(t, fmt.Sprintf("machine %s disk status mismatch: %d", machine.Name, machine.Disks[0].Status))
+        }
+        if len(extras) != 0 {
+            test.Fail(t, "unexpected extras")
+        }
+        if expStatus[i] == RomBadName && badNames["disk2.chd"] != "wrong.chd" {
+            test.Fail(t, "bad disk name mismatch")
+        }
+    }
+}
+
+func writerRoundTrip(t *testing.T, format int, compress bool, header *Header, machines []*Machine) {
+    var buf bytes.Buffer
+    dw := NewWriter(&buf, format, compress)
+    err := dw.WriteHeader(header)
+    if err != nil {
+        test.Fail(t, err)
+    }
+    for _, machine := range machines {
+        err = dw.WriteMachine(machine)
+        if err != nil {
+            test.Fail(t, err)
+        }
+    }
+    err = dw.Close()
+    if err != nil {
+        test.Fail(t, err)
+    }
+
+    rd := bufio.NewReader(&buf)
+    if compress {
+        gz, err := gzip.NewReader(&buf)
+        if err != nil {
+            test.Fail(t, err)
+        }
+        rd = bufio.NewReader(gz)
+    }
+    if DetectDatFormat(rd) != format {
+        test.Fail(t, "format mismatch")
+    }
+
+    index := 0
+    err = ParseDat(rd, nil, func(actHeader *Header) error {
+        if !reflect.DeepEqual(actHeader, header) {
+            return fmt.Errorf("header mismatch: %+v", actHeader)
+        }
+        return nil
+    }, func(machine *Machine) error {
+        expected := *machines[index]
+        if format == DatCmpro {
+            expected.XMLName.Local = "game"
+        } else if expected.XMLName.Local != "game" {
+            expected.XMLName.Local = "machine"
+        }
+        if !reflect.DeepEqual(machine, &expected) {
+            return fmt.Errorf("machine mismatch: %+v", machine)
+        }
+        index++
+        return nil
+    })
+    if err != nil {
+        test.Fail(t, err)
+    }
+    if index != len(machines) {
+        test.Fail(t, "machine count mismatch")
+    }
+}
+
+func TestWriterRoundTrip(t *testing.T) {
+    defer test.Chdir(t, "")()
+
+    for _, datFile := range []string{ "dats/zip.dat", "dats/clone.dat", "dats/dump.dat", "dats/chd.dat", "dats/md5.dat", "dats/header.dat" } {
+        var header *Header
+        machines := []*Machine{}
+        err := ParseDatFile(datFile, nil, func(h *Header) error {
+            header = h
+            return nil
+        }, func(machine *Machine) error {
+            machines = append(machines, machine)
+            return nil
+        })
+        if err != nil {
+            test.Fail(t, err)
+        }
+        writerRoundTrip(t, DatXml, false, header, machines)
+        writerRoundTrip(t, DatCmpro, false, header, machines)
+        writerRoundTrip(t, DatXml, true, header, machines)
+    }
+}
+
+func TestWriterEscape(t *testing.T) {
+    header := &Header{ Name: "Tom & Jerry's <DAT>", Description: `"quoted"`, Homepage: "No-Intro" }
+    machine := &Machine{ Name: "a&b <c>", Description: `Street Fighter II": "CE"`, IsBios: "yes",
+                         Roms: []*Rom{ { Name: `dir\rom&1.bin`, Size: 16, Date: "1990" } },
+                         Samples: []*Sample{ { Name: "boom" } } }
+    writerRoundTrip(t, DatXml, false, header, []*Machine{ machine })
+
+    var buf bytes.Buffer
+    dw := NewWriter(&buf, DatCmpro, false)
+    if dw.WriteHeader(header) == nil {
+        test.Fail(t, "quote in ClrMamePro DAT not detected")
+    }
+}
+
+func TestWriterKeepXml(t *testing.T) {
+    datXml := `<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE datafile PUBLIC "-//Logiqx//DTD ROM Management Datafile//EN" "http://www.logiqx.com/Dats/datafile.dtd">
+
+<datafile>
+	<header>
+		<name>keep</name>
+		<author></author>
+		<retool version="2"/>
+	</header>
+	<game name="game1" id="7">
+		<description>game1</description>
+		<release name="game1" region="EUR"/>
+		<rom name="rom1.bin" size="16" crc="12345678" serial="A1"/>
+		<video screen="raster"/>
+	</game>
+</datafile>
+`
+    var buf bytes.Buffer
+    dw := NewWriter(&buf, DatXml, false)
+    err := ParseDat(bufio.NewReader(strings.NewReader(datXml)), nil, func(header *Header) error {
+        return dw.WriteHeader(header)
+    }, func(machine *Machine) error {
+        return dw.WriteMachine(machine)
+    })
+    if err == nil {
+        err = dw.Close()
+    }
+    if err != nil {
+        test.Fail(t, err)
+    }
+    if buf.String() != datXml {
+        test.Fail(t, "XML DAT mismatch:\n" + buf.String())
+    }
+}
@@ -0,0 +1,417 @@
+//  GoRom - Emulator ROM Management Utilities
+//  Copyright (C) 2020 Scott Shumate <scott@shumatech.com>
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package dat
+
+import (
+    "fmt"
+    "path"
+
+    "gorom/checksum"
+    "gorom/romio"
+)
+
+///////////////////////////////////////////////////////////////////////////////
+// Set Types
+//
+// A DAT file describes parent/clone relationships with the cloneof and romof
+// machine attributes and the merge ROM attribute.  The same DAT can be used
+// to build a ROM set in any of these layouts:
+//
+//   merged     - clones are merged into their parent machine
+//   split      - clones only contain the ROMs not in their parent
+//   non-merged - clones contain all of their ROMs including the parent ROMs
+//
+// In all of the layouts, ROMs provided by a BIOS machine remain in the BIOS
+// machine.
+///////////////////////////////////////////////////////////////////////////////
+
+const (
+    SetAsIs = iota
+    SetMerged
+    SetSplit
+    SetNonMerged
+    SetAuto
+)
+
+func ParseSetType(str string) (int, error) {
+    switch str {
+    case "":
+        return SetAsIs, nil
+    case "merged":
+        return SetMerged, nil
+    case "split":
+        return SetSplit, nil
+    case "non-merged":
+        return SetNonMerged, nil
+    case "auto":
+        return SetAuto, nil
+    }
+    return SetAsIs, fmt.Errorf("invalid set type '%s'", str)
+}
+
+func SetTypeName(setType int) string {
+    switch setType {
+    case SetMerged:
+        return "merged"
+    case SetSplit:
+        return "split"
+    case SetNonMerged:
+        return "non-merged"
+    case SetAuto:
+        return "auto"
+    }
+    return "as-is"
+}
+
+type setResolver struct {
+    machMap map[string]*Machine
+    ownMap  map[string][]*Rom
+}
+
+func newSetResolver(machines []*Machine) *setResolver {
+    sr := &setResolver{
+        machMap: make(map[string]*Machine),
+        ownMap: make(map[string][]*Rom),
+    }
+    for _, machine := range machines {
+        sr.machMap[machine.Name] = machine
+    }
+    return sr
+}
+
+func copyRom(rom *Rom) *Rom {
+    dup := *rom
+    return &dup
+}
+
+func sameRom(rom1 *Rom, rom2 *Rom) bool {
+    if rom1.Sha1 != (checksum.Sha1{}) && rom2.Sha1 != (checksum.Sha1{}) {
+        return rom1.Sha1 == rom2.Sha1
+    }
+    if rom1.Md5 != (checksum.Md5{}) && rom2.Md5 != (checksum.Md5{}) {
+        return rom1.Md5 == rom2.Md5
+    }
+    // ROMs that were never dumped have nothing to compare
+    if rom1.Crc == (checksum.Crc32{}) && rom2.Crc == (checksum.Crc32{}) {
+        return false
+    }
+    return rom1.Size == rom2.Size && rom1.Crc == rom2.Crc
+}
+
+// romOf returns the name of the machine that a machine inherits ROMs from
+func romOf(machine *Machine) string {
+    if machine.RomOf != "" {
+        return machine.RomOf
+    }
+    return machine.CloneOf
+}
+
+// inherited returns true if the ROM is provided by a machine in the romof
+// chain of the machine
+func (sr *setResolver) inherited(machine *Machine, rom *Rom) bool {
+    visited := map[string]bool{ machine.Name: true }
+    for name := romOf(machine); name != "" && !visited[name]; {
+        visited[name] = true
+        parent, ok := sr.machMap[name]
+        if !ok {
+            // A missing parent can only be determined by the merge name
+            return rom.Merge != ""
+        }
+        for _, prom := range parent.Roms {
+            if (rom.Merge != "" && prom.Name == rom.Merge) || sameRom(rom, prom) {
+                return true
+            }
+        }
+        name = romOf(parent)
+    }
+    return false
+}
+
+// own returns the ROMs that are unique to a machine
+func (sr *setResolver) own(machine *Machine) []*Rom {
+    if roms, ok := sr.ownMap[machine.Name]; ok {
+        return roms
+    }
+    roms := []*Rom{}
+    for _, rom := range machine.Roms {
+        if !sr.inherited(machine, rom) {
+            roms = append(roms, rom)
+        }
+    }
+    sr.ownMap[machine.Name] = roms
+    return roms
+}
+
+// parent returns the parent machine of a clone or nil if not a clone
+func (sr *setResolver) parent(machine *Machine) *Machine {
+    if machine.CloneOf == "" || machine.CloneOf == machine.Name {
+        return nil
+    }
+    parent, ok := sr.machMap[machine.CloneOf]
+    if !ok {
+        return nil
+    }
+    return parent
+}
+
+func hasRom(roms []*Rom, rom *Rom) bool {
+    for _, r := range roms {
+        if r.Name == rom.Name || sameRom(r, rom) {
+            return true
+        }
+    }
+    return false
+}
+
+func (sr *setResolver) split(machine *Machine) *Machine {
+    dup := *machine
+    dup.Roms = []*Rom{}
+    for _, rom := range sr.own(machine) {
+        dup.Roms = append(dup.Roms, copyRom(rom))
+    }
+    return &dup
+}
+
+func (sr *setResolver) nonMerged(machine *Machine) *Machine {
+    dup := sr.split(machine)
+    visited := map[string]bool{ machine.Name: true }
+    for parent := sr.parent(machine); parent != nil && !visited[parent.Name]; parent = sr.parent(parent) {
+        visited[parent.Name] = true
+        for _, rom := range sr.own(parent) {
+            if !hasRom(dup.Roms, rom) {
+                prom := copyRom(rom)
+                prom.Merge = rom.Name
+                dup.Roms = append(dup.Roms, prom)
+            }
+        }
+    }
+    return dup
+}
+
+func (sr *setResolver) merged(machine *Machine, clones []*Machine) *Machine {
+    dup := sr.split(machine)
+    for _, clone := range clones {
+        for _, rom := range sr.own(clone) {
+            found := false
+            conflict := false
+            for _, r := range dup.Roms {
+                if r.Name == rom.Name {
+                    if sameRom(r, rom) {
+                        found = true
+                    } else {
+                        conflict = true
+                    }
+                    break
+                }
+            }
+            if found {
+                continue
+            }
+            crom := copyRom(rom)
+            if conflict {
+                // Clone ROMs with the same name as a different parent ROM
+                // are stored in a subdirectory named after the clone
+                crom.Name = path.Join(clone.Name, rom.Name)
+            }
+            dup.Roms = append(dup.Roms, crom)
+        }
+    }
+    return dup
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// ResolveSetType - Rewrite the machines in a DAT file to the layout of the
+// given set type.  New machines and ROMs are returned and the original
+// machines are not modified.
+///////////////////////////////////////////////////////////////////////////////
+
+func ResolveSetType(machines []*Machine, setType int) []*Machine {
+    if setType != SetMerged && setType != SetSplit && setType != SetNonMerged {
+        return machines
+    }
+    resolved := resolveRoms(machines, setType)
+
+    // Disks follow the same rules as ROMs so resolve them with the disks in
+    // place of the ROMs.  The resulting machines are in the same order.
+    diskMachines := make([]*Machine, len(machines))
+    for i, machine := range machines {
+        dup := *machine
+        dup.Roms = machine.Disks
+        diskMachines[i] = &dup
+    }
+    for i, machine := range resolveRoms(diskMachines, setType) {
+        resolved[i].Disks = machine.Roms
+    }
+
+    return resolved
+}
+
+func resolveRoms(machines []*Machine, setType int) []*Machine {
+    sr := newSetResolver(machines)
+    resolved := []*Machine{}
+
+    switch setType {
+    case SetSplit:
+        for _, machine := range machines {
+            resolved = append(resolved, sr.split(machine))
+        }
+    case SetNonMerged:
+        for _, machine := range machines {
+            resolved = append(resolved, sr.nonMerged(machine))
+        }
+    case SetMerged:
+        clones := map[string][]*Machine{}
+        for _, machine := range machines {
+            if parent := sr.parent(machine); parent != nil {
+                clones[parent.Name] = append(clones[parent.Name], machine)
+            }
+        }
+        for _, machine := range machines {
+            if sr.parent(machine) == nil {
+                resolved = append(resolved, sr.merged(machine, clones[machine.Name]))
+            }
+        }
+    default:
+        resolved = machines
+    }
+
+    return resolved
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// DetectSetType - Determine the layout of the ROM set in the current
+// directory from the files present in the parent and clone machines.  Only
+// the file names are examined so no checksums are calculated.  SetAsIs is
+// returned if the layout cannot be determined.
+///////////////////////////////////////////////////////////////////////////////
+
+func romFileSet(machName string) (map[string]bool, bool) {
+    rr, err := romio.OpenRomReaderByName(machName)
+    if rr == nil || err != nil {
+        return nil, false
+    }
+    defer rr.Close()
+
+    files := map[string]bool{}
+    for _, file := range rr.Files() {
+        files[file.Name] = true
+    }
+    return files, true
+}
+
+func DetectSetType(machines []*Machine) int {
+    sr := newSetResolver(machines)
+    votes := map[int]int{}
+
+    for _, machine := range machines {
+        parent := sr.parent(machine)
+        if parent == nil {
+            continue
+        }
+
+        files, ok := romFileSet(machine.Name)
+        if !ok {
+            // Clone is missing so check if its ROMs are in the parent
+            pfiles, ok := romFileSet(parent.Name)
+            if !ok {
+                continue
+            }
+            merged := sr.merged(parent, []*Machine{ machine })
+            for _, rom := range merged.Roms[len(sr.own(parent)):] {
+                if pfiles[rom.Name] {
+                    votes[SetMerged]++
+                    break
+                }
+            }
+            continue
+        }
+
+        // Clone is present so check if it contains the parent ROMs
+        own := len(sr.own(machine))
+        nonMerged := sr.nonMerged(machine)
+        for _, rom := range nonMerged.Roms[own:] {
+            if files[rom.Name] {
+                votes[SetNonMerged]++
+            } else {
+                votes[SetSplit]++
+            }
+            break
+        }
+    }
+
+    setType := SetAsIs
+    max := 0
+    for _, st := range []int{ SetMerged, SetSplit, SetNonMerged } {
+        if votes[st] > max {
+            setType = st
+            max = votes[st]
+        }
+    }
+    return setType
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// ParseDatFileSetType - Parses a DAT file like ParseDatFile but with the
+// machines rewritten to the given set type.  The entire DAT file must be read
+// before any machines are returned since the parent of a clone can appear
+// anywhere in the file.  For SetAuto, the set type is detected from the
+// current directory and passed to the setTypeFunc callback (if non-nil).
+///////////////////////////////////////////////////////////////////////////////
+
+type SetTypeFunc func(setType int) error
+
+func ParseDatFileSetType(datFile string, machFilter []string, setType int,
+                         headerFunc HeaderFunc, setTypeFunc SetTypeFunc, machFunc MachFunc) error {
+    if setType == SetAsIs {
+        return ParseDatFile(datFile, machFilter, headerFunc, machFunc)
+    }
+
+    machines := []*Machine{}
+    err := ParseDatFile(datFile, nil, headerFunc, func(machine *Machine) error {
+        machines = append(machines, machine)
+        return nil
+    })
+    if err != nil {
+        return err
+    }
+
+    if setType == SetAuto {
+        setType = DetectSetType(machines)
+        if setTypeFunc != nil {
+            err = setTypeFunc(setType)
+            if err != nil {
+                return err
+            }
+        }
+    }
+
+    machMap := make(map[string]bool)
+    for _, arg := range machFilter {
+        machMap[romio.MachName(arg)] = true
+    }
+
+    for _, machine := range ResolveSetType(machines, setType) {
+        if len(machMap) > 0 && !machMap[machine.Name] {
+            continue
+        }
+        err = machFunc(machine)
+        if err != nil {
+            return err
+        }
+    }
+
+    return nil
+}
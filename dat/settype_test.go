@@ -0,0 +1,139 @@
+//  GoRom - Emulator ROM Management Utilities
+//  Copyright (C) 2020 Scott Shumate <scott@shumatech.com>
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package dat
+
+import (
+    "fmt"
+    "io/ioutil"
+    "os"
+    "path"
+    "sort"
+    "strings"
+    "testing"
+
+    "gorom/test"
+)
+
+var (
+    setTypeRoms = map[int]map[string]string {
+        SetSplit: {
+            "bios": "rom_1.bin",
+            "parent": "rom_2.bin rom_3.bin",
+            "clone": "rom_3.bin rom_4.bin",
+        },
+        SetNonMerged: {
+            "bios": "rom_1.bin",
+            "parent": "rom_2.bin rom_3.bin",
+            "clone": "rom_2.bin rom_3.bin rom_4.bin",
+        },
+        SetMerged: {
+            "bios": "rom_1.bin",
+            "parent": "clone/rom_3.bin rom_2.bin rom_3.bin rom_4.bin",
+        },
+    }
+)
+
+func parseCloneDat(t *testing.T) []*Machine {
+    defer test.Chdir(t, "")()
+    machines := []*Machine{}
+    err := ParseDatFile("dats/clone.dat", nil, nil, func(machine *Machine) error {
+        machines = append(machines, machine)
+        return nil
+    })
+    if err != nil {
+        test.Fail(t, err)
+    }
+    return machines
+}
+
+func romNames(machine *Machine) string {
+    names := []string{}
+    for _, rom := range machine.Roms {
+        names = append(names, rom.Name)
+    }
+    sort.Strings(names)
+    return strings.Join(names, " ")
+}
+
+func TestCloneAttrs(t *testing.T) {
+    machines := parseCloneDat(t)
+    clone := machines[2]
+    if clone.CloneOf != "parent" || clone.RomOf != "parent" {
+        test.Fail(t, "clone attributes do not match")
+    }
+    if clone.Roms[0].Merge != "rom_1.bin" || clone.Roms[3].Merge != "" {
+        test.Fail(t, "merge attributes do not match")
+    }
+}
+
+func TestResolveSetType(t *testing.T) {
+    for setType, expRoms := range setTypeRoms {
+        machines := parseCloneDat(t)
+        resolved := ResolveSetType(machines, setType)
+        if len(resolved) != len(expRoms) {
+            test.Fail(t, fmt.Sprintf("%s: machine count mismatch", SetTypeName(setType)))
+        }
+        for _, machine := range resolved {
+            names := romNames(machine)
+            if names != expRoms[machine.Name] {
+                test.Fail(t, fmt.Sprintf("%s: %s roms mismatch: %s != %s", SetTypeName(setType),
+                    machine.Name, names, expRoms[machine.Name]))
+            }
+        }
+        // Original machines must not be modified
+        if len(machines[2].Roms) != 4 {
+            test.Fail(t, "original machine modified")
+        }
+    }
+}
+
+func createSetType(t *testing.T, dir string, expRoms map[string]string) {
+    for machName, roms := range expRoms {
+        for _, name := range strings.Split(roms, " ") {
+            romPath := path.Join(dir, machName, name)
+            err := os.MkdirAll(path.Dir(romPath), 0755)
+            if err != nil {
+                test.Fail(t, err)
+            }
+            err = ioutil.WriteFile(romPath, []byte{}, 0644)
+            if err != nil {
+                test.Fail(t, err)
+            }
+        }
+    }
+}
+
+func TestDetectSetType(t *testing.T) {
+    for setType, expRoms := range setTypeRoms {
+        machines := parseCloneDat(t)
+
+        tmpdir, err := ioutil.TempDir("", "gorom*")
+        if err != nil {
+            test.Fail(t, err)
+        }
+        createSetType(t, tmpdir, expRoms)
+
+        wd, _ := os.Getwd()
+        os.Chdir(tmpdir)
+        detected := DetectSetType(machines)
+        os.Chdir(wd)
+        os.RemoveAll(tmpdir)
+
+        if detected != setType {
+            test.Fail(t, fmt.Sprintf("detected %s instead of %s", SetTypeName(detected), SetTypeName(setType)))
+        }
+    }
+}
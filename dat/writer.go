@@ -0,0 +1,419 @@
+//  GoRom - Emulator ROM Management Utilities
+//  Copyright (C) 2020 Scott Shumate <scott@shumatech.com>
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package dat
+
+import (
+    "bufio"
+    "fmt"
+    "io"
+    "os"
+    "path"
+    "encoding/xml"
+    "strings"
+
+    "compress/gzip"
+
+    "gorom/checksum"
+)
+
+///////////////////////////////////////////////////////////////////////////////
+// DAT Writer
+//
+// The writer streams a header and machines out as a Logiqx XML or a
+// ClrMamePro text DAT file.  Every field that is parsed from a DAT file is
+// written so a DAT file can be parsed, filtered, and written back out without
+// losing data.  The XML elements and attributes that gorom does not use are
+// only written to XML DAT files.
+///////////////////////////////////////////////////////////////////////////////
+
+const xmlDeclaration = `<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE datafile PUBLIC "-//Logiqx//DTD ROM Management Datafile//EN" "http://www.logiqx.com/Dats/datafile.dtd">
+
+<datafile>
+`
+
+const xmlDatafileEnd = "</datafile>\n"
+
+// ParseDatFormat returns the DAT file format for a format name.  An empty
+// name returns DatInvalid so the caller can choose a default.
+func ParseDatFormat(name string) (int, error) {
+    switch strings.ToLower(name) {
+    case "":
+        return DatInvalid, nil
+    case "xml", "logiqx":
+        return DatXml, nil
+    case "cmpro", "clrmamepro":
+        return DatCmpro, nil
+    }
+    return DatInvalid, fmt.Errorf("invalid DAT format '%s'", name)
+}
+
+type Writer struct {
+    wr      *bufio.Writer
+    gz      *gzip.Writer
+    closer  io.Closer
+    format  int
+    started bool
+    blocks  int
+    require bool
+    err     error
+}
+
+// NewWriter returns a DAT writer in the format (DatXml or DatCmpro) that
+// writes to w.  The output is gzip compressed if compress is true.
+func NewWriter(w io.Writer, format int, compress bool) *Writer {
+    dw := &Writer{ format: format }
+    if compress {
+        dw.gz = gzip.NewWriter(w)
+        w = dw.gz
+    }
+    dw.wr = bufio.NewWriter(w)
+    return dw
+}
+
+// CreateDatFile creates a DAT file for a writer.  The file is gzip compressed
+// if it has a .gz extension.
+func CreateDatFile(datFile string, format int) (*Writer, error) {
+    fh, err := os.Create(datFile)
+    if err != nil {
+        return nil, err
+    }
+    dw := NewWriter(fh, format, path.Ext(datFile) == ".gz")
+    dw.closer = fh
+    return dw, nil
+}
+
+// RequireHeader makes the header always have the name, description, version,
+// and author elements that a Logiqx DAT file requires even if they are empty.
+// Otherwise only the header fields with a value or that were empty in the
+// DAT file are written.
+func (dw *Writer) RequireHeader() {
+    dw.require = true
+}
+
+func (dw *Writer) keepEmpty(header *Header, name string) bool {
+    if dw.require {
+        switch name {
+        case "name", "description", "version", "author":
+            return true
+        }
+    }
+    return header.IsEmpty(name)
+}
+
+func (dw *Writer) printf(format string, a ...interface{}) {
+    if dw.err == nil {
+        _, dw.err = fmt.Fprintf(dw.wr, format, a...)
+    }
+}
+
+func (dw *Writer) start() {
+    if !dw.started {
+        dw.started = true
+        if dw.format == DatXml {
+            dw.printf("%s", xmlDeclaration)
+        }
+    }
+}
+
+// WriteHeader writes the DAT file header.  It must be called before any
+// machines are written if the DAT file has a header.
+func (dw *Writer) WriteHeader(header *Header) error {
+    dw.start()
+    if dw.format == DatCmpro {
+        dw.cmproHeader(header)
+    } else {
+        dw.xmlHeader(header)
+    }
+    return dw.err
+}
+
+func (dw *Writer) WriteMachine(machine *Machine) error {
+    dw.start()
+    if dw.format == DatCmpro {
+        dw.cmproMachine(machine)
+    } else {
+        dw.xmlMachine(machine)
+    }
+    return dw.err
+}
+
+// Close finishes the DAT file and flushes it.  The underlying writer is only
+// closed if the writer was created with CreateDatFile.
+func (dw *Writer) Close() error {
+    dw.start()
+    if dw.format == DatXml {
+        dw.printf("%s", xmlDatafileEnd)
+    }
+    if err := dw.wr.Flush(); dw.err == nil {
+        dw.err = err
+    }
+    if dw.gz != nil {
+        if err := dw.gz.Close(); dw.err == nil {
+            dw.err = err
+        }
+    }
+    if dw.closer != nil {
+        if err := dw.closer.Close(); dw.err == nil {
+            dw.err = err
+        }
+    }
+    return dw.err
+}
+
+// hasCrc returns true if a ROM has a CRC to write.  A zero CRC is only valid
+// for ROMs that also have a SHA-1.
+func hasCrc(rom *Rom) bool {
+    return rom.Crc != (checksum.Crc32{}) || rom.Sha1 != (checksum.Sha1{})
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// Logiqx XML
+///////////////////////////////////////////////////////////////////////////////
+
+var xmlEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;", `"`, "&quot;")
+
+func xmlEscape(str string) string {
+    return xmlEscaper.Replace(str)
+}
+
+func (dw *Writer) xmlElement(indent string, name string, value string, always bool) {
+    if value != "" || always {
+        dw.printf("%s<%s>%s</%s>\n", indent, name, xmlEscape(value), name)
+    }
+}
+
+func (dw *Writer) xmlAttr(name string, value string) {
+    if value != "" {
+        dw.printf(` %s="%s"`, name, xmlEscape(value))
+    }
+}
+
+func (dw *Writer) xmlAttrs(attrs []xml.Attr) {
+    for _, attr := range attrs {
+        dw.printf(` %s="%s"`, attr.Name.Local, xmlEscape(attr.Value))
+    }
+}
+
+// xmlOther writes an element that was kept from the DAT file as is
+func (dw *Writer) xmlOther(indent string, elem XmlElement) {
+    dw.printf("%s<%s", indent, elem.XMLName.Local)
+    dw.xmlAttrs(elem.Attrs)
+    if elem.InnerXml == "" {
+        dw.printf("/>\n")
+    } else {
+        dw.printf(">%s</%s>\n", elem.InnerXml, elem.XMLName.Local)
+    }
+}
+
+func (dw *Writer) xmlHeader(header *Header) {
+    dw.printf("\t<header>\n")
+    dw.xmlElement("\t\t", "name", header.Name, dw.keepEmpty(header, "name"))
+    dw.xmlElement("\t\t", "description", header.Description, dw.keepEmpty(header, "description"))
+    dw.xmlElement("\t\t", "category", header.Category, dw.keepEmpty(header, "category"))
+    dw.xmlElement("\t\t", "version", header.Version, dw.keepEmpty(header, "version"))
+    dw.xmlElement("\t\t", "date", header.Date, dw.keepEmpty(header, "date"))
+    dw.xmlElement("\t\t", "author", header.Author, dw.keepEmpty(header, "author"))
+    dw.xmlElement("\t\t", "email", header.Email, dw.keepEmpty(header, "email"))
+    dw.xmlElement("\t\t", "homepage", header.Homepage, dw.keepEmpty(header, "homepage"))
+    dw.xmlElement("\t\t", "url", header.Url, dw.keepEmpty(header, "url"))
+    dw.xmlElement("\t\t", "comment", header.Comment, dw.keepEmpty(header, "comment"))
+    if header.ClrMamePro != (ClrMamePro{}) {
+        dw.printf("\t\t<clrmamepro")
+        dw.xmlAttr("header", header.ClrMamePro.HeaderDef)
+        dw.xmlAttr("forcemerging", header.ClrMamePro.ForceMerging)
+        dw.xmlAttr("forcenodump", header.ClrMamePro.ForceNoDump)
+        dw.xmlAttr("forcepacking", header.ClrMamePro.ForcePacking)
+        dw.printf("/>\n")
+    }
+    for _, elem := range header.Other {
+        dw.xmlOther("\t\t", elem)
+    }
+    dw.printf("\t</header>\n")
+}
+
+func (dw *Writer) xmlRom(tag string, rom *Rom) {
+    dw.printf("\t\t<%s", tag)
+    dw.xmlAttr("name", rom.Name)
+    if tag == "rom" {
+        dw.printf(` size="%d"`, rom.Size)
+        if hasCrc(rom) {
+            dw.printf(` crc="%08x"`, rom.Crc)
+        }
+    }
+    if rom.Sha1 != (checksum.Sha1{}) {
+        dw.printf(` sha1="%x"`, rom.Sha1)
+    }
+    if rom.Md5 != (checksum.Md5{}) {
+        dw.printf(` md5="%x"`, rom.Md5)
+    }
+    dw.xmlAttr("merge", rom.Merge)
+    dw.xmlAttr("status", rom.DumpStatus)
+    dw.xmlAttr("date", rom.Date)
+    dw.xmlAttrs(rom.OtherAttrs)
+    dw.printf("/>\n")
+}
+
+// isXmlRelease returns true for the elements that come before the ROMs in a
+// Logiqx machine
+func isXmlRelease(elem XmlElement) bool {
+    return elem.XMLName.Local == "release" || elem.XMLName.Local == "biosset"
+}
+
+// xmlMachine writes a machine with the element name from the DAT file so game
+// elements stay game elements
+func (dw *Writer) xmlMachine(machine *Machine) {
+    tag := "machine"
+    if machine.XMLName.Local == "game" {
+        tag = "game"
+    }
+    dw.printf("\t<%s", tag)
+    dw.xmlAttr("name", machine.Name)
+    dw.xmlAttr("sourcefile", machine.SourceFile)
+    dw.xmlAttr("isbios", machine.IsBios)
+    dw.xmlAttr("cloneof", machine.CloneOf)
+    dw.xmlAttr("romof", machine.RomOf)
+    dw.xmlAttr("sampleof", machine.SampleOf)
+    dw.xmlAttr("board", machine.Board)
+    dw.xmlAttr("rebuildto", machine.RebuildTo)
+    dw.xmlAttrs(machine.OtherAttrs)
+    dw.printf(">\n")
+    dw.xmlElement("\t\t", "description", machine.Description, true)
+    dw.xmlElement("\t\t", "year", machine.Year, false)
+    dw.xmlElement("\t\t", "manufacturer", machine.Manufacturer, false)
+    dw.xmlElement("\t\t", "category", machine.Category, false)
+    for _, elem := range machine.Other {
+        if isXmlRelease(elem) {
+            dw.xmlOther("\t\t", elem)
+        }
+    }
+    for _, rom := range machine.Roms {
+        dw.xmlRom("rom", rom)
+    }
+    for _, disk := range machine.Disks {
+        dw.xmlRom("disk", disk)
+    }
+    for _, sample := range machine.Samples {
+        dw.printf("\t\t<sample")
+        dw.xmlAttr("name", sample.Name)
+        dw.printf("/>\n")
+    }
+    for _, elem := range machine.Other {
+        if !isXmlRelease(elem) {
+            dw.xmlOther("\t\t", elem)
+        }
+    }
+    dw.printf("\t</%s>\n", tag)
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// ClrMamePro text
+///////////////////////////////////////////////////////////////////////////////
+
+// cmproQuote quotes a string value.  The format has no escapes so a string
+// with a double quote cannot be written.
+func (dw *Writer) cmproQuote(value string) string {
+    if strings.Contains(value, `"`) && dw.err == nil {
+        dw.err = fmt.Errorf("cannot write '%s' to a ClrMamePro DAT file", value)
+    }
+    return `"` + value + `"`
+}
+
+func (dw *Writer) cmproValue(indent string, name string, value string, always bool) {
+    if value != "" || always {
+        dw.printf("%s%s %s\n", indent, name, dw.cmproQuote(value))
+    }
+}
+
+// cmproBlock starts a top-level block with a blank line between blocks
+func (dw *Writer) cmproBlock(name string) {
+    if dw.blocks > 0 {
+        dw.printf("\n")
+    }
+    dw.blocks++
+    dw.printf("%s (\n", name)
+}
+
+func (dw *Writer) cmproHeader(header *Header) {
+    dw.cmproBlock("clrmamepro")
+    dw.cmproValue("\t", "name", header.Name, dw.keepEmpty(header, "name"))
+    dw.cmproValue("\t", "description", header.Description, dw.keepEmpty(header, "description"))
+    dw.cmproValue("\t", "category", header.Category, dw.keepEmpty(header, "category"))
+    dw.cmproValue("\t", "version", header.Version, dw.keepEmpty(header, "version"))
+    dw.cmproValue("\t", "date", header.Date, dw.keepEmpty(header, "date"))
+    dw.cmproValue("\t", "author", header.Author, dw.keepEmpty(header, "author"))
+    dw.cmproValue("\t", "email", header.Email, dw.keepEmpty(header, "email"))
+    dw.cmproValue("\t", "homepage", header.Homepage, dw.keepEmpty(header, "homepage"))
+    dw.cmproValue("\t", "url", header.Url, dw.keepEmpty(header, "url"))
+    dw.cmproValue("\t", "comment", header.Comment, dw.keepEmpty(header, "comment"))
+    dw.cmproValue("\t", "header", header.ClrMamePro.HeaderDef, false)
+    dw.cmproValue("\t", "forcemerging", header.ClrMamePro.ForceMerging, false)
+    dw.cmproValue("\t", "forcenodump", header.ClrMamePro.ForceNoDump, false)
+    dw.cmproValue("\t", "forcepacking", header.ClrMamePro.ForcePacking, false)
+    dw.printf(")\n")
+}
+
+func (dw *Writer) cmproRom(tag string, rom *Rom) {
+    dw.printf("\t%s ( name %s", tag, dw.cmproQuote(rom.Name))
+    if tag == "rom" {
+        dw.printf(" size %d", rom.Size)
+        if hasCrc(rom) {
+            dw.printf(" crc %08x", rom.Crc)
+        }
+    }
+    if rom.Sha1 != (checksum.Sha1{}) {
+        dw.printf(" sha1 %x", rom.Sha1)
+    }
+    if rom.Md5 != (checksum.Md5{}) {
+        dw.printf(" md5 %x", rom.Md5)
+    }
+    if rom.Merge != "" {
+        dw.printf(" merge %s", dw.cmproQuote(rom.Merge))
+    }
+    if rom.DumpStatus != "" {
+        dw.printf(" flags %s", rom.DumpStatus)
+    }
+    if rom.Date != "" {
+        dw.printf(" date %s", dw.cmproQuote(rom.Date))
+    }
+    dw.printf(" )\n")
+}
+
+func (dw *Writer) cmproMachine(machine *Machine) {
+    dw.cmproBlock("game")
+    dw.cmproValue("\t", "name", machine.Name, true)
+    dw.cmproValue("\t", "sourcefile", machine.SourceFile, false)
+    dw.cmproValue("\t", "isbios", machine.IsBios, false)
+    dw.cmproValue("\t", "cloneof", machine.CloneOf, false)
+    dw.cmproValue("\t", "romof", machine.RomOf, false)
+    dw.cmproValue("\t", "sampleof", machine.SampleOf, false)
+    dw.cmproValue("\t", "board", machine.Board, false)
+    dw.cmproValue("\t", "rebuildto", machine.RebuildTo, false)
+    dw.cmproValue("\t", "description", machine.Description, true)
+    dw.cmproValue("\t", "year", machine.Year, false)
+    dw.cmproValue("\t", "manufacturer", machine.Manufacturer, false)
+    dw.cmproValue("\t", "category", machine.Category, false)
+    for _, rom := range machine.Roms {
+        dw.cmproRom("rom", rom)
+    }
+    for _, disk := range machine.Disks {
+        dw.cmproRom("disk", disk)
+    }
+    for _, sample := range machine.Samples {
+        dw.cmproValue("\t", "sample", sample.Name, true)
+    }
+    dw.printf(")\n")
+}
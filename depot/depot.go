@@ -0,0 +1,212 @@
+//  GoRom - Emulator ROM Management Utilities
+//  Copyright (C) 2020 Scott Shumate <scott@shumatech.com>
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package depot
+
+import (
+    "crypto/md5"
+    "crypto/sha1"
+    "encoding/binary"
+    "encoding/hex"
+    "hash/crc32"
+    "io"
+    "io/ioutil"
+    "os"
+    "path"
+    "path/filepath"
+    "strings"
+
+    "gorom/checksum"
+    "gorom/romio"
+
+    "github.com/klauspost/compress/flate"
+)
+
+///////////////////////////////////////////////////////////////////////////////
+// Depot
+//
+// A depot is a content addressed store that keeps every unique ROM once.  Each
+// ROM is a gzip file named by its SHA-1 in a four level directory tree of the
+// first bytes of the SHA-1 (e.g. ab/cd/ef/01/abcdef01....gz) with the MD5,
+// CRC32, and size in the gzip header.  This is the same layout as the depots
+// of Romba and RomVault so their depots can be used and they can use ours.
+// Machines are rebuilt by copying their ROMs out of the depot.
+///////////////////////////////////////////////////////////////////////////////
+
+type Depot struct {
+    Dir string
+}
+
+// Open opens the depot in a directory and creates the directory if it does
+// not exist
+func Open(dir string) (*Depot, error) {
+    err := os.MkdirAll(dir, 0755)
+    if err != nil {
+        return nil, err
+    }
+    return &Depot{ Dir: dir }, nil
+}
+
+// IsDepot returns true if a directory has the layout of a depot where every
+// entry but the dot files is a directory named by two hex digits
+func IsDepot(dir string) bool {
+    files, err := ioutil.ReadDir(dir)
+    if err != nil {
+        return false
+    }
+    found := false
+    for _, file := range files {
+        name := file.Name()
+        if strings.HasPrefix(name, ".") {
+            continue
+        }
+        if _, err := hex.DecodeString(name); err != nil || len(name) != 2 || !file.IsDir() {
+            return false
+        }
+        found = true
+    }
+    return found
+}
+
+// Walk calls walkFunc with the path of the gzip file of each ROM in the depot
+// in a directory.  The paths are relative to the directory.
+func Walk(dir string, walkFunc func(name string) error) error {
+    root := filepath.FromSlash(dir)
+    return filepath.Walk(root, func(filePath string, info os.FileInfo, err error) error {
+        if err != nil {
+            return err
+        }
+        name := info.Name()
+        if !info.Mode().IsRegular() || strings.HasPrefix(name, ".") || path.Ext(name) != romio.GzipExt {
+            return nil
+        }
+        relPath, err := filepath.Rel(root, filePath)
+        if err != nil {
+            return err
+        }
+        return walkFunc(filepath.ToSlash(relPath))
+    })
+}
+
+// Path returns the path of the file of a SHA-1 in the depot
+func (d *Depot) Path(sum checksum.Sha1) string {
+    name := hex.EncodeToString(sum[:])
+    return path.Join(d.Dir, name[0:2], name[2:4], name[4:6], name[6:8], name + romio.GzipExt)
+}
+
+// find returns the path of the file of a SHA-1 or an empty string if the
+// depot does not have it
+func (d *Depot) find(sum checksum.Sha1) string {
+    if sum == (checksum.Sha1{}) {
+        return ""
+    }
+    depotPath := d.Path(sum)
+    info, err := os.Stat(depotPath)
+    if err != nil || !info.Mode().IsRegular() {
+        return ""
+    }
+    return depotPath
+}
+
+// Has returns true if the depot has the ROM with a SHA-1
+func (d *Depot) Has(sum checksum.Sha1) bool {
+    return d.find(sum) != ""
+}
+
+// Add stores a file in a machine in the depot and returns its checksums.  The
+// file is compressed to a temp file while its checksums are calculated and the
+// gzip header with the checksums is written once they are known.  The file is
+// then renamed to its SHA-1 path.  Added is false if the depot already had the
+// ROM.
+func (d *Depot) Add(rr romio.RomReader, file *romio.RomFile) (sums romio.Checksums, added bool, err error) {
+    rc, err := rr.Open(file)
+    if err != nil {
+        return sums, false, err
+    }
+    defer rc.Close()
+
+    fh, err := ioutil.TempFile(d.Dir, "gorom*")
+    if err != nil {
+        return sums, false, err
+    }
+    defer func() {
+        if !added {
+            os.Remove(fh.Name())
+        }
+    }()
+
+    // The space for the header is reserved and the deflate data follows it
+    sha1Hash := sha1.New()
+    crc32Hash := crc32.NewIEEE()
+    md5Hash := md5.New()
+    _, err = fh.Write(make([]byte, romio.RombaHeaderLen))
+    if err == nil {
+        var fw *flate.Writer
+        fw, err = flate.NewWriter(fh, flate.DefaultCompression)
+        if err == nil {
+            sums.Size, err = io.Copy(io.MultiWriter(fw, sha1Hash, crc32Hash, md5Hash), rc)
+        }
+        if err == nil {
+            err = fw.Close()
+        }
+    }
+    if err == nil {
+        trailer := make([]byte, 8)
+        binary.LittleEndian.PutUint32(trailer[0:4], crc32Hash.Sum32())
+        binary.LittleEndian.PutUint32(trailer[4:8], uint32(sums.Size))
+        _, err = fh.Write(trailer)
+    }
+    copy(sums.Sha1[:], sha1Hash.Sum(nil))
+    copy(sums.Crc32[:], crc32Hash.Sum(nil))
+    copy(sums.Md5[:], md5Hash.Sum(nil))
+    if err == nil {
+        _, err = fh.WriteAt(romio.RombaHeader(sums), 0)
+    }
+    if closeErr := fh.Close(); err == nil {
+        err = closeErr
+    }
+    if err != nil {
+        return sums, false, err
+    }
+
+    if d.Has(sums.Sha1) {
+        return sums, false, nil
+    }
+
+    depotPath := d.Path(sums.Sha1)
+    err = os.MkdirAll(path.Dir(depotPath), 0755)
+    if err != nil {
+        return sums, false, err
+    }
+    err = os.Chtimes(fh.Name(), file.ModTime, file.ModTime)
+    if err != nil {
+        return sums, false, err
+    }
+    err = os.Rename(fh.Name(), depotPath)
+    if err != nil {
+        return sums, false, err
+    }
+    return sums, true, nil
+}
+
+// OpenReader opens the ROM with a SHA-1 in the depot.  The file of the reader
+// is named by the SHA-1 in hex.
+func (d *Depot) OpenReader(sum checksum.Sha1) (*romio.GzipReader, error) {
+    depotPath := d.find(sum)
+    if depotPath == "" {
+        return nil, os.ErrNotExist
+    }
+    return romio.OpenGzipReader(depotPath)
+}
@@ -0,0 +1,110 @@
+//  GoRom - Emulator ROM Management Utilities
+//  Copyright (C) 2020 Scott Shumate <scott@shumatech.com>
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package depot
+
+import (
+    "io/ioutil"
+    "os"
+    "path"
+    "strings"
+    "testing"
+
+    "gorom/romio"
+    "gorom/test"
+)
+
+func TestDepot(t *testing.T) {
+    depotDir, err := ioutil.TempDir("", "depot")
+    if err != nil {
+        test.Fail(t, err)
+    }
+    defer os.RemoveAll(depotDir)
+
+    dp, err := Open(depotDir)
+    if err != nil {
+        test.Fail(t, err)
+    }
+
+    rr, err := romio.OpenRomReader(path.Join(test.TestDir, "roms/zip/machine1.zip"))
+    if err != nil {
+        test.Fail(t, err)
+    }
+    defer rr.Close()
+
+    for _, file := range rr.Files() {
+        sums, added, err := dp.Add(rr, file)
+        if err != nil {
+            test.Fail(t, err)
+        }
+        if !added || !dp.Has(sums.Sha1) {
+            test.Fail(t, "ROM not added")
+        }
+
+        // A ROM is only stored once
+        _, added, err = dp.Add(rr, file)
+        if err != nil {
+            test.Fail(t, err)
+        }
+        if added {
+            test.Fail(t, "ROM added twice")
+        }
+
+        dr, err := dp.OpenReader(sums.Sha1)
+        if err != nil {
+            test.Fail(t, err)
+        }
+        depotFile := dr.Files()[0]
+        if depotFile.Size != file.Size {
+            test.Fail(t, "depot size mismatch")
+        }
+
+        // The checksums are in the gzip header
+        headerSums, ok := dr.Checksums()
+        if !ok || headerSums.Sha1 != sums.Sha1 || headerSums.Crc32 != file.Crc32 || headerSums.Size != file.Size {
+            test.Fail(t, "depot header mismatch")
+        }
+        rc, err := dr.Open(depotFile)
+        if err != nil {
+            test.Fail(t, err)
+        }
+        depotSums, err := romio.ChecksumRom(rc, romio.ChecksumMd5)
+        rc.Close()
+        if err != nil {
+            test.Fail(t, err)
+        }
+        if depotSums != headerSums {
+            test.Fail(t, "depot checksum mismatch")
+        }
+    }
+
+    // The depot is found by its layout and walked for the ROMs
+    if !IsDepot(depotDir) || IsDepot(path.Join(test.TestDir, "roms/zip")) {
+        test.Fail(t, "depot layout not detected")
+    }
+    count := 0
+    err = Walk(depotDir, func(name string) error {
+        if path.Ext(name) == romio.GzipExt && len(strings.Split(name, "/")) == 5 {
+            count++
+        }
+        return nil
+    })
+    if err != nil {
+        test.Fail(t, err)
+    }
+    if count != len(rr.Files()) {
+        test.Fail(t, "wrong number of depot ROMs")
+    }
+}
@@ -191,7 +191,7 @@ func chkromStart(dir string, options Options) error {
     }
     defer os.Chdir(wd)
 
-    rdb, err = romdb.OpenRomDB(".", options.headers)
+    rdb, err = romdb.OpenRomDB(".", skipper())
     if err != nil {
         return err
     }
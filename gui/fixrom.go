@@ -191,7 +191,7 @@ func fixromStart(dir string, srcDirs []string, options Options) error {
     for _, dir := range srcDirs {
         call("log", "Scanning " + dir)
 
-        rdb, err := romdb.OpenRomDB(dir, options.headers)
+        rdb, err := romdb.OpenRomDB(dir, skipper())
         if err != nil {
             return err
         }
@@ -292,12 +292,14 @@ func fixromStart(dir string, srcDirs []string, options Options) error {
 
                 // Walk the sources to find the checksum 
                 for _, rdb = range romDBs {
-                    entry, err = rdb.Lookup(rom.Sha1)
+                    var entries []*romdb.RomDBEntry
+                    entries, err = dat.LookupRom(rdb, rom)
                     if err != nil {
                         call("log", "checksum lookup : " + err.Error())
                         break
                     }
-                    if entry != nil {
+                    if len(entries) > 0 {
+                        entry = entries[0]
                         break
                     }
                 }
@@ -309,7 +311,7 @@ func fixromStart(dir string, srcDirs []string, options Options) error {
                     ok = false
                 } else {
                     // Copy the found ROM to the new machine
-                    path := path.Join(rdb.Dir, entry.MachPath)
+                    path := rdb.Path(entry)
                     rom.Status = RomFixCopy
                     fixRomStats.Copied++
                     fixRomStats.Total++
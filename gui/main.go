@@ -27,6 +27,7 @@ import (
 	"github.com/sciter-sdk/go-sciter/window"
 
 	"gorom/dat"
+	"gorom/romio"
 )
 
 type Options struct {
@@ -47,6 +48,14 @@ var (
     options Options
 )
 
+// skipper returns the header skipper for the ROM databases
+func skipper() *romio.HeaderSkipper {
+    if options.headers {
+        return romio.DefaultSkipper
+    }
+    return nil
+}
+
 func isStop() bool {
     select {
     case <-stopChan:
@@ -163,6 +172,8 @@ func getRoms(args ...*sciter.Value) *sciter.Value {
             case dat.RomMissing: str = "MISSING"
             case dat.RomCorrupt: str = "CORRUPT"
             case dat.RomBadName: str = "BAD_NAME"
+            case dat.RomNoDump: str = "NO_DUMP"
+            case dat.RomBadDump: str = "BAD_DUMP"
             case RomFixCopy: str = "COPIED"
             case RomFixNotFound: str = "NOT_FOUND"
             case RomFixRename: str = "RENAMED"
@@ -0,0 +1,229 @@
+//  GoRom - Emulator ROM Management Utilities
+//  Copyright (C) 2020 Scott Shumate <scott@shumatech.com>
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package romdb
+
+import (
+    "errors"
+    "math/rand"
+    "os"
+    "path"
+    "sort"
+    "time"
+
+    "gorom"
+    "gorom/checksum"
+    "gorom/romio"
+    "gorom/util"
+
+    "github.com/boltdb/bolt"
+    "github.com/kelindar/binary"
+)
+
+var (
+    MismatchError = errors.New("checksum mismatch")
+    NotFoundError = errors.New("file not found")
+)
+
+type RomDBStats struct {
+    Entries        int
+    Machines       int
+    Bytes          int64
+    Checksums      int
+    Duplicates     int
+    DuplicateBytes int64
+}
+
+// ForEach calls the entry function with every entry in the database
+func (rdb *RomDB) ForEach(entryFunc func(entry *RomDBEntry) error) error {
+    return rdb.db.View(func(tx *bolt.Tx) error {
+        rb := tx.Bucket(rdb.bucket(RomBucket))
+        if rb == nil {
+            return nil
+        }
+        return rb.ForEach(func(k, v []byte) error {
+            var entry RomDBEntry
+            err := binary.Unmarshal(v, &entry)
+            if err != nil {
+                return nil
+            }
+            return entryFunc(&entry)
+        })
+    })
+}
+
+// Import adds entries to the database and replaces the entries with the same
+// machine and ROM paths
+func (rdb *RomDB) Import(entries []*RomDBEntry) error {
+    return rdb.putEntries(entries)
+}
+
+// Stats returns the number of entries, machines, and bytes in the database.
+// The duplicates are the checksums with more than one location and the
+// duplicate bytes are the size of the extra copies.
+func (rdb *RomDB) Stats() (RomDBStats, error) {
+    var stats RomDBStats
+    machines := util.NewStringSet()
+    counts := map[checksum.Sha1]int{}
+    err := rdb.ForEach(func(entry *RomDBEntry) error {
+        stats.Entries++
+        stats.Bytes += entry.Size
+        machines.Set(entry.MachPath)
+        if !entry.hashed() {
+            return nil
+        }
+        counts[entry.Sum]++
+        if counts[entry.Sum] == 2 {
+            stats.Duplicates++
+        }
+        if counts[entry.Sum] > 1 {
+            stats.DuplicateBytes += entry.Size
+        }
+        return nil
+    })
+    stats.Machines = len(machines)
+    stats.Checksums = len(counts)
+    return stats, err
+}
+
+// entryPath returns the path of the file of an entry that is checked for
+// existence.  The ROMs in archives are only checked for their archive.
+func (rdb *RomDB) entryPath(entry *RomDBEntry) string {
+    machPath := rdb.Path(entry)
+    if romio.MachFormat(machPath) == gorom.FormatDir {
+        return path.Join(machPath, entry.RomPath)
+    }
+    return machPath
+}
+
+// Prune removes the entries of files that no longer exist without scanning
+// the files that do and returns the number of entries removed.  The
+// directories that no longer exist are also removed from a shared database.
+func (rdb *RomDB) Prune() (int, error) {
+    staleKeys := util.NewStringSet()
+    exists := map[string]bool{}
+    err := rdb.ForEach(func(entry *RomDBEntry) error {
+        filePath := rdb.entryPath(entry)
+        found, ok := exists[filePath]
+        if !ok {
+            _, err := os.Stat(filePath)
+            found = !os.IsNotExist(err)
+            exists[filePath] = found
+        }
+        if !found {
+            staleKeys.Set(entry.MachPath + "\x00" + entry.RomPath)
+        }
+        return nil
+    })
+    if err != nil {
+        return 0, err
+    }
+
+    if len(staleKeys) > 0 {
+        err = rdb.db.Update(func(tx *bolt.Tx) error {
+            rdb.deleteEntries(tx, []byte{}, func(key []byte) bool {
+                return staleKeys.IsSet(string(key))
+            })
+            return nil
+        })
+        if err != nil {
+            return 0, err
+        }
+    }
+
+    if rdb.Shared() {
+        _, err = rdb.PruneRoots()
+    }
+    return len(staleKeys), err
+}
+
+// Verify hashes the files of the database entries again and calls the verify
+// function with each entry and a nil error if its checksum still matches.
+// Entries without checksums from quick scans are skipped.  If the sample is
+// greater than zero, then only that many random entries are verified.
+func (rdb *RomDB) Verify(sample int, verifyFunc func(entry *RomDBEntry, err error)) error {
+    entries := []*RomDBEntry{}
+    err := rdb.ForEach(func(entry *RomDBEntry) error {
+        if entry.hashed() {
+            entries = append(entries, entry)
+        }
+        return nil
+    })
+    if err != nil {
+        return err
+    }
+
+    if sample > 0 && sample < len(entries) {
+        random := rand.New(rand.NewSource(time.Now().UnixNano()))
+        random.Shuffle(len(entries), func(i, j int) {
+            entries[i], entries[j] = entries[j], entries[i]
+        })
+        entries = entries[:sample]
+        sort.Slice(entries, func(i, j int) bool {
+            if entries[i].MachPath != entries[j].MachPath {
+                return entries[i].MachPath < entries[j].MachPath
+            }
+            return entries[i].RomPath < entries[j].RomPath
+        })
+    }
+
+    // The entries are sorted by machine so each machine is only opened once
+    for i := 0; i < len(entries); {
+        machPath := entries[i].MachPath
+        j := i
+        for j < len(entries) && entries[j].MachPath == machPath {
+            j++
+        }
+        rdb.verifyMachine(entries[i:j], verifyFunc)
+        i = j
+    }
+
+    return nil
+}
+
+func (rdb *RomDB) verifyMachine(entries []*RomDBEntry, verifyFunc func(entry *RomDBEntry, err error)) {
+    rr, err := romio.OpenRomReader(rdb.Path(entries[0]))
+    if rr == nil && err == nil {
+        err = NotFoundError
+    }
+    if os.IsNotExist(err) {
+        err = NotFoundError
+    }
+    if err != nil {
+        for _, entry := range entries {
+            verifyFunc(entry, err)
+        }
+        return
+    }
+    defer rr.Close()
+
+    files := map[string]*romio.RomFile{}
+    for _, file := range rr.Files() {
+        files[file.Name] = file
+    }
+
+    for _, entry := range entries {
+        file, ok := files[entry.RomPath]
+        if !ok {
+            verifyFunc(entry, NotFoundError)
+            continue
+        }
+        sums, err := rdb.checksumRom(rr, file)
+        if err == nil && sums.Sha1 != entry.Sum {
+            err = MismatchError
+        }
+        verifyFunc(entry, err)
+    }
+}
@@ -17,14 +17,20 @@ package romdb
 
 import (
     "bytes"
+    bin "encoding/binary"
     "errors"
     "fmt"
     "os"
     "path"
+    "path/filepath"
     "runtime"
+    "sort"
+    "strings"
+    "sync"
     "time"
 
     "gorom"
+    "gorom/depot"
     "gorom/util"
     "gorom/romio"
     "gorom/checksum"
@@ -36,8 +42,14 @@ import (
 
 const (
     DbFile = ".gorom.db"
+    SharedDbFile = "index.db"
     RomBucket = "rom"
+    RootBucket = "root"
     ChecksumBucket = "checksum"
+    Crc32Bucket = "crc32"
+    Md5Bucket = "md5"
+    NameBucket = "name"
+    MachineBucket = "machine"
 )
 
 var (
@@ -47,9 +59,26 @@ var (
 type RomDB struct {
     Dir string
     db  *bolt.DB
-    skipHeader bool
+    skipper *romio.HeaderSkipper
+    prefix string
+    md5 bool
+    root string
+    dbFile string
+    wanted WantedFunc
 }
 
+// A shared database file is only opened once and each directory that uses it
+// has its own RomDB with a reference to the open database
+type sharedDB struct {
+    db *bolt.DB
+    refs int
+}
+
+var (
+    sharedLock sync.Mutex
+    sharedDBs = map[string]*sharedDB{}
+)
+
 type RomDBInfo struct {
     Checksum checksum.Sha1
     ModTime  time.Time
@@ -60,37 +89,334 @@ type RomDBEntry struct {
     RomPath  string
     ModTime  time.Time
     Sum      checksum.Sha1
+    Crc32    checksum.Crc32
+    Md5      checksum.Md5
+    Size     int64
 }
 
-func OpenRomDB(dir string, skipHeader bool) (*RomDB, error) {
+// hashed returns true if the entry has the checksums of its file.  Quick
+// scans only record the size and modification time of unwanted files.
+func (entry *RomDBEntry) hashed() bool {
+    return entry.Sum != (checksum.Sha1{})
+}
+
+func (entry *RomDBEntry) Checksums() romio.Checksums {
+    return romio.Checksums{ Sha1: entry.Sum, Crc32: entry.Crc32, Md5: entry.Md5, Size: entry.Size }
+}
+
+func skipperPrefix(skipper *romio.HeaderSkipper) string {
+    if skipper == nil {
+        return ""
+    }
+    return "header:" + skipper.Id() + "\x00"
+}
+
+// OpenRomDB opens the database in a directory.  If the skipper is not nil,
+// then ROM headers are skipped in the checksum calculations.  Checksums with
+// headers skipped are kept in separate buckets for each skipper so they never
+// mix with the checksums of the whole files.
+func OpenRomDB(dir string, skipper *romio.HeaderSkipper) (*RomDB, error) {
     path := path.Join(dir, DbFile)
     db, err := bolt.Open(path, 0644, &bolt.Options{Timeout: 3 * time.Second})
     if err != nil {
         return nil, fmt.Errorf("%s: %s", path, err.Error())
     }
 
-    return &RomDB{ dir, db, skipHeader }, nil
+    rdb := &RomDB{ Dir: dir, db: db, skipper: skipper, prefix: skipperPrefix(skipper) }
+    err = rdb.reindex()
+    if err != nil {
+        db.Close()
+        return nil, fmt.Errorf("%s: %s", path, err.Error())
+    }
+    return rdb, nil
+}
+
+// DefaultDbFile returns the path of the shared database in the user cache
+// directory
+func DefaultDbFile() (string, error) {
+    dir, err := os.UserCacheDir()
+    if err != nil {
+        return "", err
+    }
+    return filepath.Join(dir, "gorom", SharedDbFile), nil
+}
+
+// rootDir returns the absolute path of a directory with symbolic links
+// resolved so a directory always has the same identity in a shared database
+func rootDir(dir string) (string, error) {
+    if dir == "" {
+        dir = "."
+    }
+    root, err := filepath.Abs(dir)
+    if err != nil {
+        return "", err
+    }
+    if realRoot, err := filepath.EvalSymlinks(root); err == nil {
+        root = realRoot
+    }
+    return filepath.ToSlash(root), nil
+}
+
+// OpenSharedRomDB opens a database file that is shared by any number of
+// directories.  The entries of a shared database have the absolute paths of
+// their machines so lookups find the ROMs of every directory that has been
+// scanned into it.  A scan of a directory only changes the entries of the
+// machines in that directory.
+func OpenSharedRomDB(dbFile string, dir string, skipper *romio.HeaderSkipper) (*RomDB, error) {
+    root, err := rootDir(dir)
+    if err != nil {
+        return nil, err
+    }
+    dbFile, err = filepath.Abs(dbFile)
+    if err != nil {
+        return nil, err
+    }
+
+    sharedLock.Lock()
+    defer sharedLock.Unlock()
+
+    shared, ok := sharedDBs[dbFile]
+    if !ok {
+        err = os.MkdirAll(filepath.Dir(dbFile), 0755)
+        if err != nil {
+            return nil, err
+        }
+        db, err := bolt.Open(dbFile, 0644, &bolt.Options{Timeout: 3 * time.Second})
+        if err != nil {
+            return nil, fmt.Errorf("%s: %s", dbFile, err.Error())
+        }
+        shared = &sharedDB{ db: db }
+        sharedDBs[dbFile] = shared
+    }
+    shared.refs++
+
+    rdb := &RomDB{ Dir: dir, db: shared.db, skipper: skipper, prefix: skipperPrefix(skipper),
+                   root: root, dbFile: dbFile }
+    err = rdb.reindex()
+    if err != nil {
+        shared.refs--
+        return nil, fmt.Errorf("%s: %s", dbFile, err.Error())
+    }
+    return rdb, nil
+}
+
+// Shared returns true if the database is shared with other directories
+func (rdb *RomDB) Shared() bool {
+    return rdb.root != ""
+}
+
+// machPath returns the machine path stored in the database for a machine in
+// the directory.  A shared database stores the absolute path.
+func (rdb *RomDB) machPath(name string) string {
+    if rdb.root == "" {
+        return rdb.relPath(name)
+    }
+    return path.Join(rdb.root, rdb.relPath(name))
+}
+
+// relPath returns the path of a machine relative to the directory since the
+// machines of a depot are in its subdirectories.  Paths that are not in the
+// directory are reduced to their base name.
+func (rdb *RomDB) relPath(machPath string) string {
+    rel, err := filepath.Rel(filepath.FromSlash(rdb.Dir), filepath.FromSlash(machPath))
+    if err != nil || rel == ".." || strings.HasPrefix(rel, ".." + string(filepath.Separator)) {
+        return path.Base(machPath)
+    }
+    return filepath.ToSlash(rel)
+}
+
+// Path returns the path of the machine of an entry
+func (rdb *RomDB) Path(entry *RomDBEntry) string {
+    if rdb.root == "" {
+        return path.Join(rdb.Dir, entry.MachPath)
+    }
+    return entry.MachPath
+}
+
+// Contains returns true if the machine of an entry is in the directory of
+// the database.  Entries of a shared database can be in other directories.
+func (rdb *RomDB) Contains(entry *RomDBEntry) bool {
+    return rdb.root == "" || path.Dir(entry.MachPath) == rdb.root
+}
+
+// rootPrefix returns the prefix of the ROM keys of the machines in a
+// directory of a shared database
+func rootPrefix(root string) []byte {
+    if strings.HasSuffix(root, "/") {
+        return []byte(root)
+    }
+    return []byte(root + "/")
+}
+
+// inRoot returns true if a ROM key with the root prefix is for a machine
+// directly in the root directory and not in one of its subdirectories
+func inRoot(key []byte, prefix []byte) bool {
+    machPath := key[len(prefix):]
+    if i := bytes.IndexByte(machPath, 0); i >= 0 {
+        machPath = machPath[:i]
+    }
+    return bytes.IndexByte(machPath, '/') < 0
+}
+
+// bucket returns the name of a bucket for the header skipper of the database
+func (rdb *RomDB) bucket(name string) []byte {
+    return []byte(rdb.prefix + name)
+}
+
+// Skipper returns the header skipper of the database or nil
+func (rdb *RomDB) Skipper() *romio.HeaderSkipper {
+    return rdb.skipper
+}
+
+// EnableMd5 calculates MD5 checksums in addition to SHA-1 and CRC32 for DATs
+// that only have MD5 checksums.  Entries without an MD5 are recalculated.
+func (rdb *RomDB) EnableMd5() {
+    rdb.md5 = true
+}
+
+// crc32Key is the lookup key for a CRC32 which includes the size since
+// CRC32s are easily duplicated
+func crc32Key(crc checksum.Crc32, size int64) []byte {
+    key := make([]byte, len(crc) + 8)
+    copy(key, crc[:])
+    bin.BigEndian.PutUint64(key[len(crc):], uint64(size))
+    return key
+}
+
+// nameKey is the lookup key for a ROM or machine name.  The name is
+// terminated so the ROM key can be split from it.
+func nameKey(name string) []byte {
+    return []byte(name + "\x00")
+}
+
+// lookupKeys returns the bucket and key of every lookup for an entry
+func lookupKeys(entry *RomDBEntry) map[string][]byte {
+    keys := map[string][]byte{
+        NameBucket: nameKey(path.Base(entry.RomPath)),
+        MachineBucket: nameKey(romio.MachName(entry.MachPath)),
+    }
+    if entry.hashed() {
+        keys[ChecksumBucket] = entry.Sum[:]
+    }
+    if entry.Crc32 != (checksum.Crc32{}) {
+        keys[Crc32Bucket] = crc32Key(entry.Crc32, entry.Size)
+    }
+    if entry.Md5 != (checksum.Md5{}) {
+        keys[Md5Bucket] = entry.Md5[:]
+    }
+    return keys
+}
+
+// locationKey is the key of one location of a checksum in a lookup bucket.
+// Every ROM with the checksum has its own key so the lookup can return all of
+// the locations with a cursor seek on the checksum.
+func locationKey(key []byte, romKey []byte) []byte {
+    locKey := make([]byte, 0, len(key) + len(romKey))
+    locKey = append(locKey, key...)
+    return append(locKey, romKey...)
+}
+
+// deleteLookups deletes the checksum lookups of an entry.  Older databases
+// have a single location stored as the value of the checksum key which is
+// deleted if it still refers to the entry.
+func (rdb *RomDB) deleteLookups(tx *bolt.Tx, romKey []byte, entry *RomDBEntry) {
+    for bucket, key := range lookupKeys(entry) {
+        b := tx.Bucket(rdb.bucket(bucket))
+        if b == nil {
+            continue
+        }
+        b.Delete(locationKey(key, romKey))
+        if bytes.Equal(b.Get(key), romKey) {
+            b.Delete(key)
+        }
+    }
+}
+
+// lookupBuckets are the buckets with the lookups of the ROM entries
+var lookupBuckets = []string{ ChecksumBucket, Crc32Bucket, Md5Bucket, NameBucket, MachineBucket }
+
+// indexBuckets are the lookup buckets that are missing from older databases
+var indexBuckets = []string{ NameBucket, MachineBucket }
+
+// reindex adds the lookup buckets that are missing from an older database
+// and fills them from the ROM entries
+func (rdb *RomDB) reindex() error {
+    missing := false
+    err := rdb.db.View(func(tx *bolt.Tx) error {
+        if tx.Bucket(rdb.bucket(RomBucket)) == nil {
+            return nil
+        }
+        for _, bucket := range indexBuckets {
+            if tx.Bucket(rdb.bucket(bucket)) == nil {
+                missing = true
+            }
+        }
+        return nil
+    })
+    if err != nil || !missing {
+        return err
+    }
+
+    return rdb.db.Update(func(tx *bolt.Tx) error {
+        for _, bucket := range indexBuckets {
+            if tx.Bucket(rdb.bucket(bucket)) != nil {
+                continue
+            }
+            b, err := tx.CreateBucket(rdb.bucket(bucket))
+            if err != nil {
+                return err
+            }
+            err = tx.Bucket(rdb.bucket(RomBucket)).ForEach(func(k, v []byte) error {
+                var entry RomDBEntry
+                if binary.Unmarshal(v, &entry) != nil {
+                    return nil
+                }
+                return b.Put(locationKey(lookupKeys(&entry)[bucket], k), []byte{})
+            })
+            if err != nil {
+                return err
+            }
+        }
+        return nil
+    })
 }
 
 func (rdb *RomDB) Close() {
-    rdb.db.Close()
+    if rdb.dbFile == "" {
+        rdb.db.Close()
+        return
+    }
+
+    sharedLock.Lock()
+    defer sharedLock.Unlock()
+
+    shared := sharedDBs[rdb.dbFile]
+    shared.refs--
+    if shared.refs == 0 {
+        shared.db.Close()
+        delete(sharedDBs, rdb.dbFile)
+    }
 }
 
-func (rdb *RomDB) addFiles(machPath string, files []*romio.RomFile, checksums []checksum.Sha1) error {
+// putEntries adds ROM entries and their checksum lookups to the database.
+// The lookups of any entries they replace are deleted.
+func (rdb *RomDB) putEntries(entries []*RomDBEntry) error {
     return rdb.db.Batch(func(tx *bolt.Tx) error {
-        rb, err := tx.CreateBucketIfNotExists([]byte(RomBucket))
+        rb, err := tx.CreateBucketIfNotExists(rdb.bucket(RomBucket))
         if err != nil {
             return err
         }
 
-        cb, err := tx.CreateBucketIfNotExists([]byte(ChecksumBucket))
-        if err != nil {
-            return err
+        for _, bucket := range lookupBuckets {
+            _, err := tx.CreateBucketIfNotExists(rdb.bucket(bucket))
+            if err != nil {
+                return err
+            }
         }
 
-        for i, file := range files {
+        for _, entry := range entries {
              // Create the database key
-            romKey := []byte(machPath + "\x00" + file.Name)
+            romKey := []byte(entry.MachPath + "\x00" + entry.RomPath)
 
             // If there is already a ROM entry, then delete its checksum lookup
             v := rb.Get(romKey)
@@ -99,13 +425,12 @@ func (rdb *RomDB) addFiles(machPath string, files []*romio.RomFile, checksums []
                 var oldEntry RomDBEntry
                 err = binary.Unmarshal(v, &oldEntry)
                 if err == nil {
-                    cb.Delete(oldEntry.Sum[:])
+                    rdb.deleteLookups(tx, romKey, &oldEntry)
                 }
             }
 
             // Add the ROM entry to the database
-            entry := RomDBEntry{ machPath, file.Name, file.ModTime, checksums[i] }
-            buffer, err := binary.Marshal(&entry)
+            buffer, err := binary.Marshal(entry)
             if err != nil {
                 return err
             }
@@ -114,10 +439,12 @@ func (rdb *RomDB) addFiles(machPath string, files []*romio.RomFile, checksums []
                 return err
             }
 
-            // Add the checksum lookup to the database
-            err = cb.Put(checksums[i][:], romKey)
-            if err != nil {
-                return err
+            // Add the checksum lookups to the database
+            for bucket, key := range lookupKeys(entry) {
+                err = tx.Bucket(rdb.bucket(bucket)).Put(locationKey(key, romKey), []byte{})
+                if err != nil {
+                    return err
+                }
             }
         }
 
@@ -125,20 +452,24 @@ func (rdb *RomDB) addFiles(machPath string, files []*romio.RomFile, checksums []
     })
 }
 
+func (rdb *RomDB) addFiles(machPath string, files []*romio.RomFile, checksums []romio.Checksums) error {
+    entries := make([]*RomDBEntry, len(files))
+    for i, file := range files {
+        sums := checksums[i]
+        entries[i] = &RomDBEntry{ machPath, file.Name, file.ModTime, sums.Sha1, sums.Crc32, sums.Md5, sums.Size }
+    }
+    return rdb.putEntries(entries)
+}
+
 func (rdb *RomDB) deleteAll(machPath string) error {
     return rdb.db.Batch(func(tx *bolt.Tx) error {
-        rb := tx.Bucket([]byte(RomBucket))
+        rb := tx.Bucket(rdb.bucket(RomBucket))
         if rb == nil {
             return nil
         }
 
-        cb := tx.Bucket([]byte(RomBucket))
-        if cb == nil {
-            return nil
-        }
-
         delKeys := [][]byte{}
-        delSums := [][]byte{}
+        delEntries := []RomDBEntry{}
 
         machKey := []byte(machPath + "\x00")
         rbc := rb.Cursor()
@@ -146,51 +477,124 @@ func (rdb *RomDB) deleteAll(machPath string) error {
             var entry RomDBEntry
             err := binary.Unmarshal(v, &entry)
             if err == nil {
-                delSums = append(delSums, entry.Sum[:])
+                delEntries = append(delEntries, entry)
                 delKeys = append(delKeys, k)
             }
         }
 
         for i, k := range delKeys {
+            rdb.deleteLookups(tx, k, &delEntries[i])
             rb.Delete(k)
-            cb.Delete(delSums[i])
         }
 
         return nil
     })
 }
 
-func (rdb *RomDB) deleteChecksum(sum checksum.Sha1) error {
+// deleteEntries deletes the ROM entries with a key prefix and their lookups
+// if the delete function returns true for the key
+func (rdb *RomDB) deleteEntries(tx *bolt.Tx, prefix []byte, deleteFunc func(key []byte) bool) {
+    rb := tx.Bucket(rdb.bucket(RomBucket))
+    if rb == nil {
+        return
+    }
+
+    delKeys := [][]byte{}
+    delEntries := []*RomDBEntry{}
+
+    rbc := rb.Cursor()
+    for k, v := rbc.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = rbc.Next() {
+        if deleteFunc(k) {
+            delKeys = append(delKeys, k)
+
+            var entry RomDBEntry
+            err := binary.Unmarshal(v, &entry)
+            if err == nil {
+                delEntries = append(delEntries, &entry)
+            } else {
+                delEntries = append(delEntries, nil)
+            }
+        }
+    }
+
+    for i, k := range delKeys {
+        if delEntries[i] != nil {
+            rdb.deleteLookups(tx, k, delEntries[i])
+        }
+        rb.Delete(k)
+    }
+}
+
+func (rdb *RomDB) deleteKeys(bucket string, keys [][]byte) error {
     return rdb.db.Batch(func(tx *bolt.Tx) error {
-        cb := tx.Bucket([]byte(RomBucket))
-        if cb != nil {
-            cb.Delete(sum[:])
+        b := tx.Bucket(rdb.bucket(bucket))
+        if b != nil {
+            for _, key := range keys {
+                b.Delete(key)
+            }
         }
         return nil
     })
 }
 
-func checksumRom(rr romio.RomReader, rf *romio.RomFile, skipHeader bool) (checksum.Sha1, error) {
+func (rdb *RomDB) checksumRom(rr romio.RomReader, rf *romio.RomFile) (romio.Checksums, error) {
+    // Romba gzip files are not decompressed since the gzip header has the
+    // checksums unless a header skipper changes them
+    if gr, ok := rr.(*romio.GzipReader); ok && rdb.skipper == nil {
+        if sums, ok := gr.Checksums(); ok {
+            return sums, nil
+        }
+    }
+
     rc, err := rr.Open(rf)
     if err != nil {
-        return checksum.Sha1{}, err
+        return romio.Checksums{}, err
     }
     defer rc.Close()
 
-    options := romio.ChecksumNoCrc32
-    if skipHeader {
-        options = options | romio.ChecksumSkipHeader
+    // CHDs use the SHA-1 from the header.  Invalid CHDs fall through to a
+    // hash of the entire file so they show up as corrupt.
+    if romio.IsChd(rf.Name) {
+        sum, err := romio.ChdSha1(rc)
+        if err == nil {
+            return romio.Checksums{ Sha1: sum, Size: rf.Size }, nil
+        }
+        rc, err = rr.Open(rf)
+        if err != nil {
+            return romio.Checksums{}, err
+        }
+        defer rc.Close()
     }
-    checksums, err := romio.ChecksumRom(rc, options)
-    if err != nil {
-        return checksum.Sha1{}, err
+
+    options := 0
+    if rdb.md5 {
+        options |= romio.ChecksumMd5
+    }
+    return romio.ChecksumRomSkipper(rc, options, rdb.skipper)
+}
+
+// modified returns true if a file changed since its database entry
+func modified(file *romio.RomFile, entry *RomDBEntry) bool {
+    // Compare to milliseconds to avoid rounding issues across filesystems
+    t1 := file.ModTime.Round(time.Millisecond)
+    t2 := entry.ModTime.Round(time.Millisecond)
+    return !t1.Equal(t2)
+}
+
+// cached returns true if a database entry is up to date with a file
+func (rdb *RomDB) cached(file *romio.RomFile, entry *RomDBEntry) bool {
+    if modified(file, entry) || !entry.hashed() {
+        return false
+    }
+    if rdb.md5 && entry.Md5 == (checksum.Md5{}) && !romio.IsChd(file.Name) {
+        return false
     }
-    return checksums.Sha1, nil
+    return true
 }
 
 func (rdb *RomDB) Dump() {
     rdb.db.View(func(tx *bolt.Tx) error {
-        rb := tx.Bucket([]byte(RomBucket))
+        rb := tx.Bucket(rdb.bucket(RomBucket))
         if rb != nil {
             c := rb.Cursor();
             for k, v := c.First(); k != nil; k, v = c.Next() {
@@ -205,17 +609,17 @@ func (rdb *RomDB) Dump() {
     })
 }
 
-func (rdb *RomDB) ChecksumArchive(rr romio.RomReader, checksumFunc ChecksumFunc) error {
+func (rdb *RomDB) ChecksumArchive(rr romio.RomReader, checksumsFunc ChecksumsFunc) error {
     files := rr.Files()
-    checksums := make([]checksum.Sha1, len(files))
+    checksums := make([]romio.Checksums, len(files))
     sumAll := false
     delAll := false
-    machPath := path.Base(rr.Path())
+    machPath := rdb.machPath(rr.Path())
 
     // If any file is out of date or not present, then delete all entries
     // and regenerate all checksums
     err := rdb.db.View(func(tx *bolt.Tx) error {
-        rb := tx.Bucket([]byte(RomBucket))
+        rb := tx.Bucket(rdb.bucket(RomBucket))
         if rb != nil {
             same := false
             for i, file := range files {
@@ -229,14 +633,9 @@ func (rdb *RomDB) ChecksumArchive(rr romio.RomReader, checksumFunc ChecksumFunc)
                     break
                 } else {
                     err := binary.Unmarshal(val, &entry)
-                    if err == nil {
-                        // Compare to milliseconds to avoid rounding issues across filesystems
-                        t1 := file.ModTime.Round(time.Millisecond)
-                        t2 := entry.ModTime.Round(time.Millisecond)
-                        if err == nil && t1.Equal(t2) {
-                            same = true
-                            checksums[i] = entry.Sum
-                        }
+                    if err == nil && rdb.cached(file, &entry) {
+                        same = true
+                        checksums[i] = entry.Checksums()
                     }
                     if !same {
                         sumAll = true
@@ -263,12 +662,12 @@ func (rdb *RomDB) ChecksumArchive(rr romio.RomReader, checksumFunc ChecksumFunc)
 
     if sumAll {
         for i, file := range files {
-            checksums[i], err = checksumRom(rr, file, rdb.skipHeader)
+            checksums[i], err = rdb.checksumRom(rr, file)
             if err != nil {
                 return err
             }
-            if checksumFunc != nil {
-                err = checksumFunc(file.Name, checksums[i])
+            if checksumsFunc != nil {
+                err = checksumsFunc(file.Name, checksums[i])
                 if err != nil {
                     return err
                 }
@@ -277,9 +676,9 @@ func (rdb *RomDB) ChecksumArchive(rr romio.RomReader, checksumFunc ChecksumFunc)
         // Add the checksums to the database
         err = rdb.addFiles(machPath, files, checksums)
     } else {
-        if checksumFunc != nil {
+        if checksumsFunc != nil {
             for i, file := range files {
-                err = checksumFunc(file.Name, checksums[i])
+                err = checksumsFunc(file.Name, checksums[i])
                 if err != nil {
                     return err
                 }
@@ -290,9 +689,9 @@ func (rdb *RomDB) ChecksumArchive(rr romio.RomReader, checksumFunc ChecksumFunc)
     return nil
 }
 
-func (rdb *RomDB) ChecksumDir(rr romio.RomReader, checksumFunc ChecksumFunc) error {
+func (rdb *RomDB) ChecksumDir(rr romio.RomReader, checksumsFunc ChecksumsFunc) error {
     files := rr.Files()
-    machPath := path.Base(rr.Path())
+    machPath := rdb.machPath(rr.Path())
     sumAll := false
 
     // For each file, if there is no database entry then we need to calc the checksum.
@@ -301,7 +700,7 @@ func (rdb *RomDB) ChecksumDir(rr romio.RomReader, checksumFunc ChecksumFunc) err
     addFiles := []*romio.RomFile{}
     addIndex := []int{}
     err := rdb.db.View(func(tx *bolt.Tx) error {
-        rb := tx.Bucket([]byte(RomBucket))
+        rb := tx.Bucket(rdb.bucket(RomBucket))
         if rb != nil {
             for i, file := range files {
                 same := false
@@ -310,17 +709,12 @@ func (rdb *RomDB) ChecksumDir(rr romio.RomReader, checksumFunc ChecksumFunc) err
                 if val != nil {
                     var entry RomDBEntry
                     err := binary.Unmarshal(val, &entry)
-                    if (err == nil) {
-                        // Compare to milliseconds to avoid rounding issues across filesystems
-                        t1 := file.ModTime.Round(time.Millisecond)
-                        t2 := entry.ModTime.Round(time.Millisecond)
-                        if t1.Equal(t2) {
-                            same = true
-                            if checksumFunc != nil {
-                                err = checksumFunc(file.Name, entry.Sum)
-                                if err != nil {
-                                    return err
-                                }
+                    if err == nil && rdb.cached(file, &entry) {
+                        same = true
+                        if checksumsFunc != nil {
+                            err = checksumsFunc(file.Name, entry.Checksums())
+                            if err != nil {
+                                return err
                             }
                         }
                     }
@@ -340,14 +734,14 @@ func (rdb *RomDB) ChecksumDir(rr romio.RomReader, checksumFunc ChecksumFunc) err
     }
 
     if sumAll {
-        checksums := make([]checksum.Sha1, len(files))
+        checksums := make([]romio.Checksums, len(files))
         for i, file := range files {
-            checksums[i], err = checksumRom(rr, file, rdb.skipHeader)
+            checksums[i], err = rdb.checksumRom(rr, file)
             if err != nil {
                 return err
             }
-            if checksumFunc != nil {
-                err = checksumFunc(file.Name, checksums[i])
+            if checksumsFunc != nil {
+                err = checksumsFunc(file.Name, checksums[i])
                 if err != nil {
                     return err
                 }
@@ -355,14 +749,14 @@ func (rdb *RomDB) ChecksumDir(rr romio.RomReader, checksumFunc ChecksumFunc) err
         }
         err = rdb.addFiles(machPath, files, checksums)
     } else if len(addFiles) > 0 {
-        checksums := make([]checksum.Sha1, len(addFiles))
+        checksums := make([]romio.Checksums, len(addFiles))
         for i, file := range addFiles {
-            checksums[i], err = checksumRom(rr, file, rdb.skipHeader)
+            checksums[i], err = rdb.checksumRom(rr, file)
             if err != nil {
                 return err
             }
-            if checksumFunc != nil {
-                err = checksumFunc(file.Name, checksums[i])
+            if checksumsFunc != nil {
+                err = checksumsFunc(file.Name, checksums[i])
                 if err != nil {
                     return err
                 }
@@ -375,60 +769,254 @@ func (rdb *RomDB) ChecksumDir(rr romio.RomReader, checksumFunc ChecksumFunc) err
 }
 
 type ChecksumFunc func(name string, sum checksum.Sha1) error
+type ChecksumsFunc func(name string, checksums romio.Checksums) error
 
-func (rdb *RomDB) Checksum(rr romio.RomReader, checksumFunc ChecksumFunc) error {
+// Checksums calls the checksumsFunc with all of the checksums of each ROM
+// in a machine using the database entries that are up to date
+func (rdb *RomDB) Checksums(rr romio.RomReader, checksumsFunc ChecksumsFunc) error {
     if rr.Format() == gorom.FormatDir {
-        return rdb.ChecksumDir(rr, checksumFunc)
+        return rdb.ChecksumDir(rr, checksumsFunc)
     } else {
-        return rdb.ChecksumArchive(rr, checksumFunc)
+        return rdb.ChecksumArchive(rr, checksumsFunc)
     }
 }
 
-func (rdb *RomDB) Lookup(checksum checksum.Sha1) (*RomDBEntry, error) {
-    var v []byte
-    err := rdb.db.View(func(tx *bolt.Tx) error {
-        cb := tx.Bucket([]byte(ChecksumBucket))
-        if cb == nil {
-            return nil
+func (rdb *RomDB) Checksum(rr romio.RomReader, checksumFunc ChecksumFunc) error {
+    var checksumsFunc ChecksumsFunc
+    if checksumFunc != nil {
+        checksumsFunc = func(name string, checksums romio.Checksums) error {
+            return checksumFunc(name, checksums.Sha1)
+        }
+    }
+    return rdb.Checksums(rr, checksumsFunc)
+}
+
+// formatRank ranks a machine format by how fast a ROM can be copied out of
+// it.  Files in directories are copied as is and zip files can be copied raw
+// without recompressing.  Other archives have to be decompressed.
+func formatRank(machPath string) int {
+    switch romio.MachFormat(machPath) {
+    case gorom.FormatDir:
+        return 0
+    case gorom.FormatZip:
+        return 1
+    }
+    return 2
+}
+
+// checksumRomKey returns a function that splits the ROM key from a checksum
+// lookup key of a length.  Older databases store the only location as the
+// value.
+func checksumRomKey(keyLen int) func(k, v []byte) []byte {
+    return func(k, v []byte) []byte {
+        if len(k) == keyLen {
+            return v
         }
+        return k[keyLen:]
+    }
+}
 
-        romKey := cb.Get(checksum[:])
-        if romKey == nil {
+// nameRomKey returns a function that splits the ROM key from a name lookup
+// key if the name matches a glob pattern
+func nameRomKey(pattern string) func(k, v []byte) []byte {
+    return func(k, v []byte) []byte {
+        i := bytes.IndexByte(k, 0)
+        if i < 0 {
             return nil
         }
+        if matched, _ := path.Match(pattern, string(k[:i])); !matched {
+            return nil
+        }
+        return k[i + 1:]
+    }
+}
 
-        rb := tx.Bucket([]byte(RomBucket))
-        if rb != nil {
-            v = rb.Get(romKey)
+// globPrefix returns the part of a glob pattern before the first wildcard
+func globPrefix(pattern string) []byte {
+    if i := strings.IndexAny(pattern, "*?[\\"); i >= 0 {
+        pattern = pattern[:i]
+    }
+    return []byte(pattern)
+}
+
+// lookup returns all of the entries of the lookup keys with a prefix ranked
+// by their format.  The ROM key function returns the ROM key of a lookup key
+// or nil if the key does not match.  Lookups whose entries are gone or no
+// longer match are deleted.
+func (rdb *RomDB) lookup(bucket string, prefix []byte, romKeyFunc func(k, v []byte) []byte,
+                         match func(entry *RomDBEntry) bool) ([]*RomDBEntry, error) {
+    entries := []*RomDBEntry{}
+    staleKeys := [][]byte{}
+    err := rdb.db.View(func(tx *bolt.Tx) error {
+        b := tx.Bucket(rdb.bucket(bucket))
+        if b == nil {
+            return nil
         }
+        rb := tx.Bucket(rdb.bucket(RomBucket))
+
+        c := b.Cursor()
+        for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+            romKey := romKeyFunc(k, v)
+            if romKey == nil {
+                continue
+            }
+
+            var val []byte
+            if rb != nil {
+                val = rb.Get(romKey)
+            }
 
-        v = rb.Get(romKey)
-        return nil;
+            var entry RomDBEntry
+            if val == nil || binary.Unmarshal(val, &entry) != nil || !match(&entry) {
+                staleKeys = append(staleKeys, append([]byte{}, k...))
+                continue
+            }
+            entries = append(entries, &entry)
+        }
+        return nil
     })
     if err != nil {
         return nil, err
     }
-    if v == nil {
-        return nil, nil
+
+    if len(staleKeys) > 0 {
+        err = rdb.deleteKeys(bucket, staleKeys)
+        if err != nil {
+            return nil, err
+        }
     }
 
-    var entry RomDBEntry
-    err = binary.Unmarshal(v, &entry)
+    sort.SliceStable(entries, func(i, j int) bool {
+        return formatRank(entries[i].MachPath) < formatRank(entries[j].MachPath)
+    })
+
+    return entries, nil
+}
+
+// Lookup returns every location of a SHA-1 with the fastest to copy first
+func (rdb *RomDB) Lookup(checksum checksum.Sha1) ([]*RomDBEntry, error) {
+    return rdb.lookup(ChecksumBucket, checksum[:], checksumRomKey(len(checksum)), func(entry *RomDBEntry) bool {
+        return entry.Sum == checksum
+    })
+}
+
+func (rdb *RomDB) LookupMd5(checksum checksum.Md5) ([]*RomDBEntry, error) {
+    return rdb.lookup(Md5Bucket, checksum[:], checksumRomKey(len(checksum)), func(entry *RomDBEntry) bool {
+        return entry.Md5 == checksum
+    })
+}
+
+func (rdb *RomDB) LookupCrc32(checksum checksum.Crc32, size int64) ([]*RomDBEntry, error) {
+    key := crc32Key(checksum, size)
+    return rdb.lookup(Crc32Bucket, key, checksumRomKey(len(key)), func(entry *RomDBEntry) bool {
+        return entry.Crc32 == checksum && entry.Size == size
+    })
+}
+
+// LookupCrc32Any returns every location of a CRC32 with any size
+func (rdb *RomDB) LookupCrc32Any(checksum checksum.Crc32) ([]*RomDBEntry, error) {
+    keyLen := len(crc32Key(checksum, 0))
+    return rdb.lookup(Crc32Bucket, checksum[:], checksumRomKey(keyLen), func(entry *RomDBEntry) bool {
+        return entry.Crc32 == checksum
+    })
+}
+
+// LookupName returns every ROM whose file name matches a glob pattern
+func (rdb *RomDB) LookupName(pattern string) ([]*RomDBEntry, error) {
+    _, err := path.Match(pattern, "")
     if err != nil {
         return nil, err
     }
+    return rdb.lookup(NameBucket, globPrefix(pattern), nameRomKey(pattern), func(entry *RomDBEntry) bool {
+        matched, _ := path.Match(pattern, path.Base(entry.RomPath))
+        return matched
+    })
+}
 
-    // Delete the checksum in the bucket if it doesn't match
-    if checksum != entry.Sum {
-        err = rdb.deleteChecksum(checksum)
+// LookupMachine returns every ROM in the machines whose names match a glob
+// pattern.  The machine names do not have a file extension.
+func (rdb *RomDB) LookupMachine(pattern string) ([]*RomDBEntry, error) {
+    _, err := path.Match(pattern, "")
+    if err != nil {
         return nil, err
     }
-
-    return &entry, nil
+    return rdb.lookup(MachineBucket, globPrefix(pattern), nameRomKey(pattern), func(entry *RomDBEntry) bool {
+        matched, _ := path.Match(pattern, romio.MachName(entry.MachPath))
+        return matched
+    })
 }
 
 type ScanFunc func(machPath string, err error)
 
+// WantedFunc returns true if the checksums of a file are needed
+type WantedFunc func(file *romio.RomFile) bool
+
+// SetWanted makes scans only calculate the checksums of the files that the
+// wanted function returns true for.  The other files are not read and only
+// their size and modification time are recorded.
+func (rdb *RomDB) SetWanted(wanted WantedFunc) {
+    rdb.wanted = wanted
+}
+
+// checksumWanted calculates the checksums of the wanted files in a machine
+// that are not up to date in the database.  The other files only get an entry
+// with their size and modification time so a later scan knows whether they
+// changed.  It returns the names of the files with up to date entries.
+func (rdb *RomDB) checksumWanted(rr romio.RomReader, stop chan struct{}) ([]string, error) {
+    machPath := rdb.machPath(rr.Path())
+    names := []string{}
+    addFiles := []*romio.RomFile{}
+    sizeEntries := []*RomDBEntry{}
+    err := rdb.db.View(func(tx *bolt.Tx) error {
+        rb := tx.Bucket(rdb.bucket(RomBucket))
+        for _, file := range rr.Files() {
+            var entry RomDBEntry
+            found := false
+            if rb != nil {
+                val := rb.Get([]byte(machPath + "\x00" + file.Name))
+                found = val != nil && binary.Unmarshal(val, &entry) == nil
+            }
+            if found && rdb.cached(file, &entry) {
+                names = append(names, file.Name)
+                continue
+            }
+            wanted := rdb.wanted(file)
+            if found && !wanted && !modified(file, &entry) {
+                names = append(names, file.Name)
+                continue
+            }
+            if wanted {
+                addFiles = append(addFiles, file)
+            } else {
+                sizeEntries = append(sizeEntries, &RomDBEntry{ MachPath: machPath, RomPath: file.Name,
+                                                               ModTime: file.ModTime, Size: file.Size })
+                names = append(names, file.Name)
+            }
+        }
+        return nil
+    })
+    if err == nil && len(sizeEntries) > 0 {
+        err = rdb.putEntries(sizeEntries)
+    }
+    if err != nil || len(addFiles) == 0 {
+        return names, err
+    }
+
+    checksums := make([]romio.Checksums, len(addFiles))
+    for i, file := range addFiles {
+        if isStop(stop) {
+            return nil, StopError
+        }
+        checksums[i], err = rdb.checksumRom(rr, file)
+        if err != nil {
+            return nil, err
+        }
+        names = append(names, file.Name)
+    }
+
+    return names, rdb.addFiles(machPath, addFiles, checksums)
+}
+
 type ScanResults struct {
     romKeys util.StringSet
     name string
@@ -454,19 +1042,28 @@ func (rdb *RomDB) scanChecksum(name string, ch chan ScanResults, stop chan struc
     }
 
     romKeys := util.NewStringSet()
+    machPath := rdb.machPath(path.Join(rdb.Dir, name))
     rr, err := romio.OpenRomReader(path.Join(rdb.Dir, name))
     if err == nil {
         if rr != nil {
-            err := rdb.Checksum(rr, func(name string, sum checksum.Sha1) error {
-                if isStop(stop) {
-                    return StopError;
+            if rdb.wanted != nil {
+                var names []string
+                names, err = rdb.checksumWanted(rr, stop)
+                for _, fileName := range names {
+                    romKeys.Set(machPath + "\x00" + fileName)
                 }
-                return nil
-            })
-            if err == nil {
-                for _, file := range rr.Files() {
-                    keyStr := name + "\x00" + file.Name
-                    romKeys.Set(keyStr)
+            } else {
+                err := rdb.Checksum(rr, func(name string, sum checksum.Sha1) error {
+                    if isStop(stop) {
+                        return StopError;
+                    }
+                    return nil
+                })
+                if err == nil {
+                    for _, file := range rr.Files() {
+                        keyStr := machPath + "\x00" + file.Name
+                        romKeys.Set(keyStr)
+                    }
                 }
             }
             rr.Close()
@@ -488,6 +1085,18 @@ func scanResults(romKeys util.StringSet, ch chan ScanResults, scanFunc ScanFunc)
     }
 }
 
+// scanNames calls nameFunc with the name of each machine in the directory.
+// The machines of a depot are the gzip files of its ROMs so a depot can be
+// scanned like any other source directory.
+func (rdb *RomDB) scanNames(nameFunc func(name string) error) error {
+    if depot.IsDepot(rdb.Dir) {
+        return depot.Walk(rdb.Dir, nameFunc)
+    }
+    return util.ScanDir(rdb.Dir, true, func(info os.FileInfo) error {
+        return nameFunc(info.Name())
+    })
+}
+
 func (rdb *RomDB) Scan(goLimit int, stop chan struct{}, scanFunc ScanFunc) error {
     ch := make(chan ScanResults, 1)
     romKeys := util.NewStringSet()
@@ -496,14 +1105,14 @@ func (rdb *RomDB) Scan(goLimit int, stop chan struct{}, scanFunc ScanFunc) error
     }
 
     goCount := 0
-    err := util.ScanDir(rdb.Dir, true, func(info os.FileInfo) error {
+    err := rdb.scanNames(func(name string) error {
         if goCount == goLimit {
             scanResults(romKeys, ch, scanFunc)
         } else {
             goCount++
         }
 
-        go rdb.scanChecksum(info.Name(), ch, stop)
+        go rdb.scanChecksum(name, ch, stop)
 
         if isStop(stop) {
             return StopError;
@@ -522,40 +1131,84 @@ func (rdb *RomDB) Scan(goLimit int, stop chan struct{}, scanFunc ScanFunc) error
         return StopError
     }
 
-    // Remove any database entries not in the set
-    return rdb.db.Update(func(tx *bolt.Tx) error {
-        rb := tx.Bucket([]byte(RomBucket))
-        if rb == nil {
-            return nil
+    // Remove any database entries not in the set.  Only the entries of the
+    // machines in the directory are removed from a shared database.
+    err = rdb.db.Update(func(tx *bolt.Tx) error {
+        prefix := []byte{}
+        if rdb.root != "" {
+            prefix = rootPrefix(rdb.root)
         }
+        rdb.deleteEntries(tx, prefix, func(key []byte) bool {
+            return !romKeys.IsSet(string(key)) && (rdb.root == "" || inRoot(key, prefix))
+        })
 
-        cb := tx.Bucket([]byte(RomBucket))
-        if cb == nil {
+        if rdb.root == "" {
             return nil
         }
+        b, err := tx.CreateBucketIfNotExists(rdb.bucket(RootBucket))
+        if err != nil {
+            return err
+        }
+        scanTime, err := time.Now().MarshalBinary()
+        if err != nil {
+            return err
+        }
+        return b.Put([]byte(rdb.root), scanTime)
+    })
+    return err
+}
 
-        delKeys := [][]byte{}
-        delSums := [][]byte{}
+// Roots returns the directories that have been scanned into a shared
+// database
+func (rdb *RomDB) Roots() ([]string, error) {
+    roots := []string{}
+    err := rdb.db.View(func(tx *bolt.Tx) error {
+        b := tx.Bucket(rdb.bucket(RootBucket))
+        if b == nil {
+            return nil
+        }
+        return b.ForEach(func(k, v []byte) error {
+            roots = append(roots, string(k))
+            return nil
+        })
+    })
+    return roots, err
+}
 
-        rbc := rb.Cursor()
-        for k, v := rbc.First(); k != nil; k, v = rbc.Next() {
-            keyStr := string(k)
-            if !romKeys.IsSet(keyStr) {
-                delKeys = append(delKeys, k)
+// PruneRoots removes the entries of the directories in a shared database that
+// no longer exist and returns the directories that were removed
+func (rdb *RomDB) PruneRoots() ([]string, error) {
+    roots, err := rdb.Roots()
+    if err != nil {
+        return nil, err
+    }
 
-                var entry RomDBEntry
-                err = binary.Unmarshal(v, &entry)
-                if err == nil {
-                    delSums = append(delSums, entry.Sum[:])
-                }
-            }
+    staleRoots := []string{}
+    for _, root := range roots {
+        _, err := os.Stat(filepath.FromSlash(root))
+        if os.IsNotExist(err) {
+            staleRoots = append(staleRoots, root)
         }
+    }
+    if len(staleRoots) == 0 {
+        return staleRoots, nil
+    }
 
-        for i, k := range delKeys {
-            rb.Delete(k)
-            cb.Delete(delSums[i])
+    err = rdb.db.Update(func(tx *bolt.Tx) error {
+        for _, root := range staleRoots {
+            prefix := rootPrefix(root)
+            rdb.deleteEntries(tx, prefix, func(key []byte) bool {
+                return inRoot(key, prefix)
+            })
+            err := tx.Bucket(rdb.bucket(RootBucket)).Delete([]byte(root))
+            if err != nil {
+                return err
+            }
         }
-
         return nil
     })
+    if err != nil {
+        return nil, err
+    }
+    return staleRoots, nil
 }
@@ -16,17 +16,25 @@
 package romdb
 
 import (
+    "fmt"
+    "io/ioutil"
+    "time"
     "testing"
     "os"
+    "path"
+    "gorom/depot"
     "gorom/test"
     "gorom/checksum"
+    "gorom/romio"
+
+    "github.com/boltdb/bolt"
 )
 
 func runDatabaseTest(t *testing.T, df *test.DatFile) {
     defer test.Chdir(t, df.DataPath)()
 
     defer os.Remove(".gorom.db")
-    rdb, err := OpenRomDB("", true)
+    rdb, err := OpenRomDB("", romio.DefaultSkipper)
     if err != nil {
         test.Fail(t, err)
     }
@@ -43,14 +51,20 @@ func runDatabaseTest(t *testing.T, df *test.DatFile) {
             if !ok {
                 test.Fail(t, "invalid sha1")
             }
-            entry, err := rdb.Lookup(sha1)
+            entries, err := rdb.Lookup(sha1)
             if err != nil {
                 test.Fail(t, err)
             }
-            if entry == nil {
+            if len(entries) == 0 {
                 test.Fail(t, "sha1 checksum not found")
             }
-            if entry.MachPath != df.MachPath(machName) || entry.RomPath != romName {
+            found := false
+            for _, entry := range entries {
+                if entry.MachPath == df.MachPath(machName) && entry.RomPath == romName {
+                    found = true
+                }
+            }
+            if !found {
                 test.Fail(t, "database entry does not match")
             }
         }
@@ -72,3 +86,435 @@ func TestDatabaseHeader(t *testing.T) {
 func TestDatabaseArchive(t *testing.T) {
     test.ForEachDat(t, test.ArchiveDats, runDatabaseTest)
 }
+
+func TestDatabaseLocations(t *testing.T) {
+    tmpdir := test.CopyDirToTemp(t, test.TestDir, path.Join(test.TestDir, "roms/zip"))
+    defer os.RemoveAll(tmpdir)
+    test.CopyDir(t, tmpdir, path.Join(test.TestDir, "roms/7z"))
+    test.CopyDir(t, tmpdir, path.Join(test.TestDir, "roms/dir"))
+
+    rdb, err := OpenRomDB(tmpdir, nil)
+    if err != nil {
+        test.Fail(t, err)
+    }
+    defer rdb.Close()
+
+    sha1, _ := checksum.NewSha1String("325701a893c1102805329f8af2d8410e40c14c79")
+
+    // Every copy is found with directories first, then zips, then 7z
+    err = rdb.Scan(1, nil, nil)
+    if err != nil {
+        test.Fail(t, err)
+    }
+    entries, err := rdb.Lookup(sha1)
+    if err != nil {
+        test.Fail(t, err)
+    }
+    expPaths := []string{ "machine1", "machine1.zip", "machine1.7z" }
+    if len(entries) != len(expPaths) {
+        test.Fail(t, "wrong number of locations")
+    }
+    for i, entry := range entries {
+        if entry.MachPath != expPaths[i] || entry.RomPath != "rom_1.bin" {
+            test.Fail(t, "location does not match")
+        }
+    }
+
+    // The other copies are still found after one is deleted
+    err = os.RemoveAll(path.Join(tmpdir, "machine1"))
+    if err != nil {
+        test.Fail(t, err)
+    }
+    err = rdb.Scan(1, nil, nil)
+    if err != nil {
+        test.Fail(t, err)
+    }
+    entries, err = rdb.Lookup(sha1)
+    if err != nil {
+        test.Fail(t, err)
+    }
+    if len(entries) != 2 || entries[0].MachPath != "machine1.zip" {
+        test.Fail(t, "deleted location found")
+    }
+}
+
+func TestDatabaseShared(t *testing.T) {
+    zipDir := test.CopyDirToTemp(t, test.TestDir, path.Join(test.TestDir, "roms/zip"))
+    defer os.RemoveAll(zipDir)
+    dirDir := test.CopyDirToTemp(t, test.TestDir, path.Join(test.TestDir, "roms/dir"))
+    defer os.RemoveAll(dirDir)
+    dbDir, err := ioutil.TempDir(test.TestDir, "gorom*")
+    if err != nil {
+        test.Fail(t, err)
+    }
+    defer os.RemoveAll(dbDir)
+    dbFile := path.Join(dbDir, SharedDbFile)
+
+    zipDB, err := OpenSharedRomDB(dbFile, zipDir, nil)
+    if err != nil {
+        test.Fail(t, err)
+    }
+    defer zipDB.Close()
+    dirDB, err := OpenSharedRomDB(dbFile, dirDir, nil)
+    if err != nil {
+        test.Fail(t, err)
+    }
+    defer dirDB.Close()
+
+    sha1, _ := checksum.NewSha1String("325701a893c1102805329f8af2d8410e40c14c79")
+    lookup := func(rdb *RomDB, expPaths []string) {
+        entries, err := rdb.Lookup(sha1)
+        if err != nil {
+            test.Fail(t, err)
+        }
+        if len(entries) != len(expPaths) {
+            test.Fail(t, "wrong number of locations")
+        }
+        for i, entry := range entries {
+            if rdb.Path(entry) != expPaths[i] {
+                test.Fail(t, "location does not match")
+            }
+        }
+    }
+
+    // The ROMs of both directories are found from either one
+    for _, rdb := range []*RomDB{ zipDB, dirDB } {
+        err = rdb.Scan(1, nil, nil)
+        if err != nil {
+            test.Fail(t, err)
+        }
+    }
+    zipPath := path.Join(zipDB.root, "machine1.zip")
+    dirPath := path.Join(dirDB.root, "machine1")
+    lookup(zipDB, []string{ dirPath, zipPath })
+    lookup(dirDB, []string{ dirPath, zipPath })
+
+    // Scanning one directory leaves the other alone
+    err = os.Remove(path.Join(zipDir, "machine1.zip"))
+    if err != nil {
+        test.Fail(t, err)
+    }
+    err = zipDB.Scan(1, nil, nil)
+    if err != nil {
+        test.Fail(t, err)
+    }
+    lookup(dirDB, []string{ dirPath })
+
+    // Directories that are gone like unmounted drives are kept by a scan and
+    // only removed by a prune
+    err = os.Link(path.Join(test.TestDir, "roms/zip/machine1.zip"), path.Join(zipDir, "machine1.zip"))
+    if err != nil {
+        test.Fail(t, err)
+    }
+    err = zipDB.Scan(1, nil, nil)
+    if err != nil {
+        test.Fail(t, err)
+    }
+    err = os.RemoveAll(dirDir)
+    if err != nil {
+        test.Fail(t, err)
+    }
+    err = zipDB.Scan(1, nil, nil)
+    if err != nil {
+        test.Fail(t, err)
+    }
+    lookup(zipDB, []string{ dirPath, zipPath })
+    roots, err := zipDB.Roots()
+    if err != nil {
+        test.Fail(t, err)
+    }
+    if len(roots) != 2 {
+        test.Fail(t, "missing root removed by scan")
+    }
+
+    _, err = zipDB.Prune()
+    if err != nil {
+        test.Fail(t, err)
+    }
+    lookup(zipDB, []string{ zipPath })
+    roots, err = zipDB.Roots()
+    if err != nil {
+        test.Fail(t, err)
+    }
+    if len(roots) != 1 || roots[0] != zipDB.root {
+        test.Fail(t, "stale root not pruned")
+    }
+}
+
+func TestDatabaseReindex(t *testing.T) {
+    tmpdir := test.CopyDirToTemp(t, test.TestDir, path.Join(test.TestDir, "roms/zip"))
+    defer os.RemoveAll(tmpdir)
+
+    rdb, err := OpenRomDB(tmpdir, nil)
+    if err != nil {
+        test.Fail(t, err)
+    }
+    err = rdb.Scan(1, nil, nil)
+    if err != nil {
+        test.Fail(t, err)
+    }
+
+    // Remove the name indexes like a database from an older version
+    err = rdb.db.Update(func(tx *bolt.Tx) error {
+        for _, bucket := range indexBuckets {
+            err := tx.DeleteBucket(rdb.bucket(bucket))
+            if err != nil {
+                return err
+            }
+        }
+        return nil
+    })
+    rdb.Close()
+    if err != nil {
+        test.Fail(t, err)
+    }
+
+    rdb, err = OpenRomDB(tmpdir, nil)
+    if err != nil {
+        test.Fail(t, err)
+    }
+    defer rdb.Close()
+
+    entries, err := rdb.LookupName("rom_4.*")
+    if err != nil {
+        test.Fail(t, err)
+    }
+    if len(entries) != 1 || entries[0].MachPath != "machine2.zip" {
+        test.Fail(t, "name not reindexed")
+    }
+    entries, err = rdb.LookupMachine("machine3")
+    if err != nil {
+        test.Fail(t, err)
+    }
+    if len(entries) != 4 {
+        test.Fail(t, "machine not reindexed")
+    }
+}
+
+func TestDatabaseWanted(t *testing.T) {
+    tmpdir := test.CopyDirToTemp(t, test.TestDir, path.Join(test.TestDir, "roms/zip"))
+    defer os.RemoveAll(tmpdir)
+
+    rdb, err := OpenRomDB(tmpdir, nil)
+    if err != nil {
+        test.Fail(t, err)
+    }
+    defer rdb.Close()
+
+    // Only the files with the CRC32 of rom_4.bin are hashed
+    crc, _ := checksum.NewCrc32String("c506e1b8")
+    hashed := 0
+    rdb.SetWanted(func(file *romio.RomFile) bool {
+        wanted := file.HasCrc32 && file.Crc32 == crc
+        if wanted {
+            hashed++
+        }
+        return wanted
+    })
+    err = rdb.Scan(1, nil, nil)
+    if err != nil {
+        test.Fail(t, err)
+    }
+    if hashed != 1 {
+        test.Fail(t, "wrong number of files hashed")
+    }
+
+    for _, rom := range []struct{ sha1 string; found bool }{
+        { "d7ed430be515f9b9400248a7cf6ef53006fd29b0", true },
+        { "325701a893c1102805329f8af2d8410e40c14c79", false },
+    } {
+        sha1, _ := checksum.NewSha1String(rom.sha1)
+        entries, err := rdb.Lookup(sha1)
+        if err != nil {
+            test.Fail(t, err)
+        }
+        if (len(entries) > 0) != rom.found {
+            test.Fail(t, "wanted lookup mismatch")
+        }
+    }
+
+    // Up to date entries are kept by later scans
+    err = rdb.Scan(1, nil, nil)
+    if err != nil {
+        test.Fail(t, err)
+    }
+    if hashed != 1 {
+        test.Fail(t, "up to date file hashed again")
+    }
+    sha1, _ := checksum.NewSha1String("d7ed430be515f9b9400248a7cf6ef53006fd29b0")
+    entries, err := rdb.Lookup(sha1)
+    if err != nil {
+        test.Fail(t, err)
+    }
+    if len(entries) != 1 {
+        test.Fail(t, "wanted entry not kept")
+    }
+
+    // The unwanted files only have their size and modification time
+    count := 0
+    err = rdb.ForEach(func(entry *RomDBEntry) error {
+        count++
+        if entry.hashed() != (entry.Sum == sha1) {
+            return fmt.Errorf("unexpected checksums for %s", entry.RomPath)
+        }
+        return nil
+    })
+    if err != nil {
+        test.Fail(t, err)
+    }
+    if count < 2 {
+        test.Fail(t, "unwanted entries not recorded")
+    }
+
+    // A full scan hashes the unwanted files
+    rdb.SetWanted(nil)
+    err = rdb.Scan(1, nil, nil)
+    if err != nil {
+        test.Fail(t, err)
+    }
+    sha1, _ = checksum.NewSha1String("325701a893c1102805329f8af2d8410e40c14c79")
+    entries, err = rdb.Lookup(sha1)
+    if err != nil {
+        test.Fail(t, err)
+    }
+    if len(entries) != 1 {
+        test.Fail(t, "unwanted entry not hashed")
+    }
+}
+
+func TestDatabaseWatch(t *testing.T) {
+    tmpdir := test.CopyDirToTemp(t, test.TestDir, path.Join(test.TestDir, "roms/zip"))
+    defer os.RemoveAll(tmpdir)
+
+    rdb, err := OpenRomDB(tmpdir, nil)
+    if err != nil {
+        test.Fail(t, err)
+    }
+    defer rdb.Close()
+
+    stop := make(chan struct{})
+    names := make(chan string, 16)
+    done := make(chan error, 1)
+    go func() {
+        done <- rdb.Watch(stop, func(name string, err error) {
+            if err != nil {
+                t.Errorf("%s: %v", name, err)
+            }
+            names <- name
+        })
+    }()
+
+    waitName := func(want string) {
+        for {
+            select {
+            case name := <-names:
+                if name == want {
+                    return
+                }
+            case err := <-done:
+                if err == WatchUnsupportedError {
+                    t.Skip(err)
+                }
+                test.Fail(t, err)
+            case <-time.After(10 * time.Second):
+                test.Fail(t, "timeout waiting for "  + want)
+            }
+        }
+    }
+    lookupCount := func(pattern string) int {
+        entries, err := rdb.LookupMachine(pattern)
+        if err != nil {
+            test.Fail(t, err)
+        }
+        return len(entries)
+    }
+
+    // Every machine is scanned before watching
+    waitName("machine3.zip")
+    if lookupCount("machine1") == 0 {
+        test.Fail(t, "machine not scanned")
+    }
+
+    // A new machine is hashed
+    err = os.Link(path.Join(tmpdir, "machine1.zip"), path.Join(tmpdir, "newmach.zip"))
+    if err != nil {
+        test.Fail(t, err)
+    }
+    waitName("newmach.zip")
+    if lookupCount("newmach") != lookupCount("machine1") {
+        test.Fail(t, "new machine not added")
+    }
+
+    // A renamed machine moves its entries
+    err = os.Rename(path.Join(tmpdir, "newmach.zip"), path.Join(tmpdir, "renamed.zip"))
+    if err != nil {
+        test.Fail(t, err)
+    }
+    waitName("renamed.zip")
+    if lookupCount("newmach") != 0 || lookupCount("renamed") == 0 {
+        test.Fail(t, "renamed machine not updated")
+    }
+
+    // A deleted machine has its entries removed
+    err = os.Remove(path.Join(tmpdir, "renamed.zip"))
+    if err != nil {
+        test.Fail(t, err)
+    }
+    waitName("renamed.zip")
+    if lookupCount("renamed") != 0 {
+        test.Fail(t, "deleted machine not removed")
+    }
+
+    close(stop)
+    if err = <-done; err != StopError {
+        test.Fail(t, err)
+    }
+}
+
+func TestDatabaseDepot(t *testing.T) {
+    depotDir, err := ioutil.TempDir("", "depot")
+    if err != nil {
+        test.Fail(t, err)
+    }
+    defer os.RemoveAll(depotDir)
+
+    dp, err := depot.Open(depotDir)
+    if err != nil {
+        test.Fail(t, err)
+    }
+    rr, err := romio.OpenRomReader(path.Join(test.TestDir, "roms/zip/machine1.zip"))
+    if err != nil {
+        test.Fail(t, err)
+    }
+    defer rr.Close()
+    for _, file := range rr.Files() {
+        _, _, err = dp.Add(rr, file)
+        if err != nil {
+            test.Fail(t, err)
+        }
+    }
+
+    // The ROMs of a depot are found by CRC32 for DATs without SHA-1
+    rdb, err := OpenRomDB(depotDir, nil)
+    if err != nil {
+        test.Fail(t, err)
+    }
+    defer rdb.Close()
+    err = rdb.Scan(1, nil, nil)
+    if err != nil {
+        test.Fail(t, err)
+    }
+    for _, file := range rr.Files() {
+        entries, err := rdb.LookupCrc32(file.Crc32, file.Size)
+        if err != nil {
+            test.Fail(t, err)
+        }
+        if len(entries) != 1 {
+            test.Fail(t, "depot ROM not found")
+        }
+        sum, _ := checksum.NewSha1String(entries[0].RomPath)
+        if rdb.Path(entries[0]) != dp.Path(sum) {
+            test.Fail(t, "wrong depot ROM path")
+        }
+    }
+}
@@ -0,0 +1,168 @@
+//  GoRom - Emulator ROM Management Utilities
+//  Copyright (C) 2020 Scott Shumate <scott@shumatech.com>
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package romdb
+
+import (
+    "errors"
+    "os"
+    "path"
+    "path/filepath"
+    "sort"
+    "strings"
+    "time"
+
+    "gorom/romio"
+    "gorom/util"
+
+    "github.com/boltdb/bolt"
+)
+
+///////////////////////////////////////////////////////////////////////////////
+// Watch
+//
+// A watched directory is scanned once and then kept up to date from the file
+// system notifications.  The machines that change are updated after they
+// have been quiet for the watch delay so files that are still being written
+// are not hashed more than once.
+///////////////////////////////////////////////////////////////////////////////
+
+const (
+    WatchDelay = time.Second
+    watchPoll = 250 * time.Millisecond
+)
+
+var (
+    WatchUnsupportedError = errors.New("watching directories is not supported on this platform")
+    watchOverflowError = errors.New("watch event queue overflow")
+)
+
+// watcher is the platform interface for the file system notifications
+type watcher interface {
+    // add watches a directory and all of its subdirectories
+    add(dir string) error
+    // read waits up to the timeout for events and returns the paths that
+    // changed
+    read(timeout time.Duration) ([]string, error)
+    close()
+}
+
+// watchName returns the name of the machine in a directory that a changed
+// path belongs to or an empty string if it is not a machine
+func watchName(dir string, changed string) string {
+    rel, err := filepath.Rel(dir, changed)
+    if err != nil {
+        return ""
+    }
+    name := strings.SplitN(filepath.ToSlash(rel), "/", 2)[0]
+    if name == "" || name[0] == '.' {
+        return ""
+    }
+    return name
+}
+
+// Update brings the entries of a machine in the directory up to date.  The
+// entries of files that are no longer in the machine are deleted and all of
+// the entries are deleted if the machine is gone.
+func (rdb *RomDB) Update(name string) error {
+    machPath := rdb.machPath(name)
+    rr, err := romio.OpenRomReader(path.Join(rdb.Dir, name))
+    if os.IsNotExist(err) || (rr == nil && err == nil) {
+        return rdb.deleteAll(machPath)
+    }
+    if err != nil {
+        return err
+    }
+    defer rr.Close()
+
+    romKeys := util.NewStringSet()
+    for _, file := range rr.Files() {
+        romKeys.Set(machPath + "\x00" + file.Name)
+    }
+    err = rdb.db.Update(func(tx *bolt.Tx) error {
+        rdb.deleteEntries(tx, []byte(machPath + "\x00"), func(key []byte) bool {
+            return !romKeys.IsSet(string(key))
+        })
+        return nil
+    })
+    if err != nil {
+        return err
+    }
+
+    return rdb.Checksum(rr, nil)
+}
+
+// Watch scans the directory and then updates the machines that change until
+// the stop channel is closed.  The scan function is called with every machine
+// that is scanned or updated.
+func (rdb *RomDB) Watch(stop chan struct{}, scanFunc ScanFunc) error {
+    w, err := newWatcher()
+    if err != nil {
+        return err
+    }
+    defer w.close()
+
+    // The directory is watched before the scan so no changes are missed
+    dir := rdb.Dir
+    if dir == "" {
+        dir = "."
+    }
+    err = w.add(dir)
+    if err != nil {
+        return err
+    }
+    err = rdb.Scan(0, stop, scanFunc)
+    if err != nil {
+        return err
+    }
+
+    changed := map[string]time.Time{}
+    for !isStop(stop) {
+        paths, err := w.read(watchPoll)
+        if err == watchOverflowError {
+            // Events were lost so the whole directory is scanned again
+            changed = map[string]time.Time{}
+            err = rdb.Scan(0, stop, scanFunc)
+        }
+        if err != nil {
+            return err
+        }
+
+        now := time.Now()
+        for _, changedPath := range paths {
+            name := watchName(dir, changedPath)
+            if name != "" {
+                changed[name] = now
+            }
+        }
+
+        names := []string{}
+        for name, changeTime := range changed {
+            if now.Sub(changeTime) >= WatchDelay {
+                names = append(names, name)
+            }
+        }
+        sort.Strings(names)
+        for _, name := range names {
+            delete(changed, name)
+            err := rdb.Update(name)
+            if scanFunc != nil {
+                scanFunc(name, err)
+            }
+        }
+    }
+
+    return StopError
+}
@@ -0,0 +1,126 @@
+// +build linux
+
+//  GoRom - Emulator ROM Management Utilities
+//  Copyright (C) 2020 Scott Shumate <scott@shumatech.com>
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package romdb
+
+import (
+    "bytes"
+    "os"
+    "path"
+    "path/filepath"
+    "time"
+    "unsafe"
+
+    "golang.org/x/sys/unix"
+)
+
+const inotifyMask = unix.IN_CREATE | unix.IN_MODIFY | unix.IN_CLOSE_WRITE | unix.IN_ATTRIB |
+                    unix.IN_DELETE | unix.IN_MOVED_FROM | unix.IN_MOVED_TO | unix.IN_ONLYDIR
+
+// inotifyWatcher watches directories with inotify which needs a watch on
+// every subdirectory
+type inotifyWatcher struct {
+    fd int
+    dirs map[int]string
+    buffer []byte
+}
+
+func newWatcher() (watcher, error) {
+    fd, err := unix.InotifyInit1(unix.IN_CLOEXEC | unix.IN_NONBLOCK)
+    if err != nil {
+        return nil, os.NewSyscallError("inotify_init1", err)
+    }
+    return &inotifyWatcher{ fd: fd, dirs: map[int]string{}, buffer: make([]byte, 64 * 1024) }, nil
+}
+
+func (iw *inotifyWatcher) add(dir string) error {
+    return filepath.Walk(filepath.FromSlash(dir), func(dirPath string, info os.FileInfo, err error) error {
+        // The directory can be gone before it is watched
+        if os.IsNotExist(err) {
+            return nil
+        }
+        if err != nil || !info.IsDir() {
+            return err
+        }
+        wd, err := unix.InotifyAddWatch(iw.fd, dirPath, inotifyMask)
+        if err == unix.ENOENT {
+            return nil
+        }
+        if err != nil {
+            return os.NewSyscallError("inotify_add_watch", err)
+        }
+        iw.dirs[wd] = filepath.ToSlash(dirPath)
+        return nil
+    })
+}
+
+func (iw *inotifyWatcher) read(timeout time.Duration) ([]string, error) {
+    fds := []unix.PollFd{ { Fd: int32(iw.fd), Events: unix.POLLIN } }
+    n, err := unix.Poll(fds, int(timeout / time.Millisecond))
+    if err == unix.EINTR || n == 0 {
+        return nil, nil
+    }
+    if err != nil {
+        return nil, os.NewSyscallError("poll", err)
+    }
+
+    n, err = unix.Read(iw.fd, iw.buffer)
+    if err == unix.EAGAIN || err == unix.EINTR {
+        return nil, nil
+    }
+    if err != nil {
+        return nil, os.NewSyscallError("read", err)
+    }
+
+    paths := []string{}
+    for offset := 0; offset + unix.SizeofInotifyEvent <= n; {
+        event := (*unix.InotifyEvent)(unsafe.Pointer(&iw.buffer[offset]))
+        nameOffset := offset + unix.SizeofInotifyEvent
+        name := string(bytes.TrimRight(iw.buffer[nameOffset:nameOffset + int(event.Len)], "\x00"))
+        offset = nameOffset + int(event.Len)
+
+        if event.Mask & unix.IN_Q_OVERFLOW != 0 {
+            return nil, watchOverflowError
+        }
+        dir, ok := iw.dirs[int(event.Wd)]
+        if !ok {
+            continue
+        }
+        if event.Mask & unix.IN_IGNORED != 0 {
+            delete(iw.dirs, int(event.Wd))
+            continue
+        }
+        if name == "" {
+            continue
+        }
+
+        changedPath := path.Join(dir, name)
+        if event.Mask & unix.IN_ISDIR != 0 && event.Mask & (unix.IN_CREATE | unix.IN_MOVED_TO) != 0 {
+            err = iw.add(changedPath)
+            if err != nil {
+                return nil, err
+            }
+        }
+        paths = append(paths, changedPath)
+    }
+
+    return paths, nil
+}
+
+func (iw *inotifyWatcher) close() {
+    unix.Close(iw.fd)
+}
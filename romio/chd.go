@@ -0,0 +1,101 @@
+//  GoRom - Emulator ROM Management Utilities
+//  Copyright (C) 2020 Scott Shumate <scott@shumatech.com>
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package romio
+
+import (
+    "bytes"
+    "encoding/binary"
+    "errors"
+    "io"
+    "os"
+    "path"
+    "strings"
+
+    "gorom/checksum"
+)
+
+///////////////////////////////////////////////////////////////////////////////
+// CHD Header
+//
+// CHD (Compressed Hunks of Data) files hold the hard disk, CD-ROM, and
+// laserdisc images used by MAME.  DAT files list the SHA-1 of the
+// uncompressed data and metadata which is stored in the CHD header so there
+// is no need to decompress and hash the entire file.
+///////////////////////////////////////////////////////////////////////////////
+
+const (
+    ChdExt = ".chd"
+    chdMaxHeaderLen = 124     // v5 header
+)
+
+var (
+    ErrInvalidChd = errors.New("invalid chd header")
+
+    chdTag = []byte("MComprHD")
+)
+
+// Offset of the SHA-1 in the header for each supported CHD version
+var chdSha1Offset = map[uint32]int {
+    3: 80,
+    4: 48,
+    5: 84,
+}
+
+func IsChd(name string) bool {
+    return strings.ToLower(path.Ext(name)) == ChdExt
+}
+
+func ChdSha1(rd io.Reader) (checksum.Sha1, error) {
+    var sum checksum.Sha1
+
+    // Tag, header length, and version
+    var header [16]byte
+    _, err := io.ReadFull(rd, header[:])
+    if err != nil {
+        return sum, ErrInvalidChd
+    }
+    if !bytes.Equal(header[:8], chdTag) {
+        return sum, ErrInvalidChd
+    }
+    length := binary.BigEndian.Uint32(header[8:12])
+    version := binary.BigEndian.Uint32(header[12:16])
+    offset, ok := chdSha1Offset[version]
+    if !ok || length < uint32(offset + len(sum)) || length > chdMaxHeaderLen {
+        return sum, ErrInvalidChd
+    }
+
+    // Only read the header up to the end of the SHA-1
+    buffer := make([]byte, offset + len(sum) - len(header))
+    _, err = io.ReadFull(rd, buffer)
+    if err != nil {
+        return sum, ErrInvalidChd
+    }
+
+    offset -= len(header)
+    copy(sum[:], buffer[offset:offset + len(sum)])
+
+    return sum, nil
+}
+
+func ChdSha1File(chdPath string) (checksum.Sha1, error) {
+    fh, err := os.Open(chdPath)
+    if err != nil {
+        return checksum.Sha1{}, err
+    }
+    defer fh.Close()
+
+    return ChdSha1(fh)
+}
@@ -0,0 +1,181 @@
+//  GoRom - Emulator ROM Management Utilities
+//  Copyright (C) 2020 Scott Shumate <scott@shumatech.com>
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package romio
+
+import (
+    "bytes"
+    "encoding/binary"
+    "io"
+    "os"
+    "path"
+    "strings"
+
+    "gorom"
+    "gorom/checksum"
+
+    "github.com/klauspost/compress/gzip"
+)
+
+///////////////////////////////////////////////////////////////////////////////
+// Gzip Reader
+//
+// Romba and RomVault depots store each ROM as a gzip file named by its SHA-1.
+// The gzip header has an extra field with the MD5, CRC32, and size of the ROM
+// so its checksums are known without decompressing the file.  Other gzip
+// files only have the size modulo 2^32 in the gzip trailer.
+///////////////////////////////////////////////////////////////////////////////
+
+const (
+    GzipExt = ".gz"
+    RombaHeaderLen = 40
+)
+
+// Fixed gzip header with the deflate method, the FEXTRA flag, no modification
+// time, and a 28 byte extra field
+var rombaHeader = []byte{ 0x1f, 0x8b, 0x08, 0x04, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x1c, 0x00 }
+
+// isRombaHeader returns true if a gzip header has the Romba extra field.  The
+// modification time, extra flags, and OS vary between gzip writers so they are
+// not checked.
+func isRombaHeader(header []byte) bool {
+    return bytes.Equal(header[:4], rombaHeader[:4]) && bytes.Equal(header[10:12], rombaHeader[10:12])
+}
+
+// RombaHeader returns the gzip header with the MD5, CRC32, and size of a ROM.
+// The size is little endian like the rest of the gzip header.
+func RombaHeader(sums Checksums) []byte {
+    header := make([]byte, RombaHeaderLen)
+    copy(header, rombaHeader)
+    copy(header[12:28], sums.Md5[:])
+    copy(header[28:32], sums.Crc32[:])
+    binary.LittleEndian.PutUint64(header[32:40], uint64(sums.Size))
+    return header
+}
+
+// isGzip returns true for a gzip file of a single ROM.  Tar files compressed
+// with gzip are archives.
+func isGzip(machPath string) bool {
+    lower := strings.ToLower(machPath)
+    return strings.HasSuffix(lower, GzipExt) && !strings.HasSuffix(lower, ".tar" + GzipExt)
+}
+
+type GzipReader struct {
+    RomInfo
+    checksums Checksums
+    hasChecksums bool
+}
+
+// OpenGzipReader opens a gzip file as a machine with a single file named by
+// the gzip file without its extension
+func OpenGzipReader(gzPath string) (*GzipReader, error) {
+    fh, err := os.Open(gzPath)
+    if err != nil {
+        return nil, err
+    }
+    defer fh.Close()
+
+    info, err := fh.Stat()
+    if err != nil {
+        return nil, err
+    }
+
+    name := strings.TrimSuffix(path.Base(gzPath), path.Ext(gzPath))
+    file := &RomFile{ Name: name, ModTime: info.ModTime() }
+
+    var gr GzipReader
+    header := make([]byte, RombaHeaderLen)
+    _, err = io.ReadFull(fh, header)
+    if err == nil && isRombaHeader(header) {
+        copy(gr.checksums.Md5[:], header[12:28])
+        copy(gr.checksums.Crc32[:], header[28:32])
+        gr.checksums.Size = int64(binary.LittleEndian.Uint64(header[32:40]))
+        gr.checksums.Sha1, gr.hasChecksums = checksum.NewSha1String(name)
+        file.Size = gr.checksums.Size
+        file.Crc32 = gr.checksums.Crc32
+        file.HasCrc32 = true
+    } else {
+        trailer := make([]byte, 4)
+        _, err = fh.ReadAt(trailer, info.Size() - 4)
+        if err != nil {
+            return nil, err
+        }
+        file.Size = int64(binary.LittleEndian.Uint32(trailer))
+    }
+
+    gr.path = gzPath
+    gr.name = name
+    gr.files = []*RomFile{ file }
+
+    return &gr, nil
+}
+
+// Checksums returns the checksums in a Romba gzip header.  The SHA-1 is from
+// the file name.  Ok is false if the file does not have the header or is not
+// named by its SHA-1.
+func (gr *GzipReader) Checksums() (sums Checksums, ok bool) {
+    return gr.checksums, gr.hasChecksums
+}
+
+func (gr *GzipReader) Name() string {
+    return gr.name
+}
+
+func (gr *GzipReader) Path() string {
+    return gr.path
+}
+
+func (gr *GzipReader) Files() []*RomFile {
+    return gr.files
+}
+
+func (gr *GzipReader) Stat(name string) *RomFile {
+    return gr.RomInfo.Stat(name)
+}
+
+type gzipReadCloser struct {
+    *gzip.Reader
+    fh *os.File
+}
+
+func (grc *gzipReadCloser) Close() error {
+    grc.Reader.Close()
+    return grc.fh.Close()
+}
+
+func (gr *GzipReader) Open(file *RomFile) (io.ReadCloser, error) {
+    if file != gr.files[0] {
+        return nil, os.ErrNotExist
+    }
+
+    fh, err := os.Open(gr.path)
+    if err != nil {
+        return nil, err
+    }
+    gz, err := gzip.NewReader(fh)
+    if err != nil {
+        fh.Close()
+        return nil, err
+    }
+    return &gzipReadCloser{ gz, fh }, nil
+}
+
+func (gr *GzipReader) Close() error {
+    return nil
+}
+
+func (gr *GzipReader) Format() int {
+    return gorom.FormatTgz
+}
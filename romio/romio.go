@@ -16,8 +16,9 @@
 package romio
 
 import (
-	"bytes"
+	"crypto/md5"
 	"crypto/sha1"
+	"encoding/binary"
 	"fmt"
 	"hash/crc32"
 	"io"
@@ -89,10 +90,15 @@ func MachName(machPath string) string {
 // ROM Reader
 ///////////////////////////////////////////////////////////////////////////////
 
+// RomFile is a file in a machine.  Archives that store the CRC32 of their
+// files in the directory set HasCrc32 so the CRC32 is known without reading
+// the file.
 type RomFile struct {
     Name string
     Size int64
     ModTime time.Time
+    Crc32 checksum.Crc32
+    HasCrc32 bool
 }
 
 type RomInfo struct {
@@ -127,6 +133,8 @@ func OpenRomReader(machPath string) (RomReader, error) {
         machFmt := MachFormat(machPath)
         if machFmt == gorom.FormatZip {
             return OpenZipReader(machPath)
+        } else if isGzip(machPath) {
+            return OpenGzipReader(machPath)
         } else {
             return OpenArchiveReader(machPath)
         }
@@ -135,42 +143,67 @@ func OpenRomReader(machPath string) (RomReader, error) {
     return nil, nil
 }
 
+// isDiskDir returns true if a directory only contains CHD files.  This is
+// the directory that holds the disks of a machine whose ROMs are archived.
+func isDiskDir(dir string) bool {
+    files, err := ioutil.ReadDir(dir)
+    if err != nil || len(files) == 0 {
+        return false
+    }
+    for _, file := range files {
+        if !IsChd(file.Name()) {
+            return false
+        }
+    }
+    return true
+}
+
 // TODO: do we need really to modify machName???
 func OpenRomReaderByName(machName string) (RomReader, error) {
     info, err := os.Stat(machName)
     if err == nil && info.IsDir() {
+        if isDiskDir(machName) {
+            rr, err := openArchiveByName(machName)
+            if rr != nil || err != nil {
+                return rr, err
+            }
+        }
         return OpenDirReader(machName)
-    } else {
-        ext := MachExt(gorom.FormatZip)
-        fileName := machName + ext
+    }
+
+    return openArchiveByName(machName)
+}
+
+func openArchiveByName(machName string) (RomReader, error) {
+    ext := MachExt(gorom.FormatZip)
+    fileName := machName + ext
+    info, err := os.Stat(fileName)
+    if err == nil && info.Mode().IsRegular() {
+        machName = fileName
+        return OpenZipReader(machName)
+    }
+
+    fileName = machName + strings.ToUpper(ext)
+    info, err = os.Stat(fileName)
+    if err == nil && info.Mode().IsRegular() {
+        machName = fileName
+        return OpenZipReader(machName)
+    }
+
+    for _, format := range ArchiveReaderFormats() {
+        ext = MachExt(format)
+        fileName = machName + ext
         info, err = os.Stat(fileName)
         if err == nil && info.Mode().IsRegular() {
             machName = fileName
-            return OpenZipReader(machName)
+            return OpenArchiveReader(machName)
         }
 
         fileName = machName + strings.ToUpper(ext)
         info, err = os.Stat(fileName)
         if err == nil && info.Mode().IsRegular() {
             machName = fileName
-            return OpenZipReader(machName)
-        }
-
-        for _, format := range ArchiveReaderFormats() {
-            ext = MachExt(format)
-            fileName = machName + ext
-            info, err = os.Stat(fileName)
-            if err == nil && info.Mode().IsRegular() {
-                machName = fileName
-                return OpenArchiveReader(machName)
-            }
-
-            fileName = machName + strings.ToUpper(ext)
-            info, err = os.Stat(fileName)
-            if err == nil && info.Mode().IsRegular() {
-                machName = fileName
-                return OpenArchiveReader(machName)
-            }
+            return OpenArchiveReader(machName)
         }
     }
 
@@ -361,7 +394,7 @@ func (dw *DirWriter) Open(size int64, modTime *time.Time) (io.WriteCloser, error
     }
 
     name := dw.names[dw.next - 1]
-    dir := path.Dir(dw.name)
+    dir := path.Dir(name)
     if dir != "." {
         path := path.Join(dw.path, dir)
         err := os.MkdirAll(path, os.ModePerm)
@@ -436,7 +469,9 @@ func OpenZipReader(machPath string) (*ZipReader, error) {
             Name: fh.Name,
             Size: int64(fh.UncompressedSize64),
             ModTime: info.ModTime(),
+            HasCrc32: true,
         }
+        binary.BigEndian.PutUint32(file.Crc32[:], fh.CRC32)
         files = append(files, &file)
     }
 
@@ -853,65 +888,47 @@ func CopyRom(writer RomWriter, dstName string, reader RomReader, srcName string)
 type Checksums struct {
     Crc32 checksum.Crc32
     Sha1 checksum.Sha1
+    Md5 checksum.Md5
     Size int64
 }
 
+// MD5 is slower and rarely needed so it is only calculated when requested
 const (
     ChecksumSkipHeader = 1 << iota
     ChecksumNoCrc32
     ChecksumNoSha1
+    ChecksumMd5
 )
 
 type ChecksumFunc func(name string, checksums Checksums) error
 
-type RomHeader struct {
-    offset int
-    magic []byte
-    size int
-}
-
-var (
-    romHeaders = []RomHeader{
-        // NES
-        { 0x0, []byte{ 0x4E, 0x45, 0x53, 0x1A }, 0x10 },
-        // Atari 7800
-        { 0x1, []byte{ 0x41, 0x54, 0x41, 0x52, 0x49, 0x37, 0x38, 0x30, 0x30 }, 0x80 },
-        // Atari Lynx
-        { 0x0, []byte{ 0x4C, 0x59, 0x4E, 0x58 }, 0x40 },
-    }
-)
-
-func headerSize(buffer []byte) int {
-    for _, header := range romHeaders {
-        start := header.offset
-        end := start + len(header.magic)
-        if bytes.Equal(buffer[start:end], header.magic) {
-            return header.size
-        }
+// ChecksumRom calculates the checksums of a ROM.  The ChecksumSkipHeader
+// option skips the headers in the DefaultSkipper.
+func ChecksumRom(rd io.Reader, options int) (Checksums, error) {
+    var skipper *HeaderSkipper
+    if options & ChecksumSkipHeader != 0 {
+        skipper = DefaultSkipper
     }
-    return 0
+    return ChecksumRomSkipper(rd, options, skipper)
 }
 
-func ChecksumRom(rd io.Reader, options int) (Checksums, error) {
+// ChecksumRomSkipper calculates the checksums of a ROM after applying a
+// header skipper.  Only the start of the ROM that the skipper rules test is
+// read into memory before the rest is streamed, unless a rule tests the size
+// or the end of the ROM.
+func ChecksumRomSkipper(rd io.Reader, options int, skipper *HeaderSkipper) (Checksums, error) {
     checksums := Checksums{Size:0}
     sha1Hash := sha1.New()
     crc32Hash := crc32.NewIEEE()
+    md5Hash := md5.New()
     buffer := make([]byte, 256 * 1024)
 
-    if options & ChecksumSkipHeader != 0 {
-        const HeaderSize = 128
-        size, err := io.ReadAtLeast(rd, buffer, HeaderSize)
+    if skipper != nil {
+        var err error
+        rd, err = skipper.SkipReader(rd)
         if err != nil {
             return checksums, err
         }
-        offset := headerSize(buffer)
-        if options & ChecksumNoSha1 == 0 {
-            sha1Hash.Write(buffer[offset:size])
-        }
-        if options & ChecksumNoCrc32 == 0 {
-            crc32Hash.Write(buffer[offset:size])
-        }
-        checksums.Size = int64(size - offset)
     }
 
     for {
@@ -923,6 +940,9 @@ func ChecksumRom(rd io.Reader, options int) (Checksums, error) {
             if options & ChecksumNoCrc32 == 0 {
                 crc32Hash.Write(buffer[:size])
             }
+            if options & ChecksumMd5 != 0 {
+                md5Hash.Write(buffer[:size])
+            }
             checksums.Size += int64(size)
         }
         if err != nil {
@@ -935,17 +955,35 @@ func ChecksumRom(rd io.Reader, options int) (Checksums, error) {
 
     copy(checksums.Sha1[:], sha1Hash.Sum(nil))
     copy(checksums.Crc32[:], crc32Hash.Sum(nil))
+    if options & ChecksumMd5 != 0 {
+        copy(checksums.Md5[:], md5Hash.Sum(nil))
+    }
 
     return checksums, nil
 }
 
 func ChecksumMach(machPath string, options int, checksumFunc ChecksumFunc) error {
+    var skipper *HeaderSkipper
+    if options & ChecksumSkipHeader != 0 {
+        skipper = DefaultSkipper
+    }
+    return ChecksumMachSkipper(machPath, options, skipper, checksumFunc)
+}
+
+func ChecksumMachSkipper(machPath string, options int, skipper *HeaderSkipper, checksumFunc ChecksumFunc) error {
     rr, err := OpenRomReader(machPath)
     if rr == nil || err != nil {
         return err
     }
     defer rr.Close()
 
+    // Romba gzip files have their checksums in the gzip header
+    if gr, ok := rr.(*GzipReader); ok && skipper == nil {
+        if checksums, ok := gr.Checksums(); ok {
+            return checksumFunc(gr.files[0].Name, checksums)
+        }
+    }
+
     for _, file := range rr.Files() {
         rc, err := rr.Open(file)
         if err != nil {
@@ -953,7 +991,7 @@ func ChecksumMach(machPath string, options int, checksumFunc ChecksumFunc) error
         }
         defer rc.Close()
 
-        checksums, err := ChecksumRom(rc, options)
+        checksums, err := ChecksumRomSkipper(rc, options, skipper)
         if err != nil {
             return err
         }
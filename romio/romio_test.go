@@ -16,9 +16,16 @@
 package romio
 
 import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/hex"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"os"
 	"path"
+	"strings"
 	"testing"
 
 	"gorom/checksum"
@@ -200,3 +207,366 @@ func TestChecksumMachHeader(t *testing.T) {
 func TestChecksumMachArchive(t *testing.T) {
     test.ForEachDat(t, test.ArchiveDats, runChecksumMachTest)
 }
+
+func TestChdSha1(t *testing.T) {
+    defer test.Chdir(t, "roms/chd")()
+
+    sum, err := ChdSha1File("machine1/disk1.chd")
+    if err != nil {
+        test.Fail(t, err)
+    }
+    expSum, _ := checksum.NewSha1String("5ece4391740056c907bf16d57c530fa4da1554bd")
+    if sum != expSum {
+        test.Fail(t, fmt.Sprintf("sha1 mismatch: %x != %x", sum, expSum))
+    }
+
+    _, err = ChdSha1File("machine1.zip")
+    if err != ErrInvalidChd {
+        test.Fail(t, "invalid chd not detected")
+    }
+
+    // A header length larger than any CHD version is rejected
+    header := append([]byte("MComprHD"), 0xff, 0xff, 0xff, 0x00, 0, 0, 0, 5)
+    _, err = ChdSha1(bytes.NewReader(header))
+    if err != ErrInvalidChd {
+        test.Fail(t, "invalid chd header length not detected")
+    }
+}
+
+func TestGzipReaderHeader(t *testing.T) {
+    data := []byte("gorom depot file")
+    sums, err := ChecksumRom(bytes.NewReader(data), ChecksumMd5)
+    if err != nil {
+        test.Fail(t, err)
+    }
+
+    // The standard gzip writer sets the OS to unknown and the extra flags from
+    // the compression level
+    var buf bytes.Buffer
+    gw, err := gzip.NewWriterLevel(&buf, gzip.BestCompression)
+    if err != nil {
+        test.Fail(t, err)
+    }
+    gw.Extra = RombaHeader(sums)[12:]
+    _, err = gw.Write(data)
+    if err == nil {
+        err = gw.Close()
+    }
+    if err != nil {
+        test.Fail(t, err)
+    }
+    header := buf.Bytes()
+    if header[8] == 0 || header[9] == 0 {
+        test.Fail(t, "gzip header has no extra flags or OS")
+    }
+
+    gzPath := path.Join(os.TempDir(), hex.EncodeToString(sums.Sha1[:]) + GzipExt)
+    err = ioutil.WriteFile(gzPath, header, 0644)
+    if err != nil {
+        test.Fail(t, err)
+    }
+    defer os.Remove(gzPath)
+
+    gr, err := OpenGzipReader(gzPath)
+    if err != nil {
+        test.Fail(t, err)
+    }
+    defer gr.Close()
+    headerSums, ok := gr.Checksums()
+    if !ok || headerSums != sums {
+        test.Fail(t, "gzip header checksums not found")
+    }
+
+    // A gzip file is a machine of its own with the checksums of the header
+    rr, err := OpenRomReader(gzPath)
+    if err != nil {
+        test.Fail(t, err)
+    }
+    defer rr.Close()
+    if _, ok := rr.(*GzipReader); !ok {
+        test.Fail(t, "gzip file not opened with the gzip reader")
+    }
+    err = ChecksumMach(gzPath, ChecksumMd5, func(name string, machSums Checksums) error {
+        if name != hex.EncodeToString(sums.Sha1[:]) || machSums != sums {
+            test.Fail(t, "gzip machine checksum mismatch")
+        }
+        return nil
+    })
+    if err != nil {
+        test.Fail(t, err)
+    }
+}
+
+func TestRomReaderDiskDir(t *testing.T) {
+    defer test.Chdir(t, "roms/chd")()
+
+    // The disk directory must not hide the zip
+    rr, err := OpenRomReaderByName("machine1")
+    if err != nil {
+        test.Fail(t, err)
+    }
+    if rr == nil {
+        test.Fail(t, "machine not found")
+    }
+    defer rr.Close()
+    if rr.Path() != "machine1.zip" {
+        test.Fail(t, fmt.Sprintf("wrong path: %s", rr.Path()))
+    }
+}
+
+func TestHeaderSkipperDef(t *testing.T) {
+    defer test.Chdir(t, ".")()
+
+    skipper, err := LoadHeaderSkipper("dats/headers/gorom.xml")
+    if err != nil {
+        test.Fail(t, err)
+    }
+    if skipper.Id() != "GoRom Test Headers 1.0" || len(skipper.Rules) != 3 {
+        test.Fail(t, "header definition mismatch")
+    }
+
+    for _, df := range test.HeaderDats {
+        for machName, machine := range df.Machines {
+            err := ChecksumMachSkipper(path.Join(df.DataPath, df.MachPath(machName)), 0, skipper,
+                                       func (actName string, actChecksums Checksums) error {
+                expSha1, _ := checksum.NewSha1String(machine.Roms[actName].Sha1)
+                if expSha1 != actChecksums.Sha1 {
+                    test.Fail(t, fmt.Sprintf("%s: sha1 mismatch", actName))
+                }
+                return nil
+            })
+            if err != nil {
+                test.Fail(t, err)
+            }
+        }
+    }
+}
+
+func TestHeaderSkipperOps(t *testing.T) {
+    skipper, err := ParseHeaderSkipper(strings.NewReader(`<detector>
+        <name>ops</name>
+        <rule operation="byteswap"><data offset="0" value="3780"/></rule>
+        <rule operation="wordswap"><data offset="0" value="4012"/></rule>
+        <rule start_offset="2" end_offset="-1"><xor offset="-1" mask="FF" value="00"/></rule>
+        <rule operation="bitswap"><file size="PO2" result="false"/></rule>
+    </detector>`))
+    if err != nil {
+        test.Fail(t, err)
+    }
+
+    tests := []struct {
+        data string
+        exp  string
+    }{
+        { "37801240", "80374012" },
+        { "40123780", "80371240" },
+        { "000102ff", "02" },
+        { "010203", "8040c0" },
+        { "01020304", "01020304" },
+    }
+    for _, tt := range tests {
+        data, _ := hex.DecodeString(tt.data)
+        act := fmt.Sprintf("%x", skipper.Skip(data))
+        if act != tt.exp {
+            test.Fail(t, fmt.Sprintf("%s: %s != %s", tt.data, act, tt.exp))
+        }
+    }
+
+    _, err = ParseHeaderSkipper(strings.NewReader(`<detector><rule operation="bogus"/></detector>`))
+    if err == nil {
+        test.Fail(t, "invalid operation not detected")
+    }
+}
+
+func TestHeaderSkipperReader(t *testing.T) {
+    skipper, err := ParseHeaderSkipper(strings.NewReader(`<detector>
+        <name>stream</name>
+        <rule operation="byteswap"><data offset="0" value="3780"/></rule>
+        <rule operation="wordswap"><data offset="0" value="4012"/></rule>
+        <rule start_offset="10" end_offset="20010"><data offset="0" value="4E45531A"/></rule>
+        <rule start_offset="3" operation="bitswap"><and offset="1" mask="F0" value="A0"/></rule>
+    </detector>`))
+    if err != nil {
+        test.Fail(t, err)
+    }
+    if skipper.prefixLen() != 0x10 {
+        test.Fail(t, "wrong prefix length")
+    }
+
+    for _, header := range []string{ "3780", "4012", "4E45531A", "00A5", "0000", "37" } {
+        prefix, _ := hex.DecodeString(header)
+        for _, size := range []int{ len(prefix), 0x11, 3 * swapChunk + 3 } {
+            data := make([]byte, size)
+            for i := range data {
+                data[i] = byte(i * 7)
+            }
+            copy(data, prefix)
+
+            rd := bytes.NewReader(data)
+            sr, err := skipper.SkipReader(rd)
+            if err != nil {
+                test.Fail(t, err)
+            }
+            if size > 0x10 && rd.Len() != size - 0x10 {
+                test.Fail(t, fmt.Sprintf("%s: read %d bytes before streaming", header, size - rd.Len()))
+            }
+            act, err := ioutil.ReadAll(sr)
+            if err != nil {
+                test.Fail(t, err)
+            }
+            if !bytes.Equal(act, skipper.Skip(data)) {
+                test.Fail(t, fmt.Sprintf("%s: %d byte stream mismatch", header, size))
+            }
+        }
+    }
+}
+
+// zipFileNames returns the names of the files in a zip after checking their
+// CRC32s and that they have the same size as in the source readers
+func zipFileNames(t *testing.T, zipPath string, sources map[string]RomReader) []string {
+    zr, err := OpenZipReader(zipPath)
+    if err != nil {
+        test.Fail(t, err)
+    }
+    defer zr.Close()
+
+    names := []string{}
+    for _, file := range zr.Files() {
+        names = append(names, file.Name)
+        rc, err := zr.Open(file)
+        if err != nil {
+            test.Fail(t, err)
+        }
+        _, err = io.Copy(ioutil.Discard, rc)
+        rc.Close()
+        if err != nil {
+            test.Fail(t, fmt.Sprintf("%s: %s", file.Name, err))
+        }
+        if src, ok := sources[file.Name]; ok {
+            srcFile := src.Stat(file.Name)
+            if srcFile == nil || srcFile.Size != file.Size {
+                test.Fail(t, fmt.Sprintf("%s: size mismatch", file.Name))
+            }
+        }
+    }
+    return names
+}
+
+// checkZipLocalNames fails if a local header name does not match the central
+// directory name
+func checkZipLocalNames(t *testing.T, zipPath string) {
+    ze, err := OpenZipEditor(zipPath)
+    if err != nil {
+        test.Fail(t, err)
+    }
+    fh, err := os.Open(zipPath)
+    if err != nil {
+        test.Fail(t, err)
+    }
+    defer fh.Close()
+    for _, entry := range ze.files {
+        local := make([]byte, zipLocalLen + len(entry.name))
+        _, err = fh.ReadAt(local, int64(binary.LittleEndian.Uint32(entry.header[42:])))
+        if err != nil {
+            test.Fail(t, err)
+        }
+        if int(binary.LittleEndian.Uint16(local[26:])) != len(entry.name) ||
+           string(local[zipLocalLen:]) != entry.name {
+            test.Fail(t, entry.name + ": local header name mismatch")
+        }
+    }
+}
+
+func TestZipEditor(t *testing.T) {
+    zipPath := test.CopyFileToTemp(t, os.TempDir(), path.Join(test.TestDir, "roms/zip/machine2.zip"))
+    defer os.Remove(zipPath)
+    orig, err := ioutil.ReadFile(zipPath)
+    if err != nil {
+        test.Fail(t, err)
+    }
+
+    dr, err := OpenDirReader(path.Join(test.TestDir, "roms/dir/machine1"))
+    if err != nil {
+        test.Fail(t, err)
+    }
+    defer dr.Close()
+    zr, err := OpenZipReader(path.Join(test.TestDir, "roms/zip/machine3.zip"))
+    if err != nil {
+        test.Fail(t, err)
+    }
+    defer zr.Close()
+
+    ze, err := OpenZipEditor(zipPath)
+    if err != nil {
+        test.Fail(t, err)
+    }
+    if !ze.Has("rom_3.bin") || ze.Has("rom_1.bin") {
+        test.Fail(t, "wrong files in zip")
+    }
+
+    // Compressed and raw appends leave the original files
+    err = ze.Append("rom_1.bin", dr, "rom_1.bin")
+    if err != nil {
+        test.Fail(t, err)
+    }
+    err = ze.Append("rom_6.bin", zr, "rom_6.bin")
+    if err != nil {
+        test.Fail(t, err)
+    }
+    err = ze.Flush()
+    if err != nil {
+        test.Fail(t, err)
+    }
+    names := zipFileNames(t, zipPath, nil)
+    if strings.Join(names, ",") != "rom_3.bin,rom_4.bin,rom_5.bin" {
+        test.Fail(t, "wrong files after flush: " + strings.Join(names, ","))
+    }
+
+    // Rename one file in place, rename one with a longer name, and remove
+    // one
+    err = ze.Keep("new_3.bin", "rom_3.bin")
+    if err == nil {
+        err = ze.Keep("renamed_5.bin", "rom_5.bin")
+    }
+    if err != nil {
+        test.Fail(t, err)
+    }
+    removed := ze.Removed()
+    if strings.Join(removed, ",") != "rom_4.bin" {
+        test.Fail(t, "wrong removed files: " + strings.Join(removed, ","))
+    }
+    err = ze.Commit()
+    if err != nil {
+        test.Fail(t, err)
+    }
+    names = zipFileNames(t, zipPath, map[string]RomReader{ "rom_1.bin": dr, "rom_6.bin": zr })
+    if strings.Join(names, ",") != "new_3.bin,renamed_5.bin,rom_1.bin,rom_6.bin" {
+        test.Fail(t, "wrong files after commit: " + strings.Join(names, ","))
+    }
+    checkZipLocalNames(t, zipPath)
+
+    ofs, tail := ze.Tail()
+    err = RestoreZip(zipPath, ofs, tail)
+    if err != nil {
+        test.Fail(t, err)
+    }
+    data, err := ioutil.ReadFile(zipPath)
+    if err != nil {
+        test.Fail(t, err)
+    }
+    if !bytes.Equal(data, orig) {
+        test.Fail(t, "zip not restored")
+    }
+
+    // A hard linked zip is not edited
+    linkPath := zipPath + ".link"
+    err = os.Link(zipPath, linkPath)
+    if err != nil {
+        test.Fail(t, err)
+    }
+    defer os.Remove(linkPath)
+    _, err = OpenZipEditor(zipPath)
+    if err != ZipEditUnsupportedError {
+        test.Fail(t, "hard linked zip not detected")
+    }
+}
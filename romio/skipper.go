@@ -0,0 +1,553 @@
+//  GoRom - Emulator ROM Management Utilities
+//  Copyright (C) 2020 Scott Shumate <scott@shumatech.com>
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package romio
+
+import (
+    "bytes"
+    "encoding/hex"
+    "encoding/xml"
+    "fmt"
+    "io"
+    "io/ioutil"
+    "math/bits"
+    "os"
+    "strconv"
+    "strings"
+)
+
+///////////////////////////////////////////////////////////////////////////////
+// Header Skipper
+//
+// Header skippers are the clrmamepro XML header definitions used by DATs for
+// systems whose ROM dumps have a header added by copiers or emulators (NES,
+// SNES, FDS, Atari 7800, Lynx, etc.) or that are stored in a different byte
+// order (N64).  Each rule has a set of tests on the file data and size.  The
+// first rule that matches selects the range of the file to checksum and the
+// operation to apply to it.
+///////////////////////////////////////////////////////////////////////////////
+
+// Skipper operations
+const (
+    SkipNone = iota
+    SkipBitSwap
+    SkipByteSwap
+    SkipWordSwap
+    SkipWordByteSwap
+)
+
+// Skipper test types
+const (
+    TestData = iota
+    TestAnd
+    TestOr
+    TestXor
+    TestFile
+)
+
+// Skipper file size operators
+const (
+    FileEqual = iota
+    FileLess
+    FileGreater
+)
+
+// Offsets can be relative to the end of the file
+const offsetEof = "EOF"
+
+type SkipTest struct {
+    Type     int
+    Offset   int64
+    FromEnd  bool
+    Mask     []byte
+    Value    []byte
+    Size     int64
+    Po2      bool
+    Operator int
+    Result   bool
+}
+
+type SkipRule struct {
+    StartOffset int64
+    EndOffset   int64
+    EndFromEof  bool
+    Operation   int
+    Tests       []SkipTest
+}
+
+type HeaderSkipper struct {
+    Name    string
+    Author  string
+    Version string
+    Rules   []SkipRule
+}
+
+// DefaultSkipper holds the headers that were always skipped before header
+// definitions could be loaded.  It is used when header skipping is enabled
+// without a header definition.
+var DefaultSkipper *HeaderSkipper
+
+const defaultSkipperXml = `<detector>
+    <name>gorom</name>
+    <rule start_offset="10"><data offset="0" value="4E45531A"/></rule>
+    <rule start_offset="80"><data offset="1" value="415441524937383030"/></rule>
+    <rule start_offset="40"><data offset="0" value="4C594E58"/></rule>
+</detector>`
+
+func init() {
+    var err error
+    DefaultSkipper, err = ParseHeaderSkipper(strings.NewReader(defaultSkipperXml))
+    if err != nil {
+        panic(err)
+    }
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// XML parsing
+///////////////////////////////////////////////////////////////////////////////
+
+type xmlSkipTest struct {
+    XMLName  xml.Name
+    Offset   string `xml:"offset,attr"`
+    Value    string `xml:"value,attr"`
+    Mask     string `xml:"mask,attr"`
+    Result   string `xml:"result,attr"`
+    Size     string `xml:"size,attr"`
+    Operator string `xml:"operator,attr"`
+}
+
+type xmlSkipRule struct {
+    StartOffset string        `xml:"start_offset,attr"`
+    EndOffset   string        `xml:"end_offset,attr"`
+    Operation   string        `xml:"operation,attr"`
+    Tests       []xmlSkipTest `xml:",any"`
+}
+
+type xmlSkipper struct {
+    XMLName xml.Name      `xml:"detector"`
+    Name    string        `xml:"name"`
+    Author  string        `xml:"author"`
+    Version string        `xml:"version"`
+    Rules   []xmlSkipRule `xml:"rule"`
+}
+
+// parseOffset parses a hex offset that may be negative or EOF to make it
+// relative to the end of the file
+func parseOffset(str string, def string) (offset int64, fromEnd bool, err error) {
+    str = strings.TrimSpace(str)
+    if str == "" {
+        str = def
+    }
+    if strings.EqualFold(str, offsetEof) {
+        return 0, true, nil
+    }
+    fromEnd = strings.HasPrefix(str, "-")
+    offset, err = strconv.ParseInt(str, 16, 64)
+    if err != nil {
+        return 0, false, fmt.Errorf("invalid offset '%s'", str)
+    }
+    return
+}
+
+func parseResult(str string) (bool, error) {
+    switch strings.ToLower(strings.TrimSpace(str)) {
+    case "", "true":
+        return true, nil
+    case "false":
+        return false, nil
+    }
+    return false, fmt.Errorf("invalid result '%s'", str)
+}
+
+func parseHex(str string) ([]byte, error) {
+    value, err := hex.DecodeString(strings.TrimSpace(str))
+    if err != nil {
+        return nil, fmt.Errorf("invalid value '%s'", str)
+    }
+    return value, nil
+}
+
+func (xt *xmlSkipTest) test() (test SkipTest, err error) {
+    test.Result, err = parseResult(xt.Result)
+    if err != nil {
+        return
+    }
+
+    switch xt.XMLName.Local {
+    case "data":
+        test.Type = TestData
+    case "and":
+        test.Type = TestAnd
+    case "or":
+        test.Type = TestOr
+    case "xor":
+        test.Type = TestXor
+    case "file":
+        test.Type = TestFile
+        switch strings.ToLower(xt.Operator) {
+        case "", "equal":
+            test.Operator = FileEqual
+        case "less":
+            test.Operator = FileLess
+        case "greater":
+            test.Operator = FileGreater
+        default:
+            return test, fmt.Errorf("invalid file operator '%s'", xt.Operator)
+        }
+        if strings.EqualFold(xt.Size, "PO2") {
+            test.Po2 = true
+        } else {
+            test.Size, err = strconv.ParseInt(xt.Size, 16, 64)
+            if err != nil {
+                return test, fmt.Errorf("invalid file size '%s'", xt.Size)
+            }
+        }
+        return
+    default:
+        return test, fmt.Errorf("invalid test '%s'", xt.XMLName.Local)
+    }
+
+    test.Offset, test.FromEnd, err = parseOffset(xt.Offset, "0")
+    if err != nil {
+        return
+    }
+    test.Value, err = parseHex(xt.Value)
+    if err != nil {
+        return
+    }
+    if test.Type != TestData {
+        test.Mask, err = parseHex(xt.Mask)
+        if err != nil {
+            return
+        }
+        if len(test.Mask) != len(test.Value) {
+            return test, fmt.Errorf("mask and value lengths differ")
+        }
+    }
+    return
+}
+
+func (xr *xmlSkipRule) rule() (rule SkipRule, err error) {
+    var fromEnd bool
+    rule.StartOffset, fromEnd, err = parseOffset(xr.StartOffset, "0")
+    if err != nil {
+        return
+    }
+    if fromEnd {
+        return rule, fmt.Errorf("invalid start offset '%s'", xr.StartOffset)
+    }
+    rule.EndOffset, rule.EndFromEof, err = parseOffset(xr.EndOffset, offsetEof)
+    if err != nil {
+        return
+    }
+
+    switch strings.ToLower(xr.Operation) {
+    case "", "none":
+        rule.Operation = SkipNone
+    case "bitswap":
+        rule.Operation = SkipBitSwap
+    case "byteswap":
+        rule.Operation = SkipByteSwap
+    case "wordswap":
+        rule.Operation = SkipWordSwap
+    case "wordbyteswap":
+        rule.Operation = SkipWordByteSwap
+    default:
+        return rule, fmt.Errorf("invalid operation '%s'", xr.Operation)
+    }
+
+    for _, xt := range xr.Tests {
+        test, err := xt.test()
+        if err != nil {
+            return rule, err
+        }
+        rule.Tests = append(rule.Tests, test)
+    }
+    return
+}
+
+func ParseHeaderSkipper(rd io.Reader) (*HeaderSkipper, error) {
+    var xs xmlSkipper
+    err := xml.NewDecoder(rd).Decode(&xs)
+    if err != nil {
+        return nil, err
+    }
+
+    hs := &HeaderSkipper{ Name: xs.Name, Author: xs.Author, Version: xs.Version }
+    for _, xr := range xs.Rules {
+        rule, err := xr.rule()
+        if err != nil {
+            return nil, fmt.Errorf("%s: %s", xs.Name, err)
+        }
+        hs.Rules = append(hs.Rules, rule)
+    }
+    if len(hs.Rules) == 0 {
+        return nil, fmt.Errorf("%s: no header rules", xs.Name)
+    }
+    return hs, nil
+}
+
+func LoadHeaderSkipper(skipperPath string) (*HeaderSkipper, error) {
+    fh, err := os.Open(skipperPath)
+    if err != nil {
+        return nil, err
+    }
+    defer fh.Close()
+
+    hs, err := ParseHeaderSkipper(fh)
+    if err != nil {
+        return nil, fmt.Errorf("%s: %s", skipperPath, err)
+    }
+    return hs, nil
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// Rule matching
+///////////////////////////////////////////////////////////////////////////////
+
+// bytesAt returns the size bytes at an offset or nil if they are outside of
+// the data
+func bytesAt(data []byte, offset int64, fromEnd bool, size int) []byte {
+    if fromEnd {
+        offset += int64(len(data))
+    }
+    if offset < 0 || offset + int64(size) > int64(len(data)) {
+        return nil
+    }
+    return data[offset:offset + int64(size)]
+}
+
+func (test *SkipTest) match(data []byte) bool {
+    if test.Type == TestFile {
+        size := int64(len(data))
+        var ok bool
+        if test.Po2 {
+            ok = size > 0 && size & (size - 1) == 0
+        } else {
+            switch test.Operator {
+            case FileEqual:
+                ok = size == test.Size
+            case FileLess:
+                ok = size < test.Size
+            case FileGreater:
+                ok = size > test.Size
+            }
+        }
+        return ok == test.Result
+    }
+
+    buf := bytesAt(data, test.Offset, test.FromEnd, len(test.Value))
+    if buf == nil {
+        return !test.Result
+    }
+
+    ok := true
+    for i, value := range test.Value {
+        b := buf[i]
+        switch test.Type {
+        case TestAnd:
+            b &= test.Mask[i]
+        case TestOr:
+            b |= test.Mask[i]
+        case TestXor:
+            b ^= test.Mask[i]
+        }
+        if b != value {
+            ok = false
+            break
+        }
+    }
+    return ok == test.Result
+}
+
+func (rule *SkipRule) match(data []byte) bool {
+    for i := range rule.Tests {
+        if !rule.Tests[i].match(data) {
+            return false
+        }
+    }
+    return true
+}
+
+// apply returns the range of the data selected by the rule after the rule's
+// operation.  The original data is not modified.
+func (rule *SkipRule) apply(data []byte) []byte {
+    size := int64(len(data))
+    end := rule.EndOffset
+    if rule.EndFromEof {
+        end += size
+    }
+    if end > size {
+        end = size
+    }
+    start := rule.StartOffset
+    if start > end {
+        return []byte{}
+    }
+    data = data[start:end]
+
+    if rule.Operation == SkipNone {
+        return data
+    }
+
+    out := make([]byte, len(data))
+    copy(out, data)
+    swapBytes(rule.Operation, out)
+    return out
+}
+
+// swapBytes applies a swap operation to data in place.  Any bytes after the
+// last whole word are left as is.
+func swapBytes(operation int, out []byte) {
+    switch operation {
+    case SkipBitSwap:
+        for i, b := range out {
+            out[i] = bits.Reverse8(b)
+        }
+    case SkipByteSwap:
+        for i := 0; i + 1 < len(out); i += 2 {
+            out[i], out[i+1] = out[i+1], out[i]
+        }
+    case SkipWordSwap:
+        for i := 0; i + 3 < len(out); i += 4 {
+            out[i], out[i+1], out[i+2], out[i+3] = out[i+3], out[i+2], out[i+1], out[i]
+        }
+    case SkipWordByteSwap:
+        for i := 0; i + 3 < len(out); i += 4 {
+            out[i], out[i+1], out[i+2], out[i+3] = out[i+2], out[i+3], out[i], out[i+1]
+        }
+    }
+}
+
+// swapChunk is the size of the chunks that a swapReader swaps at a time.  It
+// is a multiple of the largest word size so words never span chunks.
+const swapChunk = 64 * 1024
+
+// swapReader applies a swap operation to the data of a reader
+type swapReader struct {
+    rd        io.Reader
+    operation int
+    chunk     []byte
+    buf       []byte    // swapped data not read yet
+    err       error
+}
+
+func (sr *swapReader) Read(p []byte) (int, error) {
+    for len(sr.buf) == 0 {
+        if sr.err != nil {
+            return 0, sr.err
+        }
+        if sr.chunk == nil {
+            sr.chunk = make([]byte, swapChunk)
+        }
+        n, err := io.ReadFull(sr.rd, sr.chunk)
+        if err == io.ErrUnexpectedEOF {
+            err = io.EOF
+        }
+        sr.err = err
+        sr.buf = sr.chunk[:n]
+        swapBytes(sr.operation, sr.buf)
+    }
+    n := copy(p, sr.buf)
+    sr.buf = sr.buf[n:]
+    return n, nil
+}
+
+// reader returns a reader of the range selected by the rule like apply for a
+// file that starts with prefix and continues with rd.  The prefix must have
+// the start offset.
+func (rule *SkipRule) reader(prefix []byte, rd io.Reader) io.Reader {
+    start := rule.StartOffset
+    out := io.MultiReader(bytes.NewReader(prefix[start:]), rd)
+    if !rule.EndFromEof {
+        out = io.LimitReader(out, rule.EndOffset - start)
+    }
+    if rule.Operation != SkipNone {
+        out = &swapReader{ rd: out, operation: rule.Operation }
+    }
+    return out
+}
+
+// prefixLen returns the length of the start of a file that is needed to
+// select a rule or -1 if a rule needs the whole file to test its size or its
+// end
+func (hs *HeaderSkipper) prefixLen() int64 {
+    var n int64
+    for _, rule := range hs.Rules {
+        if rule.EndFromEof && rule.EndOffset != 0 {
+            return -1
+        }
+        if rule.StartOffset > n {
+            n = rule.StartOffset
+        }
+        for _, test := range rule.Tests {
+            if test.Type == TestFile || test.FromEnd {
+                return -1
+            }
+            if end := test.Offset + int64(len(test.Value)); end > n {
+                n = end
+            }
+        }
+    }
+    return n
+}
+
+// Skip returns the data to checksum for a ROM.  If no rule matches, then the
+// data is returned as is.
+func (hs *HeaderSkipper) Skip(data []byte) []byte {
+    for i := range hs.Rules {
+        if hs.Rules[i].match(data) {
+            return hs.Rules[i].apply(data)
+        }
+    }
+    return data
+}
+
+// SkipReader returns a reader of the data to checksum for a ROM like Skip.
+// Only the start of the ROM that the rules test is read into memory unless a
+// rule tests the size or the end of the ROM.
+func (hs *HeaderSkipper) SkipReader(rd io.Reader) (io.Reader, error) {
+    n := hs.prefixLen()
+    if n < 0 {
+        data, err := ioutil.ReadAll(rd)
+        if err != nil {
+            return nil, err
+        }
+        return bytes.NewReader(hs.Skip(data)), nil
+    }
+
+    prefix := make([]byte, n)
+    size, err := io.ReadFull(rd, prefix)
+    if err == io.EOF || err == io.ErrUnexpectedEOF {
+        return bytes.NewReader(hs.Skip(prefix[:size])), nil
+    } else if err != nil {
+        return nil, err
+    }
+    for i := range hs.Rules {
+        if hs.Rules[i].match(prefix) {
+            return hs.Rules[i].reader(prefix, rd), nil
+        }
+    }
+    return io.MultiReader(bytes.NewReader(prefix), rd), nil
+}
+
+// Id returns a string that identifies the skipper so checksums calculated
+// with different skippers can be kept apart
+func (hs *HeaderSkipper) Id() string {
+    if hs.Version != "" {
+        return hs.Name + " " + hs.Version
+    }
+    return hs.Name
+}
@@ -0,0 +1,563 @@
+//  GoRom - Emulator ROM Management Utilities
+//  Copyright (C) 2020 Scott Shumate <scott@shumatech.com>
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package romio
+
+import (
+    "bufio"
+    "encoding/binary"
+    "errors"
+    "hash/crc32"
+    "io"
+    "os"
+    "sort"
+    "strings"
+    "unicode/utf8"
+
+    "github.com/klauspost/compress/flate"
+)
+
+///////////////////////////////////////////////////////////////////////////////
+// Zip Editor
+//
+// A zip editor updates a zip file in place.  New files are appended after the
+// data of the existing files and a new central directory is written after
+// them.  The data of the existing files is never moved or changed, so removing
+// a file only rewrites the central directory.  Renaming a file changes the
+// name in its local header when the new name has the same length and copies
+// the file to the end otherwise.  The original zip is restored by truncating
+// the file at the old central directory, writing it back, and changing the
+// local header names back to the names in it.  An edited zip is no longer a
+// TorrentZip.
+//
+// Editing is done in two steps so other zips can still read the files that
+// are renamed or removed.  Append adds the new files and Flush writes the
+// original central directory after them.  Keep then selects the existing files
+// to keep and Commit writes the final central directory.
+///////////////////////////////////////////////////////////////////////////////
+
+const (
+    zipLocalSig      = 0x04034b50
+    zipCentralSig    = 0x02014b50
+    zipEndSig        = 0x06054b50
+    zipLocalLen      = 30
+    zipCentralLen    = 46
+    zipEndLen        = 22
+    zipVersion       = 20
+    zipDeflate       = 8
+    zipFlagEncrypted = 0x1
+    zipFlagDataDesc  = 0x8
+    zipFlagUtf8      = 0x800
+    zipModTime       = 48128       // 11:32PM
+    zipModDate       = 8600        // 12/24/1996
+    zipMax16         = 0xffff
+    zipMax32         = 0xffffffff
+)
+
+var ZipEditUnsupportedError = errors.New("zip cannot be edited in place")
+
+type zipEntry struct {
+    name   string
+    header []byte       // central directory header without the name
+    extra  []byte       // extra field and comment
+}
+
+type ZipEditor struct {
+    path   string
+    files  []*zipEntry  // files in the original central directory
+    added  []*zipEntry  // files appended to the zip
+    kept   []*zipEntry  // original files kept by the final directory
+    copied []*zipEntry  // original files copied to the end with a new name
+    ofs    int64        // offset of the original central directory
+    tail   []byte       // original central directory and end record
+    end    int64        // end of the file data
+    fh     *os.File
+}
+
+// OpenZipEditor reads the central directory of a zip to edit.  Zips that are
+// Zip64, split, hard linked, or have data after the central directory return
+// ZipEditUnsupportedError.
+func OpenZipEditor(machPath string) (*ZipEditor, error) {
+    fh, err := os.Open(machPath)
+    if err != nil {
+        return nil, err
+    }
+    defer fh.Close()
+
+    info, err := fh.Stat()
+    if err != nil {
+        return nil, err
+    }
+
+    // Editing a hard linked zip would change the other links too
+    if linkCount(fh) > 1 {
+        return nil, ZipEditUnsupportedError
+    }
+
+    // Find the end record at the end of the file before the comment
+    size := info.Size()
+    bufLen := int64(zipEndLen + zipMax16)
+    if bufLen > size {
+        bufLen = size
+    }
+    buf := make([]byte, bufLen)
+    _, err = fh.ReadAt(buf, size - bufLen)
+    if err != nil {
+        return nil, err
+    }
+    endOfs := int64(-1)
+    for i := len(buf) - zipEndLen; i >= 0; i-- {
+        if binary.LittleEndian.Uint32(buf[i:]) == zipEndSig &&
+           i + zipEndLen + int(binary.LittleEndian.Uint16(buf[i+20:])) == len(buf) {
+            endOfs = size - bufLen + int64(i)
+            break
+        }
+    }
+    if endOfs < 0 {
+        return nil, ZipEditUnsupportedError
+    }
+    end := buf[endOfs - (size - bufLen):]
+
+    disk := binary.LittleEndian.Uint16(end[4:])
+    cdDisk := binary.LittleEndian.Uint16(end[6:])
+    records := binary.LittleEndian.Uint16(end[10:])
+    cdSize := int64(binary.LittleEndian.Uint32(end[12:]))
+    cdOfs := int64(binary.LittleEndian.Uint32(end[16:]))
+    if disk != 0 || cdDisk != 0 || records == zipMax16 || cdSize == zipMax32 ||
+       cdOfs == zipMax32 || cdOfs + cdSize != endOfs {
+        return nil, ZipEditUnsupportedError
+    }
+
+    tail := make([]byte, size - cdOfs)
+    _, err = fh.ReadAt(tail, cdOfs)
+    if err != nil {
+        return nil, err
+    }
+
+    files, rest, err := parseCentral(tail[:cdSize])
+    if err != nil {
+        return nil, err
+    }
+    if len(rest) > 0 || len(files) != int(records) {
+        return nil, ZipEditUnsupportedError
+    }
+
+    return &ZipEditor{ path: machPath, files: files, ofs: cdOfs, tail: tail, end: cdOfs }, nil
+}
+
+// parseCentral parses the central directory headers at the start of cd and
+// returns them with the rest of cd
+func parseCentral(cd []byte) ([]*zipEntry, []byte, error) {
+    files := []*zipEntry{}
+    for len(cd) >= 4 && binary.LittleEndian.Uint32(cd) == zipCentralSig {
+        if len(cd) < zipCentralLen {
+            return nil, nil, ZipEditUnsupportedError
+        }
+        nameLen := int(binary.LittleEndian.Uint16(cd[28:]))
+        extraLen := int(binary.LittleEndian.Uint16(cd[30:])) + int(binary.LittleEndian.Uint16(cd[32:]))
+        if len(cd) < zipCentralLen + nameLen + extraLen {
+            return nil, nil, ZipEditUnsupportedError
+        }
+        // Zip64 sizes and offsets are not supported
+        if binary.LittleEndian.Uint32(cd[20:]) == zipMax32 || binary.LittleEndian.Uint32(cd[24:]) == zipMax32 ||
+           binary.LittleEndian.Uint32(cd[42:]) == zipMax32 {
+            return nil, nil, ZipEditUnsupportedError
+        }
+        files = append(files, &zipEntry{
+            name: string(cd[zipCentralLen:zipCentralLen + nameLen]),
+            header: cd[:zipCentralLen],
+            extra: cd[zipCentralLen + nameLen:zipCentralLen + nameLen + extraLen],
+        })
+        cd = cd[zipCentralLen + nameLen + extraLen:]
+    }
+    return files, cd, nil
+}
+
+func (ze *ZipEditor) Path() string {
+    return ze.path
+}
+
+// Has returns true if the original zip has a file
+func (ze *ZipEditor) Has(name string) bool {
+    return ze.file(name) != nil
+}
+
+func (ze *ZipEditor) file(name string) *zipEntry {
+    for _, entry := range ze.files {
+        if entry.name == name {
+            return entry
+        }
+    }
+    return nil
+}
+
+// Tail returns the offset and data of the original central directory and end
+// record that RestoreZip needs to undo the edits
+func (ze *ZipEditor) Tail() (int64, []byte) {
+    return ze.ofs, ze.tail
+}
+
+// RestoreZip restores a zip to its original state before it was edited
+func RestoreZip(machPath string, ofs int64, tail []byte) error {
+    fh, err := os.OpenFile(machPath, os.O_RDWR, 0)
+    if err != nil {
+        return err
+    }
+    err = fh.Truncate(ofs)
+    if err == nil {
+        _, err = fh.WriteAt(tail, ofs)
+    }
+    if err == nil {
+        err = restoreLocalNames(fh, tail)
+    }
+    if err != nil {
+        fh.Close()
+        return err
+    }
+    return fh.Close()
+}
+
+// restoreLocalNames changes the local header names that were renamed in place
+// back to the names in the original central directory
+func restoreLocalNames(fh *os.File, tail []byte) error {
+    files, _, err := parseCentral(tail)
+    if err != nil {
+        return err
+    }
+    for _, entry := range files {
+        ofs := int64(binary.LittleEndian.Uint32(entry.header[42:]))
+        local := make([]byte, zipLocalLen + len(entry.name))
+        _, err = fh.ReadAt(local, ofs)
+        if err != nil {
+            return err
+        }
+        if binary.LittleEndian.Uint32(local) != zipLocalSig ||
+           int(binary.LittleEndian.Uint16(local[26:])) != len(entry.name) ||
+           string(local[zipLocalLen:]) == entry.name {
+            continue
+        }
+        _, err = fh.WriteAt([]byte(entry.name), ofs + zipLocalLen)
+        if err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+func (ze *ZipEditor) open() error {
+    if ze.fh != nil {
+        return nil
+    }
+    fh, err := os.OpenFile(ze.path, os.O_RDWR, 0)
+    if err != nil {
+        return err
+    }
+    ze.fh = fh
+    return nil
+}
+
+func (ze *ZipEditor) close() error {
+    if ze.fh == nil {
+        return nil
+    }
+    err := ze.fh.Close()
+    ze.fh = nil
+    return err
+}
+
+// Append adds a file to the end of the zip.  Files from a zip are copied
+// without decompressing them.  The original central directory is overwritten
+// so the zip must be restored with RestoreZip if Append fails.
+func (ze *ZipEditor) Append(dstName string, reader RomReader, srcName string) error {
+    srcFile := reader.Stat(srcName)
+    if srcFile == nil {
+        return os.ErrNotExist
+    }
+    if srcFile.Size >= zipMax32 {
+        return ZipEditUnsupportedError
+    }
+
+    err := ze.open()
+    if err != nil {
+        return err
+    }
+
+    entry := &zipEntry{ name: dstName, header: make([]byte, zipCentralLen) }
+    hdr := entry.header
+    binary.LittleEndian.PutUint32(hdr[0:], zipCentralSig)
+    binary.LittleEndian.PutUint16(hdr[6:], zipVersion)
+    binary.LittleEndian.PutUint16(hdr[10:], zipDeflate)
+    binary.LittleEndian.PutUint16(hdr[12:], zipModTime)
+    binary.LittleEndian.PutUint16(hdr[14:], zipModDate)
+    binary.LittleEndian.PutUint32(hdr[24:], uint32(srcFile.Size))
+    binary.LittleEndian.PutUint32(hdr[42:], uint32(ze.end))
+
+    // The local header is written after the data when the sizes are known
+    dataOfs := ze.end + zipLocalLen + int64(len(dstName))
+    _, err = ze.fh.Seek(dataOfs, io.SeekStart)
+    if err != nil {
+        return err
+    }
+    bw := bufio.NewWriter(ze.fh)
+
+    var compSize int64
+    if zr, ok := reader.(*ZipReader); ok {
+        rc, fh, err := zr.OpenRaw(srcFile)
+        if err != nil {
+            return err
+        }
+        defer rc.Close()
+        if fh.Flags & zipFlagEncrypted != 0 || fh.CompressedSize64 >= zipMax32 {
+            return ZipEditUnsupportedError
+        }
+        binary.LittleEndian.PutUint16(hdr[8:], fh.Flags &^ zipFlagDataDesc)
+        binary.LittleEndian.PutUint16(hdr[10:], fh.Method)
+        binary.LittleEndian.PutUint32(hdr[16:], fh.CRC32)
+        compSize, err = io.Copy(bw, rc)
+        if err != nil {
+            return err
+        }
+    } else {
+        rc, err := reader.Open(srcFile)
+        if err != nil {
+            return err
+        }
+        defer rc.Close()
+        cw := &countWriter{ wr: bw }
+        fw, err := flate.NewWriter(cw, flate.BestCompression)
+        if err != nil {
+            return err
+        }
+        crc := crc32.NewIEEE()
+        _, err = io.Copy(io.MultiWriter(fw, crc), rc)
+        if err == nil {
+            err = fw.Close()
+        }
+        if err != nil {
+            return err
+        }
+        binary.LittleEndian.PutUint32(hdr[16:], crc.Sum32())
+        compSize = cw.count
+    }
+    if compSize >= zipMax32 {
+        return ZipEditUnsupportedError
+    }
+    binary.LittleEndian.PutUint32(hdr[20:], uint32(compSize))
+    if !isAscii(dstName) {
+        binary.LittleEndian.PutUint16(hdr[8:], binary.LittleEndian.Uint16(hdr[8:]) | zipFlagUtf8)
+    }
+    binary.LittleEndian.PutUint16(hdr[28:], uint16(len(dstName)))
+
+    err = bw.Flush()
+    if err != nil {
+        return err
+    }
+
+    local := make([]byte, zipLocalLen, zipLocalLen + len(dstName))
+    binary.LittleEndian.PutUint32(local[0:], zipLocalSig)
+    copy(local[4:], hdr[6:28])
+    binary.LittleEndian.PutUint16(local[26:], uint16(len(dstName)))
+    local = append(local, dstName...)
+    _, err = ze.fh.WriteAt(local, ze.end)
+    if err != nil {
+        return err
+    }
+
+    ze.end = dataOfs + compSize
+    ze.added = append(ze.added, entry)
+    return nil
+}
+
+// Flush writes the original central directory after the appended files so
+// the zip still has only its original files
+func (ze *ZipEditor) Flush() error {
+    if len(ze.added) == 0 {
+        return nil
+    }
+    err := ze.open()
+    if err != nil {
+        return err
+    }
+    err = ze.writeDirectory(ze.files)
+    if err != nil {
+        return err
+    }
+    return ze.close()
+}
+
+// Keep keeps an original file in the final directory with a new name.  The
+// name in the local header is changed in place if the new name has the same
+// length and needs no new flags.  Otherwise the file is copied to the end of
+// the zip with the new name.
+func (ze *ZipEditor) Keep(dstName string, srcName string) error {
+    src := ze.file(srcName)
+    if src == nil {
+        return os.ErrNotExist
+    }
+    if dstName != srcName {
+        flags := binary.LittleEndian.Uint16(src.header[8:])
+        renamed := false
+        if len(dstName) == len(srcName) && (isAscii(dstName) || flags & zipFlagUtf8 != 0) {
+            var err error
+            renamed, err = ze.renameLocal(src, dstName)
+            if err != nil {
+                return err
+            }
+        }
+        if !renamed {
+            return ze.keepCopy(dstName, src)
+        }
+    }
+    entry := &zipEntry{ name: dstName, header: src.header, extra: src.extra }
+    ze.kept = append(ze.kept, entry)
+    return nil
+}
+
+// renameLocal changes the name in the local header of an original file.  It
+// returns false if the local header name does not have the same length as the
+// central directory name.
+func (ze *ZipEditor) renameLocal(src *zipEntry, dstName string) (bool, error) {
+    err := ze.open()
+    if err != nil {
+        return false, err
+    }
+    ofs := int64(binary.LittleEndian.Uint32(src.header[42:]))
+    local := make([]byte, zipLocalLen)
+    _, err = ze.fh.ReadAt(local, ofs)
+    if err != nil {
+        return false, err
+    }
+    if binary.LittleEndian.Uint32(local) != zipLocalSig ||
+       int(binary.LittleEndian.Uint16(local[26:])) != len(src.name) {
+        return false, nil
+    }
+    _, err = ze.fh.WriteAt([]byte(dstName), ofs + zipLocalLen)
+    return err == nil, err
+}
+
+// keepCopy copies an original file to the end of the zip with a new name and
+// writes the original central directory after it again
+func (ze *ZipEditor) keepCopy(dstName string, src *zipEntry) error {
+    self, err := OpenZipReader(ze.path)
+    if err != nil {
+        return err
+    }
+    err = ze.Append(dstName, self, src.name)
+    self.Close()
+    if err != nil {
+        return err
+    }
+    ze.copied = append(ze.copied, src)
+    return ze.Flush()
+}
+
+// Removed returns the names of the original files that are not kept
+func (ze *ZipEditor) Removed() []string {
+    kept := map[string]bool{}
+    for _, entry := range append(append([]*zipEntry{}, ze.kept...), ze.copied...) {
+        // The kept header still has the offset of the original file
+        kept[string(entry.header[42:46])] = true
+    }
+    removed := []string{}
+    for _, entry := range ze.files {
+        if !kept[string(entry.header[42:46])] {
+            removed = append(removed, entry.name)
+        }
+    }
+    return removed
+}
+
+// Commit writes the final central directory with the kept and appended files
+func (ze *ZipEditor) Commit() error {
+    entries := append(append([]*zipEntry{}, ze.kept...), ze.added...)
+    sort.SliceStable(entries, func(i, j int) bool {
+        return strings.ToLower(entries[i].name) < strings.ToLower(entries[j].name)
+    })
+    if len(entries) >= zipMax16 {
+        return ZipEditUnsupportedError
+    }
+
+    err := ze.open()
+    if err != nil {
+        return err
+    }
+    err = ze.writeDirectory(entries)
+    if err != nil {
+        return err
+    }
+    return ze.close()
+}
+
+// Close closes the zip file without writing a directory
+func (ze *ZipEditor) Close() error {
+    return ze.close()
+}
+
+// writeDirectory writes a central directory and end record after the data
+// and truncates the zip after them.  The end record has no comment.
+func (ze *ZipEditor) writeDirectory(entries []*zipEntry) error {
+    if ze.end >= zipMax32 {
+        return ZipEditUnsupportedError
+    }
+
+    _, err := ze.fh.Seek(ze.end, io.SeekStart)
+    if err != nil {
+        return err
+    }
+    bw := bufio.NewWriter(ze.fh)
+    cw := &countWriter{ wr: bw }
+    for _, entry := range entries {
+        cw.Write(entry.header)
+        cw.Write([]byte(entry.name))
+        cw.Write(entry.extra)
+    }
+    if cw.count >= zipMax32 {
+        return ZipEditUnsupportedError
+    }
+
+    end := make([]byte, zipEndLen)
+    binary.LittleEndian.PutUint32(end[0:], zipEndSig)
+    binary.LittleEndian.PutUint16(end[8:], uint16(len(entries)))
+    binary.LittleEndian.PutUint16(end[10:], uint16(len(entries)))
+    binary.LittleEndian.PutUint32(end[12:], uint32(cw.count))
+    binary.LittleEndian.PutUint32(end[16:], uint32(ze.end))
+    cw.Write(end)
+
+    err = bw.Flush()
+    if err != nil {
+        return err
+    }
+    return ze.fh.Truncate(ze.end + cw.count)
+}
+
+type countWriter struct {
+    wr    io.Writer
+    count int64
+}
+
+func (cw *countWriter) Write(p []byte) (int, error) {
+    n, err := cw.wr.Write(p)
+    cw.count += int64(n)
+    return n, err
+}
+
+func isAscii(s string) bool {
+    for i := 0; i < len(s); i++ {
+        if s[i] >= utf8.RuneSelf {
+            return false
+        }
+    }
+    return true
+}
@@ -0,0 +1,34 @@
+// +build !windows
+
+//  GoRom - Emulator ROM Management Utilities
+//  Copyright (C) 2020 Scott Shumate <scott@shumatech.com>
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package romio
+
+import (
+    "os"
+    "syscall"
+)
+
+func linkCount(fh *os.File) uint64 {
+    info, err := fh.Stat()
+    if err != nil {
+        return 1
+    }
+    if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+        return uint64(stat.Nlink)
+    }
+    return 1
+}
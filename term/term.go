@@ -44,6 +44,11 @@ func CaptureStop() []byte {
     return capture.Bytes()
 }
 
+// Writer returns the writer for the terminal output
+func Writer() io.Writer {
+    return writer
+}
+
 func Print(a ...interface{}) (int, error) {
     return fmt.Fprint(writer, a...)
 }
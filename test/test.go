@@ -177,6 +177,10 @@ var (
         { "ziproms", "Zip_ROMs", "", "", "dats/zip.dat", "roms/zip", machineMap, infoZip },
     }
 
+    CmproDats = []DatFile {
+        { "ziproms", "Zip_ROMs", "", "", "dats/cmpro.dat", "roms/zip", machineMap, infoZip },
+    }
+
     DirDats = []DatFile {
         { "dirroms", "Dir_ROMs", "", "", "dats/dir.dat", "roms/dir", machineMap, infoDir },
     }
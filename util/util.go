@@ -17,11 +17,13 @@ package util
 
 import (
     "fmt"
+    "io"
     "math"
     "os"
     "os/signal"
     "path/filepath"
     "sort"
+    "strconv"
     "strings"
 
     "gorom/term"
@@ -232,3 +234,96 @@ func HumanizePow2(num int64) string {
 
     return (str + " " + sizes[i])
 }
+
+///////////////////////////////////////////////////////////////////////////////
+// ParsePow2 - Parse a number with an optional power of 2 suffix
+///////////////////////////////////////////////////////////////////////////////
+
+func ParsePow2(str string) (int64, error) {
+    suffixes := []string{ "K", "M", "G", "T", "P" }
+
+    num := strings.ToUpper(strings.TrimSpace(str))
+    num = strings.TrimSuffix(strings.TrimSuffix(num, "B"), "I")
+    mult := int64(1)
+    for i, suffix := range suffixes {
+        if strings.HasSuffix(num, suffix) {
+            num = strings.TrimSpace(strings.TrimSuffix(num, suffix))
+            mult = int64(1) << (10 * uint(i + 1))
+            break
+        }
+    }
+
+    fnum, err := strconv.ParseFloat(num, 64)
+    if err != nil || fnum < 0 {
+        return 0, fmt.Errorf("invalid size %s", str)
+    }
+    return int64(fnum * float64(mult)), nil
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// MoveFile - Move a file or directory.  If the destination is on another
+// file system, then the file is copied and the source is removed.
+///////////////////////////////////////////////////////////////////////////////
+
+func MoveFile(srcPath string, dstPath string) error {
+    err := os.Rename(srcPath, dstPath)
+    if !isCrossDevice(err) {
+        return err
+    }
+
+    err = copyTree(srcPath, dstPath)
+    if err != nil {
+        os.RemoveAll(dstPath)
+        return err
+    }
+    return os.RemoveAll(srcPath)
+}
+
+func copyTree(srcPath string, dstPath string) error {
+    info, err := os.Lstat(srcPath)
+    if err != nil {
+        return err
+    }
+
+    if info.Mode() & os.ModeSymlink != 0 {
+        // The link is copied instead of the file that it points to
+        target, err := os.Readlink(srcPath)
+        if err != nil {
+            return err
+        }
+        return os.Symlink(target, dstPath)
+    } else if info.IsDir() {
+        err = os.Mkdir(dstPath, info.Mode().Perm())
+        if err != nil {
+            return err
+        }
+        err = ScanDir(srcPath, false, func(file os.FileInfo) error {
+            return copyTree(filepath.Join(srcPath, file.Name()), filepath.Join(dstPath, file.Name()))
+        })
+        if err != nil {
+            return err
+        }
+    } else {
+        src, err := os.Open(srcPath)
+        if err != nil {
+            return err
+        }
+        defer src.Close()
+
+        dst, err := os.OpenFile(dstPath, os.O_WRONLY | os.O_CREATE | os.O_EXCL, info.Mode().Perm())
+        if err != nil {
+            return err
+        }
+        _, err = io.Copy(dst, src)
+        if err != nil {
+            dst.Close()
+            return err
+        }
+        err = dst.Close()
+        if err != nil {
+            return err
+        }
+    }
+
+    return os.Chtimes(dstPath, info.ModTime(), info.ModTime())
+}
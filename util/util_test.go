@@ -16,6 +16,10 @@
 package util
 
 import (
+    "fmt"
+    "io/ioutil"
+    "os"
+    "path/filepath"
     "testing"
     "gorom/test"
 )
@@ -99,3 +103,58 @@ func TestStringBiMap(t *testing.T) {
         test.Fail(t, "Delete method")
     }
 }
+
+func TestParsePow2(t *testing.T) {
+    strs := []string{ "0", "1023", "1K", "1.5 KiB", "2M", "1g", "3TB" }
+    nums := []int64{ 0, 1023, 1024, 1536, 2*1024*1024, 1024*1024*1024, 3*1024*1024*1024*1024 }
+
+    for i := 0; i < len(strs); i++ {
+        n, err := ParsePow2(strs[i])
+        if err != nil || n != nums[i] {
+            test.Fail(t, fmt.Sprintf("unexpected number %s %d", strs[i], n))
+        }
+    }
+
+    for _, str := range []string{ "", "G", "-1K", "1X" } {
+        _, err := ParsePow2(str)
+        if err == nil {
+            test.Fail(t, "expected error for " + str)
+        }
+    }
+}
+
+func TestCopyTree(t *testing.T) {
+    tmpdir, err := ioutil.TempDir("", "gorom")
+    if err != nil {
+        test.Fail(t, err)
+    }
+    defer os.RemoveAll(tmpdir)
+
+    src := filepath.Join(tmpdir, "src")
+    err = os.Mkdir(src, 0755)
+    if err == nil {
+        err = ioutil.WriteFile(filepath.Join(src, "file"), []byte("data"), 0644)
+    }
+    if err != nil {
+        test.Fail(t, err)
+    }
+    err = os.Symlink("file", filepath.Join(src, "link"))
+    if err != nil {
+        t.Skip("symlinks not supported")
+    }
+
+    // Symlinks are copied as links
+    dst := filepath.Join(tmpdir, "dst")
+    err = copyTree(src, dst)
+    if err != nil {
+        test.Fail(t, err)
+    }
+    data, err := ioutil.ReadFile(filepath.Join(dst, "file"))
+    if err != nil || string(data) != "data" {
+        test.Fail(t, "file not copied")
+    }
+    target, err := os.Readlink(filepath.Join(dst, "link"))
+    if err != nil || target != "file" {
+        test.Fail(t, "symlink not copied")
+    }
+}